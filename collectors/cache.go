@@ -0,0 +1,164 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheStale = kingpin.Flag("exporter.cache-stale", "Serve the last successful values of a device that fails collection for up to this duration, 0 disables").Default("0s").Duration()
+	lastGood   = newLastGoodCache()
+)
+
+type lastGoodEntry struct {
+	time     time.Time
+	counters []PerfQueryCounters
+	ibswinfo Ibswinfo
+}
+
+// lastGoodCache keeps the values of each device's last successful collection
+type lastGoodCache struct {
+	sync.Mutex
+	entries map[deviceKey]lastGoodEntry
+}
+
+func newLastGoodCache() *lastGoodCache {
+	return &lastGoodCache{entries: make(map[deviceKey]lastGoodEntry)}
+}
+
+// updateCounters stores counters of devices that did not fail and returns cached counters for devices without counters
+func (c *lastGoodCache) updateCounters(collector string, devices []InfinibandDevice, counters []PerfQueryCounters, failed map[string]bool, now time.Time) map[string]lastGoodEntry {
+	cached := make(map[string]lastGoodEntry)
+	if *cacheStale <= 0 {
+		return cached
+	}
+	deviceCounters := make(map[string][]PerfQueryCounters)
+	for _, counter := range counters {
+		deviceCounters[counter.device.GUID] = append(deviceCounters[counter.device.GUID], counter)
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, device := range devices {
+		key := deviceKey{collector: collector, guid: device.GUID}
+		if fresh, ok := deviceCounters[device.GUID]; ok {
+			if !failed[device.GUID] {
+				c.entries[key] = lastGoodEntry{time: now, counters: fresh}
+			}
+			continue
+		}
+		if entry, ok := c.lookup(key, now); ok {
+			cached[device.GUID] = entry
+		}
+	}
+	return cached
+}
+
+// updateIbswinfo stores the collected switch information and returns cached values for devices not collected
+func (c *lastGoodCache) updateIbswinfo(collector string, devices []InfinibandDevice, swinfos []Ibswinfo, now time.Time) map[string]lastGoodEntry {
+	cached := make(map[string]lastGoodEntry)
+	if *cacheStale <= 0 {
+		return cached
+	}
+	collected := make(map[string]bool)
+	c.Lock()
+	defer c.Unlock()
+	for _, swinfo := range swinfos {
+		collected[swinfo.device.GUID] = true
+		c.entries[deviceKey{collector: collector, guid: swinfo.device.GUID}] = lastGoodEntry{time: now, ibswinfo: swinfo}
+	}
+	for _, device := range devices {
+		if collected[device.GUID] {
+			continue
+		}
+		if entry, ok := c.lookup(deviceKey{collector: collector, guid: device.GUID}, now); ok {
+			cached[device.GUID] = entry
+		}
+	}
+	return cached
+}
+
+// lookup returns an entry that is not older than the staleness window, expired entries are removed
+func (c *lastGoodCache) lookup(key deviceKey, now time.Time) (lastGoodEntry, bool) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return entry, false
+	}
+	if now.Sub(entry.time) > *cacheStale {
+		delete(c.entries, key)
+		return entry, false
+	}
+	return entry, true
+}
+
+// splitCounters separates the base and rcv-err counters so each set is cached on its own
+func splitCounters(counters []PerfQueryCounters) ([]PerfQueryCounters, []PerfQueryCounters) {
+	var base, rcvErr []PerfQueryCounters
+	for _, counter := range counters {
+		baseCounter, rcvErrCounter := counter, counter
+		filterCounters(&baseCounter, true, false)
+		filterCounters(&rcvErrCounter, false, true)
+		if hasCounters(baseCounter) {
+			base = append(base, baseCounter)
+		}
+		if hasCounters(rcvErrCounter) {
+			rcvErr = append(rcvErr, rcvErrCounter)
+		}
+	}
+	return base, rcvErr
+}
+
+func hasCounters(counter PerfQueryCounters) bool {
+	s := reflect.ValueOf(counter)
+	for i := 0; i < s.NumField(); i++ {
+		if f := s.Field(i); f.Kind() == reflect.Float64 && !math.IsNaN(f.Float()) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectStale sends the age of the oldest cached values of each device when the cache is enabled
+func collectStale(ch chan<- prometheus.Metric, desc *prometheus.Desc, collector string, devices []InfinibandDevice, now time.Time, cached ...map[string]lastGoodEntry) {
+	if *cacheStale <= 0 {
+		return
+	}
+	for _, device := range devices {
+		var age float64
+		for _, entries := range cached {
+			if entry, ok := entries[device.GUID]; ok {
+				age = math.Max(age, now.Sub(entry.time).Seconds())
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, age, device.GUID, collector)
+	}
+}
+
+// collectWithTimestamp sends the metrics of collect with the timestamp t
+func collectWithTimestamp(ch chan<- prometheus.Metric, t time.Time, collect func(ch chan<- prometheus.Metric)) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		collect(metrics)
+		close(metrics)
+	}()
+	for metric := range metrics {
+		ch <- prometheus.NewMetricWithTimestamp(t, metric)
+	}
+}
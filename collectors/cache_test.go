@@ -0,0 +1,157 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func TestLastGoodCacheCounters(t *testing.T) {
+	setupTest(t, []string{"--exporter.cache-stale=1m"})
+	now := time.Now()
+	counters := []PerfQueryCounters{
+		topCounters(switchDevices[0], "35", 1000, 10),
+		topCounters(switchDevices[1], "1", 1000, 10),
+	}
+	failed := map[string]bool{switchDevices[1].GUID: true}
+	cached := lastGood.updateCounters("switch", switchDevices, counters, failed, now)
+	if len(cached) != 0 {
+		t.Errorf("Unexpected cached values, got %v", cached)
+	}
+	cached = lastGood.updateCounters("switch", switchDevices, nil, nil, now.Add(30*time.Second))
+	if len(cached) != 1 {
+		t.Fatalf("Unexpected cached values, got %v", cached)
+	}
+	entry := cached[switchDevices[0].GUID]
+	if entry.time != now || len(entry.counters) != 1 || entry.counters[0].PortSelect != "35" {
+		t.Errorf("Unexpected cached entry, got %v", entry)
+	}
+	if cached := lastGood.updateCounters("hca", switchDevices, nil, nil, now.Add(30*time.Second)); len(cached) != 0 {
+		t.Errorf("Unexpected cached values for other collector, got %v", cached)
+	}
+	if cached := lastGood.updateCounters("switch", switchDevices, nil, nil, now.Add(2*time.Minute)); len(cached) != 0 {
+		t.Errorf("Unexpected expired cached values, got %v", cached)
+	}
+	if len(lastGood.entries) != 0 {
+		t.Errorf("Expected expired entries removed, got %v", lastGood.entries)
+	}
+}
+
+func TestLastGoodCacheDisabled(t *testing.T) {
+	setupTest(t, []string{})
+	now := time.Now()
+	counters := []PerfQueryCounters{topCounters(switchDevices[0], "35", 1000, 10)}
+	lastGood.updateCounters("switch", switchDevices, counters, nil, now)
+	lastGood.updateIbswinfo("ibswinfo", switchDevices, []Ibswinfo{{device: switchDevices[0]}}, now)
+	if len(lastGood.entries) != 0 {
+		t.Errorf("Unexpected entries, got %v", lastGood.entries)
+	}
+}
+
+func TestLastGoodCacheIbswinfo(t *testing.T) {
+	setupTest(t, []string{"--exporter.cache-stale=1m"})
+	now := time.Now()
+	lastGood.updateIbswinfo("ibswinfo", switchDevices, []Ibswinfo{{device: switchDevices[0], PSID: "MT_1"}}, now)
+	cached := lastGood.updateIbswinfo("ibswinfo", switchDevices, nil, now.Add(time.Second))
+	if len(cached) != 1 || cached[switchDevices[0].GUID].ibswinfo.PSID != "MT_1" {
+		t.Errorf("Unexpected cached values, got %v", cached)
+	}
+}
+
+func TestSwitchCollectorCache(t *testing.T) {
+	setupTest(t, []string{"--exporter.cache-stale=1m"})
+	SetPerfqueryExecs(t, false, false)
+	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if _, err := gatherers.Gather(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	SetPerfqueryExecs(t, true, false)
+	mfs, err := gatherers.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var data, stale int
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "infiniband_switch_port_transmit_data_bytes_total":
+			for _, m := range mf.GetMetric() {
+				data++
+				if m.TimestampMs == nil {
+					t.Errorf("Expected timestamp on cached metric %v", m)
+				}
+			}
+		case "infiniband_switch_collect_stale_seconds":
+			for _, m := range mf.GetMetric() {
+				if m.GetGauge().GetValue() > 0 {
+					stale++
+				}
+			}
+		}
+	}
+	if data != 3 {
+		t.Errorf("Unexpected cached data metrics, got %d", data)
+	}
+	if stale != 2 {
+		t.Errorf("Unexpected stale devices, got %d", stale)
+	}
+}
+
+func TestSwitchCollectorCacheRcvErr(t *testing.T) {
+	setupTest(t, []string{"--exporter.cache-stale=1m", "--collector.switch.rcv-err-details"})
+	SetPerfqueryExecs(t, false, false)
+	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if _, err := gatherers.Gather(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fixtureExec := PerfqueryExec
+	PerfqueryExec = func(guid string, port string, extraArgs []string, ctx context.Context) (string, error) {
+		if len(extraArgs) == 1 {
+			return "", fmt.Errorf("Error")
+		}
+		return fixtureExec(guid, port, extraArgs, ctx)
+	}
+	mfs, err := gatherers.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var data, rcvErr int
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "infiniband_switch_port_transmit_data_bytes_total":
+			for _, m := range mf.GetMetric() {
+				data++
+				if m.TimestampMs != nil {
+					t.Errorf("Unexpected timestamp on fresh metric %v", m)
+				}
+			}
+		case "infiniband_switch_port_buffer_overrun_errors_total":
+			for _, m := range mf.GetMetric() {
+				rcvErr++
+				if m.TimestampMs == nil {
+					t.Errorf("Expected timestamp on cached metric %v", m)
+				}
+			}
+		}
+	}
+	if data != 3 || rcvErr != 3 {
+		t.Errorf("Unexpected metrics, got %d data and %d rcv-err", data, rcvErr)
+	}
+}
@@ -22,18 +22,21 @@ import (
 	"testing"
 	"time"
 
+	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
 	mockedExitStatus = 0
 	mockedStdout     string
+	mockedStderr     string
 	_, cancel        = context.WithTimeout(context.Background(), 5*time.Second)
 	switchDevices    = []InfinibandDevice{
 		{Type: "SW", LID: "2052", GUID: "0x506b4b03005c2740", Name: "ib-i4l1s01",
 			Uplinks: map[string]InfinibandUplink{
 				"35": {Type: "CA", LID: "1432", PortNumber: "1", GUID: "0x506b4b0300cc02a6", Name: "p0001 HCA-1", Rate: (25 * 4 * 125000000), RawRate: 1.2890625e+10},
 			},
+			FreePorts: []string{"37"},
 		},
 		{Type: "SW", LID: "1719", GUID: "0x7cfe9003009ce5b0", Name: "ib-i1l1s01",
 			Uplinks: map[string]InfinibandUplink{
@@ -99,6 +102,7 @@ func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.
 	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1",
 		"GOCOVERDIR=" + tmp,
 		"STDOUT=" + mockedStdout,
+		"STDERR=" + mockedStderr,
 		"EXIT_STATUS=" + es}
 	return cmd
 }
@@ -110,10 +114,39 @@ func TestExecCommandHelper(t *testing.T) {
 
 	//nolint:staticcheck
 	fmt.Fprintf(os.Stdout, os.Getenv("STDOUT"))
+	fmt.Fprint(os.Stderr, os.Getenv("STDERR"))
 	i, _ := strconv.Atoi(os.Getenv("EXIT_STATUS"))
 	os.Exit(i)
 }
 
+// resetState resets the state collectors keep between collections
+func resetState() {
+	lastGood = newLastGoodCache()
+	limiters = newConcurrencyLimiters()
+	retryCounts = newDeviceCounter()
+	breakers = newCircuitBreakers()
+	scheduler = newMADScheduler()
+	events = newEventTracker()
+	failureCounts = newFailureCounter()
+	smHistory = &smHistoryState{}
+	portHistory = newPortCounterHistory()
+	commandHistory = newCommandLog()
+}
+
+// setupTest parses args and resets the collector state, both are restored when the test ends
+func setupTest(t *testing.T, args []string) {
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	resetState()
+	retrySleep = func(time.Duration) {}
+	t.Cleanup(func() {
+		kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+		resetState()
+		retrySleep = time.Sleep
+	})
+}
+
 func setupGatherer(collector prometheus.Collector) prometheus.Gatherer {
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(collector)
@@ -0,0 +1,160 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+)
+
+const (
+	commandOutputLimit = 4096
+	// Target of commands that query the whole fabric
+	fabricTarget = "fabric"
+)
+
+var (
+	commandHistorySize = kingpin.Flag("exporter.command-history", "Number of recent command invocations to keep per device, 0 disables").Default("10").Int()
+	commandHistory     = newCommandLog()
+)
+
+type CommandInvocation struct {
+	Time     time.Time `json:"time"`
+	Target   string    `json:"target"`
+	Argv     []string  `json:"argv"`
+	ExitCode int       `json:"exit_code"`
+	Duration float64   `json:"duration_seconds"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// CommandError is returned when a command fails and includes the exit code and stderr
+type CommandError struct {
+	Err      error
+	ExitCode int
+	Stderr   string
+}
+
+type commandLog struct {
+	sync.Mutex
+	invocations map[string][]CommandInvocation
+}
+
+func (e *CommandError) Error() string {
+	stderr := strings.TrimSpace(e.Stderr)
+	if stderr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Err, strings.SplitN(stderr, "\n", 2)[0])
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func newCommandLog() *commandLog {
+	return &commandLog{invocations: make(map[string][]CommandInvocation)}
+}
+
+// record keeps the most recent invocations for each target
+func (c *commandLog) record(invocation CommandInvocation) {
+	size := *commandHistorySize
+	if size <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	invocations := append(c.invocations[invocation.Target], invocation)
+	if len(invocations) > size {
+		invocations = invocations[len(invocations)-size:]
+	}
+	c.invocations[invocation.Target] = invocations
+}
+
+// CommandHistory returns the recent command invocations, most recent last
+func CommandHistory(target string) map[string][]CommandInvocation {
+	history := make(map[string][]CommandInvocation)
+	commandHistory.Lock()
+	defer commandHistory.Unlock()
+	for key, invocations := range commandHistory.invocations {
+		if target != "" && key != target {
+			continue
+		}
+		history[key] = append([]CommandInvocation{}, invocations...)
+	}
+	return history
+}
+
+// runCommand executes a command, records the invocation and returns stdout.
+// Invocations are recorded against the device GUID of ctx when set so commands
+// addressed by LID are found by the same GUID as the rest of the device.
+func runCommand(ctx context.Context, target string, command string, args []string) (string, error) {
+	target = contextDevice(ctx, target)
+	release, err := scheduler.acquire(ctx, target)
+	if err != nil {
+		commandHistory.record(CommandInvocation{Time: time.Now(), Target: target, Argv: append([]string{command}, args...), ExitCode: -1, Error: err.Error()})
+		return "", err
+	}
+	defer release()
+	cmd := execCommand(ctx, command, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err = cmd.Run()
+	invocation := CommandInvocation{
+		Time:     start,
+		Target:   target,
+		Argv:     append([]string{command}, args...),
+		Duration: time.Since(start).Seconds(),
+		Stdout:   truncateOutput(stdout.String()),
+		Stderr:   truncateOutput(stderr.String()),
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = ctx.Err()
+		invocation.ExitCode = -1
+	} else if err != nil {
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		err = &CommandError{Err: err, ExitCode: exitCode, Stderr: stderr.String()}
+		invocation.ExitCode = exitCode
+	}
+	if err != nil {
+		invocation.Error = err.Error()
+	}
+	commandHistory.record(invocation)
+	if err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+func truncateOutput(out string) string {
+	if len(out) <= commandOutputLimit {
+		return out
+	}
+	return out[:commandOutputLimit] + "...(truncated)"
+}
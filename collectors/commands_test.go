@@ -0,0 +1,134 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+)
+
+func TestRunCommandHistory(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--exporter.command-history=2"}); err != nil {
+		t.Fatal(err)
+	}
+	defer kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+	commandHistory = newCommandLog()
+	defer func() { commandHistory = newCommandLog() }()
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mockedExitStatus = 0
+	mockedStdout = "foo"
+	mockedStderr = ""
+	for i := 0; i < 2; i++ {
+		if out, err := perfquery("0x00", "1", []string{}, ctx); err != nil || out != "foo" {
+			t.Errorf("Unexpected result, out %s err %v", out, err)
+		}
+	}
+	mockedExitStatus = 2
+	mockedStderr = "ibwarn: [1234] mad_rpc: _do_madrpc failed; dport (Lid 5)\nextra line"
+	defer func() { mockedExitStatus = 0; mockedStderr = "" }()
+	_, err := perfquery("0x00", "1", []string{}, ctx)
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) {
+		t.Fatalf("Expected CommandError, got %v", err)
+	}
+	if commandErr.ExitCode != 2 {
+		t.Errorf("Unexpected exit code, got %d", commandErr.ExitCode)
+	}
+	if err.Error() != "exit status 2: ibwarn: [1234] mad_rpc: _do_madrpc failed; dport (Lid 5)" {
+		t.Errorf("Unexpected error, got %s", err.Error())
+	}
+	history := CommandHistory("0x00")
+	if len(history) != 1 || len(history["0x00"]) != 2 {
+		t.Fatalf("Unexpected history, got %v", history)
+	}
+	last := history["0x00"][1]
+	if last.ExitCode != 2 || last.Stdout != "foo" || !strings.HasPrefix(last.Stderr, "ibwarn") || last.Error == "" {
+		t.Errorf("Unexpected invocation, got %v", last)
+	}
+	if last.Argv[0] != "perfquery" || last.Argv[len(last.Argv)-1] != "1" {
+		t.Errorf("Unexpected argv, got %v", last.Argv)
+	}
+	if history["0x00"][0].ExitCode != 0 || history["0x00"][0].Error != "" {
+		t.Errorf("Unexpected invocation, got %v", history["0x00"][0])
+	}
+	if history := CommandHistory("foo"); len(history) != 0 {
+		t.Errorf("Unexpected history, got %v", history)
+	}
+}
+
+func TestRunCommandHistoryDevice(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	commandHistory = newCommandLog()
+	defer func() { commandHistory = newCommandLog() }()
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mockedExitStatus = 0
+	mockedStdout = "foo"
+	ctx = withDevice(ctx, "0x7cfe9003009ce5b0")
+	if _, err := ibswinfo("1719", ctx); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := ibroute("1719", ctx); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := smpquery("portinfo", "1719", "1", ctx); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	history := CommandHistory("")
+	if len(history) != 1 || len(history["0x7cfe9003009ce5b0"]) != 3 {
+		t.Errorf("Unexpected history, got %v", history)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	commandHistory = newCommandLog()
+	defer func() { commandHistory = newCommandLog() }()
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	ctx, cancel := context.WithTimeout(context.Background(), 0*time.Second)
+	defer cancel()
+	if _, err := ibnetdiscover(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	history := CommandHistory(fabricTarget)[fabricTarget]
+	if len(history) != 1 || history[0].ExitCode != -1 || history[0].Error != context.DeadlineExceeded.Error() {
+		t.Errorf("Unexpected history, got %v", history)
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	out := truncateOutput(strings.Repeat("a", commandOutputLimit+10))
+	if len(out) != commandOutputLimit+len("...(truncated)") {
+		t.Errorf("Unexpected length, got %d", len(out))
+	}
+	if out := truncateOutput("foo"); out != "foo" {
+		t.Errorf("Unexpected output, got %s", out)
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var (
+	countersSource  = kingpin.Flag("counters.source", "Source of port counters, one of perfquery, perfmgr, ibdiagnet or ufm").Default("perfquery").Enum("perfquery", "perfmgr", "ibdiagnet", "ufm")
+	perfmgrDumpFile = kingpin.Flag("perfmgr.dump-file", "Path to OpenSM PerfMgr counters dump file").Default("/var/log/opensm_port_counters.log").String()
+	ibdiagnetDir    = kingpin.Flag("ibdiagnet.dir", "Directory containing ibdiagnet2 output").Default("/var/tmp/ibdiagnet2").String()
+	// Fields only populated by perfquery -E
+	rcvErrCounters = map[string]bool{
+		"PortLocalPhysicalErrors": true,
+		"PortMalformedPktErrors":  true,
+		"PortBufferOverrunErrors": true,
+		"PortDLIDMappingErrors":   true,
+		"PortVLMappingErrors":     true,
+		"PortLoopingErrors":       true,
+	}
+	// OpenSM PerfMgr human readable dump names
+	perfmgrCounterNames = map[string]string{
+		"symbol_err_cnt":       "SymbolErrorCounter",
+		"link_err_recover":     "LinkErrorRecoveryCounter",
+		"link_downed":          "LinkDownedCounter",
+		"rcv_err":              "PortRcvErrors",
+		"rcv_rem_phys_err":     "PortRcvRemotePhysicalErrors",
+		"rcv_switch_relay_err": "PortRcvSwitchRelayErrors",
+		"xmit_discards":        "PortXmitDiscards",
+		"xmit_constraint_err":  "PortXmitConstraintErrors",
+		"rcv_constraint_err":   "PortRcvConstraintErrors",
+		"link_integrity_err":   "LocalLinkIntegrityErrors",
+		"buf_overrun_err":      "ExcessiveBufferOverrunErrors",
+		"vl15_dropped":         "VL15Dropped",
+		"xmit_wait":            "PortXmitWait",
+		"xmit_data":            "PortXmitData",
+		"rcv_data":             "PortRcvData",
+		"xmit_pkts":            "PortXmitPkts",
+		"rcv_pkts":             "PortRcvPkts",
+		"unicast_xmit_pkts":    "PortUnicastXmitPkts",
+		"unicast_rcv_pkts":     "PortUnicastRcvPkts",
+		"multicast_xmit_pkts":  "PortMulticastXmitPkts",
+		"multicast_rcv_pkts":   "PortMulticastRcvPkts",
+	}
+)
+
+// SourceCounters are port counters keyed by node GUID then port number
+type SourceCounters map[string]map[string]PerfQueryCounters
+
+// loadSourceCounters reads all port counters from the configured counters source
+func loadSourceCounters(devices []InfinibandDevice, logger log.Logger) (SourceCounters, float64, error) {
+	switch *countersSource {
+	case "perfmgr":
+		f, err := os.Open(*perfmgrDumpFile)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		counters, errors := perfmgrParse(f, logger)
+		return counters, errors, nil
+	case "ibdiagnet":
+		csvPath := filepath.Join(*ibdiagnetDir, "ibdiagnet2.db_csv")
+		if f, err := os.Open(csvPath); err == nil {
+			defer f.Close()
+			counters, errors := ibdiagnetCSVParse(f, logger)
+			return counters, errors, nil
+		}
+		f, err := os.Open(filepath.Join(*ibdiagnetDir, "ibdiagnet2.pm"))
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		counters, lids, errors := ibdiagnetPMParse(f, logger)
+		return mapPortGUIDs(counters, lids, devices, logger), errors, nil
+	case "ufm":
+		client, err := NewUFMClient(logger)
+		if err != nil {
+			return nil, 0, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *ufmTimeout)
+		defer cancel()
+		return client.PortCounters(ctx)
+	}
+	return nil, 0, fmt.Errorf("Unsupported counters source %s", *countersSource)
+}
+
+// collectSourceCounters returns the counters of the uplink ports for each device from the configured source.
+// Devices not present in the source are returned in missing.
+func collectSourceCounters(devices []InfinibandDevice, base bool, rcvErr bool, logger log.Logger) ([]PerfQueryCounters, map[string]bool, float64, float64, error) {
+	var counters []PerfQueryCounters
+	missing := make(map[string]bool)
+	start := time.Now()
+	source, errors, err := loadSourceCounters(devices, logger)
+	duration := time.Since(start).Seconds()
+	if err != nil {
+		return nil, nil, errors, duration, err
+	}
+	for _, device := range devices {
+		ports, ok := source[device.GUID]
+		if !ok {
+			level.Error(logger).Log("msg", "Device not found in counters source", "guid", device.GUID, "source", *countersSource)
+			missing[device.GUID] = true
+			continue
+		}
+		for _, port := range getDevicePorts(device.Uplinks) {
+			counter, ok := ports[port]
+			if !ok {
+				level.Debug(logger).Log("msg", "Port not found in counters source", "guid", device.GUID, "port", port)
+				continue
+			}
+			counter.device = device
+			filterCounters(&counter, base, rcvErr)
+			counters = append(counters, counter)
+		}
+	}
+	return counters, missing, errors, duration, nil
+}
+
+// filterCounters resets the counters not enabled for collection to NaN
+func filterCounters(counter *PerfQueryCounters, base bool, rcvErr bool) {
+	s := reflect.ValueOf(counter).Elem()
+	t := s.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := s.Field(i)
+		if f.Kind() != reflect.Float64 {
+			continue
+		}
+		if rcvErrCounters[t.Field(i).Name] {
+			if !rcvErr {
+				f.SetFloat(math.NaN())
+			}
+		} else if !base {
+			f.SetFloat(math.NaN())
+		}
+	}
+}
+
+// setSourceCounter sets the field matching name case-insensitively, Extended counters replace the 32-bit counters
+func setSourceCounter(counter *PerfQueryCounters, name string, value string) error {
+	name = strings.TrimSuffix(strings.ReplaceAll(name, "_", ""), "Extended")
+	name = strings.TrimSuffix(name, "extended")
+	f := reflect.ValueOf(counter).Elem().FieldByNameFunc(func(field string) bool {
+		return strings.EqualFold(field, name)
+	})
+	if !f.IsValid() || f.Kind() != reflect.Float64 {
+		return nil
+	}
+	val, err := parseSourceValue(value)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(strings.ToLower(name), "data") {
+		val = val * 4
+	}
+	f.SetFloat(val)
+	return nil
+}
+
+// setSourceCounterValues sets all values, Extended counters are set last so they replace the 32-bit counters
+func setSourceCounterValues(counter *PerfQueryCounters, values map[string]string, logger log.Logger) float64 {
+	var errors float64
+	for _, extended := range []bool{false, true} {
+		for name, value := range values {
+			if strings.HasSuffix(name, "Extended") != extended || value == "N/A" {
+				continue
+			}
+			if err := setSourceCounter(counter, name, value); err != nil {
+				level.Error(logger).Log("msg", "Unable to parse counter value", "port", counter.PortSelect, "counter", name, "err", err)
+				errors++
+			}
+		}
+	}
+	return errors
+}
+
+func parseSourceValue(value string) (float64, error) {
+	if strings.HasPrefix(value, "0x") {
+		val, err := strconv.ParseUint(value[2:], 16, 64)
+		return float64(val), err
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+func normalizeGUID(guid string) (string, error) {
+	val, err := strconv.ParseUint(strings.TrimPrefix(guid, "0x"), 16, 64)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("0x%016x", val), nil
+}
+
+func (s SourceCounters) counter(guid string, port string) PerfQueryCounters {
+	if _, ok := s[guid]; !ok {
+		s[guid] = make(map[string]PerfQueryCounters)
+	}
+	counter, ok := s[guid][port]
+	if !ok {
+		initializeCounters(&counter)
+		counter.PortSelect = port
+	}
+	return counter
+}
+
+// perfmgrParse parses the human readable dump written by OpenSM PerfMgr
+func perfmgrParse(r io.Reader, logger log.Logger) (SourceCounters, float64) {
+	counters := make(SourceCounters)
+	var errors float64
+	var guid, port string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "\"") {
+			end := strings.LastIndex(line, "\"")
+			items := strings.Fields(line[end+1:])
+			guid, port = "", ""
+			if len(items) < 1 {
+				level.Error(logger).Log("msg", "Unable to parse PerfMgr node line", "line", line)
+				errors++
+				continue
+			}
+			g, err := normalizeGUID(items[0])
+			if err != nil {
+				level.Error(logger).Log("msg", "Unable to parse PerfMgr node GUID", "line", line, "err", err)
+				errors++
+				continue
+			}
+			guid = g
+			for i := 1; i < len(items)-1; i++ {
+				if items[i] == "port" {
+					port = items[i+1]
+				}
+			}
+			continue
+		}
+		items := strings.Fields(line)
+		if len(items) >= 2 && strings.EqualFold(items[0], "port") {
+			port = items[1]
+			continue
+		}
+		if guid == "" || port == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		name, ok := perfmgrCounterNames[strings.TrimSpace(kv[0])]
+		if !ok {
+			continue
+		}
+		values := strings.Fields(kv[1])
+		if len(values) == 0 {
+			continue
+		}
+		counter := counters.counter(guid, port)
+		if err := setSourceCounter(&counter, name, values[0]); err != nil {
+			level.Error(logger).Log("msg", "Unable to parse counter value", "guid", guid, "port", port, "counter", name, "err", err)
+			errors++
+			continue
+		}
+		counters[guid][port] = counter
+	}
+	return counters, errors
+}
+
+// ibdiagnetCSVParse parses the START_PM_INFO section of ibdiagnet2.db_csv
+func ibdiagnetCSVParse(r io.Reader, logger log.Logger) (SourceCounters, float64) {
+	counters := make(SourceCounters)
+	var errors float64
+	var header []string
+	inSection := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "START_PM_INFO":
+			inSection = true
+			header = nil
+			continue
+		case line == "END_PM_INFO":
+			inSection = false
+			continue
+		case !inSection || line == "":
+			continue
+		}
+		items := strings.Split(line, ",")
+		if header == nil {
+			header = items
+			continue
+		}
+		if len(items) != len(header) {
+			level.Error(logger).Log("msg", "PM_INFO line has wrong number of elements", "line", line)
+			errors++
+			continue
+		}
+		var guid, port string
+		values := make(map[string]string)
+		for i, name := range header {
+			switch name {
+			case "NodeGUID":
+				guid = items[i]
+			case "PortNumber", "PortNum":
+				port = items[i]
+			default:
+				values[name] = items[i]
+			}
+		}
+		guid, err := normalizeGUID(guid)
+		if err != nil || port == "" {
+			level.Error(logger).Log("msg", "Unable to parse PM_INFO node", "line", line)
+			errors++
+			continue
+		}
+		counter := counters.counter(guid, port)
+		errors = errors + setSourceCounterValues(&counter, values, logger)
+		counters[guid][port] = counter
+	}
+	return counters, errors
+}
+
+// ibdiagnetPMParse parses ibdiagnet2.pm which is keyed by port GUID, the LID of each port GUID is also returned
+func ibdiagnetPMParse(r io.Reader, logger log.Logger) (SourceCounters, map[string]string, float64) {
+	counters := make(SourceCounters)
+	lids := make(map[string]string)
+	var errors float64
+	var guid, port, lid string
+	extended := make(map[string]string)
+	flush := func() {
+		if guid == "" || port == "" {
+			return
+		}
+		counter := counters.counter(guid, port)
+		for name, value := range extended {
+			if err := setSourceCounter(&counter, name, value); err != nil {
+				level.Error(logger).Log("msg", "Unable to parse counter value", "guid", guid, "port", port, "counter", name, "err", err)
+				errors++
+			}
+		}
+		counters[guid][port] = counter
+		extended = make(map[string]string)
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Port=") {
+			flush()
+			guid, port, lid = "", "", ""
+			for _, item := range strings.Fields(line) {
+				kv := strings.SplitN(item, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				switch kv[0] {
+				case "Port":
+					port = kv[1]
+				case "Lid":
+					if val, err := strconv.ParseUint(kv[1], 0, 16); err == nil {
+						lid = strconv.FormatUint(val, 10)
+					}
+				case "GUID":
+					g, err := normalizeGUID(kv[1])
+					if err != nil {
+						level.Error(logger).Log("msg", "Unable to parse pm GUID", "line", line, "err", err)
+						errors++
+						continue
+					}
+					guid = g
+				}
+			}
+			if guid != "" && lid != "" {
+				lids[guid] = lid
+			}
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || guid == "" || port == "" {
+			continue
+		}
+		if strings.HasSuffix(kv[0], "_extended") {
+			extended[kv[0]] = kv[1]
+			continue
+		}
+		counter := counters.counter(guid, port)
+		if err := setSourceCounter(&counter, kv[0], kv[1]); err != nil {
+			level.Error(logger).Log("msg", "Unable to parse counter value", "guid", guid, "port", port, "counter", kv[0], "err", err)
+			errors++
+			continue
+		}
+		counters[guid][port] = counter
+	}
+	flush()
+	return counters, lids, errors
+}
+
+// mapPortGUIDs returns the counters keyed by port GUID keyed by the node GUID of the device with the same LID.
+// Port GUIDs that do not map to a discovered device are skipped.
+func mapPortGUIDs(counters SourceCounters, lids map[string]string, devices []InfinibandDevice, logger log.Logger) SourceCounters {
+	nodes := make(map[string]string)
+	guids := make(map[string]bool)
+	for _, device := range devices {
+		guids[device.GUID] = true
+		if device.LID != "" {
+			nodes[device.LID] = device.GUID
+		}
+		for _, uplink := range device.Uplinks {
+			guids[uplink.GUID] = true
+			if uplink.LID != "" {
+				nodes[uplink.LID] = uplink.GUID
+			}
+		}
+	}
+	mapped := make(SourceCounters)
+	for guid, ports := range counters {
+		node := guid
+		if !guids[guid] {
+			var ok bool
+			lid := lids[guid]
+			if node, ok = nodes[lid]; lid == "" || !ok {
+				level.Debug(logger).Log("msg", "Skipping port GUID that does not map to a device", "guid", guid, "lid", lid)
+				continue
+			}
+		}
+		if _, ok := mapped[node]; !ok {
+			mapped[node] = make(map[string]PerfQueryCounters)
+		}
+		for port, counter := range ports {
+			mapped[node][port] = counter
+		}
+	}
+	return mapped
+}
@@ -0,0 +1,308 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPerfmgrParse(t *testing.T) {
+	out, err := ReadFixture("perfmgr", "test")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	counters, errors := perfmgrParse(strings.NewReader(out), log.NewNopLogger())
+	if errors != 0 {
+		t.Errorf("Unexpected errors, got %f", errors)
+	}
+	if len(counters) != 2 {
+		t.Errorf("Unexpected number of devices, got %d", len(counters))
+	}
+	if len(counters["0x7cfe9003009ce5b0"]) != 4 {
+		t.Errorf("Unexpected number of ports, got %d", len(counters["0x7cfe9003009ce5b0"]))
+	}
+	c := counters["0x506b4b03005c2740"]["35"]
+	if c.PortSelect != "35" {
+		t.Errorf("Unexpected PortSelect, got %s", c.PortSelect)
+	}
+	if c.LinkDownedCounter != 1 {
+		t.Errorf("Unexpected LinkDownedCounter, got %f", c.LinkDownedCounter)
+	}
+	if c.PortXmitData != 49380 {
+		t.Errorf("Unexpected PortXmitData, got %f", c.PortXmitData)
+	}
+	if c.PortXmitWait != 100 {
+		t.Errorf("Unexpected PortXmitWait, got %f", c.PortXmitWait)
+	}
+	if !math.IsNaN(c.QP1Dropped) {
+		t.Errorf("Expected QP1Dropped to be NaN, got %f", c.QP1Dropped)
+	}
+}
+
+func TestPerfmgrParseErrors(t *testing.T) {
+	out, err := ReadFixture("perfmgr", "test-err")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	counters, errors := perfmgrParse(strings.NewReader(out), log.NewNopLogger())
+	if errors != 2 {
+		t.Errorf("Unexpected errors, got %f", errors)
+	}
+	if len(counters) != 1 {
+		t.Errorf("Unexpected number of devices, got %d", len(counters))
+	}
+	if c := counters["0x7cfe9003009ce5b0"]["1"]; c.LinkDownedCounter != 2 {
+		t.Errorf("Unexpected LinkDownedCounter, got %f", c.LinkDownedCounter)
+	}
+}
+
+func TestIbdiagnetCSVParse(t *testing.T) {
+	f, err := os.Open("fixtures/ibdiagnet/ibdiagnet2.db_csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	counters, errors := ibdiagnetCSVParse(f, log.NewNopLogger())
+	if errors != 0 {
+		t.Errorf("Unexpected errors, got %f", errors)
+	}
+	if len(counters) != 4 {
+		t.Errorf("Unexpected number of devices, got %d", len(counters))
+	}
+	c := counters["0x506b4b03005c2740"]["35"]
+	if c.PortXmitData != 49380 {
+		t.Errorf("Unexpected PortXmitData, got %f", c.PortXmitData)
+	}
+	if c.PortXmitPkts != 10 {
+		t.Errorf("Unexpected PortXmitPkts, got %f", c.PortXmitPkts)
+	}
+	if c := counters["0x7cfe9003009ce5b0"]["1"]; c.PortLocalPhysicalErrors != 1 {
+		t.Errorf("Unexpected PortLocalPhysicalErrors, got %f", c.PortLocalPhysicalErrors)
+	}
+	if c := counters["0x7cfe9003003b4bde"]["1"]; !math.IsNaN(c.PortLocalPhysicalErrors) {
+		t.Errorf("Expected PortLocalPhysicalErrors to be NaN, got %f", c.PortLocalPhysicalErrors)
+	}
+}
+
+func TestIbdiagnetPMParse(t *testing.T) {
+	f, err := os.Open("fixtures/ibdiagnet-pm/ibdiagnet2.pm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	counters, lids, errors := ibdiagnetPMParse(f, log.NewNopLogger())
+	if errors != 0 {
+		t.Errorf("Unexpected errors, got %f", errors)
+	}
+	if len(counters) != 2 {
+		t.Errorf("Unexpected number of devices, got %d", len(counters))
+	}
+	if lids["0x7cfe9003003b4bdf"] != "134" {
+		t.Errorf("Unexpected LID, got %s", lids["0x7cfe9003003b4bdf"])
+	}
+	c := counters["0x7cfe9003003b4bdf"]["1"]
+	if c.SymbolErrorCounter != 4 {
+		t.Errorf("Unexpected SymbolErrorCounter, got %f", c.SymbolErrorCounter)
+	}
+	if c.PortXmitData != 3600 {
+		t.Errorf("Unexpected PortXmitData, got %f", c.PortXmitData)
+	}
+	if c.PortRcvData != 4000 {
+		t.Errorf("Unexpected PortRcvData, got %f", c.PortRcvData)
+	}
+	if c.VL15Dropped != 0 || c.PortDLIDMappingErrors != 0 {
+		t.Errorf("Unexpected VL15Dropped or PortDLIDMappingErrors, got %f and %f", c.VL15Dropped, c.PortDLIDMappingErrors)
+	}
+}
+
+func TestMapPortGUIDs(t *testing.T) {
+	counters := SourceCounters{
+		"0x7cfe9003009ce5b0": {"1": PerfQueryCounters{PortXmitData: 1}},
+		"0x7cfe9003003b4bdf": {"1": PerfQueryCounters{PortXmitData: 2}},
+		"0x7cfe9003003b4bee": {"1": PerfQueryCounters{PortXmitData: 3}},
+		"0x7cfe9003003b4bff": {"1": PerfQueryCounters{PortXmitData: 4}},
+	}
+	lids := map[string]string{
+		"0x7cfe9003009ce5b0": "1719",
+		"0x7cfe9003003b4bdf": "134",
+		"0x7cfe9003003b4bee": "999",
+		"0x7cfe9003003b4bff": "",
+	}
+	devices := []InfinibandDevice{
+		{GUID: "0x7cfe9003009ce5b0", LID: "1719"},
+		{GUID: "0x7cfe9003003b4bde", LID: "134"},
+		{GUID: "0x506b4b03005c2740", LID: ""},
+	}
+	mapped := mapPortGUIDs(counters, lids, devices, log.NewNopLogger())
+	if len(mapped) != 2 {
+		t.Errorf("Unexpected number of devices, got %d: %v", len(mapped), mapped)
+	}
+	if c := mapped["0x7cfe9003009ce5b0"]["1"]; c.PortXmitData != 1 {
+		t.Errorf("Unexpected PortXmitData for node GUID, got %f", c.PortXmitData)
+	}
+	if c := mapped["0x7cfe9003003b4bde"]["1"]; c.PortXmitData != 2 {
+		t.Errorf("Unexpected PortXmitData for port GUID, got %f", c.PortXmitData)
+	}
+	if _, ok := mapped[""]; ok {
+		t.Errorf("Unexpected counters without a node GUID")
+	}
+	if len(counters) != 4 {
+		t.Errorf("Unexpected change of source counters, got %d devices", len(counters))
+	}
+}
+
+func TestSwitchCollectorPerfmgr(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--counters.source=perfmgr", "--perfmgr.dump-file=fixtures/perfmgr/test.out"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	SetPerfqueryExecs(t, true, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="switch"} 0
+		# HELP infiniband_switch_collect_error Indicates if collect error
+		# TYPE infiniband_switch_collect_error gauge
+		infiniband_switch_collect_error{collector="switch",guid="0x506b4b03005c2740"} 0
+		infiniband_switch_collect_error{collector="switch",guid="0x7cfe9003009ce5b0"} 0
+		# HELP infiniband_switch_port_link_downed_total Infiniband switch port LinkDownedCounter
+		# TYPE infiniband_switch_port_link_downed_total counter
+		infiniband_switch_port_link_downed_total{guid="0x506b4b03005c2740",port="35"} 1
+		infiniband_switch_port_link_downed_total{guid="0x7cfe9003009ce5b0",port="1"} 0
+		infiniband_switch_port_link_downed_total{guid="0x7cfe9003009ce5b0",port="10"} 0
+		infiniband_switch_port_link_downed_total{guid="0x7cfe9003009ce5b0",port="11"} 3
+		# HELP infiniband_switch_port_transmit_data_bytes_total Infiniband switch port PortXmitData
+		# TYPE infiniband_switch_port_transmit_data_bytes_total counter
+		infiniband_switch_port_transmit_data_bytes_total{guid="0x506b4b03005c2740",port="35"} 49380
+		infiniband_switch_port_transmit_data_bytes_total{guid="0x7cfe9003009ce5b0",port="1"} 4000
+		infiniband_switch_port_transmit_data_bytes_total{guid="0x7cfe9003009ce5b0",port="10"} 12000
+		infiniband_switch_port_transmit_data_bytes_total{guid="0x7cfe9003009ce5b0",port="11"} 20000
+	`
+	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_switch_collect_error",
+		"infiniband_switch_port_link_downed_total", "infiniband_switch_port_transmit_data_bytes_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestHCACollectorIbdiagnet(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.hca.rcv-err-details", "--counters.source=ibdiagnet", "--ibdiagnet.dir=fixtures/ibdiagnet"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	SetPerfqueryExecs(t, true, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="hca"} 0
+		# HELP infiniband_hca_port_symbol_error_total Infiniband HCA port SymbolErrorCounter
+		# TYPE infiniband_hca_port_symbol_error_total counter
+		infiniband_hca_port_symbol_error_total{guid="0x7cfe9003003b4b96",port="1"} 0
+		infiniband_hca_port_symbol_error_total{guid="0x7cfe9003003b4bde",port="1"} 4
+		# HELP infiniband_hca_port_receive_data_bytes_total Infiniband HCA port PortRcvData
+		# TYPE infiniband_hca_port_receive_data_bytes_total counter
+		infiniband_hca_port_receive_data_bytes_total{guid="0x7cfe9003003b4b96",port="1"} 3200
+		infiniband_hca_port_receive_data_bytes_total{guid="0x7cfe9003003b4bde",port="1"} 4400
+	`
+	collector := NewHCACollector(&hcaDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_hca_port_symbol_error_total",
+		"infiniband_hca_port_receive_data_bytes_total", "infiniband_hca_port_local_physical_errors_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestHCACollectorIbdiagnetPM(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--counters.source=ibdiagnet", "--ibdiagnet.dir=fixtures/ibdiagnet-pm"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	SetPerfqueryExecs(t, true, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="hca"} 0
+		# HELP infiniband_hca_port_symbol_error_total Infiniband HCA port SymbolErrorCounter
+		# TYPE infiniband_hca_port_symbol_error_total counter
+		infiniband_hca_port_symbol_error_total{guid="0x7cfe9003003b4b96",port="1"} 0
+		infiniband_hca_port_symbol_error_total{guid="0x7cfe9003003b4bde",port="1"} 4
+	`
+	collector := NewHCACollector(&hcaDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_hca_port_symbol_error_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestSwitchCollectorSourceError(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--counters.source=ibdiagnet", "--ibdiagnet.dir=fixtures/does-not-exist"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="switch"} 1
+		# HELP infiniband_switch_collect_error Indicates if collect error
+		# TYPE infiniband_switch_collect_error gauge
+		infiniband_switch_collect_error{collector="switch",guid="0x506b4b03005c2740"} 1
+		infiniband_switch_collect_error{collector="switch",guid="0x7cfe9003009ce5b0"} 1
+	`
+	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_switch_collect_error"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestNormalizeGUID(t *testing.T) {
+	guid, err := normalizeGUID("0x7cfe9003003b4b")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if guid != "0x007cfe9003003b4b" {
+		t.Errorf("Unexpected GUID, got %s", guid)
+	}
+	if _, err := normalizeGUID("foo"); err == nil {
+		t.Errorf("Expected error")
+	}
+}
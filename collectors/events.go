@@ -0,0 +1,496 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	eventQueueSize = 100
+
+	severityCritical = "critical"
+	severityWarning  = "warning"
+	severityInfo     = "info"
+)
+
+var (
+	eventsDedupWindow  = kingpin.Flag("events.dedup-window", "Events of the same type for the same device, port or component are sent once within this window").Default("1h").Duration()
+	eventsRateLimit    = kingpin.Flag("events.rate-limit", "Maximum number of events sent per minute, 0 disables").Default("60").Float64()
+	eventsTempCritical = kingpin.Flag("events.temperature-threshold", "Send an event when a switch temperature in Celsius rises above this value, 0 disables").Default("0").Float64()
+	EventsFlushTimeout = kingpin.Flag("events.flush-timeout", "Time to wait for queued events to be sent on exit").Default("10s").Duration()
+	events             = newEventTracker()
+)
+
+// Event is a discrete change of the fabric sent to the event sinks
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	GUID      string    `json:"guid"`
+	Name      string    `json:"name"`
+	Port      string    `json:"port,omitempty"`
+	Component string    `json:"component,omitempty"`
+	Message   string    `json:"message"`
+	// revert restores the baseline the event was found with so a later collection produces it again,
+	// called with the tracker locked
+	revert func()
+}
+
+type eventBatch struct {
+	events []Event
+	logger log.Logger
+}
+
+// eventTracker compares collections with the previous collection to produce events
+type eventTracker struct {
+	sync.Mutex
+	devices    map[string]InfinibandDevice
+	counters   map[string]PerfQueryCounters
+	swinfos    map[string]Ibswinfo
+	sent       map[string]time.Time
+	tokens     float64
+	refilled   time.Time
+	sinks      []eventSink
+	sinksOnce  sync.Once
+	queue      chan eventBatch
+	queueOnce  sync.Once
+	pending    sync.WaitGroup
+	dispatch   func(eventBatch)
+	total      map[string]float64
+	suppressed map[string]float64
+	sinkErrors map[string]float64
+}
+
+type EventsCollector struct {
+	Events     *prometheus.Desc
+	Suppressed *prometheus.Desc
+	SinkErrors *prometheus.Desc
+}
+
+func newEventTracker() *eventTracker {
+	e := &eventTracker{
+		counters:   make(map[string]PerfQueryCounters),
+		swinfos:    make(map[string]Ibswinfo),
+		sent:       make(map[string]time.Time),
+		queue:      make(chan eventBatch, eventQueueSize),
+		total:      make(map[string]float64),
+		suppressed: make(map[string]float64),
+		sinkErrors: make(map[string]float64),
+	}
+	e.dispatch = e.enqueue
+	return e
+}
+
+// EventsEnabled returns true if any event sink is configured
+func EventsEnabled() bool {
+	return *eventsWebhookURL != "" || *eventsSyslog || *eventsFile != ""
+}
+
+// FlushEvents waits up to timeout for queued events to be sent to the sinks
+func FlushEvents(timeout time.Duration) error {
+	return events.flush(timeout)
+}
+
+// recordTopology sends events for devices and links that changed since the previous discovery
+func recordTopology(switches *[]InfinibandDevice, hcas *[]InfinibandDevice, logger log.Logger) {
+	if !EventsEnabled() {
+		return
+	}
+	var devices []InfinibandDevice
+	devices = append(devices, *switches...)
+	devices = append(devices, *hcas...)
+	events.emit(events.diffTopology(devices, time.Now()), time.Now(), logger)
+}
+
+func (e *eventTracker) diffTopology(devices []InfinibandDevice, now time.Time) []Event {
+	current := make(map[string]InfinibandDevice)
+	for _, device := range devices {
+		current[device.GUID] = device
+	}
+	e.Lock()
+	previous := e.devices
+	e.devices = current
+	e.Unlock()
+	// The first discovery is the baseline
+	if previous == nil {
+		return nil
+	}
+	var result []Event
+	for _, guid := range sortedKeys(current) {
+		device := current[guid]
+		old, ok := previous[guid]
+		if !ok {
+			result = append(result, Event{Time: now, Type: "device_added", Severity: severityInfo, GUID: guid, Name: device.Name,
+				Message: fmt.Sprintf("%s %s %s appeared in the fabric", device.Type, device.Name, guid),
+				revert:  func() { delete(e.devices, guid) }})
+			continue
+		}
+		for _, port := range sortedKeys(old.Uplinks) {
+			oldUplink := old.Uplinks[port]
+			uplink, ok := device.Uplinks[port]
+			if !ok {
+				result = append(result, Event{Time: now, Type: "link_down", Severity: severityWarning, GUID: guid, Name: device.Name, Port: port,
+					Message: fmt.Sprintf("Link from %s port %s to %s port %s went down", device.Name, port, oldUplink.Name, oldUplink.PortNumber),
+					revert:  e.revertUplink(guid, port, &oldUplink)})
+			} else if uplink.GUID != oldUplink.GUID || uplink.PortNumber != oldUplink.PortNumber {
+				result = append(result, Event{Time: now, Type: "port_recabled", Severity: severityWarning, GUID: guid, Name: device.Name, Port: port,
+					Message: fmt.Sprintf("%s port %s moved from %s port %s to %s port %s", device.Name, port, oldUplink.Name, oldUplink.PortNumber, uplink.Name, uplink.PortNumber),
+					revert:  e.revertUplink(guid, port, &oldUplink)})
+			}
+		}
+		for _, port := range sortedKeys(device.Uplinks) {
+			if _, ok := old.Uplinks[port]; !ok {
+				uplink := device.Uplinks[port]
+				result = append(result, Event{Time: now, Type: "link_up", Severity: severityInfo, GUID: guid, Name: device.Name, Port: port,
+					Message: fmt.Sprintf("Link from %s port %s to %s port %s came up", device.Name, port, uplink.Name, uplink.PortNumber),
+					revert:  e.revertUplink(guid, port, nil)})
+			}
+		}
+	}
+	for _, guid := range sortedKeys(previous) {
+		if _, ok := current[guid]; ok {
+			continue
+		}
+		device := previous[guid]
+		severity := severityWarning
+		if device.Type == "SW" {
+			severity = severityCritical
+		}
+		result = append(result, Event{Time: now, Type: "device_removed", Severity: severity, GUID: guid, Name: device.Name,
+			Message: fmt.Sprintf("%s %s %s disappeared from the fabric", device.Type, device.Name, guid),
+			revert:  func() { e.devices[guid] = device }})
+	}
+	return result
+}
+
+// revertUplink returns a function that restores the previous uplink of a port in the topology baseline,
+// a nil uplink removes the port. The uplinks are copied as they are shared with the discovered devices.
+func (e *eventTracker) revertUplink(guid string, port string, uplink *InfinibandUplink) func() {
+	return func() {
+		device, ok := e.devices[guid]
+		if !ok {
+			return
+		}
+		uplinks := make(map[string]InfinibandUplink, len(device.Uplinks))
+		for p, u := range device.Uplinks {
+			uplinks[p] = u
+		}
+		if uplink != nil {
+			uplinks[port] = *uplink
+		} else {
+			delete(uplinks, port)
+		}
+		device.Uplinks = uplinks
+		e.devices[guid] = device
+	}
+}
+
+func (e *eventTracker) recordCounters(counters []PerfQueryCounters, now time.Time, logger log.Logger) {
+	if !EventsEnabled() {
+		return
+	}
+	e.emit(e.diffCounters(counters, now), now, logger)
+}
+
+// diffCounters sends events for ports whose link downed or symbol error counters increased
+func (e *eventTracker) diffCounters(counters []PerfQueryCounters, now time.Time) []Event {
+	var result []Event
+	e.Lock()
+	defer e.Unlock()
+	for _, c := range counters {
+		key := fmt.Sprintf("%s-%s", c.device.GUID, c.PortSelect)
+		previous, ok := e.counters[key]
+		merged := c
+		if ok {
+			merged = previous
+			mergeCounters(&merged, c)
+		}
+		e.counters[key] = merged
+		if !ok {
+			continue
+		}
+		if delta := counterIncrease(previous.LinkDownedCounter, c.LinkDownedCounter); delta > 0 {
+			result = append(result, Event{Time: now, Type: "link_downed", Severity: severityWarning, GUID: c.device.GUID, Name: c.device.Name, Port: c.PortSelect,
+				Message: fmt.Sprintf("%s port %s link downed %.0f times", c.device.Name, c.PortSelect, delta),
+				revert:  e.revertCounter(key, func(counters *PerfQueryCounters) { counters.LinkDownedCounter = previous.LinkDownedCounter })})
+		}
+		if delta := counterIncrease(previous.SymbolErrorCounter, c.SymbolErrorCounter); delta > 0 {
+			result = append(result, Event{Time: now, Type: "symbol_errors", Severity: severityWarning, GUID: c.device.GUID, Name: c.device.Name, Port: c.PortSelect,
+				Message: fmt.Sprintf("%s port %s has %.0f new symbol errors", c.device.Name, c.PortSelect, delta),
+				revert:  e.revertCounter(key, func(counters *PerfQueryCounters) { counters.SymbolErrorCounter = previous.SymbolErrorCounter })})
+		}
+	}
+	return result
+}
+
+// revertCounter returns a function that applies restore to the counters baseline of a port
+func (e *eventTracker) revertCounter(key string, restore func(*PerfQueryCounters)) func() {
+	return func() {
+		counters := e.counters[key]
+		restore(&counters)
+		e.counters[key] = counters
+	}
+}
+
+func (e *eventTracker) recordIbswinfo(swinfos []Ibswinfo, now time.Time, logger log.Logger) {
+	if !EventsEnabled() {
+		return
+	}
+	e.emit(e.diffIbswinfo(swinfos, now), now, logger)
+}
+
+// diffIbswinfo sends events for power supplies and fans leaving the OK status and temperatures rising above the threshold
+func (e *eventTracker) diffIbswinfo(swinfos []Ibswinfo, now time.Time) []Event {
+	var result []Event
+	e.Lock()
+	defer e.Unlock()
+	for _, swinfo := range swinfos {
+		if swinfo.error > 0 || swinfo.timeout > 0 {
+			continue
+		}
+		device := swinfo.device
+		previous, ok := e.swinfos[device.GUID]
+		e.swinfos[device.GUID] = swinfo
+		if !ok {
+			continue
+		}
+		previousPSUs := make(map[string]SwitchPowerSupply)
+		for _, psu := range previous.PowerSupplies {
+			previousPSUs[psu.ID] = psu
+		}
+		for _, psu := range swinfo.PowerSupplies {
+			old, ok := previousPSUs[psu.ID]
+			if !ok {
+				continue
+			}
+			component := fmt.Sprintf("psu%s", psu.ID)
+			if old.Status == "OK" && psu.Status != "OK" {
+				result = append(result, Event{Time: now, Type: "psu_status", Severity: severityCritical, GUID: device.GUID, Name: device.Name, Component: component,
+					Message: fmt.Sprintf("%s PSU %s status changed from %s to %s", device.Name, psu.ID, old.Status, psu.Status),
+					revert:  e.revertPSU(device.GUID, psu.ID, func(current *SwitchPowerSupply) { current.Status = old.Status })})
+			}
+			if old.FanStatus == "OK" && psu.FanStatus != "OK" {
+				result = append(result, Event{Time: now, Type: "fan_failure", Severity: severityCritical, GUID: device.GUID, Name: device.Name, Component: component,
+					Message: fmt.Sprintf("%s PSU %s fan status changed from %s to %s", device.Name, psu.ID, old.FanStatus, psu.FanStatus),
+					revert:  e.revertPSU(device.GUID, psu.ID, func(current *SwitchPowerSupply) { current.FanStatus = old.FanStatus })})
+			}
+		}
+		if previous.FanStatus == "OK" && swinfo.FanStatus != "OK" {
+			result = append(result, Event{Time: now, Type: "fan_failure", Severity: severityCritical, GUID: device.GUID, Name: device.Name, Component: "fans",
+				Message: fmt.Sprintf("%s fan status changed from %s to %s", device.Name, previous.FanStatus, swinfo.FanStatus),
+				revert:  e.revertIbswinfo(device.GUID, func(current *Ibswinfo) { current.FanStatus = previous.FanStatus })})
+		}
+		threshold := *eventsTempCritical
+		if threshold > 0 && swinfo.Temp > threshold && (math.IsNaN(previous.Temp) || previous.Temp <= threshold) {
+			result = append(result, Event{Time: now, Type: "temperature", Severity: severityCritical, GUID: device.GUID, Name: device.Name,
+				Message: fmt.Sprintf("%s temperature %.0fC is above %.0fC", device.Name, swinfo.Temp, threshold),
+				revert:  e.revertIbswinfo(device.GUID, func(current *Ibswinfo) { current.Temp = previous.Temp })})
+		}
+	}
+	return result
+}
+
+// revertIbswinfo returns a function that applies restore to the ibswinfo baseline of a switch
+func (e *eventTracker) revertIbswinfo(guid string, restore func(*Ibswinfo)) func() {
+	return func() {
+		swinfo := e.swinfos[guid]
+		restore(&swinfo)
+		e.swinfos[guid] = swinfo
+	}
+}
+
+// revertPSU returns a function that applies restore to a power supply in the ibswinfo baseline of a switch,
+// the power supplies are copied as they are shared with the collected data
+func (e *eventTracker) revertPSU(guid string, id string, restore func(*SwitchPowerSupply)) func() {
+	return e.revertIbswinfo(guid, func(swinfo *Ibswinfo) {
+		psus := make([]SwitchPowerSupply, len(swinfo.PowerSupplies))
+		copy(psus, swinfo.PowerSupplies)
+		for i := range psus {
+			if psus[i].ID == id {
+				restore(&psus[i])
+			}
+		}
+		swinfo.PowerSupplies = psus
+	})
+}
+
+// counterIncrease returns the increase of a counter, counters that were reset or not collected are ignored
+func counterIncrease(previous float64, current float64) float64 {
+	if math.IsNaN(previous) || math.IsNaN(current) || current < previous {
+		return 0
+	}
+	return current - previous
+}
+
+// emit drops duplicate events within the dedup window and events above the rate limit before dispatching to sinks.
+// Events above the rate limit are reverted in the baseline so a later collection sends them.
+func (e *eventTracker) emit(pending []Event, now time.Time, logger log.Logger) {
+	if len(pending) == 0 {
+		return
+	}
+	var batch []Event
+	e.Lock()
+	if *eventsRateLimit > 0 {
+		if e.refilled.IsZero() {
+			e.tokens = *eventsRateLimit
+		} else {
+			e.tokens = math.Min(*eventsRateLimit, e.tokens+now.Sub(e.refilled).Minutes()**eventsRateLimit)
+		}
+		e.refilled = now
+	}
+	for key, sent := range e.sent {
+		if now.Sub(sent) >= *eventsDedupWindow {
+			delete(e.sent, key)
+		}
+	}
+	for _, event := range pending {
+		key := fmt.Sprintf("%s-%s-%s-%s", event.Type, event.GUID, event.Port, event.Component)
+		if _, ok := e.sent[key]; ok {
+			e.suppressed["duplicate"]++
+			continue
+		}
+		if *eventsRateLimit > 0 {
+			if e.tokens < 1 {
+				e.suppressed["rate_limit"]++
+				if event.revert != nil {
+					event.revert()
+				}
+				continue
+			}
+			e.tokens--
+		}
+		e.sent[key] = now
+		batch = append(batch, event)
+	}
+	e.Unlock()
+	if len(batch) > 0 {
+		level.Debug(logger).Log("msg", "Sending events", "count", len(batch))
+		e.dispatch(eventBatch{events: batch, logger: logger})
+	}
+}
+
+// enqueue sends events in the background so slow sinks do not delay collection
+func (e *eventTracker) enqueue(batch eventBatch) {
+	e.queueOnce.Do(func() {
+		go func() {
+			for batch := range e.queue {
+				e.send(batch)
+				e.pending.Done()
+			}
+		}()
+	})
+	e.pending.Add(1)
+	select {
+	case e.queue <- batch:
+	default:
+		e.pending.Done()
+		level.Warn(batch.logger).Log("msg", "Event queue full, dropping events", "count", len(batch.events))
+		e.Lock()
+		e.suppressed["queue_full"] += float64(len(batch.events))
+		e.Unlock()
+	}
+}
+
+// flush waits for the queued and in-flight events, giving up after timeout
+func (e *eventTracker) flush(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		e.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Timeout after %s sending queued events, %d batches not sent", timeout, len(e.queue))
+	}
+}
+
+// send sends a batch to every sink, the events are counted once any sink accepted them
+func (e *eventTracker) send(batch eventBatch) {
+	e.sinksOnce.Do(func() {
+		if e.sinks == nil {
+			e.sinks = newEventSinks(batch.logger)
+		}
+	})
+	sent := false
+	for _, sink := range e.sinks {
+		if err := sink.send(batch.events); err != nil {
+			level.Error(batch.logger).Log("msg", "Error sending events", "sink", sink.name(), "err", err)
+			e.Lock()
+			e.sinkErrors[sink.name()]++
+			e.Unlock()
+			continue
+		}
+		sent = true
+	}
+	if !sent {
+		return
+	}
+	e.Lock()
+	for _, event := range batch.events {
+		e.total[event.Type]++
+	}
+	e.Unlock()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func NewEventsCollector() *EventsCollector {
+	return &EventsCollector{
+		Events: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "events_total"),
+			"Number of events sent to event sinks", []string{"type"}, nil),
+		Suppressed: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "events_suppressed_total"),
+			"Number of events not sent because of deduplication, rate limiting or a full queue", []string{"reason"}, nil),
+		SinkErrors: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "event_sink_errors_total"),
+			"Number of failures sending events to an event sink", []string{"sink"}, nil),
+	}
+}
+
+func (c *EventsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.Events
+	ch <- c.Suppressed
+	ch <- c.SinkErrors
+}
+
+func (c *EventsCollector) Collect(ch chan<- prometheus.Metric) {
+	events.Lock()
+	defer events.Unlock()
+	for eventType, value := range events.total {
+		ch <- prometheus.MustNewConstMetric(c.Events, prometheus.CounterValue, value, eventType)
+	}
+	for reason, value := range events.suppressed {
+		ch <- prometheus.MustNewConstMetric(c.Suppressed, prometheus.CounterValue, value, reason)
+	}
+	for sink, value := range events.sinkErrors {
+		ch <- prometheus.MustNewConstMetric(c.SinkErrors, prometheus.CounterValue, value, sink)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var (
+	eventsWebhookURL     = kingpin.Flag("events.webhook-url", "URL that events are posted to as JSON").Default("").String()
+	eventsWebhookHeaders = kingpin.Flag("events.webhook-header", "Header added to event webhook requests, eg Authorization=Bearer TOKEN, can be repeated").StringMap()
+	eventsWebhookTimeout = kingpin.Flag("events.webhook-timeout", "Timeout for event webhook requests").Default("10s").Duration()
+	eventsSyslog         = kingpin.Flag("events.syslog", "Send events to the local syslog").Default("false").Bool()
+	eventsSyslogTag      = kingpin.Flag("events.syslog-tag", "Tag of events sent to syslog").Default("infiniband_exporter").String()
+	eventsFile           = kingpin.Flag("events.file", "File that events are appended to as JSON lines").Default("").String()
+)
+
+type eventSink interface {
+	name() string
+	send(events []Event) error
+}
+
+type webhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+type fileSink struct {
+	path string
+}
+
+// webhookPayload is the JSON body posted to the event webhook
+type webhookPayload struct {
+	Events []Event `json:"events"`
+}
+
+func newEventSinks(logger log.Logger) []eventSink {
+	var sinks []eventSink
+	if *eventsWebhookURL != "" {
+		sinks = append(sinks, &webhookSink{url: *eventsWebhookURL, headers: *eventsWebhookHeaders, client: &http.Client{Timeout: *eventsWebhookTimeout}})
+	}
+	if *eventsSyslog {
+		sink, err := newSyslogSink(*eventsSyslogTag)
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to connect to syslog, events will not be sent to syslog", "err", err)
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	if *eventsFile != "" {
+		sinks = append(sinks, &fileSink{path: *eventsFile})
+	}
+	return sinks
+}
+
+func (s *webhookSink) name() string {
+	return "webhook"
+}
+
+func (s *webhookSink) send(events []Event) error {
+	body, err := json.Marshal(webhookPayload{Events: events})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("Event webhook returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *fileSink) name() string {
+	return "file"
+}
+
+func (s *fileSink) send(events []Event) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, event := range events {
+		if err = encoder.Encode(event); err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
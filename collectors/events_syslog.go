@@ -0,0 +1,61 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+
+package collectors
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(tag string) (eventSink, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) name() string {
+	return "syslog"
+}
+
+func (s *syslogSink) send(events []Event) error {
+	for _, event := range events {
+		msg := formatSyslogEvent(event)
+		var err error
+		switch event.Severity {
+		case severityCritical:
+			err = s.writer.Crit(msg)
+		case severityWarning:
+			err = s.writer.Warning(msg)
+		default:
+			err = s.writer.Info(msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatSyslogEvent(event Event) string {
+	return fmt.Sprintf("type=%s severity=%s guid=%s name=%q port=%s component=%s msg=%q",
+		event.Type, event.Severity, event.GUID, event.Name, event.Port, event.Component, event.Message)
+}
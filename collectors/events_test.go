@@ -0,0 +1,358 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// captureSink records the events sent to it, returning err instead when set
+type captureSink struct {
+	sent *[]Event
+	err  error
+}
+
+func (s *captureSink) name() string {
+	return "capture"
+}
+
+func (s *captureSink) send(events []Event) error {
+	if s.err != nil {
+		return s.err
+	}
+	*s.sent = append(*s.sent, events...)
+	return nil
+}
+
+// setupEvents replaces the event tracker with one that synchronously sends events to sent
+func setupEvents(t *testing.T, args []string) *[]Event {
+	setupTest(t, args)
+	sent := &[]Event{}
+	events.sinks = []eventSink{&captureSink{sent: sent}}
+	events.dispatch = events.send
+	return sent
+}
+
+func eventTypes(events []Event) []string {
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type+" "+event.GUID+" "+event.Port+event.Component)
+	}
+	return types
+}
+
+func TestEventsTopology(t *testing.T) {
+	setupEvents(t, []string{})
+	now := time.Now()
+	if result := events.diffTopology(switchDevices, now); len(result) != 0 {
+		t.Errorf("Expected no events for first discovery, got %v", result)
+	}
+	changed := switchDevices[1]
+	changed.Uplinks = map[string]InfinibandUplink{
+		"1":  {Type: "SW", LID: "1517", PortNumber: "2", GUID: "0x7cfe900300b07321", Name: "ib-i1l2s02"},
+		"10": switchDevices[1].Uplinks["10"],
+		"12": {Type: "CA", LID: "135", PortNumber: "1", GUID: "0x7cfe9003003b4b97", Name: "o0003 HCA-1"},
+	}
+	added := InfinibandDevice{Type: "CA", GUID: "0x7cfe9003003b4b97", Name: "o0003 HCA-1"}
+	result := events.diffTopology([]InfinibandDevice{changed, added}, now)
+	expected := []string{
+		"device_added 0x7cfe9003003b4b97 ",
+		"port_recabled 0x7cfe9003009ce5b0 1",
+		"link_down 0x7cfe9003009ce5b0 11",
+		"link_up 0x7cfe9003009ce5b0 12",
+		"device_removed 0x506b4b03005c2740 ",
+	}
+	if !reflect.DeepEqual(eventTypes(result), expected) {
+		t.Errorf("Unexpected events\nExpected: %v\nGot: %v", expected, eventTypes(result))
+	}
+	if result[4].Severity != severityCritical {
+		t.Errorf("Expected removed switch to be critical, got %s", result[4].Severity)
+	}
+	if result[1].Message != "ib-i1l1s01 port 1 moved from ib-i1l2s01 port 1 to ib-i1l2s02 port 2" {
+		t.Errorf("Unexpected message, got %s", result[1].Message)
+	}
+}
+
+func TestEventsCounters(t *testing.T) {
+	setupEvents(t, []string{})
+	now := time.Now()
+	counters := topCounters(switchDevices[0], "35", 1000, 10)
+	counters.SymbolErrorCounter = 1
+	counters.LinkDownedCounter = 2
+	if result := events.diffCounters([]PerfQueryCounters{counters}, now); len(result) != 0 {
+		t.Errorf("Expected no events for first collection, got %v", result)
+	}
+	// Rcv error details do not include the base counters
+	if result := events.diffCounters([]PerfQueryCounters{topRcvErrCounters(switchDevices[0], "35", math.NaN())}, now); len(result) != 0 {
+		t.Errorf("Expected no events for counters not collected, got %v", result)
+	}
+	counters.SymbolErrorCounter = 6
+	counters.LinkDownedCounter = 3
+	result := events.diffCounters([]PerfQueryCounters{counters}, now)
+	expected := []string{"link_downed 0x506b4b03005c2740 35", "symbol_errors 0x506b4b03005c2740 35"}
+	if !reflect.DeepEqual(eventTypes(result), expected) {
+		t.Errorf("Unexpected events\nExpected: %v\nGot: %v", expected, eventTypes(result))
+	}
+	if result[1].Message != "ib-i4l1s01 port 35 has 5 new symbol errors" {
+		t.Errorf("Unexpected message, got %s", result[1].Message)
+	}
+	counters.SymbolErrorCounter = 0
+	if result := events.diffCounters([]PerfQueryCounters{counters}, now); len(result) != 0 {
+		t.Errorf("Expected no events for reset counters, got %v", result)
+	}
+}
+
+func TestEventsIbswinfo(t *testing.T) {
+	setupEvents(t, []string{"--events.temperature-threshold=50"})
+	now := time.Now()
+	swinfo := Ibswinfo{device: switchDevices[0], Temp: 45, FanStatus: "OK",
+		PowerSupplies: []SwitchPowerSupply{{ID: "0", Status: "OK", FanStatus: "OK"}, {ID: "1", Status: "OK", FanStatus: "OK"}}}
+	if result := events.diffIbswinfo([]Ibswinfo{swinfo}, now); len(result) != 0 {
+		t.Errorf("Expected no events for first collection, got %v", result)
+	}
+	failed := Ibswinfo{device: switchDevices[0], error: 1}
+	if result := events.diffIbswinfo([]Ibswinfo{failed}, now); len(result) != 0 {
+		t.Errorf("Expected no events for failed collection, got %v", result)
+	}
+	swinfo = Ibswinfo{device: switchDevices[0], Temp: 55, FanStatus: "ERROR",
+		PowerSupplies: []SwitchPowerSupply{{ID: "0", Status: "ERROR", FanStatus: "OK"}, {ID: "1", Status: "OK", FanStatus: "ERROR"}}}
+	result := events.diffIbswinfo([]Ibswinfo{swinfo}, now)
+	expected := []string{
+		"psu_status 0x506b4b03005c2740 psu0",
+		"fan_failure 0x506b4b03005c2740 psu1",
+		"fan_failure 0x506b4b03005c2740 fans",
+		"temperature 0x506b4b03005c2740 ",
+	}
+	if !reflect.DeepEqual(eventTypes(result), expected) {
+		t.Errorf("Unexpected events\nExpected: %v\nGot: %v", expected, eventTypes(result))
+	}
+	if result := events.diffIbswinfo([]Ibswinfo{swinfo}, now); len(result) != 0 {
+		t.Errorf("Expected no events without changes, got %v", result)
+	}
+}
+
+func TestEventsDedupRateLimit(t *testing.T) {
+	sent := setupEvents(t, []string{"--events.rate-limit=2", "--events.dedup-window=10m"})
+	now := time.Now()
+	logger := log.NewNopLogger()
+	linkDown := Event{Type: "link_down", GUID: switchDevices[0].GUID, Port: "35"}
+	events.emit([]Event{linkDown, linkDown}, now, logger)
+	if len(*sent) != 1 {
+		t.Errorf("Expected duplicate event dropped, got %v", *sent)
+	}
+	events.emit([]Event{{Type: "link_down", GUID: switchDevices[1].GUID, Port: "1"}, {Type: "link_down", GUID: switchDevices[1].GUID, Port: "10"}}, now, logger)
+	if len(*sent) != 2 {
+		t.Errorf("Expected rate limited event dropped, got %v", *sent)
+	}
+	events.emit([]Event{linkDown, {Type: "link_down", GUID: switchDevices[1].GUID, Port: "10"}}, now.Add(11*time.Minute), logger)
+	if len(*sent) != 4 {
+		t.Errorf("Expected events sent after dedup window and rate limit refill, got %v", *sent)
+	}
+	expected := `# HELP infiniband_exporter_events_suppressed_total Number of events not sent because of deduplication, rate limiting or a full queue
+# TYPE infiniband_exporter_events_suppressed_total counter
+infiniband_exporter_events_suppressed_total{reason="duplicate"} 1
+infiniband_exporter_events_suppressed_total{reason="rate_limit"} 1
+# HELP infiniband_exporter_events_total Number of events sent to event sinks
+# TYPE infiniband_exporter_events_total counter
+infiniband_exporter_events_total{type="link_down"} 4
+`
+	if err := testutil.CollectAndCompare(NewEventsCollector(), strings.NewReader(expected)); err != nil {
+		t.Errorf("Unexpected metrics: %v", err)
+	}
+}
+
+func TestEventsRateLimitBaseline(t *testing.T) {
+	sent := setupEvents(t, []string{"--events.rate-limit=1", "--events.temperature-threshold=50"})
+	now := time.Now()
+	logger := log.NewNopLogger()
+	events.emit(events.diffTopology(switchDevices, now), now, logger)
+	down := switchDevices[1]
+	down.Uplinks = map[string]InfinibandUplink{}
+	events.emit(events.diffTopology([]InfinibandDevice{switchDevices[0], down}, now), now, logger)
+	if len(*sent) != 1 {
+		t.Errorf("Expected one event sent, got %v", eventTypes(*sent))
+	}
+	// The rate limited links are still down in the next discovery
+	result := events.diffTopology([]InfinibandDevice{switchDevices[0], down}, now)
+	expected := []string{"link_down 0x7cfe9003009ce5b0 10", "link_down 0x7cfe9003009ce5b0 11"}
+	if !reflect.DeepEqual(eventTypes(result), expected) {
+		t.Errorf("Unexpected events\nExpected: %v\nGot: %v", expected, eventTypes(result))
+	}
+	if len(down.Uplinks) != 0 || len(switchDevices[1].Uplinks) != 3 {
+		t.Errorf("Unexpected change of discovered uplinks, got %v and %v", down.Uplinks, switchDevices[1].Uplinks)
+	}
+
+	counters := topCounters(switchDevices[0], "35", 1000, 10)
+	counters.SymbolErrorCounter = 1
+	counters.LinkDownedCounter = 2
+	events.diffCounters([]PerfQueryCounters{counters}, now)
+	counters.SymbolErrorCounter = 6
+	counters.LinkDownedCounter = 3
+	now = now.Add(time.Minute)
+	events.emit(events.diffCounters([]PerfQueryCounters{counters}, now), now, logger)
+	result = events.diffCounters([]PerfQueryCounters{counters}, now)
+	if expected := []string{"symbol_errors 0x506b4b03005c2740 35"}; !reflect.DeepEqual(eventTypes(result), expected) {
+		t.Errorf("Unexpected events\nExpected: %v\nGot: %v", expected, eventTypes(result))
+	}
+
+	swinfo := Ibswinfo{device: switchDevices[0], Temp: 45, FanStatus: "OK",
+		PowerSupplies: []SwitchPowerSupply{{ID: "0", Status: "OK", FanStatus: "OK"}}}
+	events.diffIbswinfo([]Ibswinfo{swinfo}, now)
+	swinfo = Ibswinfo{device: switchDevices[0], Temp: 55, FanStatus: "ERROR",
+		PowerSupplies: []SwitchPowerSupply{{ID: "0", Status: "ERROR", FanStatus: "OK"}}}
+	now = now.Add(time.Minute)
+	events.emit(events.diffIbswinfo([]Ibswinfo{swinfo}, now), now, logger)
+	result = events.diffIbswinfo([]Ibswinfo{swinfo}, now)
+	if expected := []string{"fan_failure 0x506b4b03005c2740 fans", "temperature 0x506b4b03005c2740 "}; !reflect.DeepEqual(eventTypes(result), expected) {
+		t.Errorf("Unexpected events\nExpected: %v\nGot: %v", expected, eventTypes(result))
+	}
+	if swinfo.PowerSupplies[0].Status != "ERROR" {
+		t.Errorf("Unexpected change of collected power supplies, got %v", swinfo.PowerSupplies)
+	}
+}
+
+func TestEventsTotalSent(t *testing.T) {
+	setupEvents(t, []string{})
+	logger := log.NewNopLogger()
+	events.sinks = []eventSink{&captureSink{err: fmt.Errorf("Error")}}
+	events.emit([]Event{{Type: "link_down", GUID: switchDevices[0].GUID, Port: "35"}}, time.Now(), logger)
+	events.dispatch = events.enqueue
+	events.queue = make(chan eventBatch)
+	events.queueOnce.Do(func() {})
+	events.emit([]Event{{Type: "link_up", GUID: switchDevices[0].GUID, Port: "35"}}, time.Now(), logger)
+	expected := `# HELP infiniband_exporter_event_sink_errors_total Number of failures sending events to an event sink
+# TYPE infiniband_exporter_event_sink_errors_total counter
+infiniband_exporter_event_sink_errors_total{sink="capture"} 1
+# HELP infiniband_exporter_events_suppressed_total Number of events not sent because of deduplication, rate limiting or a full queue
+# TYPE infiniband_exporter_events_suppressed_total counter
+infiniband_exporter_events_suppressed_total{reason="queue_full"} 1
+`
+	if err := testutil.CollectAndCompare(NewEventsCollector(), strings.NewReader(expected)); err != nil {
+		t.Errorf("Unexpected metrics: %v", err)
+	}
+}
+
+func TestEventSinks(t *testing.T) {
+	var body []byte
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		header = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "events.json")
+	setupTest(t, []string{"--events.webhook-url=" + server.URL, "--events.webhook-header=Authorization=Bearer token", "--events.file=" + path})
+	batch := []Event{
+		{Time: time.Unix(1700000000, 0).UTC(), Type: "link_down", Severity: severityWarning, GUID: switchDevices[0].GUID, Name: "ib-i4l1s01", Port: "35", Message: "down"},
+		{Time: time.Unix(1700000000, 0).UTC(), Type: "device_added", Severity: severityInfo, GUID: "0x01", Message: "added"},
+	}
+	events.send(eventBatch{events: batch, logger: log.NewNopLogger()})
+	events.send(eventBatch{events: batch[:1], logger: log.NewNopLogger()})
+	if len(events.sinks) != 2 {
+		t.Fatalf("Unexpected sinks, got %v", events.sinks)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(payload.Events, batch[:1]) || header != "Bearer token" {
+		t.Errorf("Unexpected webhook request %s %s", header, body)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 3 || lines[0] != `{"time":"2023-11-14T22:13:20Z","type":"link_down","severity":"warning","guid":"0x506b4b03005c2740","name":"ib-i4l1s01","port":"35","message":"down"}` {
+		t.Errorf("Unexpected events file:\n%s", strings.Join(lines, "\n"))
+	}
+	if len(events.sinkErrors) != 0 {
+		t.Errorf("Unexpected sink errors, got %v", events.sinkErrors)
+	}
+}
+
+// blockingSink holds each send until release is closed
+type blockingSink struct {
+	release chan struct{}
+	sent    int
+}
+
+func (s *blockingSink) name() string {
+	return "blocking"
+}
+
+func (s *blockingSink) send(events []Event) error {
+	<-s.release
+	s.sent += len(events)
+	return nil
+}
+
+func TestEventsFlush(t *testing.T) {
+	setupEvents(t, []string{})
+	if err := FlushEvents(time.Second); err != nil {
+		t.Errorf("Unexpected error flushing empty queue: %v", err)
+	}
+	sink := &blockingSink{release: make(chan struct{})}
+	events.sinks = []eventSink{sink}
+	events.enqueue(eventBatch{events: []Event{{Type: "link_down"}, {Type: "link_up"}}, logger: log.NewNopLogger()})
+	if err := events.flush(10 * time.Millisecond); err == nil {
+		t.Errorf("Expected timeout flushing blocked sink")
+	}
+	close(sink.release)
+	if err := events.flush(time.Second); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if sink.sent != 2 {
+		t.Errorf("Expected 2 events sent, got %d", sink.sent)
+	}
+}
+
+func TestEventsTopologyDiscovery(t *testing.T) {
+	sent := setupEvents(t, []string{"--events.file=" + filepath.Join(t.TempDir(), "events.json")})
+	SetIbnetdiscoverExec(t, false, false)
+	collector := NewIBNetDiscover(false, log.NewNopLogger())
+	if _, _, err := collector.GetPorts(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events.devices) == 0 {
+		t.Errorf("Expected discovery to record the topology")
+	}
+	events.devices = map[string]InfinibandDevice{}
+	if _, _, err := collector.GetPorts(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sent) == 0 || (*sent)[0].Type != "device_added" {
+		t.Errorf("Expected device_added events from discovery, got %v", eventTypes(*sent))
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	reasonTimeout    = "timeout"
+	reasonExitStatus = "exit_status"
+	reasonMADTimeout = "mad_timeout"
+	reasonParse      = "parse"
+	reasonPermission = "permission"
+	reasonNotFound   = "not_found"
+	reasonOther      = "other"
+)
+
+var (
+	collectFailures = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "collect_failures_total"),
+		"Number of collection failures by reason",
+		[]string{"collector", "reason", "guid"}, nil)
+	failureCounts = newFailureCounter()
+	// stderr messages from infiniband-diags and sudo, matched case insensitive
+	madTimeoutMessages = []string{"_do_madrpc failed", "mad_rpc", "timeout", "timed out"}
+	permissionMessages = []string{"permission denied", "operation not permitted", "a password is required", "not in the sudoers", "can't open umad port", "sudo:"}
+	notFoundMessages   = []string{"command not found", "no such file or directory"}
+)
+
+// ParseError is returned when command output can not be parsed
+type ParseError struct {
+	Err error
+}
+
+type failureKey struct {
+	collector string
+	reason    string
+	guid      string
+}
+
+type failureCounter struct {
+	sync.Mutex
+	counts map[failureKey]float64
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func newFailureCounter() *failureCounter {
+	return &failureCounter{counts: make(map[failureKey]float64)}
+}
+
+func (f *failureCounter) add(collector string, reason string, guid string, count float64) {
+	if count <= 0 {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.counts[failureKey{collector: collector, reason: reason, guid: guid}] += count
+}
+
+// collect sends the failure counters of the given collectors
+func (f *failureCounter) collect(ch chan<- prometheus.Metric, collectors ...string) {
+	f.Lock()
+	defer f.Unlock()
+	for key, count := range f.counts {
+		for _, collector := range collectors {
+			if key.collector == collector {
+				ch <- prometheus.MustNewConstMetric(collectFailures, prometheus.CounterValue, count, key.collector, key.reason, key.guid)
+			}
+		}
+	}
+}
+
+// recordFailure counts a failed collection using the reason classified from err
+func recordFailure(collector string, guid string, err error) {
+	failureCounts.add(collector, classifyError(err), guid, 1)
+}
+
+// recordParseFailures counts values that could not be parsed
+func recordParseFailures(collector string, guid string, count float64) {
+	failureCounts.add(collector, reasonParse, guid, count)
+}
+
+func classifyError(err error) string {
+	var parseErr *ParseError
+	var commandErr *CommandError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return reasonTimeout
+	case errors.As(err, &parseErr):
+		return reasonParse
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return reasonNotFound
+	case errors.Is(err, os.ErrPermission):
+		return reasonPermission
+	case errors.As(err, &commandErr):
+		return classifyCommandError(commandErr)
+	}
+	return reasonOther
+}
+
+func classifyCommandError(err *CommandError) string {
+	switch err.ExitCode {
+	case 126:
+		return reasonPermission
+	case 127:
+		return reasonNotFound
+	}
+	stderr := strings.ToLower(err.Stderr)
+	for _, reason := range []struct {
+		reason   string
+		messages []string
+	}{
+		{reasonNotFound, notFoundMessages},
+		{reasonPermission, permissionMessages},
+		{reasonMADTimeout, madTimeoutMessages},
+	} {
+		for _, message := range reason.messages {
+			if strings.Contains(stderr, message) {
+				return reason.reason
+			}
+		}
+	}
+	return reasonExitStatus
+}
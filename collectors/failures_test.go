@@ -0,0 +1,81 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+)
+
+func TestClassifyError(t *testing.T) {
+	exitErr := fmt.Errorf("exit status 1")
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{context.DeadlineExceeded, reasonTimeout},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), reasonTimeout},
+		{&ParseError{Err: fmt.Errorf("bad")}, reasonParse},
+		{&exec.Error{Name: "perfquery", Err: exec.ErrNotFound}, reasonNotFound},
+		{&CommandError{Err: exitErr, ExitCode: 127}, reasonNotFound},
+		{&CommandError{Err: exitErr, ExitCode: 126}, reasonPermission},
+		{&CommandError{Err: exitErr, ExitCode: 1, Stderr: "sudo: perfquery: command not found"}, reasonNotFound},
+		{&CommandError{Err: exitErr, ExitCode: 1, Stderr: "sudo: a password is required"}, reasonPermission},
+		{&CommandError{Err: exitErr, ExitCode: 1, Stderr: "ibwarn: [3] mad_rpc_open_port: can't open UMAD port ((null):0)"}, reasonPermission},
+		{&CommandError{Err: exitErr, ExitCode: 1, Stderr: "ibwarn: [1234] _do_madrpc: recv failed: Connection timed out"}, reasonMADTimeout},
+		{&CommandError{Err: exitErr, ExitCode: 1, Stderr: "perfquery: iberror: failed: foo"}, reasonExitStatus},
+		{fmt.Errorf("Error"), reasonOther},
+	}
+	for _, test := range tests {
+		if reason := classifyError(test.err); reason != test.reason {
+			t.Errorf("Unexpected reason for %v, got %s expected %s", test.err, reason, test.reason)
+		}
+	}
+}
+
+func TestClassifyErrorNotFound(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--perfquery.path=/dne/perfquery"}); err != nil {
+		t.Fatal(err)
+	}
+	defer kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := perfquery("0x00", "1", []string{}, ctx)
+	if reason := classifyError(err); reason != reasonNotFound {
+		t.Errorf("Unexpected reason for %v, got %s", err, reason)
+	}
+}
+
+func TestFailureCounter(t *testing.T) {
+	failureCounts = newFailureCounter()
+	defer func() { failureCounts = newFailureCounter() }()
+	recordFailure("switch", "0x00", context.DeadlineExceeded)
+	recordFailure("switch", "0x00", context.DeadlineExceeded)
+	recordParseFailures("switch-rcv-err", "0x00", 2)
+	recordParseFailures("switch", "0x01", 0)
+	if val := failureCounts.counts[failureKey{collector: "switch", reason: reasonTimeout, guid: "0x00"}]; val != 2 {
+		t.Errorf("Unexpected timeout count, got %f", val)
+	}
+	if val := failureCounts.counts[failureKey{collector: "switch-rcv-err", reason: reasonParse, guid: "0x00"}]; val != 2 {
+		t.Errorf("Unexpected parse count, got %f", val)
+	}
+	if len(failureCounts.counts) != 2 {
+		t.Errorf("Unexpected counts, got %v", failureCounts.counts)
+	}
+}
@@ -0,0 +1,34 @@
+--------------------------------------------------------
+Port=1 Lid=0x0085 GUID=0x7cfe9003003b4b97 Device=4123 Port Name=o0002/U1/P1
+--------------------------------------------------------
+symbol_error_counter=0x0000000000000000
+link_error_recovery_counter=0x0000000000000000
+link_downed_counter=0x0000000000000000
+port_rcv_errors=0x0000000000000000
+port_xmit_discards=0x0000000000000000
+vl15_dropped=0x0000000000000000
+port_xmit_wait=0x0000000000000001
+port_xmit_data=0x00000000ffffffff
+port_rcv_data=0x00000000ffffffff
+port_xmit_data_extended=0x00000000000002bc
+port_rcv_data_extended=0x0000000000000320
+port_unicast_xmit_pkts=0x0000000000000008
+port_multicast_rcv_pkts=0x0000000000000002
+port_dlid_mapping_errors=0x0000000000000000
+--------------------------------------------------------
+Port=1 Lid=0x0086 GUID=0x7cfe9003003b4bdf Device=4123 Port Name=o0001/U1/P1
+--------------------------------------------------------
+symbol_error_counter=0x0000000000000004
+link_error_recovery_counter=0x0000000000000000
+link_downed_counter=0x0000000000000000
+port_rcv_errors=0x0000000000000000
+port_xmit_discards=0x0000000000000000
+vl15_dropped=0x0000000000000000
+port_xmit_wait=0x0000000000000001
+port_xmit_data=0x00000000ffffffff
+port_rcv_data=0x00000000ffffffff
+port_xmit_data_extended=0x0000000000000384
+port_rcv_data_extended=0x00000000000003e8
+port_unicast_xmit_pkts=0x0000000000000008
+port_multicast_rcv_pkts=0x0000000000000002
+port_dlid_mapping_errors=0x0000000000000000
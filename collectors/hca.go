@@ -40,6 +40,7 @@ type HCACollector struct {
 	Duration                     *prometheus.Desc
 	Error                        *prometheus.Desc
 	Timeout                      *prometheus.Desc
+	Stale                        *prometheus.Desc
 	PortXmitData                 *prometheus.Desc
 	PortRcvData                  *prometheus.Desc
 	PortXmitPkts                 *prometheus.Desc
@@ -99,6 +100,8 @@ func NewHCACollector(devices *[]InfinibandDevice, runonce bool, logger log.Logge
 			"Indicates if collect error", []string{"guid", "collector"}, nil),
 		Timeout: prometheus.NewDesc(prometheus.BuildFQName(namespace, "hca", "collect_timeout"),
 			"Indicates if collect timeout", []string{"guid", "collector"}, nil),
+		Stale: prometheus.NewDesc(prometheus.BuildFQName(namespace, "hca", "collect_stale_seconds"),
+			"Age of cached values served after a failed collect, 0 when not cached", []string{"guid", "collector"}, nil),
 		PortXmitData: prometheus.NewDesc(prometheus.BuildFQName(namespace, "hca", "port_transmit_data_bytes_total"),
 			"Infiniband HCA port PortXmitData", labels, nil),
 		PortRcvData: prometheus.NewDesc(prometheus.BuildFQName(namespace, "hca", "port_receive_data_bytes_total"),
@@ -170,6 +173,7 @@ func (h *HCACollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- h.Duration
 	ch <- h.Error
 	ch <- h.Timeout
+	ch <- h.Stale
 	ch <- h.PortXmitData
 	ch <- h.PortRcvData
 	ch <- h.PortXmitPkts
@@ -207,6 +211,62 @@ func (h *HCACollector) Describe(ch chan<- *prometheus.Desc) {
 func (h *HCACollector) Collect(ch chan<- prometheus.Metric) {
 	collectTime := time.Now()
 	counters, metrics, errors, timeouts := h.collect()
+	now := time.Now()
+	portHistory.record(counters, now)
+	events.recordCounters(counters, now, h.logger)
+	failed := make(map[string]bool)
+	rcvErrFailed := make(map[string]bool)
+	for guid, metric := range metrics {
+		failed[guid] = metric.timeout+metric.error > 0
+		rcvErrFailed[guid] = metric.rcvErrTimeout+metric.rcvErrError > 0
+	}
+	baseCounters, rcvErrCounters := splitCounters(counters)
+	cached := lastGood.updateCounters(h.collector, *h.devices, baseCounters, failed, now)
+	rcvErrCached := lastGood.updateCounters(fmt.Sprintf("%s-rcv-err", h.collector), *h.devices, rcvErrCounters, rcvErrFailed, now)
+	h.collectCounters(ch, counters)
+	for _, entries := range []map[string]lastGoodEntry{cached, rcvErrCached} {
+		for _, entry := range entries {
+			collectWithTimestamp(ch, entry.time, func(ch chan<- prometheus.Metric) { h.collectCounters(ch, entry.counters) })
+		}
+	}
+	if *hcaCollectBase {
+		for _, device := range *h.devices {
+			metric := metrics[device.GUID]
+			ch <- prometheus.MustNewConstMetric(h.Rate, prometheus.GaugeValue, device.Rate, device.GUID)
+			ch <- prometheus.MustNewConstMetric(h.RawRate, prometheus.GaugeValue, device.RawRate, device.GUID)
+			ch <- prometheus.MustNewConstMetric(h.Info, prometheus.GaugeValue, 1, device.GUID, device.Name, device.LID)
+			ch <- prometheus.MustNewConstMetric(h.Duration, prometheus.GaugeValue, metric.duration, device.GUID, h.collector)
+			ch <- prometheus.MustNewConstMetric(h.Timeout, prometheus.GaugeValue, metric.timeout, device.GUID, h.collector)
+			ch <- prometheus.MustNewConstMetric(h.Error, prometheus.GaugeValue, metric.error, device.GUID, h.collector)
+			for port, uplink := range device.Uplinks {
+				ch <- prometheus.MustNewConstMetric(h.Uplink, prometheus.GaugeValue, 1, device.GUID, port, device.Name, uplink.Name, uplink.GUID, uplink.Type, uplink.PortNumber, uplink.LID)
+			}
+		}
+	}
+	if *hcaCollectRcvErr {
+		for _, device := range *h.devices {
+			metric := metrics[device.GUID]
+			ch <- prometheus.MustNewConstMetric(h.Duration, prometheus.GaugeValue, metric.rcvErrDuration, device.GUID, fmt.Sprintf("%s-rcv-err", h.collector))
+			ch <- prometheus.MustNewConstMetric(h.Timeout, prometheus.GaugeValue, metric.rcvErrTimeout, device.GUID, fmt.Sprintf("%s-rcv-err", h.collector))
+			ch <- prometheus.MustNewConstMetric(h.Error, prometheus.GaugeValue, metric.rcvErrError, device.GUID, fmt.Sprintf("%s-rcv-err", h.collector))
+		}
+	}
+	collectStale(ch, h.Stale, h.collector, *h.devices, now, cached, rcvErrCached)
+	failureCounts.collect(ch, h.collector, fmt.Sprintf("%s-rcv-err", h.collector))
+	retryCounts.collect(ch, collectRetries, h.collector)
+	breakers.collect(ch, h.collector)
+	if *countersSource == "perfquery" {
+		limiters.collect(ch, h.collector)
+	}
+	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, errors, h.collector)
+	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, timeouts, h.collector)
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), h.collector)
+	if strings.HasSuffix(h.collector, "-runonce") {
+		ch <- prometheus.MustNewConstMetric(lastExecution, prometheus.GaugeValue, float64(time.Now().Unix()), h.collector)
+	}
+}
+
+func (h *HCACollector) collectCounters(ch chan<- prometheus.Metric, counters []PerfQueryCounters) {
 	for _, c := range counters {
 		if !math.IsNaN(c.PortXmitData) {
 			ch <- prometheus.MustNewConstMetric(h.PortXmitData, prometheus.CounterValue, c.PortXmitData, c.device.GUID, c.PortSelect)
@@ -293,72 +353,65 @@ func (h *HCACollector) Collect(ch chan<- prometheus.Metric) {
 			ch <- prometheus.MustNewConstMetric(h.PortLoopingErrors, prometheus.CounterValue, c.PortLoopingErrors, c.device.GUID, c.PortSelect)
 		}
 	}
-	if *hcaCollectBase {
-		for _, device := range *h.devices {
-			metric := metrics[device.GUID]
-			ch <- prometheus.MustNewConstMetric(h.Rate, prometheus.GaugeValue, device.Rate, device.GUID)
-			ch <- prometheus.MustNewConstMetric(h.RawRate, prometheus.GaugeValue, device.RawRate, device.GUID)
-			ch <- prometheus.MustNewConstMetric(h.Info, prometheus.GaugeValue, 1, device.GUID, device.Name, device.LID)
-			ch <- prometheus.MustNewConstMetric(h.Duration, prometheus.GaugeValue, metric.duration, device.GUID, h.collector)
-			ch <- prometheus.MustNewConstMetric(h.Timeout, prometheus.GaugeValue, metric.timeout, device.GUID, h.collector)
-			ch <- prometheus.MustNewConstMetric(h.Error, prometheus.GaugeValue, metric.error, device.GUID, h.collector)
-			for port, uplink := range device.Uplinks {
-				ch <- prometheus.MustNewConstMetric(h.Uplink, prometheus.GaugeValue, 1, device.GUID, port, device.Name, uplink.Name, uplink.GUID, uplink.Type, uplink.PortNumber, uplink.LID)
-			}
-		}
-	}
-	if *hcaCollectRcvErr {
-		for _, device := range *h.devices {
-			metric := metrics[device.GUID]
-			ch <- prometheus.MustNewConstMetric(h.Duration, prometheus.GaugeValue, metric.rcvErrDuration, device.GUID, fmt.Sprintf("%s-rcv-err", h.collector))
-			ch <- prometheus.MustNewConstMetric(h.Timeout, prometheus.GaugeValue, metric.rcvErrTimeout, device.GUID, fmt.Sprintf("%s-rcv-err", h.collector))
-			ch <- prometheus.MustNewConstMetric(h.Error, prometheus.GaugeValue, metric.rcvErrError, device.GUID, fmt.Sprintf("%s-rcv-err", h.collector))
-		}
-	}
-	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, errors, h.collector)
-	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, timeouts, h.collector)
-	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), h.collector)
-	if strings.HasSuffix(h.collector, "-runonce") {
-		ch <- prometheus.MustNewConstMetric(lastExecution, prometheus.GaugeValue, float64(time.Now().Unix()), h.collector)
-	}
 }
 
 func (h *HCACollector) collect() ([]PerfQueryCounters, map[string]HCAMetrics, float64, float64) {
+	if *countersSource != "perfquery" {
+		return h.collectSource()
+	}
 	var counters []PerfQueryCounters
 	metrics := make(map[string]HCAMetrics)
 	var countersLock sync.Mutex
 	var errors, timeouts float64
-	limit := make(chan int, *maxConcurrent)
+	rcvErrCollector := fmt.Sprintf("%s-rcv-err", h.collector)
+	pma := &lazyMADTransport{}
+	defer pma.Close() //nolint:errcheck
+	limiter := limiters.get(h.collector, *maxConcurrent, *perfqueryTimeout)
 	wg := &sync.WaitGroup{}
 	for _, device := range *h.devices {
-		limit <- 1
+		limiter.acquire()
 		wg.Add(1)
 		go func(device InfinibandDevice) {
+			var err error
+			var duration time.Duration
+			var metric HCAMetrics
 			defer func() {
-				<-limit
+				countersLock.Lock()
+				metrics[device.GUID] = metric
+				countersLock.Unlock()
+				limiter.release(err, duration)
 				wg.Done()
 			}()
-			ctxExtended, cancelExtended := context.WithTimeout(context.Background(), *perfqueryTimeout)
-			defer cancelExtended()
+			if breakers.skip(h.collector, device.GUID) {
+				level.Debug(h.logger).Log("msg", "Skipping device with open circuit breaker", "guid", device.GUID)
+				return
+			}
+			retry := newDeviceRetry(h.collector, device.GUID)
 			ports := getDevicePorts(device.Uplinks)
-			perfqueryPorts := strings.Join(ports, ",")
 			start := time.Now()
-			extendedOut, err := PerfqueryExec(device.GUID, perfqueryPorts, []string{"-l", "-x"}, ctxExtended)
-			metric := HCAMetrics{duration: time.Since(start).Seconds()}
+			extendedOut, extendedErrs := perfqueryDevice(retry, device.GUID, perfqueryPorts(ports), []string{"-l", "-x"})
+			if len(extendedErrs) > 0 {
+				err = extendedErrs[0]
+			}
+			breakers.result(h.collector, device.GUID, err)
+			duration = time.Since(start)
+			metric.duration = duration.Seconds()
 			if err == context.DeadlineExceeded {
 				metric.timeout = 1
 				level.Error(h.logger).Log("msg", "Timeout collecting extended perfquery counters", "guid", device.GUID)
 				timeouts++
 			} else if err != nil {
 				metric.error = 1
-				level.Error(h.logger).Log("msg", "Error collecting extended perfquery counters", "guid", device.GUID)
+				level.Error(h.logger).Log("msg", "Error collecting extended perfquery counters", "err", err, "guid", device.GUID)
 				errors++
 			}
 			if err != nil {
+				recordFailure(h.collector, device.GUID, err)
 				return
 			}
 			deviceCounters, errs := perfqueryParse(device, extendedOut, h.logger)
 			errors = errors + errs
+			recordParseFailures(h.collector, device.GUID, errs)
 			if *hcaCollectBase {
 				level.Debug(h.logger).Log("msg", "Adding parsed counters", "count", len(deviceCounters), "guid", device.GUID, "name", device.Name)
 				countersLock.Lock()
@@ -366,36 +419,53 @@ func (h *HCACollector) collect() ([]PerfQueryCounters, map[string]HCAMetrics, fl
 				countersLock.Unlock()
 			}
 			if *hcaCollectRcvErr {
+				rcvErrPorts := make([]string, 0, len(deviceCounters))
 				for _, deviceCounter := range deviceCounters {
-					ctxRcvErr, cancelRcvErr := context.WithTimeout(context.Background(), *perfqueryTimeout)
-					defer cancelRcvErr()
-					rcvErrStart := time.Now()
-					rcvErrOut, err := PerfqueryExec(device.GUID, deviceCounter.PortSelect, []string{"-E"}, ctxRcvErr)
-					metric.rcvErrDuration = time.Since(rcvErrStart).Seconds()
+					rcvErrPorts = append(rcvErrPorts, deviceCounter.PortSelect)
+				}
+				rcvErrStart := time.Now()
+				rcvErrCounters, errs, rcvErrErrs := collectRcvErr(pma, retry, device, rcvErrPorts, h.logger)
+				metric.rcvErrDuration = time.Since(rcvErrStart).Seconds()
+				for _, err := range rcvErrErrs {
+					recordFailure(rcvErrCollector, device.GUID, err)
 					if err == context.DeadlineExceeded {
 						metric.rcvErrTimeout = 1
 						level.Error(h.logger).Log("msg", "Timeout collecting rcvErr perfquery counters", "guid", device.GUID)
 						timeouts++
-						continue
-					} else if err != nil {
+					} else {
 						metric.rcvErrError = 1
-						level.Error(h.logger).Log("msg", "Error collecting rcvErr perfquery counters", "guid", device.GUID)
+						level.Error(h.logger).Log("msg", "Error collecting rcvErr perfquery counters", "err", err, "guid", device.GUID)
 						errors++
-						continue
 					}
-					rcvErrCounters, errs := perfqueryParse(device, rcvErrOut, h.logger)
-					errors = errors + errs
-					countersLock.Lock()
-					counters = append(counters, rcvErrCounters...)
-					countersLock.Unlock()
 				}
+				errors = errors + errs
+				recordParseFailures(rcvErrCollector, device.GUID, errs)
+				countersLock.Lock()
+				counters = append(counters, rcvErrCounters...)
+				countersLock.Unlock()
 			}
-			countersLock.Lock()
-			metrics[device.GUID] = metric
-			countersLock.Unlock()
 		}(device)
 	}
 	wg.Wait()
-	close(limit)
 	return counters, metrics, errors, timeouts
 }
+
+// collectSource reads counters from the configured counters source instead of executing perfquery
+func (h *HCACollector) collectSource() ([]PerfQueryCounters, map[string]HCAMetrics, float64, float64) {
+	metrics := make(map[string]HCAMetrics)
+	counters, missing, errors, duration, err := collectSourceCounters(*h.devices, *hcaCollectBase, *hcaCollectRcvErr, h.logger)
+	if err != nil {
+		level.Error(h.logger).Log("msg", "Error reading counters source", "source", *countersSource, "err", err)
+		errors++
+	}
+	for _, device := range *h.devices {
+		metric := HCAMetrics{duration: duration, rcvErrDuration: duration}
+		if err != nil || missing[device.GUID] {
+			metric.error = 1
+			metric.rcvErrError = 1
+		}
+		metrics[device.GUID] = metric
+	}
+	errors = errors + float64(len(missing))
+	return counters, metrics, errors, 0
+}
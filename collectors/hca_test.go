@@ -350,6 +350,7 @@ func TestHCACollectorFull(t *testing.T) {
 }
 
 func TestHCACollectorError(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -366,8 +367,8 @@ func TestHCACollectorError(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 17 {
-		t.Errorf("Unexpected collection count %d, expected 17", val)
+	} else if val != 19 {
+		t.Errorf("Unexpected collection count %d, expected 19", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_hca_port_excessive_buffer_overrun_errors_total", "infiniband_hca_port_link_downed_total",
@@ -378,6 +379,7 @@ func TestHCACollectorError(t *testing.T) {
 }
 
 func TestHCACollectorErrorRunonce(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -394,8 +396,8 @@ func TestHCACollectorErrorRunonce(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 18 {
-		t.Errorf("Unexpected collection count %d, expected 18", val)
+	} else if val != 20 {
+		t.Errorf("Unexpected collection count %d, expected 20", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_hca_port_excessive_buffer_overrun_errors_total", "infiniband_hca_port_link_downed_total",
@@ -406,6 +408,7 @@ func TestHCACollectorErrorRunonce(t *testing.T) {
 }
 
 func TestHCACollectorTimeout(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -422,8 +425,8 @@ func TestHCACollectorTimeout(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 17 {
-		t.Errorf("Unexpected collection count %d, expected 17", val)
+	} else if val != 19 {
+		t.Errorf("Unexpected collection count %d, expected 19", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_hca_port_excessive_buffer_overrun_errors_total", "infiniband_hca_port_link_downed_total",
@@ -14,7 +14,6 @@
 package collectors
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"math"
@@ -51,13 +50,15 @@ var (
 )
 
 type InfinibandDevice struct {
-	Type    string
-	LID     string
-	GUID    string
-	Rate    float64
-	RawRate float64
-	Name    string
-	Uplinks map[string]InfinibandUplink
+	Type       string
+	LID        string
+	GUID       string
+	Rate       float64
+	RawRate    float64
+	Name       string
+	Uplinks    map[string]InfinibandUplink
+	FreePorts  []string
+	SplitPorts []string
 }
 
 type InfinibandUplink struct {
@@ -70,6 +71,12 @@ type InfinibandUplink struct {
 	RawRate    float64
 }
 
+// Discoverer discovers the switches and HCAs of the fabric
+type Discoverer interface {
+	prometheus.Collector
+	GetPorts() (*[]InfinibandDevice, *[]InfinibandDevice, error)
+}
+
 type IBNetDiscover struct {
 	timeoutMetric float64
 	errorMetric   float64
@@ -100,6 +107,11 @@ func (ib *IBNetDiscover) GetPorts() (*[]InfinibandDevice, *[]InfinibandDevice, e
 		level.Error(ib.logger).Log("msg", "Error executing ibnetdiscover", "err", err)
 		ib.errorMetric = 1
 	}
+	if err != nil {
+		recordFailure(ib.collector, "", err)
+	} else {
+		recordTopology(switches, hcas, ib.logger)
+	}
 	return switches, hcas, err
 }
 
@@ -107,6 +119,7 @@ func (ib *IBNetDiscover) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (ib *IBNetDiscover) Collect(ch chan<- prometheus.Metric) {
+	failureCounts.collect(ch, ib.collector)
 	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, ib.errorMetric, ib.collector)
 	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, ib.timeoutMetric, ib.collector)
 	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, ib.duration, ib.collector)
@@ -123,12 +136,17 @@ func (ib *IBNetDiscover) collect() (*[]InfinibandDevice, *[]InfinibandDevice, er
 		return nil, nil, err
 	}
 	switches, hcas, err := ibnetdiscoverParse(out, ib.logger)
-	return switches, hcas, err
+	if err != nil {
+		return nil, nil, &ParseError{Err: err}
+	}
+	return switches, hcas, nil
 }
 
 func ibnetdiscoverParse(out string, logger log.Logger) (*[]InfinibandDevice, *[]InfinibandDevice, error) {
 	var switches, hcas []InfinibandDevice
 	devices := make(map[string]InfinibandDevice)
+	freePorts := make(map[string][]string)
+	splitPorts := make(map[string][]string)
 	lines := strings.Split(out, "\n")
 	for _, line := range lines {
 		items := strings.Fields(line)
@@ -137,7 +155,9 @@ func ibnetdiscoverParse(out string, logger log.Logger) (*[]InfinibandDevice, *[]
 			continue
 		}
 		if items[5] == "???" {
-			level.Debug(logger).Log("msg", "Skipping line that is not connected", "line", line)
+			level.Debug(logger).Log("msg", "Recording port that is not connected", "line", line)
+			freePorts[items[3]] = append(freePorts[items[3]], items[2])
+			addUnconnectedDevice(devices, items, line)
 			continue
 		}
 		// check the last item, because name may have space so that it is split into multiple items
@@ -156,7 +176,9 @@ func ibnetdiscoverParse(out string, logger log.Logger) (*[]InfinibandDevice, *[]
 			items[len(items)-1] = name
 		}
 		if items[5] == "SDR" && len(items) == 7 {
-			level.Debug(logger).Log("msg", "Skipping split mode port", "line", line)
+			level.Debug(logger).Log("msg", "Recording split mode port", "line", line)
+			splitPorts[items[3]] = append(splitPorts[items[3]], items[2])
+			addUnconnectedDevice(devices, items, line)
 			continue
 		}
 		guid := items[3]
@@ -196,10 +218,17 @@ func ibnetdiscoverParse(out string, logger log.Logger) (*[]InfinibandDevice, *[]
 			uplink.Rate = effectiveRate
 			uplink.RawRate = rawRate
 			device.Uplinks[portNumber] = uplink
+		} else {
+			freePorts[guid] = append(freePorts[guid], portNumber)
 		}
 		device.Name = portName
 		devices[guid] = device
 	}
+	for guid, device := range devices {
+		device.FreePorts = freePorts[guid]
+		device.SplitPorts = splitPorts[guid]
+		devices[guid] = device
+	}
 	deviceGUIDs := getDeviceGUIDs(devices)
 	sort.Strings(deviceGUIDs)
 	for _, guid := range deviceGUIDs {
@@ -214,6 +243,21 @@ func ibnetdiscoverParse(out string, logger log.Logger) (*[]InfinibandDevice, *[]
 	return &switches, &hcas, nil
 }
 
+// addUnconnectedDevice records a device from a free or split port so devices without an active port are still reported
+func addUnconnectedDevice(devices map[string]InfinibandDevice, items []string, line string) {
+	if _, ok := devices[items[3]]; ok {
+		return
+	}
+	name, _, _ := parseNames(line)
+	devices[items[3]] = InfinibandDevice{
+		Type:    items[0],
+		LID:     items[1],
+		GUID:    items[3],
+		Name:    name,
+		Uplinks: make(map[string]InfinibandUplink),
+	}
+}
+
 func parseRate(width string, rateStr string) (float64, float64, error) {
 	widthRe := regexp.MustCompile("[0-9]+")
 	widthMatch := widthRe.FindAllString(width, 1)
@@ -294,14 +338,5 @@ func ibnetdiscoverArgs() (string, []string) {
 
 func ibnetdiscover(ctx context.Context) (string, error) {
 	command, args := ibnetdiscoverArgs()
-	cmd := execCommand(ctx, command, args...)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if ctx.Err() == context.DeadlineExceeded {
-		return "", ctx.Err()
-	} else if err != nil {
-		return "", err
-	}
-	return out.String(), nil
+	return runCommand(ctx, fabricTarget, command, args)
 }
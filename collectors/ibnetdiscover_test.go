@@ -33,6 +33,11 @@ var (
 SW  1719 10 0x7cfe9003009ce5b0 4x ZDR - CA   134  1 0x7cfe9003003b4bde ( 'ib-i1l1s01' - 'o0001 HCA-1' )`
 	ibnetdiscoverBadName = `CA   134  1 0x7cfe9003003b4bde 4x EDR - SW  1719 10 0x7cfe9003009ce5b0 ( )
 SW  1719 10 0x7cfe9003009ce5b0 4x EDR - CA   134  1 0x7cfe9003003b4bde ( )`
+	ibnetdiscoverPorts = `SW  1719 10 0x7cfe9003009ce5b0 4x EDR - CA   134  1 0x7cfe9003003b4bde ( 'ib-i1l1s01' - 'o0001 HCA-1' )
+SW  1719 12 0x7cfe9003009ce5b0 4x ???                                    'ib-i1l1s01'
+SW  1719 13 0x7cfe9003009ce5b0 4x SDR                                    'ib-i1l1s01'
+SW  1719 14 0x7cfe9003009ce5b0 4x ???                                    'ib-i1l1s01'
+SW  1781 80 0x08c0eb0300add20e 4x SDR                                    'ib-i7l2s01'`
 )
 
 func TestIbnetdiscoverCollector(t *testing.T) {
@@ -60,6 +65,7 @@ func TestIbnetdiscoverCollector(t *testing.T) {
 }
 
 func TestIbnetdiscoverCollectorError(t *testing.T) {
+	failureCounts = newFailureCounter()
 	SetIbnetdiscoverExec(t, true, false)
 	expected := `
 		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
@@ -74,8 +80,8 @@ func TestIbnetdiscoverCollectorError(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 3 {
-		t.Errorf("Unexpected collection count %d, expected 3", val)
+	} else if val != 4 {
+		t.Errorf("Unexpected collection count %d, expected 4", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
@@ -84,6 +90,7 @@ func TestIbnetdiscoverCollectorError(t *testing.T) {
 }
 
 func TestIbnetdiscoverCollectorErrorRunonce(t *testing.T) {
+	failureCounts = newFailureCounter()
 	SetIbnetdiscoverExec(t, true, false)
 	expected := `
 		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
@@ -98,8 +105,8 @@ func TestIbnetdiscoverCollectorErrorRunonce(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 4 {
-		t.Errorf("Unexpected collection count %d, expected 4", val)
+	} else if val != 5 {
+		t.Errorf("Unexpected collection count %d, expected 5", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
@@ -108,8 +115,12 @@ func TestIbnetdiscoverCollectorErrorRunonce(t *testing.T) {
 }
 
 func TestIbnetdiscoverCollectorTimeout(t *testing.T) {
+	failureCounts = newFailureCounter()
 	SetIbnetdiscoverExec(t, false, true)
 	expected := `
+		# HELP infiniband_exporter_collect_failures_total Number of collection failures by reason
+		# TYPE infiniband_exporter_collect_failures_total counter
+		infiniband_exporter_collect_failures_total{collector="ibnetdiscover",guid="",reason="timeout"} 1
 		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
 		# TYPE infiniband_exporter_collect_errors gauge
 		infiniband_exporter_collect_errors{collector="ibnetdiscover"} 0
@@ -122,11 +133,12 @@ func TestIbnetdiscoverCollectorTimeout(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 3 {
-		t.Errorf("Unexpected collection count %d, expected 3", val)
+	} else if val != 4 {
+		t.Errorf("Unexpected collection count %d, expected 4", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
-		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts",
+		"infiniband_exporter_collect_failures_total"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
@@ -151,10 +163,15 @@ func TestIbnetdiscoverParse(t *testing.T) {
 	}
 
 	expectSwitches := []InfinibandDevice{
+		{Type: "SW", LID: "1781", GUID: "0x08c0eb0300add20e", Name: "ib-i7l2s01",
+			Uplinks:    map[string]InfinibandUplink{},
+			SplitPorts: []string{"80"},
+		},
 		{Type: "SW", LID: "2052", GUID: "0x506b4b03005c2740", Name: "ib-i4l1s01",
 			Uplinks: map[string]InfinibandUplink{
 				"35": {Type: "CA", LID: "1432", PortNumber: "1", GUID: "0x506b4b0300cc02a6", Name: "p0001 HCA-1", Rate: (25 * 4 * 125000000), RawRate: 1.2890625e+10},
 			},
+			FreePorts: []string{"37"},
 		},
 		{Type: "SW", LID: "1719", GUID: "0x7cfe9003009ce5b0", Name: "ib-i1l1s01",
 			Uplinks: map[string]InfinibandUplink{
@@ -179,8 +196,8 @@ func TestIbnetdiscoverParse(t *testing.T) {
 		t.Errorf("Unexpected number of HCAs:\nExpected 3\nGot: %d", len(*hcas))
 		return
 	}
-	if len(*switches) != 2 {
-		t.Errorf("Unexpected number of switches:\nExpected 2\nGot: %d", len(*switches))
+	if len(*switches) != 3 {
+		t.Errorf("Unexpected number of switches:\nExpected 3\nGot: %d", len(*switches))
 		return
 	}
 	for i, e := range expectedHCAs {
@@ -211,13 +228,22 @@ func TestIbnetdiscoverParse2(t *testing.T) {
 
 	expectSwitches := []InfinibandDevice{
 		{Type: "SW", LID: "478", GUID: "0x0002c9020040f160", Name: "Infiniscale-IV Mellanox Technologies",
-			Uplinks: map[string]InfinibandUplink{},
+			Uplinks:   map[string]InfinibandUplink{},
+			FreePorts: []string{"22"},
 		},
 		{Type: "SW", LID: "9", GUID: "0x946dae030053ec1a", Name: "5FB0406-spine-IB03",
 			Uplinks: map[string]InfinibandUplink{
 				"81": {Type: "CA", LID: "60", PortNumber: "1", GUID: "0x946dae0300630bfe", Name: "Mellanox Technologies Aggregation Node", Rate: 50 * 4 * 125000000, RawRate: 50 * 4 * 125000000},
 			},
 		},
+		{Type: "SW", LID: "24", GUID: "0x946dae0300618c82", Name: "5FB0406-spine-IB01",
+			Uplinks:    map[string]InfinibandUplink{},
+			SplitPorts: []string{"1"},
+		},
+		{Type: "SW", LID: "25", GUID: "0x946dae0300618c83", Name: "5FB0406-spine-IB02",
+			Uplinks:    map[string]InfinibandUplink{},
+			SplitPorts: []string{"1"},
+		},
 	}
 	out, err := ReadFixture("ibnetdiscover", "test2")
 	if err != nil {
@@ -284,6 +310,31 @@ func TestIbnetdiscoverParseErrors(t *testing.T) {
 	}
 }
 
+func TestIbnetdiscoverParsePorts(t *testing.T) {
+	switches, _, err := ibnetdiscoverParse(ibnetdiscoverPorts, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(*switches) != 2 {
+		t.Fatalf("Unexpected number of switches, got %d", len(*switches))
+	}
+	// Switch with only split ports
+	sw := (*switches)[0]
+	if sw.GUID != "0x08c0eb0300add20e" || sw.Name != "ib-i7l2s01" || len(sw.Uplinks) != 0 {
+		t.Errorf("Unexpected switch, got %v", sw)
+	}
+	if !reflect.DeepEqual(sw.SplitPorts, []string{"80"}) {
+		t.Errorf("Unexpected split ports, got %v", sw.SplitPorts)
+	}
+	sw = (*switches)[1]
+	if !reflect.DeepEqual(sw.FreePorts, []string{"12", "14"}) {
+		t.Errorf("Unexpected free ports, got %v", sw.FreePorts)
+	}
+	if !reflect.DeepEqual(sw.SplitPorts, []string{"13"}) {
+		t.Errorf("Unexpected split ports, got %v", sw.SplitPorts)
+	}
+}
+
 func TestParseRate(t *testing.T) {
 	tests := []struct {
 		Width                 string
@@ -14,9 +14,9 @@
 package collectors
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"math"
 	"regexp"
 	"strconv"
@@ -35,23 +35,37 @@ var (
 	ibswinfoPath          = kingpin.Flag("ibswinfo.path", "Path to ibswinfo").Default("ibswinfo").String()
 	ibswinfoTimeout       = kingpin.Flag("ibswinfo.timeout", "Timeout for ibswinfo execution").Default("10s").Duration()
 	ibswinfoMaxConcurrent = kingpin.Flag("ibswinfo.max-concurrent", "Max number of concurrent ibswinfo executions").Default("1").Int()
+	ibswinfoSource        = kingpin.Flag("ibswinfo.source", "Source of switch information, exec runs ibswinfo and native reads switch registers using vendor specific MADs").Default("exec").Enum("exec", "native")
 	IbswinfoExec          = ibswinfo
 )
 
+// IbswinfoReader reads the hardware and health information of a single unmanaged switch
+type IbswinfoReader interface {
+	Read(device InfinibandDevice, ctx context.Context) (Ibswinfo, error)
+}
+
+type execIbswinfoReader struct {
+	logger log.Logger
+}
+
 type IbswinfoCollector struct {
 	devices              *[]InfinibandDevice
 	logger               log.Logger
 	collector            string
+	reader               IbswinfoReader
 	Duration             *prometheus.Desc
 	Error                *prometheus.Desc
 	Timeout              *prometheus.Desc
+	Stale                *prometheus.Desc
 	HardwareInfo         *prometheus.Desc
 	Uptime               *prometheus.Desc
+	PowerSupplyInfo      *prometheus.Desc
 	PowerSupplyStatus    *prometheus.Desc
 	PowerSupplyDCPower   *prometheus.Desc
 	PowerSupplyFanStatus *prometheus.Desc
 	PowerSupplyWatts     *prometheus.Desc
 	Temp                 *prometheus.Desc
+	MaxTemp              *prometheus.Desc
 	FanStatus            *prometheus.Desc
 	FanRPM               *prometheus.Desc
 }
@@ -60,11 +74,16 @@ type Ibswinfo struct {
 	device          InfinibandDevice
 	PartNumber      string
 	SerialNumber    string
+	ProductName     string
+	Revision        string
+	Ports           string
+	GUID            string
 	PSID            string
 	FirmwareVersion string
 	Uptime          float64
 	PowerSupplies   []SwitchPowerSupply
 	Temp            float64
+	MaxTemp         float64
 	FanStatus       string
 	Fans            []SwitchFan
 	duration        float64
@@ -73,11 +92,13 @@ type Ibswinfo struct {
 }
 
 type SwitchPowerSupply struct {
-	ID        string
-	Status    string
-	DCPower   string
-	FanStatus string
-	PowerW    float64
+	ID           string
+	PartNumber   string
+	SerialNumber string
+	Status       string
+	DCPower      string
+	FanStatus    string
+	PowerW       float64
 }
 
 type SwitchFan struct {
@@ -90,20 +111,33 @@ func NewIbswinfoCollector(devices *[]InfinibandDevice, runonce bool, logger log.
 	if runonce {
 		collector = "ibswinfo-runonce"
 	}
+	logger = log.With(logger, "collector", collector)
+	var reader IbswinfoReader
+	if *ibswinfoSource == "native" {
+		reader = &nativeIbswinfoReader{logger: logger}
+	} else {
+		reader = &execIbswinfoReader{logger: logger}
+	}
 	return &IbswinfoCollector{
 		devices:   devices,
-		logger:    log.With(logger, "collector", collector),
+		logger:    logger,
 		collector: collector,
+		reader:    reader,
 		Duration: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_duration_seconds"),
 			"Duration of collection", []string{"guid", "collector"}, nil),
 		Error: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_error"),
 			"Indicates if collect error", []string{"guid", "collector"}, nil),
 		Timeout: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_timeout"),
 			"Indicates if collect timeout", []string{"guid", "collector"}, nil),
+		Stale: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_stale_seconds"),
+			"Age of cached values served after a failed collect, 0 when not cached", []string{"guid", "collector"}, nil),
 		HardwareInfo: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "hardware_info"),
-			"Infiniband switch hardware info", []string{"guid", "firmware_version", "psid", "part_number", "serial_number", "switch"}, nil),
+			"Infiniband switch hardware info", []string{"guid", "firmware_version", "psid", "part_number", "serial_number",
+				"product_name", "revision", "ports", "system_guid", "switch"}, nil),
 		Uptime: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "uptime_seconds"),
 			"Infiniband switch uptime in seconds", []string{"guid"}, nil),
+		PowerSupplyInfo: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "power_supply_hardware_info"),
+			"Infiniband switch power supply hardware info", []string{"guid", "psu", "part_number", "serial_number"}, nil),
 		PowerSupplyStatus: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "power_supply_status_info"),
 			"Infiniband switch power supply status", []string{"guid", "psu", "status"}, nil),
 		PowerSupplyDCPower: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "power_supply_dc_power_status_info"),
@@ -114,6 +148,8 @@ func NewIbswinfoCollector(devices *[]InfinibandDevice, runonce bool, logger log.
 			"Infiniband switch power supply watts", []string{"guid", "psu"}, nil),
 		Temp: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "temperature_celsius"),
 			"Infiniband switch temperature celsius", []string{"guid"}, nil),
+		MaxTemp: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "max_temperature_celsius"),
+			"Infiniband switch max temperature celsius", []string{"guid"}, nil),
 		FanStatus: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "fan_status_info"),
 			"Infiniband switch fan status", []string{"guid", "status"}, nil),
 		FanRPM: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "fan_rpm"),
@@ -127,13 +163,16 @@ func (s *IbswinfoCollector) Describe(ch chan<- *prometheus.Desc) {
 	// ch <- s.Duration
 	// ch <- s.Error
 	// ch <- s.Timeout
+	// ch <- s.Stale
 	ch <- s.HardwareInfo
 	ch <- s.Uptime
+	ch <- s.PowerSupplyInfo
 	ch <- s.PowerSupplyStatus
 	ch <- s.PowerSupplyDCPower
 	ch <- s.PowerSupplyFanStatus
 	ch <- s.PowerSupplyWatts
 	ch <- s.Temp
+	ch <- s.MaxTemp
 	ch <- s.FanStatus
 	ch <- s.FanRPM
 }
@@ -141,39 +180,23 @@ func (s *IbswinfoCollector) Describe(ch chan<- *prometheus.Desc) {
 func (s *IbswinfoCollector) Collect(ch chan<- prometheus.Metric) {
 	collectTime := time.Now()
 	swinfos, errors, timeouts := s.collect()
+	now := time.Now()
+	events.recordIbswinfo(swinfos, now, s.logger)
+	cached := lastGood.updateIbswinfo(s.collector, *s.devices, swinfos, now)
 	for _, swinfo := range swinfos {
-		ch <- prometheus.MustNewConstMetric(s.HardwareInfo, prometheus.GaugeValue, 1, swinfo.device.GUID,
-			swinfo.FirmwareVersion, swinfo.PSID, swinfo.PartNumber, swinfo.SerialNumber, swinfo.device.Name)
-		ch <- prometheus.MustNewConstMetric(s.Uptime, prometheus.GaugeValue, swinfo.Uptime, swinfo.device.GUID)
 		ch <- prometheus.MustNewConstMetric(s.Duration, prometheus.GaugeValue, swinfo.duration, swinfo.device.GUID, s.collector)
 		ch <- prometheus.MustNewConstMetric(s.Error, prometheus.GaugeValue, swinfo.error, swinfo.device.GUID, s.collector)
 		ch <- prometheus.MustNewConstMetric(s.Timeout, prometheus.GaugeValue, swinfo.timeout, swinfo.device.GUID, s.collector)
-		for _, psu := range swinfo.PowerSupplies {
-			if psu.Status != "" {
-				ch <- prometheus.MustNewConstMetric(s.PowerSupplyStatus, prometheus.GaugeValue, 1, swinfo.device.GUID, psu.ID, psu.Status)
-			}
-			if psu.DCPower != "" {
-				ch <- prometheus.MustNewConstMetric(s.PowerSupplyDCPower, prometheus.GaugeValue, 1, swinfo.device.GUID, psu.ID, psu.DCPower)
-			}
-			if psu.FanStatus != "" {
-				ch <- prometheus.MustNewConstMetric(s.PowerSupplyFanStatus, prometheus.GaugeValue, 1, swinfo.device.GUID, psu.ID, psu.FanStatus)
-			}
-			if !math.IsNaN(psu.PowerW) {
-				ch <- prometheus.MustNewConstMetric(s.PowerSupplyWatts, prometheus.GaugeValue, psu.PowerW, swinfo.device.GUID, psu.ID)
-			}
-		}
-		if !math.IsNaN(swinfo.Temp) {
-			ch <- prometheus.MustNewConstMetric(s.Temp, prometheus.GaugeValue, swinfo.Temp, swinfo.device.GUID)
-		}
-		if swinfo.FanStatus != "" {
-			ch <- prometheus.MustNewConstMetric(s.FanStatus, prometheus.GaugeValue, 1, swinfo.device.GUID, swinfo.FanStatus)
-		}
-		for _, fan := range swinfo.Fans {
-			if !math.IsNaN(fan.RPM) {
-				ch <- prometheus.MustNewConstMetric(s.FanRPM, prometheus.GaugeValue, fan.RPM, swinfo.device.GUID, fan.ID)
-			}
-		}
+		s.collectIbswinfo(ch, swinfo)
 	}
+	for _, entry := range cached {
+		collectWithTimestamp(ch, entry.time, func(ch chan<- prometheus.Metric) { s.collectIbswinfo(ch, entry.ibswinfo) })
+	}
+	collectStale(ch, s.Stale, s.collector, *s.devices, now, cached)
+	failureCounts.collect(ch, s.collector)
+	retryCounts.collect(ch, collectRetries, s.collector)
+	breakers.collect(ch, s.collector)
+	limiters.collect(ch, s.collector)
 	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, errors, s.collector)
 	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, timeouts, s.collector)
 	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), s.collector)
@@ -182,55 +205,117 @@ func (s *IbswinfoCollector) Collect(ch chan<- prometheus.Metric) {
 	}
 }
 
+func (s *IbswinfoCollector) collectIbswinfo(ch chan<- prometheus.Metric, swinfo Ibswinfo) {
+	ch <- prometheus.MustNewConstMetric(s.HardwareInfo, prometheus.GaugeValue, 1, swinfo.device.GUID,
+		swinfo.FirmwareVersion, swinfo.PSID, swinfo.PartNumber, swinfo.SerialNumber,
+		swinfo.ProductName, swinfo.Revision, swinfo.Ports, swinfo.GUID, swinfo.device.Name)
+	ch <- prometheus.MustNewConstMetric(s.Uptime, prometheus.GaugeValue, swinfo.Uptime, swinfo.device.GUID)
+	for _, psu := range swinfo.PowerSupplies {
+		if psu.PartNumber != "" || psu.SerialNumber != "" {
+			ch <- prometheus.MustNewConstMetric(s.PowerSupplyInfo, prometheus.GaugeValue, 1, swinfo.device.GUID, psu.ID, psu.PartNumber, psu.SerialNumber)
+		}
+		if psu.Status != "" {
+			ch <- prometheus.MustNewConstMetric(s.PowerSupplyStatus, prometheus.GaugeValue, 1, swinfo.device.GUID, psu.ID, psu.Status)
+		}
+		if psu.DCPower != "" {
+			ch <- prometheus.MustNewConstMetric(s.PowerSupplyDCPower, prometheus.GaugeValue, 1, swinfo.device.GUID, psu.ID, psu.DCPower)
+		}
+		if psu.FanStatus != "" {
+			ch <- prometheus.MustNewConstMetric(s.PowerSupplyFanStatus, prometheus.GaugeValue, 1, swinfo.device.GUID, psu.ID, psu.FanStatus)
+		}
+		if !math.IsNaN(psu.PowerW) {
+			ch <- prometheus.MustNewConstMetric(s.PowerSupplyWatts, prometheus.GaugeValue, psu.PowerW, swinfo.device.GUID, psu.ID)
+		}
+	}
+	if !math.IsNaN(swinfo.Temp) {
+		ch <- prometheus.MustNewConstMetric(s.Temp, prometheus.GaugeValue, swinfo.Temp, swinfo.device.GUID)
+	}
+	if !math.IsNaN(swinfo.MaxTemp) {
+		ch <- prometheus.MustNewConstMetric(s.MaxTemp, prometheus.GaugeValue, swinfo.MaxTemp, swinfo.device.GUID)
+	}
+	if swinfo.FanStatus != "" {
+		ch <- prometheus.MustNewConstMetric(s.FanStatus, prometheus.GaugeValue, 1, swinfo.device.GUID, swinfo.FanStatus)
+	}
+	for _, fan := range swinfo.Fans {
+		if !math.IsNaN(fan.RPM) {
+			ch <- prometheus.MustNewConstMetric(s.FanRPM, prometheus.GaugeValue, fan.RPM, swinfo.device.GUID, fan.ID)
+		}
+	}
+}
+
 func (s *IbswinfoCollector) collect() ([]Ibswinfo, float64, float64) {
 	var ibswinfos []Ibswinfo
 	var ibswinfosLock sync.Mutex
 	var errors, timeouts float64
-	limit := make(chan int, *ibswinfoMaxConcurrent)
+	limiter := limiters.get(s.collector, *ibswinfoMaxConcurrent, *ibswinfoTimeout)
 	wg := &sync.WaitGroup{}
 	level.Debug(s.logger).Log("msg", "Collecting ibswinfo on devices", "count", len(*s.devices))
 	for _, device := range *s.devices {
-		limit <- 1
+		limiter.acquire()
 		wg.Add(1)
 		go func(device InfinibandDevice) {
+			var ibswinfoErr error
+			var duration time.Duration
 			defer func() {
-				<-limit
+				limiter.release(ibswinfoErr, duration)
 				wg.Done()
 			}()
-			ctxibswinfo, cancelibswinfo := context.WithTimeout(context.Background(), *ibswinfoTimeout)
-			defer cancelibswinfo()
+			if breakers.skip(s.collector, device.GUID) {
+				level.Debug(s.logger).Log("msg", "Skipping device with open circuit breaker", "guid", device.GUID, "lid", device.LID)
+				return
+			}
 			level.Debug(s.logger).Log("msg", "Run ibswinfo", "lid", device.LID)
 			start := time.Now()
-			ibswinfoOut, ibswinfoErr := IbswinfoExec(device.LID, ctxibswinfo)
-			ibswinfoData := Ibswinfo{duration: time.Since(start).Seconds()}
+			var ibswinfoData Ibswinfo
+			ibswinfoErr = newDeviceRetry(s.collector, device.GUID).run(*ibswinfoTimeout, func(ctx context.Context) error {
+				var err error
+				ibswinfoData, err = s.reader.Read(device, ctx)
+				return err
+			})
+			duration = time.Since(start)
+			ibswinfoData.duration = duration.Seconds()
+			breakers.result(s.collector, device.GUID, ibswinfoErr)
+			if ibswinfoErr != nil {
+				recordFailure(s.collector, device.GUID, ibswinfoErr)
+			}
 			if ibswinfoErr == context.DeadlineExceeded {
-				ibswinfoData.timeout = 1
 				level.Error(s.logger).Log("msg", "Timeout collecting ibswinfo data", "guid", device.GUID, "lid", device.LID)
 				timeouts++
 			} else if ibswinfoErr != nil {
-				ibswinfoData.error = 1
-				level.Error(s.logger).Log("msg", "Error collecting ibswinfo data", "err", fmt.Sprintf("%s:%s", ibswinfoErr, ibswinfoOut), "guid", device.GUID, "lid", device.LID)
+				level.Error(s.logger).Log("msg", "Error collecting ibswinfo data", "err", ibswinfoErr, "guid", device.GUID, "lid", device.LID)
 				errors++
 			}
 			if ibswinfoErr == nil {
-				err := parse_ibswinfo(ibswinfoOut, &ibswinfoData, s.logger)
-				if err != nil {
-					level.Error(s.logger).Log("msg", "Error parsing ibswinfo output", "guid", device.GUID, "lid", device.LID)
-					errors++
-				} else {
-					ibswinfoData.device = device
-					ibswinfosLock.Lock()
-					ibswinfos = append(ibswinfos, ibswinfoData)
-					ibswinfosLock.Unlock()
-				}
+				ibswinfoData.device = device
+				ibswinfosLock.Lock()
+				ibswinfos = append(ibswinfos, ibswinfoData)
+				ibswinfosLock.Unlock()
 			}
 		}(device)
 	}
 	wg.Wait()
-	close(limit)
+	if closer, ok := s.reader.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			level.Error(s.logger).Log("msg", "Error closing ibswinfo reader", "err", err)
+		}
+	}
 	return ibswinfos, errors, timeouts
 }
 
+func (r *execIbswinfoReader) Read(device InfinibandDevice, ctx context.Context) (Ibswinfo, error) {
+	var data Ibswinfo
+	out, err := IbswinfoExec(device.LID, ctx)
+	if err != nil {
+		return data, err
+	}
+	err = parse_ibswinfo(out, &data, r.logger)
+	if err != nil {
+		level.Error(r.logger).Log("msg", "Error parsing ibswinfo output", "guid", device.GUID, "lid", device.LID)
+		return data, &ParseError{Err: err}
+	}
+	return data, nil
+}
+
 func ibswinfoArgs(lid string) (string, []string) {
 	var command string
 	var args []string
@@ -246,33 +331,28 @@ func ibswinfoArgs(lid string) (string, []string) {
 
 func ibswinfo(lid string, ctx context.Context) (string, error) {
 	command, args := ibswinfoArgs(lid)
-	cmd := execCommand(ctx, command, args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if ctx.Err() == context.DeadlineExceeded {
-		return "", ctx.Err()
-	} else if err != nil {
-		return stderr.String(), err
-	}
-	return stdout.String(), nil
+	return runCommand(ctx, lid, command, args)
 }
 
 func parse_ibswinfo(out string, data *Ibswinfo, logger log.Logger) error {
 	data.Temp = math.NaN()
+	data.MaxTemp = math.NaN()
 	lines := strings.Split(out, "\n")
 	psus := make(map[string]SwitchPowerSupply)
 	var err error
 	var powerSupplies []SwitchPowerSupply
 	var fans []SwitchFan
 	var psuID string
-	var dividerCount int
-	rePSU := regexp.MustCompile(`PSU([0-9]) status`)
+	// Track if within the PSU section rather than counting dividers as the
+	// number of sections differs between SwitchIB, Quantum and Quantum-2 output
+	var inPSUSection bool
+	rePSU := regexp.MustCompile(`^PSU([0-9]+) status`)
 	reFan := regexp.MustCompile(`fan#([0-9]+)`)
 	for _, line := range lines {
-		if strings.HasPrefix(line, "-----") {
-			dividerCount++
+		if strings.HasPrefix(line, "-----") || strings.HasPrefix(line, "=====") {
+			inPSUSection = false
+			psuID = ""
+			continue
 		}
 		l := strings.Split(line, "|")
 		if len(l) != 2 {
@@ -285,6 +365,14 @@ func parse_ibswinfo(out string, data *Ibswinfo, logger log.Logger) error {
 			data.PartNumber = value
 		case "serial number":
 			data.SerialNumber = value
+		case "product name":
+			data.ProductName = value
+		case "revision":
+			data.Revision = value
+		case "ports":
+			data.Ports = value
+		case "GUID":
+			data.GUID = value
 		case "PSID":
 			data.PSID = value
 		case "firmware version":
@@ -314,46 +402,56 @@ func parse_ibswinfo(out string, data *Ibswinfo, logger log.Logger) error {
 			t2, _ := time.Parse("15:04:05", "00:00:00")
 			data.Uptime = (days * 86400) + t1.Sub(t2).Seconds()
 		}
-		var psu SwitchPowerSupply
-		psu.PowerW = math.NaN()
 		matchesPSU := rePSU.FindStringSubmatch(key)
 		if len(matchesPSU) == 2 {
+			inPSUSection = true
 			psuID = matchesPSU[1]
-			psu.Status = value
-		}
-		if psu.Status == "" && psuID != "" && dividerCount < 4 {
+			psu := SwitchPowerSupply{PowerW: math.NaN()}
 			if p, ok := psus[psuID]; ok {
 				psu = p
 			}
+			psu.Status = value
+			psus[psuID] = psu
+			continue
 		}
-		if key == "DC power" {
-			psu.DCPower = value
-		}
-		if key == "fan status" && dividerCount < 4 {
-			psu.FanStatus = value
-		}
-		if key == "power (W)" {
-			powerW, err := strconv.ParseFloat(value, 64)
-			if err == nil {
+		if inPSUSection && psuID != "" {
+			psu := psus[psuID]
+			switch key {
+			case "P/N":
+				psu.PartNumber = value
+			case "S/N":
+				psu.SerialNumber = value
+			case "DC power":
+				psu.DCPower = value
+			case "fan status":
+				psu.FanStatus = value
+			case "power (W)":
+				powerW, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					level.Error(logger).Log("msg", "Unable to parse power (W)", "err", err, "value", value)
+					return err
+				}
 				psu.PowerW = powerW
-			} else {
-				level.Error(logger).Log("msg", "Unable to parse power (W)", "err", err, "value", value)
-				return err
 			}
-		}
-		if psuID != "" && dividerCount < 4 {
 			psus[psuID] = psu
+			continue
 		}
-		if key == "temperature (C)" {
+		switch key {
+		case "temperature (C)":
 			temp, err := strconv.ParseFloat(value, 64)
-			if err == nil {
-				data.Temp = temp
-			} else {
+			if err != nil {
 				level.Error(logger).Log("msg", "Unable to parse temperature (C)", "err", err, "value", value)
 				return err
 			}
-		}
-		if key == "fan status" && dividerCount >= 4 {
+			data.Temp = temp
+		case "max temp (C)":
+			maxTemp, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				level.Error(logger).Log("msg", "Unable to parse max temp (C)", "err", err, "value", value)
+				return err
+			}
+			data.MaxTemp = maxTemp
+		case "fan status":
 			data.FanStatus = value
 		}
 		matchesFan := reFan.FindStringSubmatch(key)
@@ -368,10 +466,7 @@ func parse_ibswinfo(out string, data *Ibswinfo, logger log.Logger) error {
 			}
 			rpm, err := strconv.ParseFloat(value, 64)
 			if err == nil {
-				fan := SwitchFan{
-					ID:  matchesFan[1],
-					RPM: rpm,
-				}
+				fan.RPM = rpm
 				fans = append(fans, fan)
 			} else {
 				level.Error(logger).Log("msg", "Unable to parse fan RPM", "err", err, "value", value)
@@ -0,0 +1,204 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Register IDs and sizes from the Mellanox switch PRM
+const (
+	regMFCR     = 0x9001
+	regMFCRSize = 0x08
+	regMTMP     = 0x900A
+	regMTMPSize = 0x20
+	regMSPS     = 0x900D
+	regMSPSSize = 0x50
+	regMGIR     = 0x9020
+	regMGIRSize = 0xA0
+	regMSGI     = 0x9021
+	regMSGISize = 0x80
+	regMFSM     = 0x9067
+	regMFSMSize = 0x08
+	// Each MSPS power supply entry
+	mspsPSUSize = 0x28
+	mspsPSUs    = 2
+)
+
+// nativeIbswinfoReader shares one MAD transport between the switches read during a collection
+type nativeIbswinfoReader struct {
+	logger    log.Logger
+	transport lazyMADTransport
+}
+
+// Close closes the transport once every switch has been read
+func (r *nativeIbswinfoReader) Close() error {
+	return r.transport.Close()
+}
+
+// Read gets the switch information from NodeInfo and the switch registers.
+// The registers do not include the power supply inventory so power supply part and serial numbers are not read.
+func (r *nativeIbswinfoReader) Read(device InfinibandDevice, ctx context.Context) (Ibswinfo, error) {
+	data := Ibswinfo{Temp: math.NaN(), MaxTemp: math.NaN()}
+	lid, err := strconv.ParseUint(device.LID, 10, 16)
+	if err != nil {
+		return data, fmt.Errorf("Invalid LID %s: %w", device.LID, err)
+	}
+	transport := &r.transport
+	read := func(register uint16, size int, payload []byte) ([]byte, error) {
+		level.Debug(r.logger).Log("msg", "Read register", "register", fmt.Sprintf("0x%04x", register), "lid", device.LID)
+		out, err := readRegister(transport, uint16(lid), register, size, payload, ctx)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ctx.Err()
+		}
+		return out, err
+	}
+	nodeInfo, err := readAttribute(transport, uint16(lid), madClassSubnLID, madAttrNodeInfo, nodeInfoSize, nil, ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		return data, ctx.Err()
+	} else if err != nil {
+		return data, err
+	}
+	parseNodeInfo(nodeInfo, &data)
+	mgir, err := read(regMGIR, regMGIRSize, nil)
+	if err != nil {
+		return data, err
+	}
+	parseMGIR(mgir, &data)
+	msgi, err := read(regMSGI, regMSGISize, nil)
+	if err != nil {
+		return data, err
+	}
+	parseMSGI(msgi, &data)
+	mtmp, err := read(regMTMP, regMTMPSize, nil)
+	if err != nil {
+		return data, err
+	}
+	parseMTMP(mtmp, &data)
+	msps, err := read(regMSPS, regMSPSSize, nil)
+	if err != nil {
+		return data, err
+	}
+	data.PowerSupplies = parseMSPS(msps)
+	mfcr, err := read(regMFCR, regMFCRSize, nil)
+	if err != nil {
+		return data, err
+	}
+	data.FanStatus = "OK"
+	tachoActive := binary.BigEndian.Uint16(mfcr[6:8])
+	for tacho := 0; tacho < 16; tacho++ {
+		if tachoActive&(1<<tacho) == 0 {
+			continue
+		}
+		payload := make([]byte, regMFSMSize)
+		payload[0] = byte(tacho)
+		mfsm, err := read(regMFSM, regMFSMSize, payload)
+		if err != nil {
+			return data, err
+		}
+		fan := parseMFSM(mfsm)
+		if fan.RPM == 0 {
+			data.FanStatus = "ERROR"
+		}
+		data.Fans = append(data.Fans, fan)
+	}
+	return data, nil
+}
+
+// parseNodeInfo reads the number of ports and the system image GUID from the NodeInfo attribute
+func parseNodeInfo(attr []byte, data *Ibswinfo) {
+	data.Ports = strconv.Itoa(int(attr[3]))
+	data.GUID = fmt.Sprintf("0x%016x", binary.BigEndian.Uint64(attr[4:12]))
+}
+
+// parseMGIR reads firmware version, PSID and uptime from the MGIR register
+func parseMGIR(reg []byte, data *Ibswinfo) {
+	data.Uptime = float64(binary.BigEndian.Uint32(reg[0x1C:0x20]))
+	major := binary.BigEndian.Uint32(reg[0x44:0x48])
+	minor := binary.BigEndian.Uint32(reg[0x48:0x4C])
+	subMinor := binary.BigEndian.Uint32(reg[0x4C:0x50])
+	// Older firmware only populates the 8-bit version fields
+	if major == 0 && minor == 0 && subMinor == 0 {
+		major = uint32(reg[0x21])
+		minor = uint32(reg[0x22])
+		subMinor = uint32(reg[0x23])
+	}
+	data.FirmwareVersion = fmt.Sprintf("%d.%04d.%04d", major, minor, subMinor)
+	data.PSID = registerString(reg[0x30:0x40])
+}
+
+// parseMSGI reads the inventory strings from the MSGI register
+func parseMSGI(reg []byte, data *Ibswinfo) {
+	data.SerialNumber = registerString(reg[0x00:0x18])
+	data.PartNumber = registerString(reg[0x20:0x34])
+	data.Revision = registerString(reg[0x38:0x3C])
+	data.ProductName = registerString(reg[0x40:0x80])
+}
+
+// parseMTMP reads the ASIC temperature, the register reports in 0.125 Celsius units
+func parseMTMP(reg []byte, data *Ibswinfo) {
+	data.Temp = float64(int16(binary.BigEndian.Uint16(reg[0x06:0x08]))) * 0.125
+	data.MaxTemp = float64(int16(binary.BigEndian.Uint16(reg[0x0A:0x0C]))) * 0.125
+}
+
+// parseMSPS reads the power supply status entries, absent power supplies are skipped
+func parseMSPS(reg []byte) []SwitchPowerSupply {
+	var psus []SwitchPowerSupply
+	for i := 0; i < mspsPSUs; i++ {
+		entry := reg[i*mspsPSUSize : (i+1)*mspsPSUSize]
+		status := binary.BigEndian.Uint32(entry[0:4])
+		if status&(1<<31) == 0 {
+			continue
+		}
+		psu := SwitchPowerSupply{
+			ID:        strconv.Itoa(i),
+			Status:    okOrError(status&(1<<2) == 0),
+			DCPower:   okOrError(status&(1<<0) != 0),
+			FanStatus: okOrError(status&(1<<1) != 0),
+			PowerW:    math.NaN(),
+		}
+		if watts := binary.BigEndian.Uint16(entry[6:8]); watts != 0 {
+			psu.PowerW = float64(watts)
+		}
+		psus = append(psus, psu)
+	}
+	return psus
+}
+
+// parseMFSM reads the RPM of a single tachometer
+func parseMFSM(reg []byte) SwitchFan {
+	return SwitchFan{
+		ID:  strconv.Itoa(int(reg[0]) + 1),
+		RPM: float64(binary.BigEndian.Uint16(reg[6:8])),
+	}
+}
+
+func okOrError(ok bool) string {
+	if ok {
+		return "OK"
+	}
+	return "ERROR"
+}
+
+func registerString(b []byte) string {
+	return string(bytes.TrimSpace(bytes.TrimRight(b, "\x00")))
+}
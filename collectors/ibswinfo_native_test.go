@@ -0,0 +1,294 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeMADTransport struct {
+	nodeInfo  []byte
+	registers map[uint16][]byte
+	fans      map[byte]uint16
+	status    uint16
+	timeout   bool
+	failPort  byte
+	closes    int
+}
+
+func (f *fakeMADTransport) Send(lid uint16, mad []byte, ctx context.Context) ([]byte, error) {
+	if f.timeout {
+		return nil, context.DeadlineExceeded
+	}
+	resp := make([]byte, len(mad))
+	copy(resp, mad)
+	resp[3] = madMethodGetResp
+	binary.BigEndian.PutUint16(resp[4:6], f.status)
+	if mad[1] == madClassSubnLID {
+		copy(resp[madAttrDataOffset:], f.nodeInfo)
+		return resp, nil
+	}
+	// PortRcvErrorDetails reports the port number as PortLocalPhysicalErrors
+	if mad[1] == madClassPerf {
+		port := mad[madAttrDataOffset+1]
+		if port == f.failPort {
+			return nil, fmt.Errorf("Error")
+		}
+		binary.BigEndian.PutUint16(resp[madAttrDataOffset+4:madAttrDataOffset+6], uint16(port))
+		return resp, nil
+	}
+	register := binary.BigEndian.Uint16(mad[madHeaderSize+4 : madHeaderSize+6])
+	start := madHeaderSize + regTLVOperationSize + regTLVHeaderSize
+	if register == regMFSM {
+		tacho := mad[start]
+		resp[start] = tacho
+		binary.BigEndian.PutUint16(resp[start+6:start+8], f.fans[tacho])
+	} else {
+		copy(resp[start:], f.registers[register])
+	}
+	return resp, nil
+}
+
+func (f *fakeMADTransport) Close() error {
+	f.closes++
+	return nil
+}
+
+func newFakeMADTransport() *fakeMADTransport {
+	nodeInfo := make([]byte, nodeInfoSize)
+	nodeInfo[3] = 36
+	binary.BigEndian.PutUint64(nodeInfo[4:12], 0x1c34da0300010540)
+	mgir := make([]byte, regMGIRSize)
+	binary.BigEndian.PutUint32(mgir[0x1C:0x20], 8301347)
+	binary.BigEndian.PutUint32(mgir[0x44:0x48], 27)
+	binary.BigEndian.PutUint32(mgir[0x48:0x4C], 2010)
+	binary.BigEndian.PutUint32(mgir[0x4C:0x50], 3118)
+	copy(mgir[0x30:], "MT_0000000063")
+	msgi := make([]byte, regMSGISize)
+	copy(msgi[0x00:], "MT2152T10239")
+	copy(msgi[0x20:], "MQM8790-HS2F")
+	copy(msgi[0x38:], "AJ")
+	copy(msgi[0x40:], "Jaguar Unmng IB 200")
+	mtmp := make([]byte, regMTMPSize)
+	binary.BigEndian.PutUint16(mtmp[0x06:0x08], 53*8)
+	binary.BigEndian.PutUint16(mtmp[0x0A:0x0C], 58*8)
+	msps := make([]byte, regMSPSSize)
+	binary.BigEndian.PutUint32(msps[0:4], 1<<31|1<<1|1<<0)
+	binary.BigEndian.PutUint16(msps[6:8], 154)
+	binary.BigEndian.PutUint32(msps[mspsPSUSize:mspsPSUSize+4], 1<<31|1<<2)
+	mfcr := make([]byte, regMFCRSize)
+	binary.BigEndian.PutUint16(mfcr[6:8], 0x7)
+	return &fakeMADTransport{
+		nodeInfo: nodeInfo,
+		registers: map[uint16][]byte{
+			regMGIR: mgir,
+			regMSGI: msgi,
+			regMTMP: mtmp,
+			regMSPS: msps,
+			regMFCR: mfcr,
+		},
+		fans: map[byte]uint16{0: 6125, 1: 5251, 2: 6013},
+	}
+}
+
+func TestRegAccessMAD(t *testing.T) {
+	mad, err := encodeRegAccessMAD(regMTMP, regMTMPSize, 10, []byte{0x1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(mad) != madSize {
+		t.Errorf("Unexpected MAD size %d", len(mad))
+	}
+	if mad[1] != madClassVendorMLNX {
+		t.Errorf("Unexpected class 0x%02x", mad[1])
+	}
+	if attr := binary.BigEndian.Uint16(mad[16:18]); attr != madAttrRegAccess {
+		t.Errorf("Unexpected attribute 0x%04x", attr)
+	}
+	transport := newFakeMADTransport()
+	resp, _ := transport.Send(1, mad, context.Background())
+	reg, err := decodeRegAccessMAD(resp, regMTMP, regMTMPSize, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(reg) != regMTMPSize {
+		t.Errorf("Unexpected register size %d", len(reg))
+	}
+	if _, err := decodeRegAccessMAD(resp, regMTMP, regMTMPSize, 11); err == nil {
+		t.Errorf("Expected error for mismatched transaction ID")
+	}
+	if _, err := decodeRegAccessMAD(resp, regMGIR, regMTMPSize, 10); err == nil {
+		t.Errorf("Expected error for mismatched register")
+	}
+	transport.status = 0x1c
+	resp, _ = transport.Send(1, mad, context.Background())
+	if _, err := decodeRegAccessMAD(resp, regMTMP, regMTMPSize, 10); err == nil {
+		t.Errorf("Expected error for bad status")
+	}
+	if _, err := encodeRegAccessMAD(regMGIR, regMaxSize+4, 1, nil); err == nil {
+		t.Errorf("Expected error for oversized register")
+	}
+}
+
+func TestGetMAD(t *testing.T) {
+	mad := encodeGetMAD(madClassSubnLID, madAttrNodeInfo, 10)
+	if mad[1] != madClassSubnLID || binary.BigEndian.Uint16(mad[16:18]) != madAttrNodeInfo {
+		t.Errorf("Unexpected MAD header %v", mad[:24])
+	}
+	transport := newFakeMADTransport()
+	resp, _ := transport.Send(1, mad, context.Background())
+	attr, err := decodeGetResp(resp, madClassSubnLID, madAttrNodeInfo, nodeInfoSize, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if attr[3] != 36 {
+		t.Errorf("Unexpected NodeInfo %v", attr)
+	}
+	if _, err := decodeGetResp(resp, madClassSubnLID, madAttrNodeInfo, nodeInfoSize, 11); err == nil {
+		t.Errorf("Expected error for mismatched transaction ID")
+	}
+	if _, err := decodeGetResp(resp, madClassSubnLID, madAttrRegAccess, nodeInfoSize, 10); err == nil {
+		t.Errorf("Expected error for mismatched attribute")
+	}
+	transport.status = 0x1c
+	resp, _ = transport.Send(1, mad, context.Background())
+	if _, err := decodeGetResp(resp, madClassSubnLID, madAttrNodeInfo, nodeInfoSize, 10); err == nil {
+		t.Errorf("Expected error for bad status")
+	}
+}
+
+func TestNativeIbswinfoReader(t *testing.T) {
+	transport := newFakeMADTransport()
+	NewMADTransport = func(device string) (MADTransport, error) {
+		return transport, nil
+	}
+	defer func() { NewMADTransport = newUmadTransport }()
+	reader := &nativeIbswinfoReader{logger: log.NewNopLogger()}
+	data, err := reader.Read(switchDevices[0], context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if data.FirmwareVersion != "27.2010.3118" {
+		t.Errorf("Unexpected firmware version, got %s", data.FirmwareVersion)
+	}
+	if data.PSID != "MT_0000000063" {
+		t.Errorf("Unexpected PSID, got %s", data.PSID)
+	}
+	if data.PartNumber != "MQM8790-HS2F" {
+		t.Errorf("Unexpected part number, got %s", data.PartNumber)
+	}
+	if data.Ports != "36" || data.GUID != "0x1c34da0300010540" {
+		t.Errorf("Unexpected ports %s or GUID %s", data.Ports, data.GUID)
+	}
+	if data.ProductName != "Jaguar Unmng IB 200" {
+		t.Errorf("Unexpected product name, got %s", data.ProductName)
+	}
+	if data.Uptime != 8301347 {
+		t.Errorf("Unexpected uptime, got %f", data.Uptime)
+	}
+	if data.Temp != 53 || data.MaxTemp != 58 {
+		t.Errorf("Unexpected temperatures, got %f and %f", data.Temp, data.MaxTemp)
+	}
+	if len(data.PowerSupplies) != 2 {
+		t.Fatalf("Unexpected number of power supplies, got %d", len(data.PowerSupplies))
+	}
+	if psu := data.PowerSupplies[0]; psu.Status != "OK" || psu.DCPower != "OK" || psu.FanStatus != "OK" || psu.PowerW != 154 {
+		t.Errorf("Unexpected power supply 0, got %v", psu)
+	}
+	if psu := data.PowerSupplies[0]; psu.PartNumber != "" || psu.SerialNumber != "" {
+		t.Errorf("Expected no power supply inventory from registers, got %v", psu)
+	}
+	if psu := data.PowerSupplies[1]; psu.Status != "ERROR" || psu.DCPower != "ERROR" || !math.IsNaN(psu.PowerW) {
+		t.Errorf("Unexpected power supply 1, got %v", psu)
+	}
+	if len(data.Fans) != 3 {
+		t.Errorf("Unexpected number of fans, got %d", len(data.Fans))
+	}
+	if data.FanStatus != "OK" {
+		t.Errorf("Unexpected fan status, got %s", data.FanStatus)
+	}
+	transport.fans[1] = 0
+	data, _ = reader.Read(switchDevices[0], context.Background())
+	if data.FanStatus != "ERROR" {
+		t.Errorf("Unexpected fan status with stopped fan, got %s", data.FanStatus)
+	}
+}
+
+func TestIbswinfoCollectorNative(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--ibswinfo.source=native"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	transport := newFakeMADTransport()
+	var opens int
+	NewMADTransport = func(device string) (MADTransport, error) {
+		opens++
+		return transport, nil
+	}
+	defer func() { NewMADTransport = newUmadTransport }()
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="ibswinfo"} 0
+		# HELP infiniband_switch_fan_rpm Infiniband switch fan RPM
+		# TYPE infiniband_switch_fan_rpm gauge
+		infiniband_switch_fan_rpm{fan="1",guid="0x506b4b03005c2740"} 6125
+		infiniband_switch_fan_rpm{fan="1",guid="0x7cfe9003009ce5b0"} 6125
+		infiniband_switch_fan_rpm{fan="2",guid="0x506b4b03005c2740"} 5251
+		infiniband_switch_fan_rpm{fan="2",guid="0x7cfe9003009ce5b0"} 5251
+		infiniband_switch_fan_rpm{fan="3",guid="0x506b4b03005c2740"} 6013
+		infiniband_switch_fan_rpm{fan="3",guid="0x7cfe9003009ce5b0"} 6013
+		# HELP infiniband_switch_hardware_info Infiniband switch hardware info
+		# TYPE infiniband_switch_hardware_info gauge
+		infiniband_switch_hardware_info{firmware_version="27.2010.3118",guid="0x506b4b03005c2740",part_number="MQM8790-HS2F",ports="36",product_name="Jaguar Unmng IB 200",psid="MT_0000000063",revision="AJ",serial_number="MT2152T10239",switch="ib-i4l1s01",system_guid="0x1c34da0300010540"} 1
+		infiniband_switch_hardware_info{firmware_version="27.2010.3118",guid="0x7cfe9003009ce5b0",part_number="MQM8790-HS2F",ports="36",product_name="Jaguar Unmng IB 200",psid="MT_0000000063",revision="AJ",serial_number="MT2152T10239",switch="ib-i1l1s01",system_guid="0x1c34da0300010540"} 1
+		# HELP infiniband_switch_temperature_celsius Infiniband switch temperature celsius
+		# TYPE infiniband_switch_temperature_celsius gauge
+		infiniband_switch_temperature_celsius{guid="0x506b4b03005c2740"} 53
+		infiniband_switch_temperature_celsius{guid="0x7cfe9003009ce5b0"} 53
+	`
+	collector := NewIbswinfoCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	// The power supply inventory is only available from ibswinfo
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_switch_fan_rpm", "infiniband_switch_hardware_info", "infiniband_switch_power_supply_hardware_info",
+		"infiniband_switch_temperature_celsius", "infiniband_exporter_collect_errors"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	if opens != 1 || transport.closes != 1 {
+		t.Errorf("Expected one transport opened and closed for all switches, got %d opens and %d closes", opens, transport.closes)
+	}
+	transport.timeout = true
+	expected = `
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="ibswinfo"} 2
+	`
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected), "infiniband_exporter_collect_timeouts"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
@@ -45,6 +45,18 @@ func TestParseIBSWInfo(t *testing.T) {
 	if data.SerialNumber != "MT1943X00498" {
 		t.Errorf("Unexpected serial number, got %s", data.SerialNumber)
 	}
+	if data.ProductName != "Scorpion IB EDR Unmanaged" {
+		t.Errorf("Unexpected product name, got %s", data.ProductName)
+	}
+	if data.Revision != "AN" {
+		t.Errorf("Unexpected revision, got %s", data.Revision)
+	}
+	if data.Ports != "36" {
+		t.Errorf("Unexpected ports, got %s", data.Ports)
+	}
+	if data.GUID != "0x1c34da0300010540" {
+		t.Errorf("Unexpected GUID, got %s", data.GUID)
+	}
 	if data.PSID != "MT_1880110032" {
 		t.Errorf("Unexpected PSID, got %s", data.PSID)
 	}
@@ -76,9 +88,18 @@ func TestParseIBSWInfo(t *testing.T) {
 	if psu0.PowerW != 72 {
 		t.Errorf("Unexpected power supply watts, got %f", psu0.PowerW)
 	}
+	if psu0.PartNumber != "MTEF-PSF-AC-A" {
+		t.Errorf("Unexpected power supply part number, got %s", psu0.PartNumber)
+	}
+	if psu0.SerialNumber != "MT1944X10558" {
+		t.Errorf("Unexpected power supply serial number, got %s", psu0.SerialNumber)
+	}
 	if data.Temp != 45 {
 		t.Errorf("Unexpected temp, got %f", data.Temp)
 	}
+	if data.MaxTemp != 57 {
+		t.Errorf("Unexpected max temp, got %f", data.MaxTemp)
+	}
 	if data.FanStatus != "ERROR" {
 		t.Errorf("Unexpected fan status, got %s", data.FanStatus)
 	}
@@ -180,11 +201,59 @@ func TestParseIBSWInfoFailedPSU(t *testing.T) {
 	}
 }
 
+func TestParseIBSWInfoQuantum2(t *testing.T) {
+	out, err := ReadFixture("ibswinfo", "test4")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	data := Ibswinfo{}
+	err = parse_ibswinfo(out, &data, log.NewNopLogger())
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if data.PartNumber != "MQM9790-NS2F" {
+		t.Errorf("Unexpected part number, got %s", data.PartNumber)
+	}
+	if data.ProductName != "Jaguar Unmng IB 400" {
+		t.Errorf("Unexpected product name, got %s", data.ProductName)
+	}
+	if data.Ports != "64" {
+		t.Errorf("Unexpected ports, got %s", data.Ports)
+	}
+	if data.Uptime != 0 {
+		t.Errorf("Unexpected uptime, got %f", data.Uptime)
+	}
+	if len(data.PowerSupplies) != 2 {
+		t.Errorf("Unexpected number of power supplies, got %d", len(data.PowerSupplies))
+	}
+	for _, psu := range data.PowerSupplies {
+		if psu.FanStatus != "OK" {
+			t.Errorf("Unexpected power supply %s fan status, got %s", psu.ID, psu.FanStatus)
+		}
+		if psu.PartNumber != "930-9SPSU-00RA-000" {
+			t.Errorf("Unexpected power supply %s part number, got %s", psu.ID, psu.PartNumber)
+		}
+	}
+	if data.Temp != 51 {
+		t.Errorf("Unexpected temp, got %f", data.Temp)
+	}
+	if data.MaxTemp != 63 {
+		t.Errorf("Unexpected max temp, got %f", data.MaxTemp)
+	}
+	if data.FanStatus != "OK" {
+		t.Errorf("Unexpected fan status, got %s", data.FanStatus)
+	}
+	if len(data.Fans) != 10 {
+		t.Errorf("Unexpected number of fans, got %d", len(data.Fans))
+	}
+}
+
 func TestParseIBSWInfoErrors(t *testing.T) {
 	tests := []string{
 		"test-err1",
 		"test-err2",
 		"test-err3",
+		"test-err4",
 	}
 	for i, test := range tests {
 		out, err := ReadFixture("ibswinfo", test)
@@ -200,6 +269,7 @@ func TestParseIBSWInfoErrors(t *testing.T) {
 }
 
 func TestIbswinfoCollector(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -246,8 +316,12 @@ func TestIbswinfoCollector(t *testing.T) {
 		infiniband_switch_fan_status_info{guid="0x7cfe9003009ce5b0",status="ERROR"} 1
 		# HELP infiniband_switch_hardware_info Infiniband switch hardware info
 		# TYPE infiniband_switch_hardware_info gauge
-		infiniband_switch_hardware_info{firmware_version="11.2008.2102",guid="0x7cfe9003009ce5b0",part_number="MSB7790-ES2F",psid="MT_1880110032",serial_number="MT1943X00498",switch="ib-i1l1s01"} 1
-		infiniband_switch_hardware_info{firmware_version="27.2010.3118",guid="0x506b4b03005c2740",part_number="MQM8790-HS2F",psid="MT_0000000063",serial_number="MT2152T10239",switch="ib-i4l1s01"} 1
+		infiniband_switch_hardware_info{firmware_version="11.2008.2102",guid="0x7cfe9003009ce5b0",part_number="MSB7790-ES2F",ports="36",product_name="Scorpion IB EDR Unmanaged",psid="MT_1880110032",revision="AN",serial_number="MT1943X00498",switch="ib-i1l1s01",system_guid="0x1c34da0300010540"} 1
+		infiniband_switch_hardware_info{firmware_version="27.2010.3118",guid="0x506b4b03005c2740",part_number="MQM8790-HS2F",ports="40",product_name="Jaguar Unmng IB 200",psid="MT_0000000063",revision="AJ",serial_number="MT2152T10239",switch="ib-i4l1s01",system_guid="0x08c0eb0300d9f672"} 1
+		# HELP infiniband_switch_max_temperature_celsius Infiniband switch max temperature celsius
+		# TYPE infiniband_switch_max_temperature_celsius gauge
+		infiniband_switch_max_temperature_celsius{guid="0x506b4b03005c2740"} 58
+		infiniband_switch_max_temperature_celsius{guid="0x7cfe9003009ce5b0"} 57
 		# HELP infiniband_switch_power_supply_dc_power_status_info Infiniband switch power supply DC power status
 		# TYPE infiniband_switch_power_supply_dc_power_status_info gauge
 		infiniband_switch_power_supply_dc_power_status_info{guid="0x506b4b03005c2740",psu="0",status="OK"} 1
@@ -260,6 +334,12 @@ func TestIbswinfoCollector(t *testing.T) {
 		infiniband_switch_power_supply_fan_status_info{guid="0x506b4b03005c2740",psu="1",status="OK"} 1
 		infiniband_switch_power_supply_fan_status_info{guid="0x7cfe9003009ce5b0",psu="0",status="OK"} 1
 		infiniband_switch_power_supply_fan_status_info{guid="0x7cfe9003009ce5b0",psu="1",status="OK"} 1
+		# HELP infiniband_switch_power_supply_hardware_info Infiniband switch power supply hardware info
+		# TYPE infiniband_switch_power_supply_hardware_info gauge
+		infiniband_switch_power_supply_hardware_info{guid="0x506b4b03005c2740",part_number="MTEF-PSF-AC-C",psu="0",serial_number="MT2150T22468"} 1
+		infiniband_switch_power_supply_hardware_info{guid="0x506b4b03005c2740",part_number="MTEF-PSF-AC-C",psu="1",serial_number="MT2150T22467"} 1
+		infiniband_switch_power_supply_hardware_info{guid="0x7cfe9003009ce5b0",part_number="MTEF-PSF-AC-A",psu="0",serial_number="MT1944X10558"} 1
+		infiniband_switch_power_supply_hardware_info{guid="0x7cfe9003009ce5b0",part_number="MTEF-PSF-AC-A",psu="1",serial_number="MT1944X10555"} 1
 		# HELP infiniband_switch_power_supply_status_info Infiniband switch power supply status
 		# TYPE infiniband_switch_power_supply_status_info gauge
 		infiniband_switch_power_supply_status_info{guid="0x506b4b03005c2740",psu="0",status="OK"} 1
@@ -285,12 +365,13 @@ func TestIbswinfoCollector(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 50 {
-		t.Errorf("Unexpected collection count %d, expected 50", val)
+	} else if val != 56 {
+		t.Errorf("Unexpected collection count %d, expected 56", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_switch_power_supply_status_info", "infiniband_switch_power_supply_dc_power_status_info",
 		"infiniband_switch_power_supply_fan_status_info", "infiniband_switch_power_supply_watts",
+		"infiniband_switch_power_supply_hardware_info", "infiniband_switch_max_temperature_celsius",
 		"infiniband_switch_temperature_celsius", "infiniband_switch_fan_status_info", "infiniband_switch_fan_rpm",
 		"infiniband_switch_hardware_info", "infiniband_switch_uptime_seconds",
 		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
@@ -299,6 +380,7 @@ func TestIbswinfoCollector(t *testing.T) {
 }
 
 func TestIbswinfoCollectorMissingStatus(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -317,12 +399,13 @@ func TestIbswinfoCollectorMissingStatus(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 43 {
-		t.Errorf("Unexpected collection count %d, expected 43", val)
+	} else if val != 48 {
+		t.Errorf("Unexpected collection count %d, expected 48", val)
 	}
 }
 
 func TestIbswinfoCollectorError(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -339,6 +422,10 @@ func TestIbswinfoCollectorError(t *testing.T) {
 		return out, err
 	}
 	expected := `
+		# HELP infiniband_exporter_collect_failures_total Number of collection failures by reason
+		# TYPE infiniband_exporter_collect_failures_total counter
+		infiniband_exporter_collect_failures_total{collector="ibswinfo",guid="0x506b4b03005c2740",reason="other"} 2
+		infiniband_exporter_collect_failures_total{collector="ibswinfo",guid="0x7cfe9003009ce5b0",reason="parse"} 2
 		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
 		# TYPE infiniband_exporter_collect_errors gauge
 		infiniband_exporter_collect_errors{collector="ibswinfo"} 2
@@ -352,17 +439,19 @@ func TestIbswinfoCollectorError(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 3 {
-		t.Errorf("Unexpected collection count %d, expected 3", val)
+	} else if val != 5 {
+		t.Errorf("Unexpected collection count %d, expected 5", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_switch_power_supply_status_info",
-		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts",
+		"infiniband_exporter_collect_failures_total"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
 
 func TestIbswinfoCollectorErrorRunonce(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -390,8 +479,8 @@ func TestIbswinfoCollectorErrorRunonce(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 4 {
-		t.Errorf("Unexpected collection count %d, expected 4", val)
+	} else if val != 6 {
+		t.Errorf("Unexpected collection count %d, expected 6", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_switch_power_supply_status_info",
@@ -401,6 +490,7 @@ func TestIbswinfoCollectorErrorRunonce(t *testing.T) {
 }
 
 func TestIbswinfoCollectorTimeout(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -419,8 +509,8 @@ func TestIbswinfoCollectorTimeout(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 3 {
-		t.Errorf("Unexpected collection count %d, expected 3", val)
+	} else if val != 5 {
+		t.Errorf("Unexpected collection count %d, expected 5", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_switch_power_supply_status_info",
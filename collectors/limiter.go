@@ -0,0 +1,137 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Limit is multiplied by this when a device times out
+	limiterBackoffRatio = 0.5
+)
+
+var (
+	adaptiveConcurrency = kingpin.Flag("exporter.adaptive-concurrency", "Adjust perfquery and ibswinfo concurrency based on latency and timeouts, max-concurrent flags set the initial limit").Default("false").Bool()
+	concurrencyMin      = kingpin.Flag("exporter.adaptive-concurrency.min", "Minimum concurrency when adaptive concurrency is enabled").Default("1").Int()
+	concurrencyMax      = kingpin.Flag("exporter.adaptive-concurrency.max", "Maximum concurrency when adaptive concurrency is enabled").Default("16").Int()
+	limiters            = newConcurrencyLimiters()
+	concurrencyLimit    = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "concurrency_limit"),
+		"Current limit of concurrent command executions",
+		[]string{"collector"}, nil)
+	concurrencyWait = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "concurrency_queue_wait_seconds_total"),
+		"Time devices waited for a concurrency slot",
+		[]string{"collector"}, nil)
+)
+
+// concurrencyLimiter limits concurrent collections, additively increasing the limit while
+// collections are fast and halving it when they time out
+type concurrencyLimiter struct {
+	sync.Mutex
+	cond     *sync.Cond
+	limit    float64
+	inFlight int
+	min      float64
+	max      float64
+	timeout  time.Duration
+	adaptive bool
+	wait     float64
+}
+
+type concurrencyLimiters struct {
+	sync.Mutex
+	limiters map[string]*concurrencyLimiter
+}
+
+func newConcurrencyLimiters() *concurrencyLimiters {
+	return &concurrencyLimiters{limiters: make(map[string]*concurrencyLimiter)}
+}
+
+// get returns the limiter of a collector, adaptive limits are kept between collections
+func (c *concurrencyLimiters) get(collector string, initial int, timeout time.Duration) *concurrencyLimiter {
+	c.Lock()
+	defer c.Unlock()
+	l, ok := c.limiters[collector]
+	if !ok {
+		l = &concurrencyLimiter{limit: float64(initial)}
+		l.cond = sync.NewCond(&l.Mutex)
+		c.limiters[collector] = l
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.adaptive = *adaptiveConcurrency
+	l.timeout = timeout
+	if l.adaptive {
+		l.min = math.Max(1, float64(*concurrencyMin))
+		l.max = math.Max(l.min, float64(*concurrencyMax))
+	} else {
+		l.limit = float64(initial)
+		l.min = 1
+		l.max = math.Max(1, float64(initial))
+	}
+	l.limit = math.Min(l.max, math.Max(l.min, l.limit))
+	return l
+}
+
+func (c *concurrencyLimiters) collect(ch chan<- prometheus.Metric, collector string) {
+	c.Lock()
+	l, ok := c.limiters[collector]
+	c.Unlock()
+	if !ok {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if !l.adaptive {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(concurrencyLimit, prometheus.GaugeValue, math.Floor(l.limit), collector)
+	ch <- prometheus.MustNewConstMetric(concurrencyWait, prometheus.CounterValue, l.wait, collector)
+}
+
+// acquire blocks until a slot is available
+func (l *concurrencyLimiter) acquire() {
+	start := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	for l.inFlight >= int(l.limit) {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	l.wait += time.Since(start).Seconds()
+}
+
+// release frees a slot and adjusts the limit using the result of the collection
+func (l *concurrencyLimiter) release(err error, duration time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	l.inFlight--
+	defer l.cond.Broadcast()
+	// Skipped devices do not adjust the limit
+	if !l.adaptive || (err == nil && duration == 0) {
+		return
+	}
+	if err != nil && retryable(err) {
+		l.limit = math.Max(l.min, l.limit*limiterBackoffRatio)
+	} else if err == nil && duration < l.timeout/2 {
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestConcurrencyLimiterStatic(t *testing.T) {
+	setupTest(t, []string{})
+	limiter := limiters.get("switch", 2, time.Second)
+	limiter.acquire()
+	limiter.acquire()
+	acquired := make(chan bool)
+	go func() {
+		limiter.acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Expected acquire to block at limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	limiter.release(context.DeadlineExceeded, time.Second)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected acquire after release")
+	}
+	if limiter.limit != 2 {
+		t.Errorf("Unexpected static limit change, got %f", limiter.limit)
+	}
+	if limiter = limiters.get("switch", 0, time.Second); limiter.limit != 1 {
+		t.Errorf("Unexpected limit, got %f", limiter.limit)
+	}
+}
+
+func TestConcurrencyLimiterAdaptive(t *testing.T) {
+	setupTest(t, []string{"--exporter.adaptive-concurrency", "--exporter.adaptive-concurrency.max=4"})
+	limiter := limiters.get("switch", 2, time.Second)
+	for i := 0; i < 20; i++ {
+		limiter.acquire()
+		limiter.release(nil, time.Millisecond)
+	}
+	if limiter.limit != 4 {
+		t.Errorf("Expected limit raised to max, got %f", limiter.limit)
+	}
+	limiter.acquire()
+	limiter.release(nil, 900*time.Millisecond)
+	if limiter.limit != 4 {
+		t.Errorf("Unexpected limit change for slow collection, got %f", limiter.limit)
+	}
+	limiter.acquire()
+	limiter.release(fmt.Errorf("Error"), time.Millisecond)
+	if limiter.limit != 4 {
+		t.Errorf("Unexpected limit change for error, got %f", limiter.limit)
+	}
+	for i := 0; i < 3; i++ {
+		limiter.acquire()
+		limiter.release(context.DeadlineExceeded, time.Second)
+	}
+	if limiter.limit != 1 {
+		t.Errorf("Expected limit lowered to min, got %f", limiter.limit)
+	}
+	limiter.acquire()
+	limiter.release(nil, 0)
+	if limiter.limit != 1 {
+		t.Errorf("Unexpected limit change for skipped device, got %f", limiter.limit)
+	}
+	if limiter = limiters.get("switch", 2, time.Second); limiter.limit != 1 {
+		t.Errorf("Expected adaptive limit kept between collections, got %f", limiter.limit)
+	}
+}
+
+func TestConcurrencyLimitersCollect(t *testing.T) {
+	setupTest(t, []string{})
+	ch := make(chan prometheus.Metric, 10)
+	limiters.collect(ch, "switch")
+	if len(ch) != 0 {
+		t.Errorf("Unexpected metrics for unknown collector")
+	}
+	limiters.get("switch", 3, time.Second)
+	limiters.collect(ch, "switch")
+	if len(ch) != 0 {
+		t.Errorf("Unexpected metrics without adaptive concurrency")
+	}
+	setupTest(t, []string{"--exporter.adaptive-concurrency"})
+	limiters.get("switch", 3, time.Second)
+	limiters.collect(ch, "switch")
+	close(ch)
+	var values []float64
+	for metric := range ch {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Gauge != nil {
+			values = append(values, m.GetGauge().GetValue())
+		}
+	}
+	if len(values) != 1 || values[0] != 3 {
+		t.Errorf("Unexpected limit metric, got %v", values)
+	}
+}
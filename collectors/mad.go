@@ -0,0 +1,229 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+)
+
+const (
+	madSize = 256
+	// Offset of the MAD data after the common MAD header
+	madHeaderSize = 24
+	// Subnet management class of LID routed SMPs
+	madClassSubnLID = 0x01
+	// Performance management class read by perfquery
+	madClassPerf = 0x04
+	// Vendor specific management class used by Mellanox for register access
+	madClassVendorMLNX  = 0x0A
+	madClassVersion     = 0x01
+	madMethodGet        = 0x01
+	madMethodGetResp    = 0x81
+	madAttrNodeInfo     = 0x0011
+	madAttrRcvErrDetail = 0x0015
+	madAttrRegAccess    = 0x0051
+	regTLVTypeOperation = 0x1
+	regTLVTypeRegister  = 0x3
+	regTLVOperationSize = 16
+	regTLVHeaderSize    = 4
+	// Largest register payload that fits in a single MAD
+	regMaxSize = madSize - madHeaderSize - regTLVOperationSize - regTLVHeaderSize
+	// SMP and PMA attribute data follow the M_Key or reserved bytes after the common MAD header
+	madAttrDataOffset = 64
+	nodeInfoSize      = 40
+	rcvErrDetailSize  = 16
+)
+
+var (
+	umadDevice      = kingpin.Flag("mad.umad-device", "Path to umad device used to send MADs").Default("/dev/infiniband/umad0").String()
+	NewMADTransport = newUmadTransport
+	madTID          uint64
+)
+
+// MADTransport sends a single MAD to a LID and returns the response MAD
+type MADTransport interface {
+	Send(lid uint16, mad []byte, ctx context.Context) ([]byte, error)
+	Close() error
+}
+
+// lazyMADTransport opens the MAD transport on first use so one umad device is shared by a collection
+type lazyMADTransport struct {
+	sync.Mutex
+	transport MADTransport
+}
+
+type madStatusError struct {
+	status   uint16
+	register uint16
+}
+
+func (e *madStatusError) Error() string {
+	return fmt.Sprintf("register 0x%04x access returned status 0x%04x", e.register, e.status)
+}
+
+func (l *lazyMADTransport) Send(lid uint16, mad []byte, ctx context.Context) ([]byte, error) {
+	l.Lock()
+	if l.transport == nil {
+		transport, err := NewMADTransport(*umadDevice)
+		if err != nil {
+			l.Unlock()
+			return nil, err
+		}
+		l.transport = transport
+	}
+	transport := l.transport
+	l.Unlock()
+	return transport.Send(lid, mad, ctx)
+}
+
+// Close closes the transport if it was opened
+func (l *lazyMADTransport) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.transport == nil {
+		return nil
+	}
+	err := l.transport.Close()
+	l.transport = nil
+	return err
+}
+
+func nextMADTID() uint64 {
+	return atomic.AddUint64(&madTID, 1)
+}
+
+// encodeGetMAD builds the common header of a MAD that gets an attribute
+func encodeGetMAD(class uint8, attr uint16, tid uint64) []byte {
+	mad := make([]byte, madSize)
+	mad[0] = 1 // BaseVersion
+	mad[1] = class
+	mad[2] = madClassVersion
+	mad[3] = madMethodGet
+	binary.BigEndian.PutUint64(mad[8:16], tid)
+	binary.BigEndian.PutUint16(mad[16:18], attr)
+	return mad
+}
+
+// decodeGetResp validates the response to a Get of an SMP or PMA attribute and returns its data
+func decodeGetResp(mad []byte, class uint8, attr uint16, size int, tid uint64) ([]byte, error) {
+	if len(mad) < madAttrDataOffset+size {
+		return nil, fmt.Errorf("Short MAD response of %d bytes", len(mad))
+	}
+	if mad[1] != class || mad[3] != madMethodGetResp {
+		return nil, fmt.Errorf("Unexpected MAD class 0x%02x method 0x%02x", mad[1], mad[3])
+	}
+	if uint32(binary.BigEndian.Uint64(mad[8:16])) != uint32(tid) {
+		return nil, fmt.Errorf("Unexpected MAD transaction ID")
+	}
+	if got := binary.BigEndian.Uint16(mad[16:18]); got != attr {
+		return nil, fmt.Errorf("Unexpected attribute 0x%04x in response, expected 0x%04x", got, attr)
+	}
+	// Bit 15 of an SMP status is the direction bit of directed route SMPs
+	if status := binary.BigEndian.Uint16(mad[4:6]) & 0x7fff; status != 0 {
+		return nil, fmt.Errorf("MAD attribute 0x%04x access returned status 0x%04x", attr, status)
+	}
+	return mad[madAttrDataOffset : madAttrDataOffset+size], nil
+}
+
+// encodeRegAccessMAD builds a vendor specific MAD that reads a register.
+// The layout follows the register access TLVs used by mstflint over in-band GMPs.
+func encodeRegAccessMAD(register uint16, size int, tid uint64, payload []byte) ([]byte, error) {
+	if size%4 != 0 || size > regMaxSize {
+		return nil, fmt.Errorf("Invalid register size %d", size)
+	}
+	mad := encodeGetMAD(madClassVendorMLNX, madAttrRegAccess, tid)
+	op := mad[madHeaderSize : madHeaderSize+regTLVOperationSize]
+	// type(5 bits) | len(11 bits) in dwords
+	binary.BigEndian.PutUint16(op[0:2], uint16(regTLVTypeOperation<<11|regTLVOperationSize/4))
+	binary.BigEndian.PutUint16(op[2:4], 0)
+	binary.BigEndian.PutUint16(op[4:6], register)
+	op[6] = madMethodGet // method: query
+	op[7] = 1            // class: register access
+	binary.BigEndian.PutUint64(op[8:16], tid)
+	reg := mad[madHeaderSize+regTLVOperationSize:]
+	binary.BigEndian.PutUint16(reg[0:2], uint16(regTLVTypeRegister<<11|(size/4+1)))
+	copy(reg[regTLVHeaderSize:regTLVHeaderSize+size], payload)
+	return mad, nil
+}
+
+// decodeRegAccessMAD validates a register access response and returns the register payload
+func decodeRegAccessMAD(mad []byte, register uint16, size int, tid uint64) ([]byte, error) {
+	if len(mad) < madHeaderSize+regTLVOperationSize+regTLVHeaderSize+size {
+		return nil, fmt.Errorf("Short MAD response of %d bytes", len(mad))
+	}
+	if mad[1] != madClassVendorMLNX || mad[3] != madMethodGetResp {
+		return nil, fmt.Errorf("Unexpected MAD class 0x%02x method 0x%02x", mad[1], mad[3])
+	}
+	// The kernel replaces the upper 32 bits of the TID with the agent ID
+	if uint32(binary.BigEndian.Uint64(mad[8:16])) != uint32(tid) {
+		return nil, fmt.Errorf("Unexpected MAD transaction ID")
+	}
+	if status := binary.BigEndian.Uint16(mad[4:6]); status != 0 {
+		return nil, &madStatusError{status: status, register: register}
+	}
+	op := mad[madHeaderSize : madHeaderSize+regTLVOperationSize]
+	if status := binary.BigEndian.Uint16(op[2:4]) & 0x7f; status != 0 {
+		return nil, &madStatusError{status: status, register: register}
+	}
+	if got := binary.BigEndian.Uint16(op[4:6]); got != register {
+		return nil, fmt.Errorf("Unexpected register 0x%04x in response, expected 0x%04x", got, register)
+	}
+	start := madHeaderSize + regTLVOperationSize + regTLVHeaderSize
+	return mad[start : start+size], nil
+}
+
+// sendMAD sends a MAD to lid once the device may be queried
+func sendMAD(transport MADTransport, lid uint16, mad []byte, ctx context.Context) ([]byte, error) {
+	release, err := scheduler.acquire(ctx, contextDevice(ctx, strconv.Itoa(int(lid))))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return transport.Send(lid, mad, ctx)
+}
+
+// readRegister queries a register from the switch at lid, payload is used to
+// select the instance of the register such as a sensor or tachometer index
+func readRegister(transport MADTransport, lid uint16, register uint16, size int, payload []byte, ctx context.Context) ([]byte, error) {
+	tid := nextMADTID()
+	mad, err := encodeRegAccessMAD(register, size, tid, payload)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sendMAD(transport, lid, mad, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRegAccessMAD(resp, register, size, tid)
+}
+
+// readAttribute gets an SMP or PMA attribute of lid, payload is copied to the
+// attribute data to select an instance such as a port
+func readAttribute(transport MADTransport, lid uint16, class uint8, attr uint16, size int, payload []byte, ctx context.Context) ([]byte, error) {
+	tid := nextMADTID()
+	mad := encodeGetMAD(class, attr, tid)
+	copy(mad[madAttrDataOffset:], payload)
+	resp, err := sendMAD(transport, lid, mad, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodeGetResp(resp, class, attr, size, tid)
+}
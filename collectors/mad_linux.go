@@ -0,0 +1,169 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package collectors
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// _IOWR(IB_IOCTL_MAGIC, 1, struct ib_user_mad_reg_req)
+	umadRegisterAgent = 0xC01C1B01
+	// _IOW(IB_IOCTL_MAGIC, 2, __u32)
+	umadUnregisterAgent = 0x40041B02
+	// struct ib_user_mad header including struct ib_mad_addr
+	umadHeaderSize = 64
+	smiQPN         = 0
+	gsiQPN         = 1
+	gsiQKey        = 0x80010000
+)
+
+// ibUserMADRegReq mirrors struct ib_user_mad_reg_req from rdma/ib_user_mad.h
+type ibUserMADRegReq struct {
+	id               uint32
+	methodMask       [4]uint32
+	qpn              uint8
+	mgmtClass        uint8
+	mgmtClassVersion uint8
+	oui              [3]uint8
+	rmppVersion      uint8
+	_                uint8
+}
+
+// umadTransport sends one MAD at a time so a response is always read by the request that sent it.
+// An agent is registered for each management class the first time a MAD of that class is sent.
+type umadTransport struct {
+	sync.Mutex
+	device string
+	file   *os.File
+	agents map[uint8]uint32
+}
+
+func newUmadTransport(device string) (MADTransport, error) {
+	file, err := os.OpenFile(device, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &umadTransport{device: device, file: file, agents: make(map[uint8]uint32)}, nil
+}
+
+// agent returns the agent ID of a management class, registering it if needed
+func (u *umadTransport) agent(class uint8) (uint32, error) {
+	if id, ok := u.agents[class]; ok {
+		return id, nil
+	}
+	req := ibUserMADRegReq{
+		qpn:              madQPN(class),
+		mgmtClass:        class,
+		mgmtClassVersion: madClassVersion,
+	}
+	conn, err := u.file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, umadRegisterAgent, uintptr(unsafe.Pointer(&req)))
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Unable to register MAD agent for class 0x%02x on %s: %w", class, u.device, err)
+	}
+	u.agents[class] = req.id
+	return req.id, nil
+}
+
+// madQPN returns the QP of a management class, SMPs use QP0 and GMPs QP1
+func madQPN(class uint8) uint8 {
+	if class == madClassSubnLID {
+		return smiQPN
+	}
+	return gsiQPN
+}
+
+func (u *umadTransport) Send(lid uint16, mad []byte, ctx context.Context) ([]byte, error) {
+	u.Lock()
+	defer u.Unlock()
+	timeoutMS := uint32(1000)
+	deadline, ok := ctx.Deadline()
+	if ok {
+		timeoutMS = uint32(time.Until(deadline).Milliseconds())
+	}
+	if err := u.file.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	agentID, err := u.agent(mad[1])
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, umadHeaderSize+len(mad))
+	binary.LittleEndian.PutUint32(buf[0:4], agentID)
+	binary.LittleEndian.PutUint32(buf[8:12], timeoutMS)
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(len(mad)))
+	// struct ib_mad_addr fields are in network byte order
+	if qpn := madQPN(mad[1]); qpn == gsiQPN {
+		binary.BigEndian.PutUint32(buf[20:24], gsiQPN)
+		binary.BigEndian.PutUint32(buf[24:28], gsiQKey)
+	}
+	binary.BigEndian.PutUint16(buf[28:30], lid)
+	copy(buf[umadHeaderSize:], mad)
+	if _, err := u.file.Write(buf); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, umadHeaderSize+madSize)
+	for {
+		n, err := u.file.Read(resp)
+		if os.IsTimeout(err) {
+			return nil, context.DeadlineExceeded
+		} else if err != nil {
+			return nil, err
+		}
+		// Skip short reads and late responses to requests that already timed out
+		if n < umadHeaderSize+madHeaderSize || binary.BigEndian.Uint32(resp[umadHeaderSize+12:umadHeaderSize+16]) != binary.BigEndian.Uint32(mad[12:16]) {
+			continue
+		}
+		if status := binary.LittleEndian.Uint32(resp[4:8]); status != 0 {
+			if syscall.Errno(status) == syscall.ETIMEDOUT {
+				return nil, context.DeadlineExceeded
+			}
+			return nil, fmt.Errorf("MAD send to LID %d failed: %w", lid, syscall.Errno(status))
+		}
+		return resp[umadHeaderSize:n], nil
+	}
+}
+
+func (u *umadTransport) Close() error {
+	u.Lock()
+	defer u.Unlock()
+	conn, err := u.file.SyscallConn()
+	if err == nil {
+		for _, agentID := range u.agents {
+			_ = conn.Control(func(fd uintptr) {
+				_, _, _ = syscall.Syscall(syscall.SYS_IOCTL, fd, umadUnregisterAgent, uintptr(unsafe.Pointer(&agentID)))
+			})
+		}
+	}
+	return u.file.Close()
+}
@@ -14,8 +14,9 @@
 package collectors
 
 import (
-	"bytes"
 	"context"
+	"encoding/binary"
+	"fmt"
 	"math"
 	"reflect"
 	"strconv"
@@ -30,6 +31,7 @@ var (
 	perfqueryPath    = kingpin.Flag("perfquery.path", "Path to perfquery").Default("perfquery").String()
 	perfqueryTimeout = kingpin.Flag("perfquery.timeout", "Timeout for perfquery execution").Default("5s").Duration()
 	maxConcurrent    = kingpin.Flag("perfquery.max-concurrent", "Max number of concurrent perfquery executions").Default("1").Int()
+	rcvErrSource     = kingpin.Flag("perfquery.rcv-err-source", "Source of rcv-err details, exec runs perfquery -E for each port and mad reads every port using performance management MADs").Default("exec").Enum("exec", "mad")
 	PerfqueryExec    = perfquery
 )
 
@@ -132,6 +134,96 @@ func perfqueryParse(device InfinibandDevice, out string, logger log.Logger) ([]P
 	return counters, errors
 }
 
+// perfqueryPorts returns the comma separated port list of a device queried by one perfquery execution,
+// nothing is queried for a device without ports
+func perfqueryPorts(ports []string) []string {
+	if len(ports) == 0 {
+		return nil
+	}
+	return []string{strings.Join(ports, ",")}
+}
+
+// perfqueryDevice runs perfquery once for each port list of a device, returning the combined output of
+// the batches that succeeded and the errors of the batches that failed.
+func perfqueryDevice(retry *deviceRetry, guid string, batches []string, extraArgs []string) (string, []error) {
+	var out strings.Builder
+	var errs []error
+	for _, batch := range batches {
+		var batchOut string
+		err := retry.run(*perfqueryTimeout, func(ctx context.Context) error {
+			var err error
+			batchOut, err = PerfqueryExec(guid, batch, extraArgs, ctx)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		out.WriteString(batchOut)
+		if !strings.HasSuffix(batchOut, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	return out.String(), errs
+}
+
+// collectRcvErr reads the rcv-err details of the ports of a device, returning the counters and parse errors
+// of the ports that succeeded and the errors of the ports that failed.
+// perfquery -E only reads the first port of a list so it is executed once per port.
+func collectRcvErr(transport MADTransport, retry *deviceRetry, device InfinibandDevice, ports []string, logger log.Logger) ([]PerfQueryCounters, float64, []error) {
+	if *rcvErrSource == "mad" {
+		counters, errs := rcvErrDetailsMAD(transport, retry, device, ports)
+		return counters, 0, errs
+	}
+	out, errs := perfqueryDevice(retry, device.GUID, ports, []string{"-E"})
+	counters, parseErrors := perfqueryParse(device, out, logger)
+	return counters, parseErrors, errs
+}
+
+// rcvErrDetailsMAD reads PortRcvErrorDetails of each port with a performance management MAD
+func rcvErrDetailsMAD(transport MADTransport, retry *deviceRetry, device InfinibandDevice, ports []string) ([]PerfQueryCounters, []error) {
+	lid, err := strconv.ParseUint(device.LID, 10, 16)
+	if err != nil {
+		return nil, []error{fmt.Errorf("Invalid LID %s: %w", device.LID, err)}
+	}
+	var counters []PerfQueryCounters
+	var errs []error
+	for _, port := range ports {
+		portNum, err := strconv.ParseUint(port, 10, 8)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Invalid port %s: %w", port, err))
+			continue
+		}
+		var attr []byte
+		err = retry.run(*perfqueryTimeout, func(ctx context.Context) error {
+			var err error
+			attr, err = readAttribute(transport, uint16(lid), madClassPerf, madAttrRcvErrDetail, rcvErrDetailSize, []byte{0, byte(portNum)}, ctx)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		counters = append(counters, parseRcvErrDetails(device, port, attr))
+	}
+	return counters, errs
+}
+
+// parseRcvErrDetails reads the counters of the PortRcvErrorDetails attribute
+func parseRcvErrDetails(device InfinibandDevice, port string, attr []byte) PerfQueryCounters {
+	var counter PerfQueryCounters
+	initializeCounters(&counter)
+	counter.device = device
+	counter.PortSelect = port
+	counter.PortLocalPhysicalErrors = float64(binary.BigEndian.Uint16(attr[4:6]))
+	counter.PortMalformedPktErrors = float64(binary.BigEndian.Uint16(attr[6:8]))
+	counter.PortBufferOverrunErrors = float64(binary.BigEndian.Uint16(attr[8:10]))
+	counter.PortDLIDMappingErrors = float64(binary.BigEndian.Uint16(attr[10:12]))
+	counter.PortVLMappingErrors = float64(binary.BigEndian.Uint16(attr[12:14]))
+	counter.PortLoopingErrors = float64(binary.BigEndian.Uint16(attr[14:16]))
+	return counter
+}
+
 func perfqueryArgs(guid string, port string, extraArgs []string) (string, []string) {
 	var command string
 	var args []string
@@ -149,14 +241,5 @@ func perfqueryArgs(guid string, port string, extraArgs []string) (string, []stri
 
 func perfquery(guid string, port string, extraArgs []string, ctx context.Context) (string, error) {
 	command, args := perfqueryArgs(guid, port, extraArgs)
-	cmd := execCommand(ctx, command, args...)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if ctx.Err() == context.DeadlineExceeded {
-		return "", ctx.Err()
-	} else if err != nil {
-		return "", err
-	}
-	return out.String(), nil
+	return runCommand(ctx, guid, command, args)
 }
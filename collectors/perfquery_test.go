@@ -20,6 +20,8 @@ import (
 	"os"
 	"os/exec"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -261,3 +263,114 @@ func TestPerfqueryTimeout(t *testing.T) {
 		t.Errorf("Unexpected out: %s", out)
 	}
 }
+
+func TestRcvErrDetailsMAD(t *testing.T) {
+	transport := newFakeMADTransport()
+	transport.failPort = 2
+	device := InfinibandDevice{LID: "1719", GUID: "0x7cfe9003009ce5b0"}
+	counters, errs := rcvErrDetailsMAD(transport, newDeviceRetry("switch", device.GUID), device, []string{"1", "2", "3"})
+	if len(errs) != 1 {
+		t.Errorf("Expected one error, got %v", errs)
+	}
+	if len(counters) != 2 {
+		t.Fatalf("Expected counters of ports that succeeded, got %v", counters)
+	}
+	if counters[1].PortSelect != "3" || counters[1].PortLocalPhysicalErrors != 3 || counters[1].PortLoopingErrors != 0 {
+		t.Errorf("Unexpected counters, got %v", counters[1])
+	}
+	if !math.IsNaN(counters[1].PortXmitData) {
+		t.Errorf("Expected extended counters not set, got %f", counters[1].PortXmitData)
+	}
+	if _, errs := rcvErrDetailsMAD(transport, newDeviceRetry("switch", device.GUID), InfinibandDevice{LID: "foo"}, []string{"1"}); len(errs) != 1 {
+		t.Errorf("Expected error for invalid LID, got %v", errs)
+	}
+}
+
+func TestPerfqueryDevice(t *testing.T) {
+	var calls []string
+	PerfqueryExec = func(guid string, port string, extraArgs []string, ctx context.Context) (string, error) {
+		calls = append(calls, port)
+		if port == "3" {
+			return "", fmt.Errorf("Error")
+		}
+		return fmt.Sprintf("PortSelect:...%s", port), nil
+	}
+	defer func() { PerfqueryExec = perfquery }()
+	out, errs := perfqueryDevice(newDeviceRetry("switch", "0x00"), "0x00", []string{"1", "2"}, []string{"-E"})
+	if len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if out != "PortSelect:...1\nPortSelect:...2\n" {
+		t.Errorf("Unexpected out: %q", out)
+	}
+	calls = nil
+	out, errs = perfqueryDevice(newDeviceRetry("switch", "0x00"), "0x00", []string{"3", "4"}, []string{"-E"})
+	if len(errs) != 1 {
+		t.Errorf("Expected one error, got %v", errs)
+	}
+	if out != "PortSelect:...4\n" {
+		t.Errorf("Expected output of batches after the error, got %q", out)
+	}
+	if !reflect.DeepEqual(calls, []string{"3", "4"}) {
+		t.Errorf("Expected every batch queried, got %v", calls)
+	}
+}
+
+func benchmarkDevice(ports int) InfinibandDevice {
+	device := InfinibandDevice{Type: "SW", LID: "1719", GUID: "0x7cfe9003009ce5b0", Name: "ib-i1l1s01", Uplinks: make(map[string]InfinibandUplink)}
+	for port := 1; port <= ports; port++ {
+		device.Uplinks[strconv.Itoa(port)] = InfinibandUplink{Type: "CA", PortNumber: "1"}
+	}
+	return device
+}
+
+// benchmarkExecCommand returns perfquery output for the ports passed as the last argument
+func benchmarkExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	var out strings.Builder
+	for _, port := range strings.Split(args[len(args)-1], ",") {
+		fmt.Fprintf(&out, "PortSelect:......................%s\nPortXmitData:....................%s\nPortLocalPhysicalErrors:.........0\n", port, port)
+	}
+	cmd := fakeExecCommand(ctx, command, args...)
+	cmd.Env = append(cmd.Env, "STDOUT="+out.String())
+	return cmd
+}
+
+func BenchmarkSwitchCollectorRcvErr(b *testing.B) {
+	devices := []InfinibandDevice{benchmarkDevice(40)}
+	var execs int
+	PerfqueryExec = perfquery
+	execCommand = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		execs++
+		return benchmarkExecCommand(ctx, command, args...)
+	}
+	mockedExitStatus = 0
+	NewMADTransport = func(device string) (MADTransport, error) {
+		return newFakeMADTransport(), nil
+	}
+	defer func() {
+		execCommand = exec.CommandContext
+		NewMADTransport = newUmadTransport
+	}()
+	for _, source := range []string{"exec", "mad"} {
+		b.Run(fmt.Sprintf("rcv-err-source=%s", source), func(b *testing.B) {
+			args := []string{"--collector.switch.rcv-err-details", fmt.Sprintf("--perfquery.rcv-err-source=%s", source)}
+			if _, err := kingpin.CommandLine.Parse(args); err != nil {
+				b.Fatal(err)
+			}
+			defer kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+			collector := NewSwitchCollector(&devices, false, log.NewNopLogger())
+			execs = 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				counters, _, errors, _ := collector.collect()
+				if errors != 0 {
+					b.Fatalf("Unexpected errors: %f", errors)
+				}
+				if len(counters) != 80 {
+					b.Fatalf("Unexpected counters, got %d", len(counters))
+				}
+			}
+			b.ReportMetric(float64(execs)/float64(b.N), "execs/op")
+		})
+	}
+}
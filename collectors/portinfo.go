@@ -0,0 +1,388 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	CollectPortinfo       = kingpin.Flag("collector.portinfo", "Enable the switch port state collector using smpquery portinfo").Default("false").Bool()
+	smpqueryPath          = kingpin.Flag("smpquery.path", "Path to smpquery").Default("smpquery").String()
+	smpqueryTimeout       = kingpin.Flag("smpquery.timeout", "Timeout for smpquery execution").Default("5s").Duration()
+	smpqueryMaxConcurrent = kingpin.Flag("smpquery.max-concurrent", "Max number of concurrent smpquery executions").Default("1").Int()
+	SmpqueryExec          = smpquery
+	// Values defined by the InfiniBand specification PortInfo attribute
+	portLogicalStates = map[string]float64{
+		"Down":       1,
+		"Initialize": 2,
+		"Armed":      3,
+		"Active":     4,
+	}
+	portPhysicalStates = map[string]float64{
+		"Sleep":                     1,
+		"Polling":                   2,
+		"Disabled":                  3,
+		"PortConfigurationTraining": 4,
+		"LinkUp":                    5,
+		"LinkErrorRecovery":         6,
+		"PhyTest":                   7,
+	}
+	vlCapPattern = regexp.MustCompile(`^VL0(-([0-9]+))?$`)
+)
+
+type PortinfoCollector struct {
+	devices         *[]InfinibandDevice
+	logger          log.Logger
+	collector       string
+	Duration        *prometheus.Desc
+	Error           *prometheus.Desc
+	Timeout         *prometheus.Desc
+	State           *prometheus.Desc
+	PhysicalState   *prometheus.Desc
+	StateInfo       *prometheus.Desc
+	LinkWidthInfo   *prometheus.Desc
+	LinkWidthActive *prometheus.Desc
+	LinkSpeedInfo   *prometheus.Desc
+	LinkSpeedActive *prometheus.Desc
+	MTU             *prometheus.Desc
+	MTUCapability   *prometheus.Desc
+	VLCapability    *prometheus.Desc
+}
+
+type Portinfo struct {
+	device             InfinibandDevice
+	Port               string
+	LinkState          string
+	PhysLinkState      string
+	LinkDownDefState   string
+	LinkWidthEnabled   string
+	LinkWidthSupported string
+	LinkWidthActive    string
+	LinkSpeedEnabled   string
+	LinkSpeedSupported string
+	LinkSpeedActive    string
+	NeighborMTU        float64
+	MtuCap             float64
+	VLCap              float64
+}
+
+type PortinfoMetrics struct {
+	duration float64
+	timeout  float64
+	error    float64
+}
+
+func NewPortinfoCollector(devices *[]InfinibandDevice, runonce bool, logger log.Logger) *PortinfoCollector {
+	labels := []string{"guid", "port"}
+	collector := "portinfo"
+	if runonce {
+		collector = "portinfo-runonce"
+	}
+	return &PortinfoCollector{
+		devices:   devices,
+		logger:    log.With(logger, "collector", collector),
+		collector: collector,
+		Duration: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_duration_seconds"),
+			"Duration of collection", []string{"guid", "collector"}, nil),
+		Error: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_error"),
+			"Indicates if collect error", []string{"guid", "collector"}, nil),
+		Timeout: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_timeout"),
+			"Indicates if collect timeout", []string{"guid", "collector"}, nil),
+		State: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_state"),
+			"Infiniband switch port logical state, 1=Down 2=Init 3=Armed 4=Active", labels, nil),
+		PhysicalState: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_physical_state"),
+			"Infiniband switch port physical state, 1=Sleep 2=Polling 3=Disabled 4=PortConfigurationTraining 5=LinkUp 6=LinkErrorRecovery 7=PhyTest", labels, nil),
+		StateInfo: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_state_info"),
+			"Infiniband switch port state information", append(labels, "state", "physical_state", "link_down_default"), nil),
+		LinkWidthInfo: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_link_width_info"),
+			"Infiniband switch port link width information", append(labels, "enabled", "supported", "active"), nil),
+		LinkWidthActive: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_link_width_active_lanes"),
+			"Infiniband switch port active link width in lanes", labels, nil),
+		LinkSpeedInfo: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_link_speed_info"),
+			"Infiniband switch port link speed information", append(labels, "enabled", "supported", "active"), nil),
+		LinkSpeedActive: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_link_speed_active_gbps"),
+			"Infiniband switch port active lane speed in Gbps", labels, nil),
+		MTU: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_mtu_bytes"),
+			"Infiniband switch port active MTU", labels, nil),
+		MTUCapability: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_mtu_capability_bytes"),
+			"Infiniband switch port MTU capability", labels, nil),
+		VLCapability: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_vl_capability"),
+			"Infiniband switch port number of data virtual lanes supported", labels, nil),
+	}
+}
+
+func (p *PortinfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	// Do not describe as will conflict with switch but label set is unique
+	// ch <- p.Duration
+	// ch <- p.Error
+	// ch <- p.Timeout
+	ch <- p.State
+	ch <- p.PhysicalState
+	ch <- p.StateInfo
+	ch <- p.LinkWidthInfo
+	ch <- p.LinkWidthActive
+	ch <- p.LinkSpeedInfo
+	ch <- p.LinkSpeedActive
+	ch <- p.MTU
+	ch <- p.MTUCapability
+	ch <- p.VLCapability
+}
+
+func (p *PortinfoCollector) Collect(ch chan<- prometheus.Metric) {
+	collectTime := time.Now()
+	portinfos, metrics, errors, timeouts := p.collect()
+	for _, pi := range portinfos {
+		guid := pi.device.GUID
+		if val, ok := portLogicalStates[pi.LinkState]; ok {
+			ch <- prometheus.MustNewConstMetric(p.State, prometheus.GaugeValue, val, guid, pi.Port)
+		}
+		if val, ok := portPhysicalStates[pi.PhysLinkState]; ok {
+			ch <- prometheus.MustNewConstMetric(p.PhysicalState, prometheus.GaugeValue, val, guid, pi.Port)
+		}
+		ch <- prometheus.MustNewConstMetric(p.StateInfo, prometheus.GaugeValue, 1, guid, pi.Port, pi.LinkState, pi.PhysLinkState, pi.LinkDownDefState)
+		ch <- prometheus.MustNewConstMetric(p.LinkWidthInfo, prometheus.GaugeValue, 1, guid, pi.Port, pi.LinkWidthEnabled, pi.LinkWidthSupported, pi.LinkWidthActive)
+		ch <- prometheus.MustNewConstMetric(p.LinkSpeedInfo, prometheus.GaugeValue, 1, guid, pi.Port, pi.LinkSpeedEnabled, pi.LinkSpeedSupported, pi.LinkSpeedActive)
+		if val := parseLinkWidth(pi.LinkWidthActive); !math.IsNaN(val) {
+			ch <- prometheus.MustNewConstMetric(p.LinkWidthActive, prometheus.GaugeValue, val, guid, pi.Port)
+		}
+		if val := parseLinkSpeed(pi.LinkSpeedActive); !math.IsNaN(val) {
+			ch <- prometheus.MustNewConstMetric(p.LinkSpeedActive, prometheus.GaugeValue, val, guid, pi.Port)
+		}
+		if !math.IsNaN(pi.NeighborMTU) {
+			ch <- prometheus.MustNewConstMetric(p.MTU, prometheus.GaugeValue, pi.NeighborMTU, guid, pi.Port)
+		}
+		if !math.IsNaN(pi.MtuCap) {
+			ch <- prometheus.MustNewConstMetric(p.MTUCapability, prometheus.GaugeValue, pi.MtuCap, guid, pi.Port)
+		}
+		if !math.IsNaN(pi.VLCap) {
+			ch <- prometheus.MustNewConstMetric(p.VLCapability, prometheus.GaugeValue, pi.VLCap, guid, pi.Port)
+		}
+	}
+	for _, device := range *p.devices {
+		metric := metrics[device.GUID]
+		ch <- prometheus.MustNewConstMetric(p.Duration, prometheus.GaugeValue, metric.duration, device.GUID, p.collector)
+		ch <- prometheus.MustNewConstMetric(p.Timeout, prometheus.GaugeValue, metric.timeout, device.GUID, p.collector)
+		ch <- prometheus.MustNewConstMetric(p.Error, prometheus.GaugeValue, metric.error, device.GUID, p.collector)
+	}
+	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, errors, p.collector)
+	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, timeouts, p.collector)
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), p.collector)
+	if strings.HasSuffix(p.collector, "-runonce") {
+		ch <- prometheus.MustNewConstMetric(lastExecution, prometheus.GaugeValue, float64(time.Now().Unix()), p.collector)
+	}
+}
+
+func (p *PortinfoCollector) collect() ([]Portinfo, map[string]PortinfoMetrics, float64, float64) {
+	var portinfos []Portinfo
+	metrics := make(map[string]PortinfoMetrics)
+	var portinfosLock sync.Mutex
+	var errors, timeouts float64
+	limit := make(chan int, *smpqueryMaxConcurrent)
+	wg := &sync.WaitGroup{}
+	for _, device := range *p.devices {
+		limit <- 1
+		wg.Add(1)
+		go func(device InfinibandDevice) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			start := time.Now()
+			devicePortinfos, err := p.collectDevice(device)
+			metric := PortinfoMetrics{duration: time.Since(start).Seconds()}
+			portinfosLock.Lock()
+			defer portinfosLock.Unlock()
+			if err == context.DeadlineExceeded {
+				metric.timeout = 1
+				level.Error(p.logger).Log("msg", "Timeout collecting portinfo", "guid", device.GUID, "lid", device.LID)
+				timeouts++
+			} else if err != nil {
+				metric.error = 1
+				level.Error(p.logger).Log("msg", "Error collecting portinfo", "err", err, "guid", device.GUID, "lid", device.LID)
+				errors++
+			}
+			portinfos = append(portinfos, devicePortinfos...)
+			metrics[device.GUID] = metric
+		}(device)
+	}
+	wg.Wait()
+	close(limit)
+	return portinfos, metrics, errors, timeouts
+}
+
+// collectDevice queries nodeinfo for the number of ports then portinfo of every port
+func (p *PortinfoCollector) collectDevice(device InfinibandDevice) ([]Portinfo, error) {
+	var portinfos []Portinfo
+	ctx, cancel := context.WithTimeout(context.Background(), *smpqueryTimeout)
+	defer cancel()
+	out, err := SmpqueryExec("nodeinfo", device.LID, "", withDevice(ctx, device.GUID))
+	if err != nil {
+		return nil, err
+	}
+	numPorts, err := nodeinfoNumPorts(out)
+	if err != nil {
+		return nil, err
+	}
+	for port := 1; port <= numPorts; port++ {
+		ctxPort, cancelPort := context.WithTimeout(context.Background(), *smpqueryTimeout)
+		out, err := SmpqueryExec("portinfo", device.LID, strconv.Itoa(port), withDevice(ctxPort, device.GUID))
+		cancelPort()
+		if err != nil {
+			return portinfos, err
+		}
+		portinfo, err := portinfoParse(out)
+		if err != nil {
+			return portinfos, err
+		}
+		portinfo.device = device
+		portinfo.Port = strconv.Itoa(port)
+		portinfos = append(portinfos, portinfo)
+	}
+	return portinfos, nil
+}
+
+func smpqueryFields(out string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		items := strings.SplitN(line, ":", 2)
+		if len(items) != 2 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields[items[0]] = strings.TrimLeft(items[1], ".")
+	}
+	return fields
+}
+
+func nodeinfoNumPorts(out string) (int, error) {
+	fields := smpqueryFields(out)
+	numPorts, ok := fields["NumPorts"]
+	if !ok {
+		return 0, fmt.Errorf("NumPorts not found in nodeinfo")
+	}
+	return strconv.Atoi(numPorts)
+}
+
+func portinfoParse(out string) (Portinfo, error) {
+	fields := smpqueryFields(out)
+	portinfo := Portinfo{
+		LinkState:          fields["LinkState"],
+		PhysLinkState:      fields["PhysLinkState"],
+		LinkDownDefState:   fields["LinkDownDefState"],
+		LinkWidthEnabled:   fields["LinkWidthEnabled"],
+		LinkWidthSupported: fields["LinkWidthSupported"],
+		LinkWidthActive:    fields["LinkWidthActive"],
+		LinkSpeedEnabled:   fields["LinkSpeedEnabled"],
+		LinkSpeedSupported: fields["LinkSpeedSupported"],
+		LinkSpeedActive:    fields["LinkSpeedActive"],
+		NeighborMTU:        math.NaN(),
+		MtuCap:             math.NaN(),
+		VLCap:              math.NaN(),
+	}
+	if portinfo.LinkState == "" {
+		return portinfo, fmt.Errorf("LinkState not found in portinfo")
+	}
+	// Extended speeds (FDR and faster) are reported separately and take precedence when active
+	if active, ok := fields["LinkSpeedExtActive"]; ok && !math.IsNaN(parseLinkSpeed(active)) {
+		portinfo.LinkSpeedActive = active
+		portinfo.LinkSpeedEnabled = joinSpeeds(portinfo.LinkSpeedEnabled, fields["LinkSpeedExtEnabled"])
+		portinfo.LinkSpeedSupported = joinSpeeds(portinfo.LinkSpeedSupported, fields["LinkSpeedExtSupported"])
+	}
+	if val, err := strconv.ParseFloat(fields["NeighborMTU"], 64); err == nil {
+		portinfo.NeighborMTU = val
+	}
+	if val, err := strconv.ParseFloat(fields["MtuCap"], 64); err == nil {
+		portinfo.MtuCap = val
+	}
+	if matches := vlCapPattern.FindStringSubmatch(fields["VLCap"]); matches != nil {
+		val, _ := strconv.ParseFloat(matches[2], 64)
+		portinfo.VLCap = val + 1
+	}
+	return portinfo, nil
+}
+
+func joinSpeeds(speeds ...string) string {
+	var all []string
+	seen := make(map[string]bool)
+	for _, s := range speeds {
+		for _, speed := range strings.Split(s, " or ") {
+			speed = strings.TrimSpace(speed)
+			if math.IsNaN(parseLinkSpeed(speed)) || seen[speed] {
+				continue
+			}
+			seen[speed] = true
+			all = append(all, speed)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return parseLinkSpeed(all[i]) < parseLinkSpeed(all[j])
+	})
+	return strings.Join(all, " or ")
+}
+
+// parseLinkWidth converts width such as 4X to number of lanes
+func parseLinkWidth(width string) float64 {
+	val, err := strconv.ParseFloat(strings.TrimSuffix(width, "X"), 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return val
+}
+
+// parseLinkSpeed converts speed such as 25.78125 Gbps to Gbps
+func parseLinkSpeed(speed string) float64 {
+	items := strings.Fields(speed)
+	if len(items) != 2 || items[1] != "Gbps" {
+		return math.NaN()
+	}
+	val, err := strconv.ParseFloat(items[0], 64)
+	if err != nil || val == 0 {
+		return math.NaN()
+	}
+	return val
+}
+
+func smpqueryArgs(query string, lid string, port string) (string, []string) {
+	var command string
+	var args []string
+	if *useSudo {
+		command = "sudo"
+		args = []string{*smpqueryPath}
+	} else {
+		command = *smpqueryPath
+	}
+	args = append(args, query, lid)
+	if port != "" {
+		args = append(args, port)
+	}
+	return command, args
+}
+
+func smpquery(query string, lid string, port string, ctx context.Context) (string, error) {
+	command, args := smpqueryArgs(query, lid, port)
+	return runCommand(ctx, lid, command, args)
+}
@@ -0,0 +1,298 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func SetSmpqueryExec(t *testing.T, setErr bool, timeout bool) {
+	SmpqueryExec = func(query string, lid string, port string, ctx context.Context) (string, error) {
+		if setErr {
+			return "", fmt.Errorf("Error")
+		}
+		if timeout {
+			return "", context.DeadlineExceeded
+		}
+		name := fmt.Sprintf("%s-%s", query, lid)
+		if port != "" {
+			name = fmt.Sprintf("%s-%s", name, port)
+		}
+		out, err := ReadFixture("smpquery", name)
+		if err != nil {
+			t.Fatal(err.Error())
+			return "", err
+		}
+		return out, nil
+	}
+}
+
+func TestPortinfoParse(t *testing.T) {
+	out, err := ReadFixture("smpquery", "portinfo-2052-1")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	data, err := portinfoParse(out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if data.LinkState != "Active" || data.PhysLinkState != "LinkUp" || data.LinkDownDefState != "Polling" {
+		t.Errorf("Unexpected state, got %v", data)
+	}
+	if data.LinkWidthActive != "4X" || data.LinkWidthEnabled != "1X or 4X" {
+		t.Errorf("Unexpected width, got %v", data)
+	}
+	if data.LinkSpeedActive != "25.78125 Gbps" {
+		t.Errorf("Unexpected speed active, got %s", data.LinkSpeedActive)
+	}
+	if data.LinkSpeedEnabled != "2.5 Gbps or 5.0 Gbps or 10.0 Gbps or 14.0625 Gbps or 25.78125 Gbps" {
+		t.Errorf("Unexpected speed enabled, got %s", data.LinkSpeedEnabled)
+	}
+	if data.NeighborMTU != 4096 || data.MtuCap != 4096 || data.VLCap != 8 {
+		t.Errorf("Unexpected MTU or VLCap, got %v", data)
+	}
+	out, err = ReadFixture("smpquery", "portinfo-1719-2")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	data, err = portinfoParse(out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if data.LinkSpeedActive != "2.5 Gbps" || data.VLCap != 1 {
+		t.Errorf("Unexpected speed or VLCap, got %v", data)
+	}
+	out, err = ReadFixture("smpquery", "portinfo-err")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	if _, err = portinfoParse(out); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestNodeinfoNumPorts(t *testing.T) {
+	out, err := ReadFixture("smpquery", "nodeinfo-1719")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	numPorts, err := nodeinfoNumPorts(out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if numPorts != 3 {
+		t.Errorf("Unexpected NumPorts, got %d", numPorts)
+	}
+	if _, err := nodeinfoNumPorts("foo"); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestParseLinkSpeed(t *testing.T) {
+	if val := parseLinkSpeed("25.78125 Gbps"); val != 25.78125 {
+		t.Errorf("Unexpected speed, got %f", val)
+	}
+	if val := parseLinkSpeed("No Extended Speed"); !math.IsNaN(val) {
+		t.Errorf("Unexpected speed, got %f", val)
+	}
+	if val := parseLinkSpeed("0 Gbps"); !math.IsNaN(val) {
+		t.Errorf("Unexpected speed, got %f", val)
+	}
+}
+
+func TestPortinfoCollector(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	SetSmpqueryExec(t, false, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="portinfo"} 0
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="portinfo"} 0
+		# HELP infiniband_switch_collect_error Indicates if collect error
+		# TYPE infiniband_switch_collect_error gauge
+		infiniband_switch_collect_error{collector="portinfo",guid="0x506b4b03005c2740"} 0
+		infiniband_switch_collect_error{collector="portinfo",guid="0x7cfe9003009ce5b0"} 0
+		# HELP infiniband_switch_port_link_speed_active_gbps Infiniband switch port active lane speed in Gbps
+		# TYPE infiniband_switch_port_link_speed_active_gbps gauge
+		infiniband_switch_port_link_speed_active_gbps{guid="0x506b4b03005c2740",port="1"} 25.78125
+		infiniband_switch_port_link_speed_active_gbps{guid="0x506b4b03005c2740",port="2"} 2.5
+		infiniband_switch_port_link_speed_active_gbps{guid="0x7cfe9003009ce5b0",port="1"} 25.78125
+		infiniband_switch_port_link_speed_active_gbps{guid="0x7cfe9003009ce5b0",port="2"} 2.5
+		infiniband_switch_port_link_speed_active_gbps{guid="0x7cfe9003009ce5b0",port="3"} 14.0625
+		# HELP infiniband_switch_port_link_width_active_lanes Infiniband switch port active link width in lanes
+		# TYPE infiniband_switch_port_link_width_active_lanes gauge
+		infiniband_switch_port_link_width_active_lanes{guid="0x506b4b03005c2740",port="1"} 4
+		infiniband_switch_port_link_width_active_lanes{guid="0x506b4b03005c2740",port="2"} 4
+		infiniband_switch_port_link_width_active_lanes{guid="0x7cfe9003009ce5b0",port="1"} 4
+		infiniband_switch_port_link_width_active_lanes{guid="0x7cfe9003009ce5b0",port="2"} 1
+		infiniband_switch_port_link_width_active_lanes{guid="0x7cfe9003009ce5b0",port="3"} 4
+		# HELP infiniband_switch_port_mtu_bytes Infiniband switch port active MTU
+		# TYPE infiniband_switch_port_mtu_bytes gauge
+		infiniband_switch_port_mtu_bytes{guid="0x506b4b03005c2740",port="1"} 4096
+		infiniband_switch_port_mtu_bytes{guid="0x506b4b03005c2740",port="2"} 256
+		infiniband_switch_port_mtu_bytes{guid="0x7cfe9003009ce5b0",port="1"} 4096
+		infiniband_switch_port_mtu_bytes{guid="0x7cfe9003009ce5b0",port="2"} 256
+		infiniband_switch_port_mtu_bytes{guid="0x7cfe9003009ce5b0",port="3"} 2048
+		# HELP infiniband_switch_port_physical_state Infiniband switch port physical state, 1=Sleep 2=Polling 3=Disabled 4=PortConfigurationTraining 5=LinkUp 6=LinkErrorRecovery 7=PhyTest
+		# TYPE infiniband_switch_port_physical_state gauge
+		infiniband_switch_port_physical_state{guid="0x506b4b03005c2740",port="1"} 5
+		infiniband_switch_port_physical_state{guid="0x506b4b03005c2740",port="2"} 2
+		infiniband_switch_port_physical_state{guid="0x7cfe9003009ce5b0",port="1"} 5
+		infiniband_switch_port_physical_state{guid="0x7cfe9003009ce5b0",port="2"} 3
+		infiniband_switch_port_physical_state{guid="0x7cfe9003009ce5b0",port="3"} 5
+		# HELP infiniband_switch_port_state Infiniband switch port logical state, 1=Down 2=Init 3=Armed 4=Active
+		# TYPE infiniband_switch_port_state gauge
+		infiniband_switch_port_state{guid="0x506b4b03005c2740",port="1"} 4
+		infiniband_switch_port_state{guid="0x506b4b03005c2740",port="2"} 1
+		infiniband_switch_port_state{guid="0x7cfe9003009ce5b0",port="1"} 4
+		infiniband_switch_port_state{guid="0x7cfe9003009ce5b0",port="2"} 1
+		infiniband_switch_port_state{guid="0x7cfe9003009ce5b0",port="3"} 2
+		# HELP infiniband_switch_port_state_info Infiniband switch port state information
+		# TYPE infiniband_switch_port_state_info gauge
+		infiniband_switch_port_state_info{guid="0x506b4b03005c2740",link_down_default="Polling",physical_state="LinkUp",port="1",state="Active"} 1
+		infiniband_switch_port_state_info{guid="0x506b4b03005c2740",link_down_default="Polling",physical_state="Polling",port="2",state="Down"} 1
+		infiniband_switch_port_state_info{guid="0x7cfe9003009ce5b0",link_down_default="Polling",physical_state="LinkUp",port="1",state="Active"} 1
+		infiniband_switch_port_state_info{guid="0x7cfe9003009ce5b0",link_down_default="Polling",physical_state="Disabled",port="2",state="Down"} 1
+		infiniband_switch_port_state_info{guid="0x7cfe9003009ce5b0",link_down_default="Polling",physical_state="LinkUp",port="3",state="Initialize"} 1
+		# HELP infiniband_switch_port_vl_capability Infiniband switch port number of data virtual lanes supported
+		# TYPE infiniband_switch_port_vl_capability gauge
+		infiniband_switch_port_vl_capability{guid="0x506b4b03005c2740",port="1"} 8
+		infiniband_switch_port_vl_capability{guid="0x506b4b03005c2740",port="2"} 8
+		infiniband_switch_port_vl_capability{guid="0x7cfe9003009ce5b0",port="1"} 8
+		infiniband_switch_port_vl_capability{guid="0x7cfe9003009ce5b0",port="2"} 1
+		infiniband_switch_port_vl_capability{guid="0x7cfe9003009ce5b0",port="3"} 8
+	`
+	collector := NewPortinfoCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 59 {
+		t.Errorf("Unexpected collection count %d, expected 59", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts",
+		"infiniband_switch_collect_error", "infiniband_switch_port_link_speed_active_gbps",
+		"infiniband_switch_port_link_width_active_lanes", "infiniband_switch_port_mtu_bytes",
+		"infiniband_switch_port_physical_state", "infiniband_switch_port_state",
+		"infiniband_switch_port_state_info", "infiniband_switch_port_vl_capability"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestPortinfoCollectorError(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	SetSmpqueryExec(t, true, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="portinfo-runonce"} 2
+		# HELP infiniband_switch_collect_error Indicates if collect error
+		# TYPE infiniband_switch_collect_error gauge
+		infiniband_switch_collect_error{collector="portinfo-runonce",guid="0x506b4b03005c2740"} 1
+		infiniband_switch_collect_error{collector="portinfo-runonce",guid="0x7cfe9003009ce5b0"} 1
+	`
+	collector := NewPortinfoCollector(&switchDevices, true, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 10 {
+		t.Errorf("Unexpected collection count %d, expected 10", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_switch_collect_error"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestPortinfoCollectorTimeout(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	SetSmpqueryExec(t, false, true)
+	expected := `
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="portinfo"} 2
+		# HELP infiniband_switch_collect_timeout Indicates if collect timeout
+		# TYPE infiniband_switch_collect_timeout gauge
+		infiniband_switch_collect_timeout{collector="portinfo",guid="0x506b4b03005c2740"} 1
+		infiniband_switch_collect_timeout{collector="portinfo",guid="0x7cfe9003009ce5b0"} 1
+	`
+	collector := NewPortinfoCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_timeouts", "infiniband_switch_collect_timeout"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestSmpqueryArgs(t *testing.T) {
+	command, args := smpqueryArgs("portinfo", "1719", "1")
+	if command != "smpquery" {
+		t.Errorf("Unexpected command, got: %s", command)
+	}
+	expectedArgs := []string{"portinfo", "1719", "1"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Unexpected args\nExpected\n%v\nGot\n%v", expectedArgs, args)
+	}
+	trueValue := true
+	falseValue := false
+	useSudo = &trueValue
+	defer func() { useSudo = &falseValue }()
+	command, args = smpqueryArgs("nodeinfo", "1719", "")
+	if command != "sudo" {
+		t.Errorf("Unexpected command, got: %s", command)
+	}
+	expectedArgs = []string{"smpquery", "nodeinfo", "1719"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Unexpected args\nExpected\n%v\nGot\n%v", expectedArgs, args)
+	}
+}
+
+func TestSmpquery(t *testing.T) {
+	execCommand = fakeExecCommand
+	mockedExitStatus = 0
+	mockedStdout = "foo"
+	defer func() { execCommand = exec.CommandContext }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := smpquery("portinfo", "1", "1", ctx)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if out != mockedStdout {
+		t.Errorf("Unexpected out: %s", out)
+	}
+	mockedExitStatus = 1
+	if _, err := smpquery("portinfo", "1", "1", ctx); err == nil {
+		t.Errorf("Expected error")
+	}
+}
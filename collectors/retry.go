@@ -0,0 +1,205 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	retries         = kingpin.Flag("exporter.retries", "Number of times to retry perfquery and ibswinfo after a timeout").Default("0").Int()
+	retryBackoff    = kingpin.Flag("exporter.retry-backoff", "Initial backoff between retries, doubled for each retry with jitter").Default("500ms").Duration()
+	retryBudget     = kingpin.Flag("exporter.retry-budget", "Total time allowed to collect a device including retries, 0 disables").Default("0s").Duration()
+	breakerFailures = kingpin.Flag("exporter.breaker-failures", "Consecutive failed collections before a device is skipped, 0 disables").Default("0").Int()
+	breakerCycles   = kingpin.Flag("exporter.breaker-cycles", "Number of collections to skip a device once it has failed too often").Default("5").Int()
+	retrySleep      = time.Sleep
+	retryCounts     = newDeviceCounter()
+	breakers        = newCircuitBreakers()
+	collectRetries  = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "collect_retries_total"),
+		"Number of times collecting a device was retried",
+		[]string{"collector", "guid"}, nil)
+	breakerOpen = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "circuit_breaker_open"),
+		"Indicates the device is skipped because collection repeatedly failed",
+		[]string{"collector", "guid"}, nil)
+)
+
+// deviceRetry tracks the retries and time budget of collecting one device
+type deviceRetry struct {
+	collector string
+	guid      string
+	start     time.Time
+}
+
+type deviceKey struct {
+	collector string
+	guid      string
+}
+
+type deviceCounter struct {
+	sync.Mutex
+	counts map[deviceKey]float64
+}
+
+type breakerState struct {
+	failures int
+	skip     int
+	open     bool
+	// tripped is set once the breaker has opened so a failed half-open probe re-opens it
+	tripped bool
+}
+
+type circuitBreakers struct {
+	sync.Mutex
+	states map[deviceKey]*breakerState
+}
+
+func newDeviceRetry(collector string, guid string) *deviceRetry {
+	return &deviceRetry{collector: collector, guid: guid, start: time.Now()}
+}
+
+// run executes f until it succeeds or fails with an error that is not transient
+func (r *deviceRetry) run(timeout time.Duration, f func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		attemptTimeout := timeout
+		if *retryBudget > 0 {
+			remaining := *retryBudget - time.Since(r.start)
+			if remaining <= 0 {
+				if err == nil {
+					err = context.DeadlineExceeded
+				}
+				return err
+			}
+			if remaining < attemptTimeout {
+				attemptTimeout = remaining
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), attemptTimeout)
+		err = f(withDevice(ctx, r.guid))
+		cancel()
+		if err == nil || attempt >= *retries || !retryable(err) {
+			return err
+		}
+		backoff := retryBackoffDuration(attempt)
+		if *retryBudget > 0 && time.Since(r.start)+backoff >= *retryBudget {
+			return err
+		}
+		retryCounts.add(r.collector, r.guid)
+		retrySleep(backoff)
+	}
+}
+
+func retryable(err error) bool {
+	switch classifyError(err) {
+	case reasonTimeout, reasonMADTimeout:
+		return true
+	}
+	return false
+}
+
+// retryBackoffDuration doubles the backoff for each attempt and adds up to 50% jitter either way
+func retryBackoffDuration(attempt int) time.Duration {
+	backoff := *retryBackoff << attempt
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+func newDeviceCounter() *deviceCounter {
+	return &deviceCounter{counts: make(map[deviceKey]float64)}
+}
+
+func (d *deviceCounter) add(collector string, guid string) {
+	d.Lock()
+	defer d.Unlock()
+	d.counts[deviceKey{collector: collector, guid: guid}]++
+}
+
+func (d *deviceCounter) collect(ch chan<- prometheus.Metric, desc *prometheus.Desc, collector string) {
+	d.Lock()
+	defer d.Unlock()
+	for key, count := range d.counts {
+		if key.collector == collector {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, count, key.collector, key.guid)
+		}
+	}
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{states: make(map[deviceKey]*breakerState)}
+}
+
+// skip returns true if the device should not be collected this cycle
+func (c *circuitBreakers) skip(collector string, guid string) bool {
+	c.Lock()
+	defer c.Unlock()
+	state, ok := c.states[deviceKey{collector: collector, guid: guid}]
+	if !ok {
+		return false
+	}
+	state.open = state.skip > 0
+	if state.open {
+		state.skip--
+	}
+	return state.open
+}
+
+// result records the outcome of collecting a device and opens the breaker after too many failures
+func (c *circuitBreakers) result(collector string, guid string, err error) {
+	if *breakerFailures <= 0 {
+		return
+	}
+	key := deviceKey{collector: collector, guid: guid}
+	c.Lock()
+	defer c.Unlock()
+	if err == nil {
+		delete(c.states, key)
+		return
+	}
+	state, ok := c.states[key]
+	if !ok {
+		state = &breakerState{}
+		c.states[key] = state
+	}
+	state.failures++
+	if state.failures >= *breakerFailures || state.tripped {
+		state.failures = 0
+		state.skip = *breakerCycles
+		state.tripped = true
+	}
+}
+
+func (c *circuitBreakers) collect(ch chan<- prometheus.Metric, collector string) {
+	c.Lock()
+	defer c.Unlock()
+	for key, state := range c.states {
+		if key.collector != collector {
+			continue
+		}
+		var open float64
+		if state.open {
+			open = 1
+		}
+		ch <- prometheus.MustNewConstMetric(breakerOpen, prometheus.GaugeValue, open, key.collector, key.guid)
+	}
+}
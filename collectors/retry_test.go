@@ -0,0 +1,173 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeviceRetryRun(t *testing.T) {
+	setupTest(t, []string{"--exporter.retries=2"})
+	var sleeps []time.Duration
+	retrySleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	calls := 0
+	err := newDeviceRetry("switch", "0x00").run(time.Second, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return context.DeadlineExceeded
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if calls != 3 || len(sleeps) != 2 {
+		t.Errorf("Unexpected calls %d and sleeps %v", calls, sleeps)
+	}
+	if val := retryCounts.counts[deviceKey{collector: "switch", guid: "0x00"}]; val != 2 {
+		t.Errorf("Unexpected retry count, got %f", val)
+	}
+	calls = 0
+	err = newDeviceRetry("switch", "0x00").run(time.Second, func(ctx context.Context) error {
+		calls++
+		return fmt.Errorf("Error")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("Expected error without retry, got %v after %d calls", err, calls)
+	}
+	calls = 0
+	err = newDeviceRetry("switch", "0x00").run(time.Second, func(ctx context.Context) error {
+		calls++
+		return &CommandError{Err: fmt.Errorf("exit status 1"), ExitCode: 1, Stderr: "ibwarn: _do_madrpc failed"}
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("Expected error after retries, got %v after %d calls", err, calls)
+	}
+}
+
+func TestDeviceRetryBudget(t *testing.T) {
+	setupTest(t, []string{"--exporter.retries=5", "--exporter.retry-budget=50ms", "--exporter.retry-backoff=1s"})
+	calls := 0
+	err := newDeviceRetry("switch", "0x00").run(time.Second, func(ctx context.Context) error {
+		calls++
+		deadline, _ := ctx.Deadline()
+		if time.Until(deadline) > 50*time.Millisecond {
+			t.Errorf("Expected timeout limited by budget, got %s", time.Until(deadline))
+		}
+		return context.DeadlineExceeded
+	})
+	if err != context.DeadlineExceeded || calls != 1 {
+		t.Errorf("Expected no retries past budget, got %v after %d calls", err, calls)
+	}
+	retry := newDeviceRetry("switch", "0x00")
+	retry.start = time.Now().Add(-time.Minute)
+	err = retry.run(time.Second, func(ctx context.Context) error {
+		t.Errorf("Unexpected call when budget is exhausted")
+		return nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestRetryBackoffDuration(t *testing.T) {
+	setupTest(t, []string{"--exporter.retry-backoff=100ms"})
+	for attempt := 0; attempt < 3; attempt++ {
+		backoff := 100 * time.Millisecond << attempt
+		if d := retryBackoffDuration(attempt); d < backoff/2 || d >= backoff*3/2 {
+			t.Errorf("Unexpected backoff for attempt %d, got %s", attempt, d)
+		}
+	}
+}
+
+func TestCircuitBreakers(t *testing.T) {
+	setupTest(t, []string{"--exporter.breaker-failures=2", "--exporter.breaker-cycles=2"})
+	err := fmt.Errorf("Error")
+	breakers.result("switch", "0x00", err)
+	if breakers.skip("switch", "0x00") {
+		t.Errorf("Unexpected skip after one failure")
+	}
+	breakers.result("switch", "0x00", err)
+	for i := 0; i < 2; i++ {
+		if !breakers.skip("switch", "0x00") {
+			t.Errorf("Expected skip %d", i)
+		}
+	}
+	if breakers.skip("switch", "0x00") {
+		t.Errorf("Unexpected skip after cycles")
+	}
+	// A failed probe after the skipped cycles re-opens the breaker immediately
+	breakers.result("switch", "0x00", err)
+	if !breakers.skip("switch", "0x00") {
+		t.Errorf("Expected skip after failed probe")
+	}
+	breakers.result("switch", "0x00", nil)
+	if _, ok := breakers.states[deviceKey{collector: "switch", guid: "0x00"}]; ok {
+		t.Errorf("Expected state removed after success")
+	}
+}
+
+func TestSwitchCollectorRetry(t *testing.T) {
+	setupTest(t, []string{"--exporter.retries=1", "--exporter.breaker-failures=1"})
+	SetPerfqueryExecs(t, false, false)
+	fixtureExec := PerfqueryExec
+	calls := make(map[string]int)
+	var callsLock sync.Mutex
+	PerfqueryExec = func(guid string, port string, extraArgs []string, ctx context.Context) (string, error) {
+		callsLock.Lock()
+		calls[guid]++
+		count := calls[guid]
+		callsLock.Unlock()
+		if guid == "0x7cfe9003009ce5b0" || count == 1 {
+			return "", context.DeadlineExceeded
+		}
+		return fixtureExec(guid, port, extraArgs, ctx)
+	}
+	expected := `
+		# HELP infiniband_exporter_circuit_breaker_open Indicates the device is skipped because collection repeatedly failed
+		# TYPE infiniband_exporter_circuit_breaker_open gauge
+		infiniband_exporter_circuit_breaker_open{collector="switch",guid="0x7cfe9003009ce5b0"} 1
+		# HELP infiniband_exporter_collect_retries_total Number of times collecting a device was retried
+		# TYPE infiniband_exporter_collect_retries_total counter
+		infiniband_exporter_collect_retries_total{collector="switch",guid="0x506b4b03005c2740"} 1
+		infiniband_exporter_collect_retries_total{collector="switch",guid="0x7cfe9003009ce5b0"} 1
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="switch"} 0
+	`
+	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if _, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if calls["0x506b4b03005c2740"] != 2 || calls["0x7cfe9003009ce5b0"] != 2 {
+		t.Errorf("Unexpected calls, got %v", calls)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_circuit_breaker_open", "infiniband_exporter_collect_retries_total",
+		"infiniband_exporter_collect_timeouts"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	if calls["0x506b4b03005c2740"] != 3 || calls["0x7cfe9003009ce5b0"] != 2 {
+		t.Errorf("Unexpected calls after breaker opened, got %v", calls)
+	}
+}
@@ -0,0 +1,471 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	routeMaxHops = 64
+)
+
+var (
+	CollectRoutes        = kingpin.Flag("collector.routes", "Enable the switch routing table collector using ibroute").Default("false").Bool()
+	ibroutePath          = kingpin.Flag("ibroute.path", "Path to ibroute").Default("ibroute").String()
+	ibrouteTimeout       = kingpin.Flag("ibroute.timeout", "Timeout for ibroute execution").Default("10s").Duration()
+	ibrouteMaxConcurrent = kingpin.Flag("ibroute.max-concurrent", "Max number of concurrent ibroute executions").Default("1").Int()
+	routesLFTFile        = kingpin.Flag("routes.lft-file", "Path to dump_lfts.sh output to read instead of executing ibroute").Default("").String()
+	IbrouteExec          = ibroute
+	ErrNodeNotFound      = errors.New("Node not found")
+	lftHeaderPattern     = regexp.MustCompile(`^Unicast lids .* guid (0x[0-9a-fA-F]+)`)
+	lftRoutePattern      = regexp.MustCompile(`^\s*0x([0-9a-fA-F]+)\s+([0-9]+)\s+:`)
+)
+
+// LinearForwardingTable maps destination LID to switch output port
+type LinearForwardingTable map[string]string
+
+type RoutesCollector struct {
+	devices    *[]InfinibandDevice
+	logger     log.Logger
+	collector  string
+	Duration   *prometheus.Desc
+	Error      *prometheus.Desc
+	Timeout    *prometheus.Desc
+	Routes     *prometheus.Desc
+	PortRoutes *prometheus.Desc
+	Imbalance  *prometheus.Desc
+}
+
+type RoutesMetrics struct {
+	duration float64
+	timeout  float64
+	error    float64
+}
+
+type RouteNode struct {
+	GUID string `json:"guid"`
+	Name string `json:"name"`
+	LID  string `json:"lid"`
+	Type string `json:"type"`
+}
+
+type RouteHop struct {
+	GUID    string `json:"guid"`
+	Name    string `json:"name"`
+	LID     string `json:"lid"`
+	InPort  string `json:"in_port"`
+	OutPort string `json:"out_port"`
+}
+
+type RoutePath struct {
+	Source      RouteNode  `json:"source"`
+	Destination RouteNode  `json:"destination"`
+	Hops        []RouteHop `json:"hops"`
+}
+
+// lftLoader reads switch forwarding tables from ibroute or once from --routes.lft-file
+type lftLoader struct {
+	tables map[string]LinearForwardingTable
+	err    error
+	logger log.Logger
+}
+
+func NewRoutesCollector(devices *[]InfinibandDevice, runonce bool, logger log.Logger) *RoutesCollector {
+	labels := []string{"guid"}
+	collector := "routes"
+	if runonce {
+		collector = "routes-runonce"
+	}
+	return &RoutesCollector{
+		devices:   devices,
+		logger:    log.With(logger, "collector", collector),
+		collector: collector,
+		Duration: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_duration_seconds"),
+			"Duration of collection", []string{"guid", "collector"}, nil),
+		Error: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_error"),
+			"Indicates if collect error", []string{"guid", "collector"}, nil),
+		Timeout: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_timeout"),
+			"Indicates if collect timeout", []string{"guid", "collector"}, nil),
+		Routes: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "routes"),
+			"Infiniband switch number of destination LIDs in the linear forwarding table", labels, nil),
+		PortRoutes: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_routes"),
+			"Infiniband switch port number of destination LIDs routed through the port", append(labels, "port", "direction"), nil),
+		Imbalance: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "route_imbalance_ratio"),
+			"Infiniband switch ratio of the maximum to the mean number of routes across ports connected to switches", labels, nil),
+	}
+}
+
+func (r *RoutesCollector) Describe(ch chan<- *prometheus.Desc) {
+	// Do not describe as will conflict with switch but label set is unique
+	// ch <- r.Duration
+	// ch <- r.Error
+	// ch <- r.Timeout
+	ch <- r.Routes
+	ch <- r.PortRoutes
+	ch <- r.Imbalance
+}
+
+func (r *RoutesCollector) Collect(ch chan<- prometheus.Metric) {
+	collectTime := time.Now()
+	tables, metrics, errors, timeouts := r.collect()
+	ranks := switchRanks(*r.devices)
+	for _, device := range *r.devices {
+		metric := metrics[device.GUID]
+		ch <- prometheus.MustNewConstMetric(r.Duration, prometheus.GaugeValue, metric.duration, device.GUID, r.collector)
+		ch <- prometheus.MustNewConstMetric(r.Timeout, prometheus.GaugeValue, metric.timeout, device.GUID, r.collector)
+		ch <- prometheus.MustNewConstMetric(r.Error, prometheus.GaugeValue, metric.error, device.GUID, r.collector)
+		lft, ok := tables[device.GUID]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(r.Routes, prometheus.GaugeValue, float64(len(lft)), device.GUID)
+		counts := routeCounts(device, lft)
+		for port, count := range counts {
+			ch <- prometheus.MustNewConstMetric(r.PortRoutes, prometheus.GaugeValue, count, device.GUID, port, routeDirection(device, port, ranks))
+		}
+		if ratio, ok := routeImbalance(device, counts); ok {
+			ch <- prometheus.MustNewConstMetric(r.Imbalance, prometheus.GaugeValue, ratio, device.GUID)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, errors, r.collector)
+	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, timeouts, r.collector)
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), r.collector)
+	if strings.HasSuffix(r.collector, "-runonce") {
+		ch <- prometheus.MustNewConstMetric(lastExecution, prometheus.GaugeValue, float64(time.Now().Unix()), r.collector)
+	}
+}
+
+func (r *RoutesCollector) collect() (map[string]LinearForwardingTable, map[string]RoutesMetrics, float64, float64) {
+	tables := make(map[string]LinearForwardingTable)
+	metrics := make(map[string]RoutesMetrics)
+	var tablesLock sync.Mutex
+	var errors, timeouts float64
+	loader := newLFTLoader(r.logger)
+	limit := make(chan int, *ibrouteMaxConcurrent)
+	wg := &sync.WaitGroup{}
+	for _, device := range *r.devices {
+		limit <- 1
+		wg.Add(1)
+		go func(device InfinibandDevice) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			start := time.Now()
+			lft, err := loader.load(device)
+			metric := RoutesMetrics{duration: time.Since(start).Seconds()}
+			tablesLock.Lock()
+			defer tablesLock.Unlock()
+			if err == context.DeadlineExceeded {
+				metric.timeout = 1
+				level.Error(r.logger).Log("msg", "Timeout collecting routes", "guid", device.GUID, "lid", device.LID)
+				timeouts++
+			} else if err != nil {
+				metric.error = 1
+				level.Error(r.logger).Log("msg", "Error collecting routes", "err", err, "guid", device.GUID, "lid", device.LID)
+				errors++
+			} else {
+				tables[device.GUID] = lft
+			}
+			metrics[device.GUID] = metric
+		}(device)
+	}
+	wg.Wait()
+	close(limit)
+	return tables, metrics, errors, timeouts
+}
+
+func newLFTLoader(logger log.Logger) *lftLoader {
+	loader := &lftLoader{logger: logger}
+	if *routesLFTFile != "" {
+		out, err := os.ReadFile(*routesLFTFile)
+		if err != nil {
+			loader.err = err
+		} else {
+			loader.tables = lftParse(string(out), logger)
+		}
+	}
+	return loader
+}
+
+func (l *lftLoader) load(device InfinibandDevice) (LinearForwardingTable, error) {
+	tables := l.tables
+	if *routesLFTFile != "" {
+		if l.err != nil {
+			return nil, l.err
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), *ibrouteTimeout)
+		defer cancel()
+		out, err := IbrouteExec(device.LID, withDevice(ctx, device.GUID))
+		if err != nil {
+			return nil, err
+		}
+		tables = lftParse(out, l.logger)
+	}
+	lft, ok := tables[device.GUID]
+	if !ok {
+		return nil, fmt.Errorf("No forwarding table found for switch %s", device.GUID)
+	}
+	return lft, nil
+}
+
+// lftParse parses ibroute output, dump_lfts.sh output is multiple ibroute outputs
+func lftParse(out string, logger log.Logger) map[string]LinearForwardingTable {
+	tables := make(map[string]LinearForwardingTable)
+	var lft LinearForwardingTable
+	for _, line := range strings.Split(out, "\n") {
+		if matches := lftHeaderPattern.FindStringSubmatch(line); matches != nil {
+			guid, err := normalizeGUID(matches[1])
+			if err != nil {
+				level.Error(logger).Log("msg", "Unable to parse switch GUID", "line", line, "err", err)
+				lft = nil
+				continue
+			}
+			lft = make(LinearForwardingTable)
+			tables[guid] = lft
+			continue
+		}
+		matches := lftRoutePattern.FindStringSubmatch(line)
+		if matches == nil || lft == nil {
+			continue
+		}
+		lid, err := strconv.ParseUint(matches[1], 16, 16)
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to parse LID", "line", line, "err", err)
+			continue
+		}
+		port, err := strconv.Atoi(matches[2])
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to parse port", "line", line, "err", err)
+			continue
+		}
+		lft[strconv.FormatUint(lid, 10)] = strconv.Itoa(port)
+	}
+	return tables
+}
+
+// routeCounts returns the number of destinations per port, connected ports without routes are included
+func routeCounts(device InfinibandDevice, lft LinearForwardingTable) map[string]float64 {
+	counts := make(map[string]float64)
+	for port := range device.Uplinks {
+		counts[port] = 0
+	}
+	for _, port := range lft {
+		// Port 0 is the switch itself
+		if port == "0" {
+			continue
+		}
+		counts[port]++
+	}
+	return counts
+}
+
+// switchRanks returns the number of hops from each switch to the nearest HCA, leaf switches have rank 0
+func switchRanks(switches []InfinibandDevice) map[string]int {
+	ranks := make(map[string]int)
+	neighbors := make(map[string][]string)
+	var queue []string
+	for _, device := range switches {
+		for _, uplink := range device.Uplinks {
+			if uplink.Type == "SW" {
+				neighbors[device.GUID] = append(neighbors[device.GUID], uplink.GUID)
+				neighbors[uplink.GUID] = append(neighbors[uplink.GUID], device.GUID)
+			} else if _, ok := ranks[device.GUID]; !ok {
+				ranks[device.GUID] = 0
+				queue = append(queue, device.GUID)
+			}
+		}
+	}
+	for len(queue) > 0 {
+		guid := queue[0]
+		queue = queue[1:]
+		for _, neighbor := range neighbors[guid] {
+			if _, ok := ranks[neighbor]; !ok {
+				ranks[neighbor] = ranks[guid] + 1
+				queue = append(queue, neighbor)
+			}
+		}
+	}
+	return ranks
+}
+
+// routeDirection treats ports leading away from the HCAs as up and ports leading towards the HCAs as down
+func routeDirection(device InfinibandDevice, port string, ranks map[string]int) string {
+	uplink, ok := device.Uplinks[port]
+	if !ok {
+		return "unknown"
+	}
+	if uplink.Type != "SW" {
+		return "down"
+	}
+	rank, ok := ranks[device.GUID]
+	remoteRank, remoteOk := ranks[uplink.GUID]
+	switch {
+	case !ok || !remoteOk:
+		return "unknown"
+	case remoteRank > rank:
+		return "up"
+	case remoteRank < rank:
+		return "down"
+	}
+	return "lateral"
+}
+
+// routeImbalance compares the number of routes across the ports connected to other switches
+func routeImbalance(device InfinibandDevice, counts map[string]float64) (float64, bool) {
+	var total, max, ports float64
+	for port, count := range counts {
+		if uplink, ok := device.Uplinks[port]; !ok || uplink.Type != "SW" {
+			continue
+		}
+		ports++
+		total += count
+		if count > max {
+			max = count
+		}
+	}
+	if ports == 0 || total == 0 {
+		return 0, false
+	}
+	return max / (total / ports), true
+}
+
+// TracePath follows the forwarding tables hop by hop from src to dst
+func TracePath(switches *[]InfinibandDevice, hcas *[]InfinibandDevice, src string, dst string, logger log.Logger) (RoutePath, error) {
+	var path RoutePath
+	devices := make(map[string]InfinibandDevice)
+	for _, device := range *switches {
+		devices[device.GUID] = device
+	}
+	for _, device := range *hcas {
+		devices[device.GUID] = device
+	}
+	srcDevice, err := findRouteNode(devices, src)
+	if err != nil {
+		return path, err
+	}
+	dstDevice, err := findRouteNode(devices, dst)
+	if err != nil {
+		return path, err
+	}
+	path.Source = RouteNode{GUID: srcDevice.GUID, Name: srcDevice.Name, LID: srcDevice.LID, Type: srcDevice.Type}
+	path.Destination = RouteNode{GUID: dstDevice.GUID, Name: dstDevice.Name, LID: dstDevice.LID, Type: dstDevice.Type}
+	path.Hops = []RouteHop{}
+	if srcDevice.GUID == dstDevice.GUID {
+		return path, nil
+	}
+	current := srcDevice
+	var inPort string
+	if srcDevice.Type != "SW" {
+		ports := getDevicePorts(srcDevice.Uplinks)
+		sort.Strings(ports)
+		if len(ports) == 0 {
+			return path, fmt.Errorf("Node %s has no uplink", srcDevice.GUID)
+		}
+		uplink := srcDevice.Uplinks[ports[0]]
+		next, ok := devices[uplink.GUID]
+		if !ok {
+			return path, fmt.Errorf("Switch %s not found in topology", uplink.GUID)
+		}
+		current = next
+		inPort = uplink.PortNumber
+	}
+	loader := newLFTLoader(logger)
+	for i := 0; i < routeMaxHops; i++ {
+		lft, err := loader.load(current)
+		if err != nil {
+			return path, err
+		}
+		outPort, ok := lft[dstDevice.LID]
+		if !ok {
+			return path, fmt.Errorf("No route to LID %s on switch %s", dstDevice.LID, current.GUID)
+		}
+		path.Hops = append(path.Hops, RouteHop{GUID: current.GUID, Name: current.Name, LID: current.LID, InPort: inPort, OutPort: outPort})
+		if outPort == "0" {
+			if current.GUID == dstDevice.GUID {
+				return path, nil
+			}
+			return path, fmt.Errorf("Switch %s routes LID %s to itself", current.GUID, dstDevice.LID)
+		}
+		uplink, ok := current.Uplinks[outPort]
+		if !ok {
+			return path, fmt.Errorf("Switch %s port %s is not connected", current.GUID, outPort)
+		}
+		if uplink.GUID == dstDevice.GUID {
+			return path, nil
+		}
+		if uplink.Type != "SW" {
+			return path, fmt.Errorf("Switch %s port %s leads to %s", current.GUID, outPort, uplink.GUID)
+		}
+		next, ok := devices[uplink.GUID]
+		if !ok {
+			return path, fmt.Errorf("Switch %s not found in topology", uplink.GUID)
+		}
+		current = next
+		inPort = uplink.PortNumber
+	}
+	return path, fmt.Errorf("Route exceeds %d hops", routeMaxHops)
+}
+
+// findRouteNode looks up a device by GUID, LID or name
+func findRouteNode(devices map[string]InfinibandDevice, node string) (InfinibandDevice, error) {
+	if guid, err := normalizeGUID(node); err == nil && strings.HasPrefix(strings.ToLower(node), "0x") {
+		if device, ok := devices[guid]; ok {
+			return device, nil
+		}
+	}
+	guids := getDeviceGUIDs(devices)
+	sort.Strings(guids)
+	for _, guid := range guids {
+		device := devices[guid]
+		if device.LID == node || device.Name == node {
+			return device, nil
+		}
+	}
+	return InfinibandDevice{}, fmt.Errorf("%w: %s", ErrNodeNotFound, node)
+}
+
+func ibrouteArgs(lid string) (string, []string) {
+	var command string
+	var args []string
+	if *useSudo {
+		command = "sudo"
+		args = []string{*ibroutePath}
+	} else {
+		command = *ibroutePath
+	}
+	args = append(args, lid)
+	return command, args
+}
+
+func ibroute(lid string, ctx context.Context) (string, error) {
+	command, args := ibrouteArgs(lid)
+	return runCommand(ctx, lid, command, args)
+}
@@ -0,0 +1,327 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func SetIbrouteExec(t *testing.T, setErr bool, timeout bool) {
+	IbrouteExec = func(lid string, ctx context.Context) (string, error) {
+		if setErr {
+			return "", fmt.Errorf("Error")
+		}
+		if timeout {
+			return "", context.DeadlineExceeded
+		}
+		out, err := ReadFixture("ibroute", lid)
+		if err != nil {
+			t.Fatal(err.Error())
+			return "", err
+		}
+		return out, nil
+	}
+}
+
+func routesSwitches() []InfinibandDevice {
+	switches := append([]InfinibandDevice{}, switchDevices...)
+	switches = append(switches, InfinibandDevice{Type: "SW", LID: "1516", GUID: "0x7cfe900300b07320", Name: "ib-i1l2s01",
+		Uplinks: map[string]InfinibandUplink{
+			"1": {Type: "SW", LID: "1719", PortNumber: "1", GUID: "0x7cfe9003009ce5b0", Name: "ib-i1l1s01"},
+			"2": {Type: "SW", LID: "2052", PortNumber: "1", GUID: "0x506b4b03005c2740", Name: "ib-i4l1s01"},
+		},
+	})
+	return switches
+}
+
+func TestLFTParse(t *testing.T) {
+	out, err := ReadFixture("dump_lfts", "test")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	tables := lftParse(out, log.NewNopLogger())
+	if len(tables) != 2 {
+		t.Fatalf("Unexpected number of tables, got %d", len(tables))
+	}
+	expected := LinearForwardingTable{"133": "11", "134": "10", "1432": "1", "1516": "1", "1719": "0", "2052": "1"}
+	if !reflect.DeepEqual(tables["0x7cfe9003009ce5b0"], expected) {
+		t.Errorf("Unexpected table\nExpected\n%v\nGot\n%v", expected, tables["0x7cfe9003009ce5b0"])
+	}
+	if val := tables["0x506b4b03005c2740"]["1432"]; val != "35" {
+		t.Errorf("Unexpected port, got %s", val)
+	}
+}
+
+func TestRouteImbalance(t *testing.T) {
+	device := routesSwitches()[2]
+	counts := map[string]float64{"1": 4, "2": 2}
+	ratio, ok := routeImbalance(device, counts)
+	if !ok {
+		t.Fatalf("Expected imbalance")
+	}
+	if ratio != 4.0/3.0 {
+		t.Errorf("Unexpected ratio, got %f", ratio)
+	}
+	if _, ok := routeImbalance(switchDevices[0], map[string]float64{"35": 1}); ok {
+		t.Errorf("Expected no imbalance without ports connected to switches")
+	}
+}
+
+func TestRouteDirection(t *testing.T) {
+	// Leaf ib-i1l1s01 connects to spine ib-i1l2s01 which connects to core ib-i1c1s01
+	switches := routesSwitches()
+	switches[2].Uplinks["3"] = InfinibandUplink{Type: "SW", LID: "1600", PortNumber: "1", GUID: "0x7cfe900300b07400", Name: "ib-i1c1s01"}
+	switches = append(switches, InfinibandDevice{Type: "SW", LID: "1600", GUID: "0x7cfe900300b07400", Name: "ib-i1c1s01",
+		Uplinks: map[string]InfinibandUplink{
+			"1": {Type: "SW", LID: "1516", PortNumber: "3", GUID: "0x7cfe900300b07320", Name: "ib-i1l2s01"},
+		},
+	})
+	ranks := switchRanks(switches)
+	expectedRanks := map[string]int{"0x506b4b03005c2740": 0, "0x7cfe9003009ce5b0": 0, "0x7cfe900300b07320": 1, "0x7cfe900300b07400": 2}
+	if !reflect.DeepEqual(ranks, expectedRanks) {
+		t.Errorf("Unexpected ranks, got %v", ranks)
+	}
+	tests := []struct {
+		device   InfinibandDevice
+		port     string
+		expected string
+	}{
+		{switches[1], "1", "up"},
+		{switches[1], "10", "down"},
+		{switches[1], "2", "unknown"},
+		{switches[2], "1", "down"},
+		{switches[2], "3", "up"},
+		{switches[3], "1", "down"},
+	}
+	for _, test := range tests {
+		if direction := routeDirection(test.device, test.port, ranks); direction != test.expected {
+			t.Errorf("Unexpected direction for %s port %s, got %s", test.device.Name, test.port, direction)
+		}
+	}
+}
+
+func TestRoutesCollector(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	SetIbrouteExec(t, false, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="routes"} 0
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="routes"} 0
+		# HELP infiniband_switch_port_routes Infiniband switch port number of destination LIDs routed through the port
+		# TYPE infiniband_switch_port_routes gauge
+		infiniband_switch_port_routes{direction="down",guid="0x506b4b03005c2740",port="35"} 1
+		infiniband_switch_port_routes{direction="unknown",guid="0x506b4b03005c2740",port="1"} 4
+		infiniband_switch_port_routes{direction="down",guid="0x7cfe9003009ce5b0",port="10"} 1
+		infiniband_switch_port_routes{direction="down",guid="0x7cfe9003009ce5b0",port="11"} 1
+		infiniband_switch_port_routes{direction="up",guid="0x7cfe9003009ce5b0",port="1"} 3
+		# HELP infiniband_switch_route_imbalance_ratio Infiniband switch ratio of the maximum to the mean number of routes across ports connected to switches
+		# TYPE infiniband_switch_route_imbalance_ratio gauge
+		infiniband_switch_route_imbalance_ratio{guid="0x7cfe9003009ce5b0"} 1
+		# HELP infiniband_switch_routes Infiniband switch number of destination LIDs in the linear forwarding table
+		# TYPE infiniband_switch_routes gauge
+		infiniband_switch_routes{guid="0x506b4b03005c2740"} 6
+		infiniband_switch_routes{guid="0x7cfe9003009ce5b0"} 6
+	`
+	collector := NewRoutesCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 17 {
+		t.Errorf("Unexpected collection count %d, expected 17", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts",
+		"infiniband_switch_port_routes", "infiniband_switch_route_imbalance_ratio", "infiniband_switch_routes"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestRoutesCollectorLFTFile(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--routes.lft-file=fixtures/dump_lfts/test.out"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	SetIbrouteExec(t, true, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="routes"} 0
+		# HELP infiniband_switch_routes Infiniband switch number of destination LIDs in the linear forwarding table
+		# TYPE infiniband_switch_routes gauge
+		infiniband_switch_routes{guid="0x506b4b03005c2740"} 6
+		infiniband_switch_routes{guid="0x7cfe9003009ce5b0"} 6
+	`
+	collector := NewRoutesCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_switch_routes"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestRoutesCollectorError(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	SetIbrouteExec(t, true, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="routes-runonce"} 2
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="routes-runonce"} 0
+	`
+	collector := NewRoutesCollector(&switchDevices, true, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 10 {
+		t.Errorf("Unexpected collection count %d, expected 10", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestRoutesCollectorTimeout(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	SetIbrouteExec(t, false, true)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="routes"} 0
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="routes"} 2
+	`
+	collector := NewRoutesCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestTracePath(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	SetIbrouteExec(t, false, false)
+	switches := routesSwitches()
+	path, err := TracePath(&switches, &hcaDevices, "o0001 HCA-1", "0x7cfe9003003b4b96", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []RouteHop{
+		{GUID: "0x7cfe9003009ce5b0", Name: "ib-i1l1s01", LID: "1719", InPort: "10", OutPort: "11"},
+	}
+	if !reflect.DeepEqual(path.Hops, expected) {
+		t.Errorf("Unexpected hops\nExpected\n%v\nGot\n%v", expected, path.Hops)
+	}
+	if path.Source.LID != "134" || path.Destination.Name != "o0002 HCA-1" {
+		t.Errorf("Unexpected source or destination, got %v", path)
+	}
+	path, err = TracePath(&switches, &hcaDevices, "134", "ib-i4l1s01", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected = []RouteHop{
+		{GUID: "0x7cfe9003009ce5b0", Name: "ib-i1l1s01", LID: "1719", InPort: "10", OutPort: "1"},
+		{GUID: "0x7cfe900300b07320", Name: "ib-i1l2s01", LID: "1516", InPort: "1", OutPort: "2"},
+	}
+	if !reflect.DeepEqual(path.Hops, expected) {
+		t.Errorf("Unexpected hops\nExpected\n%v\nGot\n%v", expected, path.Hops)
+	}
+}
+
+func TestTracePathErrors(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	SetIbrouteExec(t, false, false)
+	if _, err := TracePath(&switchDevices, &hcaDevices, "foo", "133", log.NewNopLogger()); !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("Expected node not found, got %v", err)
+	}
+	_, err := TracePath(&switchDevices, &hcaDevices, "134", "2052", log.NewNopLogger())
+	if err == nil || err.Error() != "Switch 0x7cfe900300b07320 not found in topology" {
+		t.Errorf("Unexpected error, got %v", err)
+	}
+}
+
+func TestIbrouteArgs(t *testing.T) {
+	command, args := ibrouteArgs("1719")
+	if command != "ibroute" {
+		t.Errorf("Unexpected command, got: %s", command)
+	}
+	expectedArgs := []string{"1719"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Unexpected args\nExpected\n%v\nGot\n%v", expectedArgs, args)
+	}
+	trueValue := true
+	falseValue := false
+	useSudo = &trueValue
+	defer func() { useSudo = &falseValue }()
+	command, args = ibrouteArgs("1719")
+	if command != "sudo" {
+		t.Errorf("Unexpected command, got: %s", command)
+	}
+	expectedArgs = []string{"ibroute", "1719"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Unexpected args\nExpected\n%v\nGot\n%v", expectedArgs, args)
+	}
+}
+
+func TestIbroute(t *testing.T) {
+	execCommand = fakeExecCommand
+	mockedExitStatus = 0
+	mockedStdout = "foo"
+	defer func() { execCommand = exec.CommandContext }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := ibroute("1", ctx)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if out != mockedStdout {
+		t.Errorf("Unexpected out: %s", out)
+	}
+	mockedExitStatus = 1
+	if _, err := ibroute("1", ctx); err == nil {
+		t.Errorf("Expected error")
+	}
+}
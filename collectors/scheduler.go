@@ -0,0 +1,179 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type deviceContextKey struct{}
+
+var (
+	madRate              = kingpin.Flag("mad.rate", "Fabric wide limit of commands and MADs started per second, 0 disables").Default("0").Float64()
+	madMaxInFlight       = kingpin.Flag("mad.max-in-flight", "Fabric wide limit of concurrent commands and MADs, 0 disables").Default("0").Int()
+	madDeviceMaxInFlight = kingpin.Flag("mad.device-max-in-flight", "Limit of concurrent commands and MADs against a single device, 0 disables").Default("0").Int()
+	scheduler            = newMADScheduler()
+)
+
+// madScheduler throttles every command and MAD sent to the fabric
+type madScheduler struct {
+	sync.Mutex
+	inFlight  int
+	devices   map[string]int
+	queued    int
+	next      time.Time
+	changed   chan struct{}
+	requests  float64
+	wait      float64
+	throttled float64
+}
+
+type MADSchedulerCollector struct {
+	InFlight  *prometheus.Desc
+	Queued    *prometheus.Desc
+	Requests  *prometheus.Desc
+	Wait      *prometheus.Desc
+	Throttled *prometheus.Desc
+}
+
+func newMADScheduler() *madScheduler {
+	return &madScheduler{devices: make(map[string]int), changed: make(chan struct{})}
+}
+
+// MADSchedulerEnabled returns true if any fabric wide limit is configured
+func MADSchedulerEnabled() bool {
+	return *madRate > 0 || *madMaxInFlight > 0 || *madDeviceMaxInFlight > 0
+}
+
+// withDevice sets the device GUID used for per device limits of commands run with ctx
+func withDevice(ctx context.Context, guid string) context.Context {
+	return context.WithValue(ctx, deviceContextKey{}, guid)
+}
+
+func contextDevice(ctx context.Context, fallback string) string {
+	if guid, ok := ctx.Value(deviceContextKey{}).(string); ok && guid != "" {
+		return guid
+	}
+	return fallback
+}
+
+func (s *madScheduler) available(device string) bool {
+	if *madMaxInFlight > 0 && s.inFlight >= *madMaxInFlight {
+		return false
+	}
+	if *madDeviceMaxInFlight > 0 && s.devices[device] >= *madDeviceMaxInFlight {
+		return false
+	}
+	return true
+}
+
+// acquire waits for an in-flight slot and the rate limit, the returned function must be called when done
+func (s *madScheduler) acquire(ctx context.Context, device string) (func(), error) {
+	if !MADSchedulerEnabled() {
+		return func() {}, nil
+	}
+	start := time.Now()
+	s.Lock()
+	s.queued++
+	for !s.available(device) {
+		changed := s.changed
+		s.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.Lock()
+			s.queued--
+			s.wait += time.Since(start).Seconds()
+			s.Unlock()
+			return nil, ctx.Err()
+		}
+		s.Lock()
+	}
+	s.queued--
+	s.inFlight++
+	s.devices[device]++
+	s.requests++
+	s.wait += time.Since(start).Seconds()
+	var delay time.Duration
+	if *madRate > 0 {
+		now := time.Now()
+		if s.next.Before(now) {
+			s.next = now
+		}
+		delay = s.next.Sub(now)
+		s.next = s.next.Add(time.Duration(float64(time.Second) / *madRate))
+		s.throttled += delay.Seconds()
+	}
+	s.Unlock()
+	release := func() {
+		s.Lock()
+		defer s.Unlock()
+		s.inFlight--
+		s.devices[device]--
+		if s.devices[device] <= 0 {
+			delete(s.devices, device)
+		}
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+func NewMADSchedulerCollector() *MADSchedulerCollector {
+	return &MADSchedulerCollector{
+		InFlight: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "mad_scheduler_in_flight"),
+			"Number of commands and MADs currently running", nil, nil),
+		Queued: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "mad_scheduler_queued"),
+			"Number of commands and MADs waiting to run", nil, nil),
+		Requests: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "mad_scheduler_requests_total"),
+			"Number of commands and MADs scheduled", nil, nil),
+		Wait: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "mad_scheduler_queue_wait_seconds_total"),
+			"Time commands and MADs waited for an in-flight slot", nil, nil),
+		Throttled: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "mad_scheduler_throttled_seconds_total"),
+			"Time commands and MADs were delayed by the rate limit", nil, nil),
+	}
+}
+
+func (m *MADSchedulerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.InFlight
+	ch <- m.Queued
+	ch <- m.Requests
+	ch <- m.Wait
+	ch <- m.Throttled
+}
+
+func (m *MADSchedulerCollector) Collect(ch chan<- prometheus.Metric) {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	ch <- prometheus.MustNewConstMetric(m.InFlight, prometheus.GaugeValue, float64(scheduler.inFlight))
+	ch <- prometheus.MustNewConstMetric(m.Queued, prometheus.GaugeValue, float64(scheduler.queued))
+	ch <- prometheus.MustNewConstMetric(m.Requests, prometheus.CounterValue, scheduler.requests)
+	ch <- prometheus.MustNewConstMetric(m.Wait, prometheus.CounterValue, scheduler.wait)
+	ch <- prometheus.MustNewConstMetric(m.Throttled, prometheus.CounterValue, scheduler.throttled)
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMADSchedulerDisabled(t *testing.T) {
+	setupTest(t, []string{})
+	if MADSchedulerEnabled() {
+		t.Errorf("Expected scheduler disabled")
+	}
+	release, err := scheduler.acquire(context.Background(), "0x00")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	release()
+	if scheduler.requests != 0 {
+		t.Errorf("Unexpected requests, got %f", scheduler.requests)
+	}
+}
+
+func TestMADSchedulerMaxInFlight(t *testing.T) {
+	setupTest(t, []string{"--mad.max-in-flight=1"})
+	release, err := scheduler.acquire(context.Background(), "0x00")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acquired := make(chan func())
+	go func() {
+		release, _ := scheduler.acquire(context.Background(), "0x01")
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Expected acquire to wait for in-flight slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("Expected acquire after release")
+	}
+	if scheduler.requests != 2 || scheduler.inFlight != 0 || scheduler.wait <= 0 {
+		t.Errorf("Unexpected scheduler state, requests %f in-flight %d wait %f", scheduler.requests, scheduler.inFlight, scheduler.wait)
+	}
+}
+
+func TestMADSchedulerDeviceMaxInFlight(t *testing.T) {
+	setupTest(t, []string{"--mad.device-max-in-flight=1"})
+	release, err := scheduler.acquire(context.Background(), "0x00")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer release()
+	other, err := scheduler.acquire(context.Background(), "0x01")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	other()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := scheduler.acquire(ctx, "0x00"); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if scheduler.queued != 0 {
+		t.Errorf("Unexpected queued, got %d", scheduler.queued)
+	}
+}
+
+func TestMADSchedulerRate(t *testing.T) {
+	setupTest(t, []string{"--mad.rate=20"})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := scheduler.acquire(context.Background(), "0x00")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		release()
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected rate limit delay, took %s", elapsed)
+	}
+	if scheduler.throttled <= 0 {
+		t.Errorf("Expected throttled time, got %f", scheduler.throttled)
+	}
+}
+
+func TestMADSchedulerContextDevice(t *testing.T) {
+	ctx := context.Background()
+	if device := contextDevice(ctx, "1719"); device != "1719" {
+		t.Errorf("Unexpected device, got %s", device)
+	}
+	if device := contextDevice(withDevice(ctx, "0x7cfe9003009ce5b0"), "1719"); device != "0x7cfe9003009ce5b0" {
+		t.Errorf("Unexpected device, got %s", device)
+	}
+}
+
+func TestMADSchedulerCollector(t *testing.T) {
+	setupTest(t, []string{"--mad.max-in-flight=1"})
+	gatherers := setupGatherer(NewMADSchedulerCollector())
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 5 {
+		t.Errorf("Unexpected collection count %d, expected 5", val)
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	CollectSM     = kingpin.Flag("collector.sm", "Enable the subnet manager collector").Default("false").Bool()
+	sminfoPath    = kingpin.Flag("sminfo.path", "Path to sminfo").Default("sminfo").String()
+	saqueryPath   = kingpin.Flag("saquery.path", "Path to saquery").Default("saquery").String()
+	smTimeout     = kingpin.Flag("sm.timeout", "Timeout for sminfo and saquery execution").Default("5s").Duration()
+	SminfoExec    = sminfo
+	SaqueryExec   = saquery
+	smStates      = map[string]string{"0": "notactive", "1": "discovering", "2": "standby", "3": "master"}
+	smHistory     = &smHistoryState{}
+	sminfoPattern = regexp.MustCompile(`sm lid ([0-9]+) sm guid (0x[0-9a-fA-F]+), activity count ([0-9]+) priority ([0-9]+) state ([0-9]+)`)
+)
+
+type SMCollector struct {
+	names              map[string]string
+	lidNames           map[string]string
+	logger             log.Logger
+	collector          string
+	MasterInfo         *prometheus.Desc
+	MasterChanges      *prometheus.Desc
+	MasterStalled      *prometheus.Desc
+	Info               *prometheus.Desc
+	Priority           *prometheus.Desc
+	ActivityCount      *prometheus.Desc
+	ActivityLastChange *prometheus.Desc
+	Count              *prometheus.Desc
+}
+
+type SubnetManager struct {
+	LID           string
+	GUID          string
+	Name          string
+	ActivityCount float64
+	Priority      float64
+	State         string
+}
+
+// smHistoryState tracks the master and activity counts between collections
+// so that master changes and stalled subnet managers can be detected
+type smHistoryState struct {
+	sync.Mutex
+	master        string
+	masterChanges float64
+	activity      map[string]float64
+	lastChange    map[string]time.Time
+}
+
+// updateActivity records the activity count of a subnet manager reported by source and returns
+// if a previous count from that source exists and if the count changed.
+// Counts are only compared with counts from the same source as sminfo and saquery read them at different times.
+func (h *smHistoryState) updateActivity(source string, sm *SubnetManager, collectTime time.Time) (bool, bool) {
+	if h.activity == nil {
+		h.activity = make(map[string]float64)
+		h.lastChange = make(map[string]time.Time)
+	}
+	key := source + "/" + sm.GUID
+	prev, ok := h.activity[key]
+	h.activity[key] = sm.ActivityCount
+	changed := !ok || prev != sm.ActivityCount
+	if _, seen := h.lastChange[sm.GUID]; changed && (ok || !seen) {
+		h.lastChange[sm.GUID] = collectTime
+	}
+	return ok, changed
+}
+
+func NewSMCollector(switches *[]InfinibandDevice, hcas *[]InfinibandDevice, runonce bool, logger log.Logger) *SMCollector {
+	collector := "sm"
+	if runonce {
+		collector = "sm-runonce"
+	}
+	names := make(map[string]string)
+	lidNames := make(map[string]string)
+	for _, devices := range []*[]InfinibandDevice{switches, hcas} {
+		if devices == nil {
+			continue
+		}
+		for _, device := range *devices {
+			names[device.GUID] = device.Name
+			lidNames[device.LID] = device.Name
+			for _, uplink := range device.Uplinks {
+				if uplink.LID != "" && uplink.LID != "0" {
+					lidNames[uplink.LID] = uplink.Name
+				}
+			}
+		}
+	}
+	return &SMCollector{
+		names:     names,
+		lidNames:  lidNames,
+		logger:    log.With(logger, "collector", collector),
+		collector: collector,
+		MasterInfo: prometheus.NewDesc(prometheus.BuildFQName(namespace, "sm", "master_info"),
+			"Infiniband master subnet manager information", []string{"guid", "lid", "name"}, nil),
+		MasterChanges: prometheus.NewDesc(prometheus.BuildFQName(namespace, "sm", "master_changes_total"),
+			"Number of times the master subnet manager has changed since the exporter started", nil, nil),
+		MasterStalled: prometheus.NewDesc(prometheus.BuildFQName(namespace, "sm", "master_activity_stalled"),
+			"Indicates if the master subnet manager activity count did not change since last collection", []string{"guid"}, nil),
+		Info: prometheus.NewDesc(prometheus.BuildFQName(namespace, "sm", "info"),
+			"Infiniband subnet manager information", []string{"guid", "lid", "name", "state"}, nil),
+		Priority: prometheus.NewDesc(prometheus.BuildFQName(namespace, "sm", "priority"),
+			"Infiniband subnet manager priority", []string{"guid"}, nil),
+		ActivityCount: prometheus.NewDesc(prometheus.BuildFQName(namespace, "sm", "activity_count_total"),
+			"Infiniband subnet manager activity count", []string{"guid"}, nil),
+		ActivityLastChange: prometheus.NewDesc(prometheus.BuildFQName(namespace, "sm", "activity_last_change_timestamp_seconds"),
+			"Time the subnet manager activity count last changed", []string{"guid"}, nil),
+		Count: prometheus.NewDesc(prometheus.BuildFQName(namespace, "sm", "count"),
+			"Number of subnet managers on the fabric", nil, nil),
+	}
+}
+
+func (s *SMCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.MasterInfo
+	ch <- s.MasterChanges
+	ch <- s.MasterStalled
+	ch <- s.Info
+	ch <- s.Priority
+	ch <- s.ActivityCount
+	ch <- s.ActivityLastChange
+	ch <- s.Count
+}
+
+func (s *SMCollector) Collect(ch chan<- prometheus.Metric) {
+	collectTime := time.Now()
+	master, sms, errors, timeouts := s.collect()
+	smHistory.Lock()
+	saquerySMs := len(sms)
+	if master != nil {
+		if smHistory.master != "" && smHistory.master != master.GUID {
+			level.Info(s.logger).Log("msg", "Master subnet manager changed", "old", smHistory.master, "new", master.GUID, "name", master.Name)
+			smHistory.masterChanges++
+		}
+		smHistory.master = master.GUID
+		stalled := 0.0
+		if ok, changed := smHistory.updateActivity("sminfo", master, collectTime); ok && !changed {
+			stalled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(s.MasterInfo, prometheus.GaugeValue, 1, master.GUID, master.LID, master.Name)
+		ch <- prometheus.MustNewConstMetric(s.MasterStalled, prometheus.GaugeValue, stalled, master.GUID)
+		// Ensure the master is tracked if saquery did not return it
+		found := false
+		for _, sm := range sms {
+			if sm.GUID == master.GUID {
+				found = true
+			}
+		}
+		if !found {
+			sms = append(sms, *master)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(s.MasterChanges, prometheus.CounterValue, smHistory.masterChanges)
+	for i, sm := range sms {
+		// The master appended from sminfo was already recorded
+		if i < saquerySMs {
+			smHistory.updateActivity("saquery", &sm, collectTime)
+		}
+		ch <- prometheus.MustNewConstMetric(s.Info, prometheus.GaugeValue, 1, sm.GUID, sm.LID, sm.Name, sm.State)
+		ch <- prometheus.MustNewConstMetric(s.Priority, prometheus.GaugeValue, sm.Priority, sm.GUID)
+		ch <- prometheus.MustNewConstMetric(s.ActivityCount, prometheus.CounterValue, sm.ActivityCount, sm.GUID)
+		ch <- prometheus.MustNewConstMetric(s.ActivityLastChange, prometheus.GaugeValue, float64(smHistory.lastChange[sm.GUID].Unix()), sm.GUID)
+	}
+	smHistory.Unlock()
+	ch <- prometheus.MustNewConstMetric(s.Count, prometheus.GaugeValue, float64(len(sms)))
+	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, errors, s.collector)
+	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, timeouts, s.collector)
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), s.collector)
+	if strings.HasSuffix(s.collector, "-runonce") {
+		ch <- prometheus.MustNewConstMetric(lastExecution, prometheus.GaugeValue, float64(time.Now().Unix()), s.collector)
+	}
+}
+
+func (s *SMCollector) collect() (*SubnetManager, []SubnetManager, float64, float64) {
+	var master *SubnetManager
+	var sms []SubnetManager
+	var errors, timeouts float64
+	ctxSminfo, cancelSminfo := context.WithTimeout(context.Background(), *smTimeout)
+	defer cancelSminfo()
+	sminfoOut, err := SminfoExec(ctxSminfo)
+	if err == context.DeadlineExceeded {
+		level.Error(s.logger).Log("msg", "Timeout collecting sminfo")
+		timeouts++
+	} else if err != nil {
+		level.Error(s.logger).Log("msg", "Error collecting sminfo", "err", err)
+		errors++
+	} else {
+		master, err = sminfoParse(sminfoOut)
+		if err != nil {
+			level.Error(s.logger).Log("msg", "Error parsing sminfo output", "err", err)
+			errors++
+		} else {
+			master.Name = s.name(master)
+		}
+	}
+	ctxSaquery, cancelSaquery := context.WithTimeout(context.Background(), *smTimeout)
+	defer cancelSaquery()
+	saqueryOut, err := SaqueryExec(ctxSaquery)
+	if err == context.DeadlineExceeded {
+		level.Error(s.logger).Log("msg", "Timeout collecting saquery")
+		timeouts++
+	} else if err != nil {
+		level.Error(s.logger).Log("msg", "Error collecting saquery", "err", err)
+		errors++
+	} else {
+		var errs float64
+		sms, errs = saquerySMIRParse(saqueryOut, s.logger)
+		errors = errors + errs
+		for i := range sms {
+			sms[i].Name = s.name(&sms[i])
+		}
+	}
+	return master, sms, errors, timeouts
+}
+
+// name returns the name of the device running a subnet manager, the subnet manager reports
+// its port GUID so fall back to the LID when the port GUID differs from the device GUID
+func (s *SMCollector) name(sm *SubnetManager) string {
+	if name, ok := s.names[sm.GUID]; ok {
+		return name
+	}
+	return s.lidNames[sm.LID]
+}
+
+func sminfoParse(out string) (*SubnetManager, error) {
+	matches := sminfoPattern.FindStringSubmatch(out)
+	if len(matches) != 6 {
+		return nil, fmt.Errorf("Unable to parse sminfo output: %s", strings.TrimSpace(out))
+	}
+	activity, _ := strconv.ParseFloat(matches[3], 64)
+	priority, _ := strconv.ParseFloat(matches[4], 64)
+	return &SubnetManager{
+		LID:           matches[1],
+		GUID:          matches[2],
+		ActivityCount: activity,
+		Priority:      priority,
+		State:         smStateName(matches[5]),
+	}, nil
+}
+
+func saquerySMIRParse(out string, logger log.Logger) ([]SubnetManager, float64) {
+	var sms []SubnetManager
+	var errors float64
+	var sm *SubnetManager
+	lines := strings.Split(out, "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "SMInfoRecord dump") {
+			if sm != nil {
+				sms = append(sms, *sm)
+			}
+			sm = &SubnetManager{}
+			continue
+		}
+		if sm == nil {
+			continue
+		}
+		items := strings.SplitN(line, ".", 2)
+		if len(items) != 2 {
+			continue
+		}
+		key := items[0]
+		value := strings.TrimLeft(items[1], ".")
+		switch key {
+		case "LID":
+			sm.LID = value
+		case "GUID":
+			sm.GUID = value
+		case "SMState":
+			sm.State = smStateName(value)
+		case "ActCount", "Priority":
+			val, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				level.Error(logger).Log("msg", "Unable to parse SMInfo value", "key", key, "value", value, "err", err)
+				errors++
+				continue
+			}
+			if key == "ActCount" {
+				sm.ActivityCount = val
+			} else {
+				sm.Priority = val
+			}
+		}
+	}
+	if sm != nil {
+		sms = append(sms, *sm)
+	}
+	return sms, errors
+}
+
+func smStateName(state string) string {
+	if name, ok := smStates[state]; ok {
+		return name
+	}
+	return state
+}
+
+func smArgs(path string, extraArgs []string) (string, []string) {
+	var command string
+	var args []string
+	if *useSudo {
+		command = "sudo"
+		args = []string{path}
+	} else {
+		command = path
+	}
+	args = append(args, extraArgs...)
+	return command, args
+}
+
+func sminfo(ctx context.Context) (string, error) {
+	command, args := smArgs(*sminfoPath, nil)
+	return smExec(ctx, command, args)
+}
+
+func saquery(ctx context.Context) (string, error) {
+	command, args := smArgs(*saqueryPath, []string{"SMIR"})
+	return smExec(ctx, command, args)
+}
+
+func smExec(ctx context.Context, command string, args []string) (string, error) {
+	return runCommand(ctx, fabricTarget, command, args)
+}
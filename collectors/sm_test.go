@@ -0,0 +1,306 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func SetSMExecs(t *testing.T, sminfoFixture string, setErr bool, timeout bool) {
+	SminfoExec = func(ctx context.Context) (string, error) {
+		if setErr {
+			return "", fmt.Errorf("Error")
+		}
+		if timeout {
+			return "", context.DeadlineExceeded
+		}
+		out, err := ReadFixture("sminfo", sminfoFixture)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return out, nil
+	}
+	SaqueryExec = func(ctx context.Context) (string, error) {
+		if setErr {
+			return "", fmt.Errorf("Error")
+		}
+		if timeout {
+			return "", context.DeadlineExceeded
+		}
+		out, err := ReadFixture("saquery", "test")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return out, nil
+	}
+}
+
+func TestSminfoParse(t *testing.T) {
+	out, err := ReadFixture("sminfo", "test")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	sm, err := sminfoParse(out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &SubnetManager{LID: "1719", GUID: "0x7cfe9003009ce5b0", ActivityCount: 3442145, Priority: 15, State: "master"}
+	if !reflect.DeepEqual(sm, expected) {
+		t.Errorf("Unexpected value:\nExpected: %v\nGot: %v", expected, sm)
+	}
+	if _, err := sminfoParse("ibwarn: [1234] mad_rpc_open_port: can't open UMAD port"); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestSaquerySMIRParse(t *testing.T) {
+	out, err := ReadFixture("saquery", "test")
+	if err != nil {
+		t.Fatal("Unable to read fixture")
+	}
+	sms, errors := saquerySMIRParse(out, log.NewNopLogger())
+	if errors != 0 {
+		t.Errorf("Unexpected errors: %f", errors)
+	}
+	expected := []SubnetManager{
+		{LID: "1719", GUID: "0x7cfe9003009ce5b0", ActivityCount: 3442145, Priority: 15, State: "master"},
+		{LID: "134", GUID: "0x7cfe9003003b4bde", ActivityCount: 1003, Priority: 14, State: "standby"},
+	}
+	if !reflect.DeepEqual(sms, expected) {
+		t.Errorf("Unexpected value:\nExpected: %v\nGot: %v", expected, sms)
+	}
+	_, errors = saquerySMIRParse("SMInfoRecord dump:\n\t\tActCount..............foo\n", log.NewNopLogger())
+	if errors != 1 {
+		t.Errorf("Unexpected errors: %f", errors)
+	}
+}
+
+func TestSMCollector(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	smHistory = &smHistoryState{}
+	SetSMExecs(t, "test", false, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="sm"} 0
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="sm"} 0
+		# HELP infiniband_sm_activity_count_total Infiniband subnet manager activity count
+		# TYPE infiniband_sm_activity_count_total counter
+		infiniband_sm_activity_count_total{guid="0x7cfe9003003b4bde"} 1003
+		infiniband_sm_activity_count_total{guid="0x7cfe9003009ce5b0"} 3442145
+		# HELP infiniband_sm_count Number of subnet managers on the fabric
+		# TYPE infiniband_sm_count gauge
+		infiniband_sm_count 2
+		# HELP infiniband_sm_info Infiniband subnet manager information
+		# TYPE infiniband_sm_info gauge
+		infiniband_sm_info{guid="0x7cfe9003003b4bde",lid="134",name="o0001 HCA-1",state="standby"} 1
+		infiniband_sm_info{guid="0x7cfe9003009ce5b0",lid="1719",name="ib-i1l1s01",state="master"} 1
+		# HELP infiniband_sm_master_changes_total Number of times the master subnet manager has changed since the exporter started
+		# TYPE infiniband_sm_master_changes_total counter
+		infiniband_sm_master_changes_total 0
+		# HELP infiniband_sm_master_info Infiniband master subnet manager information
+		# TYPE infiniband_sm_master_info gauge
+		infiniband_sm_master_info{guid="0x7cfe9003009ce5b0",lid="1719",name="ib-i1l1s01"} 1
+		# HELP infiniband_sm_priority Infiniband subnet manager priority
+		# TYPE infiniband_sm_priority gauge
+		infiniband_sm_priority{guid="0x7cfe9003003b4bde"} 14
+		infiniband_sm_priority{guid="0x7cfe9003009ce5b0"} 15
+	`
+	collector := NewSMCollector(&switchDevices, &hcaDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 15 {
+		t.Errorf("Unexpected collection count %d, expected 15", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_sm_activity_count_total", "infiniband_sm_count", "infiniband_sm_info",
+		"infiniband_sm_master_changes_total", "infiniband_sm_master_info", "infiniband_sm_priority",
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	// Same activity count as previous collection and then a new master
+	expected = `
+		# HELP infiniband_sm_master_activity_stalled Indicates if the master subnet manager activity count did not change since last collection
+		# TYPE infiniband_sm_master_activity_stalled gauge
+		infiniband_sm_master_activity_stalled{guid="0x7cfe9003009ce5b0"} 1
+	`
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected), "infiniband_sm_master_activity_stalled"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	SetSMExecs(t, "test2", false, false)
+	expected = `
+		# HELP infiniband_sm_master_activity_stalled Indicates if the master subnet manager activity count did not change since last collection
+		# TYPE infiniband_sm_master_activity_stalled gauge
+		infiniband_sm_master_activity_stalled{guid="0x7cfe9003003b4bde"} 0
+		# HELP infiniband_sm_master_changes_total Number of times the master subnet manager has changed since the exporter started
+		# TYPE infiniband_sm_master_changes_total counter
+		infiniband_sm_master_changes_total 1
+		# HELP infiniband_sm_master_info Infiniband master subnet manager information
+		# TYPE infiniband_sm_master_info gauge
+		infiniband_sm_master_info{guid="0x7cfe9003003b4bde",lid="134",name="o0001 HCA-1"} 1
+	`
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_sm_master_activity_stalled", "infiniband_sm_master_changes_total", "infiniband_sm_master_info"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	// The sminfo activity count is unchanged while saquery reports a different count
+	expected = `
+		# HELP infiniband_sm_master_activity_stalled Indicates if the master subnet manager activity count did not change since last collection
+		# TYPE infiniband_sm_master_activity_stalled gauge
+		infiniband_sm_master_activity_stalled{guid="0x7cfe9003003b4bde"} 1
+	`
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected), "infiniband_sm_master_activity_stalled"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestSMCollectorPortGUID(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	smHistory = &smHistoryState{}
+	SetSMExecs(t, "test3", false, false)
+	expected := `
+		# HELP infiniband_sm_master_info Infiniband master subnet manager information
+		# TYPE infiniband_sm_master_info gauge
+		infiniband_sm_master_info{guid="0x7cfe9003003b4bdd",lid="134",name="o0001 HCA-1"} 1
+	`
+	collector := NewSMCollector(&switchDevices, &hcaDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected), "infiniband_sm_master_info"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestSMCollectorError(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	smHistory = &smHistoryState{}
+	SetSMExecs(t, "test", true, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="sm-runonce"} 2
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="sm-runonce"} 0
+	`
+	collector := NewSMCollector(nil, nil, true, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 6 {
+		t.Errorf("Unexpected collection count %d, expected 6", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestSMCollectorTimeout(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	smHistory = &smHistoryState{}
+	SetSMExecs(t, "test", false, true)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="sm"} 0
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="sm"} 2
+	`
+	collector := NewSMCollector(nil, nil, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestSMArgs(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	trueValue := true
+	falseValue := false
+	command, args := smArgs(*saqueryPath, []string{"SMIR"})
+	if command != "saquery" {
+		t.Errorf("Unexpected command, got: %s", command)
+	}
+	expectedArgs := []string{"SMIR"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Unexpected args\nExpected\n%v\nGot\n%v", expectedArgs, args)
+	}
+	useSudo = &trueValue
+	command, args = smArgs(*sminfoPath, nil)
+	if command != "sudo" {
+		t.Errorf("Unexpected command, got: %s", command)
+	}
+	expectedArgs = []string{"sminfo"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Unexpected args\nExpected\n%v\nGot\n%v", expectedArgs, args)
+	}
+	useSudo = &falseValue
+}
+
+func TestSminfo(t *testing.T) {
+	execCommand = fakeExecCommand
+	mockedExitStatus = 0
+	mockedStdout = "foo"
+	defer func() { execCommand = exec.CommandContext }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := sminfo(ctx)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if out != mockedStdout {
+		t.Errorf("Unexpected out: %s", out)
+	}
+}
+
+func TestSaqueryError(t *testing.T) {
+	execCommand = fakeExecCommand
+	mockedExitStatus = 1
+	mockedStdout = "foo"
+	defer func() { execCommand = exec.CommandContext }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := saquery(ctx)
+	if err == nil {
+		t.Errorf("Expected error")
+	}
+	if out != "" {
+		t.Errorf("Unexpected out: %s", out)
+	}
+}
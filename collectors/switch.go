@@ -40,6 +40,7 @@ type SwitchCollector struct {
 	Duration                     *prometheus.Desc
 	Error                        *prometheus.Desc
 	Timeout                      *prometheus.Desc
+	Stale                        *prometheus.Desc
 	PortXmitData                 *prometheus.Desc
 	PortRcvData                  *prometheus.Desc
 	PortXmitPkts                 *prometheus.Desc
@@ -72,6 +73,8 @@ type SwitchCollector struct {
 	RawRate                      *prometheus.Desc
 	Uplink                       *prometheus.Desc
 	Info                         *prometheus.Desc
+	Ports                        *prometheus.Desc
+	FreePort                     *prometheus.Desc
 }
 
 type SwitchMetrics struct {
@@ -99,6 +102,8 @@ func NewSwitchCollector(devices *[]InfinibandDevice, runonce bool, logger log.Lo
 			"Indicates if collect error", []string{"guid", "collector"}, nil),
 		Timeout: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_timeout"),
 			"Indicates if collect timeout", []string{"guid", "collector"}, nil),
+		Stale: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "collect_stale_seconds"),
+			"Age of cached values served after a failed collect, 0 when not cached", []string{"guid", "collector"}, nil),
 		PortXmitData: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_transmit_data_bytes_total"),
 			"Infiniband switch port PortXmitData", labels, nil),
 		PortRcvData: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "port_receive_data_bytes_total"),
@@ -163,6 +168,10 @@ func NewSwitchCollector(devices *[]InfinibandDevice, runonce bool, logger log.Lo
 			"Infiniband switch uplink information", append(labels, []string{"switch", "uplink", "uplink_guid", "uplink_type", "uplink_port", "uplink_lid"}...), nil),
 		Info: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "info"),
 			"Infiniband switch information", []string{"guid", "switch", "lid"}, nil),
+		Ports: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "ports"),
+			"Infiniband switch number of ports by status", []string{"guid", "status"}, nil),
+		FreePort: prometheus.NewDesc(prometheus.BuildFQName(namespace, "switch", "free_port_info"),
+			"Infiniband switch port that is not connected", []string{"guid", "switch", "port"}, nil),
 	}
 }
 
@@ -170,6 +179,7 @@ func (s *SwitchCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- s.Duration
 	ch <- s.Error
 	ch <- s.Timeout
+	ch <- s.Stale
 	ch <- s.PortXmitData
 	ch <- s.PortRcvData
 	ch <- s.PortXmitPkts
@@ -202,11 +212,79 @@ func (s *SwitchCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- s.RawRate
 	ch <- s.Uplink
 	ch <- s.Info
+	ch <- s.Ports
+	ch <- s.FreePort
 }
 
 func (s *SwitchCollector) Collect(ch chan<- prometheus.Metric) {
 	collectTime := time.Now()
 	counters, metrics, errors, timeouts := s.collect()
+	now := time.Now()
+	portHistory.record(counters, now)
+	events.recordCounters(counters, now, s.logger)
+	failed := make(map[string]bool)
+	rcvErrFailed := make(map[string]bool)
+	for guid, metric := range metrics {
+		failed[guid] = metric.timeout+metric.error > 0
+		rcvErrFailed[guid] = metric.rcvErrTimeout+metric.rcvErrError > 0
+	}
+	baseCounters, rcvErrCounters := splitCounters(counters)
+	cached := lastGood.updateCounters(s.collector, *s.devices, baseCounters, failed, now)
+	rcvErrCached := lastGood.updateCounters(fmt.Sprintf("%s-rcv-err", s.collector), *s.devices, rcvErrCounters, rcvErrFailed, now)
+	s.collectCounters(ch, counters)
+	for _, entries := range []map[string]lastGoodEntry{cached, rcvErrCached} {
+		for _, entry := range entries {
+			collectWithTimestamp(ch, entry.time, func(ch chan<- prometheus.Metric) { s.collectCounters(ch, entry.counters) })
+		}
+	}
+	if *switchCollectBase {
+		for _, device := range *s.devices {
+			metric := metrics[device.GUID]
+			ch <- prometheus.MustNewConstMetric(s.Info, prometheus.GaugeValue, 1, device.GUID, device.Name, device.LID)
+			ch <- prometheus.MustNewConstMetric(s.Duration, prometheus.GaugeValue, metric.duration, device.GUID, s.collector)
+			ch <- prometheus.MustNewConstMetric(s.Timeout, prometheus.GaugeValue, metric.timeout, device.GUID, s.collector)
+			ch <- prometheus.MustNewConstMetric(s.Error, prometheus.GaugeValue, metric.error, device.GUID, s.collector)
+			for port, uplink := range device.Uplinks {
+				ch <- prometheus.MustNewConstMetric(s.Rate, prometheus.GaugeValue, uplink.Rate, device.GUID, port)
+				ch <- prometheus.MustNewConstMetric(s.RawRate, prometheus.GaugeValue, uplink.RawRate, device.GUID, port)
+				ch <- prometheus.MustNewConstMetric(s.Uplink, prometheus.GaugeValue, 1, device.GUID, port, device.Name, uplink.Name, uplink.GUID, uplink.Type, uplink.PortNumber, uplink.LID)
+			}
+			connected := float64(len(device.Uplinks))
+			disconnected := float64(len(device.FreePorts))
+			split := float64(len(device.SplitPorts))
+			ch <- prometheus.MustNewConstMetric(s.Ports, prometheus.GaugeValue, connected+disconnected+split, device.GUID, "total")
+			ch <- prometheus.MustNewConstMetric(s.Ports, prometheus.GaugeValue, connected, device.GUID, "connected")
+			ch <- prometheus.MustNewConstMetric(s.Ports, prometheus.GaugeValue, disconnected, device.GUID, "disconnected")
+			ch <- prometheus.MustNewConstMetric(s.Ports, prometheus.GaugeValue, split, device.GUID, "split")
+			for _, port := range device.FreePorts {
+				ch <- prometheus.MustNewConstMetric(s.FreePort, prometheus.GaugeValue, 1, device.GUID, device.Name, port)
+			}
+		}
+	}
+	if *switchCollectRcvErr {
+		for _, device := range *s.devices {
+			metric := metrics[device.GUID]
+			ch <- prometheus.MustNewConstMetric(s.Duration, prometheus.GaugeValue, metric.rcvErrDuration, device.GUID, fmt.Sprintf("%s-rcv-err", s.collector))
+			ch <- prometheus.MustNewConstMetric(s.Timeout, prometheus.GaugeValue, metric.rcvErrTimeout, device.GUID, fmt.Sprintf("%s-rcv-err", s.collector))
+			ch <- prometheus.MustNewConstMetric(s.Error, prometheus.GaugeValue, metric.rcvErrError, device.GUID, fmt.Sprintf("%s-rcv-err", s.collector))
+		}
+	}
+	collectStale(ch, s.Stale, s.collector, *s.devices, now, cached, rcvErrCached)
+	failureCounts.collect(ch, s.collector, fmt.Sprintf("%s-rcv-err", s.collector))
+	retryCounts.collect(ch, collectRetries, s.collector)
+	breakers.collect(ch, s.collector)
+	if *countersSource == "perfquery" {
+		limiters.collect(ch, s.collector)
+	}
+	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, errors, s.collector)
+	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, timeouts, s.collector)
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), s.collector)
+	if strings.HasSuffix(s.collector, "-runonce") {
+		ch <- prometheus.MustNewConstMetric(lastExecution, prometheus.GaugeValue, float64(time.Now().Unix()), s.collector)
+	}
+}
+
+func (s *SwitchCollector) collectCounters(ch chan<- prometheus.Metric, counters []PerfQueryCounters) {
 	for _, c := range counters {
 		if !math.IsNaN(c.PortXmitData) {
 			ch <- prometheus.MustNewConstMetric(s.PortXmitData, prometheus.CounterValue, c.PortXmitData, c.device.GUID, c.PortSelect)
@@ -293,72 +371,65 @@ func (s *SwitchCollector) Collect(ch chan<- prometheus.Metric) {
 			ch <- prometheus.MustNewConstMetric(s.PortLoopingErrors, prometheus.CounterValue, c.PortLoopingErrors, c.device.GUID, c.PortSelect)
 		}
 	}
-	if *switchCollectBase {
-		for _, device := range *s.devices {
-			metric := metrics[device.GUID]
-			ch <- prometheus.MustNewConstMetric(s.Info, prometheus.GaugeValue, 1, device.GUID, device.Name, device.LID)
-			ch <- prometheus.MustNewConstMetric(s.Duration, prometheus.GaugeValue, metric.duration, device.GUID, s.collector)
-			ch <- prometheus.MustNewConstMetric(s.Timeout, prometheus.GaugeValue, metric.timeout, device.GUID, s.collector)
-			ch <- prometheus.MustNewConstMetric(s.Error, prometheus.GaugeValue, metric.error, device.GUID, s.collector)
-			for port, uplink := range device.Uplinks {
-				ch <- prometheus.MustNewConstMetric(s.Rate, prometheus.GaugeValue, uplink.Rate, device.GUID, port)
-				ch <- prometheus.MustNewConstMetric(s.RawRate, prometheus.GaugeValue, uplink.RawRate, device.GUID, port)
-				ch <- prometheus.MustNewConstMetric(s.Uplink, prometheus.GaugeValue, 1, device.GUID, port, device.Name, uplink.Name, uplink.GUID, uplink.Type, uplink.PortNumber, uplink.LID)
-			}
-		}
-	}
-	if *switchCollectRcvErr {
-		for _, device := range *s.devices {
-			metric := metrics[device.GUID]
-			ch <- prometheus.MustNewConstMetric(s.Duration, prometheus.GaugeValue, metric.rcvErrDuration, device.GUID, fmt.Sprintf("%s-rcv-err", s.collector))
-			ch <- prometheus.MustNewConstMetric(s.Timeout, prometheus.GaugeValue, metric.rcvErrTimeout, device.GUID, fmt.Sprintf("%s-rcv-err", s.collector))
-			ch <- prometheus.MustNewConstMetric(s.Error, prometheus.GaugeValue, metric.rcvErrError, device.GUID, fmt.Sprintf("%s-rcv-err", s.collector))
-		}
-	}
-	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, errors, s.collector)
-	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, timeouts, s.collector)
-	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), s.collector)
-	if strings.HasSuffix(s.collector, "-runonce") {
-		ch <- prometheus.MustNewConstMetric(lastExecution, prometheus.GaugeValue, float64(time.Now().Unix()), s.collector)
-	}
 }
 
 func (s *SwitchCollector) collect() ([]PerfQueryCounters, map[string]SwitchMetrics, float64, float64) {
+	if *countersSource != "perfquery" {
+		return s.collectSource()
+	}
 	var counters []PerfQueryCounters
 	metrics := make(map[string]SwitchMetrics)
 	var countersLock sync.Mutex
 	var errors, timeouts float64
-	limit := make(chan int, *maxConcurrent)
+	rcvErrCollector := fmt.Sprintf("%s-rcv-err", s.collector)
+	pma := &lazyMADTransport{}
+	defer pma.Close() //nolint:errcheck
+	limiter := limiters.get(s.collector, *maxConcurrent, *perfqueryTimeout)
 	wg := &sync.WaitGroup{}
 	for _, device := range *s.devices {
-		limit <- 1
+		limiter.acquire()
 		wg.Add(1)
 		go func(device InfinibandDevice) {
+			var err error
+			var duration time.Duration
+			var metric SwitchMetrics
 			defer func() {
-				<-limit
+				countersLock.Lock()
+				metrics[device.GUID] = metric
+				countersLock.Unlock()
+				limiter.release(err, duration)
 				wg.Done()
 			}()
-			ctxExtended, cancelExtended := context.WithTimeout(context.Background(), *perfqueryTimeout)
-			defer cancelExtended()
+			if breakers.skip(s.collector, device.GUID) {
+				level.Debug(s.logger).Log("msg", "Skipping device with open circuit breaker", "guid", device.GUID)
+				return
+			}
+			retry := newDeviceRetry(s.collector, device.GUID)
 			ports := getDevicePorts(device.Uplinks)
-			perfqueryPorts := strings.Join(ports, ",")
 			start := time.Now()
-			extendedOut, err := PerfqueryExec(device.GUID, perfqueryPorts, []string{"-l", "-x"}, ctxExtended)
-			metric := SwitchMetrics{duration: time.Since(start).Seconds()}
+			extendedOut, extendedErrs := perfqueryDevice(retry, device.GUID, perfqueryPorts(ports), []string{"-l", "-x"})
+			if len(extendedErrs) > 0 {
+				err = extendedErrs[0]
+			}
+			breakers.result(s.collector, device.GUID, err)
+			duration = time.Since(start)
+			metric.duration = duration.Seconds()
 			if err == context.DeadlineExceeded {
 				metric.timeout = 1
 				level.Error(s.logger).Log("msg", "Timeout collecting extended perfquery counters", "guid", device.GUID)
 				timeouts++
 			} else if err != nil {
 				metric.error = 1
-				level.Error(s.logger).Log("msg", "Error collecting extended perfquery counters", "guid", device.GUID)
+				level.Error(s.logger).Log("msg", "Error collecting extended perfquery counters", "err", err, "guid", device.GUID)
 				errors++
 			}
 			if err != nil {
+				recordFailure(s.collector, device.GUID, err)
 				return
 			}
 			deviceCounters, errs := perfqueryParse(device, extendedOut, s.logger)
 			errors = errors + errs
+			recordParseFailures(s.collector, device.GUID, errs)
 			if *switchCollectBase {
 				level.Debug(s.logger).Log("msg", "Adding parsed counters", "count", len(deviceCounters), "guid", device.GUID, "name", device.Name)
 				countersLock.Lock()
@@ -366,36 +437,53 @@ func (s *SwitchCollector) collect() ([]PerfQueryCounters, map[string]SwitchMetri
 				countersLock.Unlock()
 			}
 			if *switchCollectRcvErr {
+				rcvErrPorts := make([]string, 0, len(deviceCounters))
 				for _, deviceCounter := range deviceCounters {
-					ctxRcvErr, cancelRcvErr := context.WithTimeout(context.Background(), *perfqueryTimeout)
-					defer cancelRcvErr()
-					rcvErrStart := time.Now()
-					rcvErrOut, err := PerfqueryExec(device.GUID, deviceCounter.PortSelect, []string{"-E"}, ctxRcvErr)
-					metric.rcvErrDuration = time.Since(rcvErrStart).Seconds()
+					rcvErrPorts = append(rcvErrPorts, deviceCounter.PortSelect)
+				}
+				rcvErrStart := time.Now()
+				rcvErrCounters, errs, rcvErrErrs := collectRcvErr(pma, retry, device, rcvErrPorts, s.logger)
+				metric.rcvErrDuration = time.Since(rcvErrStart).Seconds()
+				for _, err := range rcvErrErrs {
+					recordFailure(rcvErrCollector, device.GUID, err)
 					if err == context.DeadlineExceeded {
 						metric.rcvErrTimeout = 1
 						level.Error(s.logger).Log("msg", "Timeout collecting rcvErr perfquery counters", "guid", device.GUID)
 						timeouts++
-						continue
-					} else if err != nil {
+					} else {
 						metric.rcvErrError = 1
-						level.Error(s.logger).Log("msg", "Error collecting rcvErr perfquery counters", "guid", device.GUID)
+						level.Error(s.logger).Log("msg", "Error collecting rcvErr perfquery counters", "err", err, "guid", device.GUID)
 						errors++
-						continue
 					}
-					rcvErrCounters, errs := perfqueryParse(device, rcvErrOut, s.logger)
-					errors = errors + errs
-					countersLock.Lock()
-					counters = append(counters, rcvErrCounters...)
-					countersLock.Unlock()
 				}
+				errors = errors + errs
+				recordParseFailures(rcvErrCollector, device.GUID, errs)
+				countersLock.Lock()
+				counters = append(counters, rcvErrCounters...)
+				countersLock.Unlock()
 			}
-			countersLock.Lock()
-			metrics[device.GUID] = metric
-			countersLock.Unlock()
 		}(device)
 	}
 	wg.Wait()
-	close(limit)
 	return counters, metrics, errors, timeouts
 }
+
+// collectSource reads counters from the configured counters source instead of executing perfquery
+func (s *SwitchCollector) collectSource() ([]PerfQueryCounters, map[string]SwitchMetrics, float64, float64) {
+	metrics := make(map[string]SwitchMetrics)
+	counters, missing, errors, duration, err := collectSourceCounters(*s.devices, *switchCollectBase, *switchCollectRcvErr, s.logger)
+	if err != nil {
+		level.Error(s.logger).Log("msg", "Error reading counters source", "source", *countersSource, "err", err)
+		errors++
+	}
+	for _, device := range *s.devices {
+		metric := SwitchMetrics{duration: duration, rcvErrDuration: duration}
+		if err != nil || missing[device.GUID] {
+			metric.error = 1
+			metric.rcvErrError = 1
+		}
+		metrics[device.GUID] = metric
+	}
+	errors = errors + float64(len(missing))
+	return counters, metrics, errors, 0
+}
@@ -14,6 +14,8 @@
 package collectors
 
 import (
+	"context"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -166,15 +168,29 @@ func TestSwitchCollector(t *testing.T) {
 		infiniband_switch_uplink_info{guid="0x7cfe9003009ce5b0",port="1",switch="ib-i1l1s01",uplink="ib-i1l2s01",uplink_guid="0x7cfe900300b07320",uplink_lid="1516",uplink_port="1",uplink_type="SW"} 1
 		infiniband_switch_uplink_info{guid="0x7cfe9003009ce5b0",port="10",switch="ib-i1l1s01",uplink="o0001 HCA-1",uplink_guid="0x7cfe9003003b4bde",uplink_lid="134",uplink_port="1",uplink_type="CA"} 1
 		infiniband_switch_uplink_info{guid="0x7cfe9003009ce5b0",port="11",switch="ib-i1l1s01",uplink="o0002 HCA-1",uplink_guid="0x7cfe9003003b4b96",uplink_lid="133",uplink_port="1",uplink_type="CA"} 1
+		# HELP infiniband_switch_ports Infiniband switch number of ports by status
+		# TYPE infiniband_switch_ports gauge
+		infiniband_switch_ports{guid="0x506b4b03005c2740",status="connected"} 1
+		infiniband_switch_ports{guid="0x506b4b03005c2740",status="disconnected"} 1
+		infiniband_switch_ports{guid="0x506b4b03005c2740",status="split"} 0
+		infiniband_switch_ports{guid="0x506b4b03005c2740",status="total"} 2
+		infiniband_switch_ports{guid="0x7cfe9003009ce5b0",status="connected"} 3
+		infiniband_switch_ports{guid="0x7cfe9003009ce5b0",status="disconnected"} 0
+		infiniband_switch_ports{guid="0x7cfe9003009ce5b0",status="split"} 0
+		infiniband_switch_ports{guid="0x7cfe9003009ce5b0",status="total"} 3
+		# HELP infiniband_switch_free_port_info Infiniband switch port that is not connected
+		# TYPE infiniband_switch_free_port_info gauge
+		infiniband_switch_free_port_info{guid="0x506b4b03005c2740",port="37",switch="ib-i4l1s01"} 1
 	`
 	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 89 {
-		t.Errorf("Unexpected collection count %d, expected 89", val)
+	} else if val != 98 {
+		t.Errorf("Unexpected collection count %d, expected 98", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_switch_ports", "infiniband_switch_free_port_info",
 		"infiniband_switch_port_excessive_buffer_overrun_errors_total", "infiniband_switch_port_link_downed_total",
 		"infiniband_switch_port_link_error_recovery_total", "infiniband_switch_port_local_link_integrity_errors_total",
 		"infiniband_switch_port_multicast_receive_packets_total", "infiniband_switch_port_multicast_transmit_packets_total",
@@ -372,8 +388,8 @@ func TestSwitchCollectorFull(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 113 {
-		t.Errorf("Unexpected collection count %d, expected 113", val)
+	} else if val != 122 {
+		t.Errorf("Unexpected collection count %d, expected 122", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_switch_port_excessive_buffer_overrun_errors_total", "infiniband_switch_port_link_downed_total",
@@ -467,7 +483,77 @@ func TestSwitchCollectorNoBase(t *testing.T) {
 	}
 }
 
+func TestSwitchCollectorRcvErrPortError(t *testing.T) {
+	failureCounts = newFailureCounter()
+	if _, err := kingpin.CommandLine.Parse([]string{"--no-collector.switch.base-metrics", "--collector.switch.rcv-err-details"}); err != nil {
+		t.Fatal(err)
+	}
+	defer kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+	SetPerfqueryExecs(t, false, false)
+	fixtureExec := PerfqueryExec
+	PerfqueryExec = func(guid string, port string, extraArgs []string, ctx context.Context) (string, error) {
+		if guid == "0x7cfe9003009ce5b0" && port == "2" && len(extraArgs) == 1 {
+			return "", fmt.Errorf("Error")
+		}
+		return fixtureExec(guid, port, extraArgs, ctx)
+	}
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="switch"} 1
+		# HELP infiniband_switch_collect_error Indicates if collect error
+		# TYPE infiniband_switch_collect_error gauge
+		infiniband_switch_collect_error{collector="switch-rcv-err",guid="0x506b4b03005c2740"} 0
+		infiniband_switch_collect_error{collector="switch-rcv-err",guid="0x7cfe9003009ce5b0"} 1
+		# HELP infiniband_switch_port_local_physical_errors_total Infiniband switch port PortLocalPhysicalErrors
+		# TYPE infiniband_switch_port_local_physical_errors_total counter
+		infiniband_switch_port_local_physical_errors_total{guid="0x506b4b03005c2740",port="1"} 0
+		infiniband_switch_port_local_physical_errors_total{guid="0x7cfe9003009ce5b0",port="1"} 0
+	`
+	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_switch_port_local_physical_errors_total", "infiniband_switch_collect_error", "infiniband_exporter_collect_errors"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestSwitchCollectorRcvErrMAD(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--no-collector.switch.base-metrics", "--collector.switch.rcv-err-details", "--perfquery.rcv-err-source=mad"}); err != nil {
+		t.Fatal(err)
+	}
+	defer kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+	SetPerfqueryExecs(t, false, false)
+	transport := newFakeMADTransport()
+	var opens int
+	NewMADTransport = func(device string) (MADTransport, error) {
+		opens++
+		return transport, nil
+	}
+	defer func() { NewMADTransport = newUmadTransport }()
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="switch"} 0
+		# HELP infiniband_switch_port_local_physical_errors_total Infiniband switch port PortLocalPhysicalErrors
+		# TYPE infiniband_switch_port_local_physical_errors_total counter
+		infiniband_switch_port_local_physical_errors_total{guid="0x506b4b03005c2740",port="1"} 1
+		infiniband_switch_port_local_physical_errors_total{guid="0x7cfe9003009ce5b0",port="1"} 1
+		infiniband_switch_port_local_physical_errors_total{guid="0x7cfe9003009ce5b0",port="2"} 2
+	`
+	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_switch_port_local_physical_errors_total", "infiniband_exporter_collect_errors"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	if opens != 1 || transport.closes != 1 {
+		t.Errorf("Expected one transport for the collection, got %d opens and %d closes", opens, transport.closes)
+	}
+}
+
 func TestSwitchCollectorError(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -484,8 +570,8 @@ func TestSwitchCollectorError(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 23 {
-		t.Errorf("Unexpected collection count %d, expected 23", val)
+	} else if val != 34 {
+		t.Errorf("Unexpected collection count %d, expected 34", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_switch_port_excessive_buffer_overrun_errors_total", "infiniband_switch_port_link_downed_total",
@@ -496,6 +582,7 @@ func TestSwitchCollectorError(t *testing.T) {
 }
 
 func TestSwitchCollectorErrorRunonce(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
@@ -512,8 +599,8 @@ func TestSwitchCollectorErrorRunonce(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 24 {
-		t.Errorf("Unexpected collection count %d, expected 24", val)
+	} else if val != 35 {
+		t.Errorf("Unexpected collection count %d, expected 35", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_switch_port_excessive_buffer_overrun_errors_total", "infiniband_switch_port_link_downed_total",
@@ -524,11 +611,16 @@ func TestSwitchCollectorErrorRunonce(t *testing.T) {
 }
 
 func TestSwitchCollectorTimeout(t *testing.T) {
+	failureCounts = newFailureCounter()
 	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
 		t.Fatal(err)
 	}
 	SetPerfqueryExecs(t, false, true)
 	expected := `
+		# HELP infiniband_exporter_collect_failures_total Number of collection failures by reason
+		# TYPE infiniband_exporter_collect_failures_total counter
+		infiniband_exporter_collect_failures_total{collector="switch",guid="0x506b4b03005c2740",reason="timeout"} 2
+		infiniband_exporter_collect_failures_total{collector="switch",guid="0x7cfe9003009ce5b0",reason="timeout"} 2
 		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
 		# TYPE infiniband_exporter_collect_errors gauge
 		infiniband_exporter_collect_errors{collector="switch"} 0
@@ -540,13 +632,14 @@ func TestSwitchCollectorTimeout(t *testing.T) {
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 23 {
-		t.Errorf("Unexpected collection count %d, expected 23", val)
+	} else if val != 34 {
+		t.Errorf("Unexpected collection count %d, expected 34", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"infiniband_switch_port_excessive_buffer_overrun_errors_total", "infiniband_switch_port_link_downed_total",
 		"infiniband_switch_port_link_error_recovery_total", "infiniband_switch_port_local_link_integrity_errors_total",
-		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts",
+		"infiniband_exporter_collect_failures_total"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
@@ -0,0 +1,249 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// topHistoryExpire is the longest window ports can be ranked over
+	topHistoryExpire = time.Hour
+	// topBucket is the resolution of the increases kept for each port
+	topBucket = time.Minute
+)
+
+var (
+	// TopSorts are the values ports can be ranked by
+	TopSorts    = []string{"throughput", "xmit_wait", "discards", "errors", "symbol_errors"}
+	portHistory = newPortCounterHistory()
+	// Counters summed for the errors ranking
+	topErrorCounters = []string{
+		"SymbolErrorCounter",
+		"LinkErrorRecoveryCounter",
+		"LinkDownedCounter",
+		"PortRcvErrors",
+		"PortRcvRemotePhysicalErrors",
+		"PortRcvSwitchRelayErrors",
+		"PortXmitConstraintErrors",
+		"PortRcvConstraintErrors",
+		"LocalLinkIntegrityErrors",
+		"ExcessiveBufferOverrunErrors",
+		"VL15Dropped",
+	}
+	topSortFields = map[string][]string{
+		"throughput":    {"PortXmitData", "PortRcvData"},
+		"xmit_wait":     {"PortXmitWait"},
+		"discards":      {"PortXmitDiscards"},
+		"errors":        topErrorCounters,
+		"symbol_errors": {"SymbolErrorCounter"},
+	}
+)
+
+type TopPort struct {
+	GUID     string  `json:"guid"`
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Port     string  `json:"port"`
+	Peer     string  `json:"peer"`
+	Rate     float64 `json:"rate"`
+	Delta    float64 `json:"delta"`
+	Value    float64 `json:"value"`
+	Interval float64 `json:"interval_seconds"`
+}
+
+// portIncrease is the increase of each ranking, indexed like TopSorts, between two collections
+type portIncrease struct {
+	start    time.Time
+	end      time.Time
+	increase []float64
+}
+
+// portCounters is the last counters of a port and the increases of the last hour grouped by minute
+type portCounters struct {
+	time     time.Time
+	counters PerfQueryCounters
+	latest   *portIncrease
+	buckets  []portIncrease
+}
+
+type portCounterHistory struct {
+	sync.Mutex
+	ports map[string]*portCounters
+}
+
+func newPortCounterHistory() *portCounterHistory {
+	return &portCounterHistory{
+		ports: make(map[string]*portCounters),
+	}
+}
+
+// record stores counters from one collection, rcv-err counters for the same port are merged
+func (h *portCounterHistory) record(counters []PerfQueryCounters, now time.Time) {
+	merged := make(map[string]PerfQueryCounters)
+	for _, c := range counters {
+		key := fmt.Sprintf("%s-%s", c.device.GUID, c.PortSelect)
+		existing, ok := merged[key]
+		if !ok {
+			merged[key] = c
+			continue
+		}
+		mergeCounters(&existing, c)
+		merged[key] = existing
+	}
+	h.Lock()
+	defer h.Unlock()
+	for key, c := range merged {
+		port, ok := h.ports[key]
+		if !ok {
+			h.ports[key] = &portCounters{time: now, counters: c}
+			continue
+		}
+		if !now.After(port.time) {
+			continue
+		}
+		increase := portIncrease{start: port.time, end: now, increase: make([]float64, len(TopSorts))}
+		for i, sortBy := range TopSorts {
+			increase.increase[i] = counterDelta(port.counters, c, topSortFields[sortBy])
+		}
+		port.latest = &increase
+		if last := len(port.buckets) - 1; last >= 0 && now.Sub(port.buckets[last].start) <= topBucket {
+			port.buckets[last].end = now
+			for i := range increase.increase {
+				port.buckets[last].increase[i] += increase.increase[i]
+			}
+		} else {
+			bucket := increase
+			bucket.increase = append([]float64{}, increase.increase...)
+			port.buckets = append(port.buckets, bucket)
+		}
+		for len(port.buckets) > 0 && now.Sub(port.buckets[0].end) > topHistoryExpire {
+			port.buckets = port.buckets[1:]
+		}
+		mergeCounters(&port.counters, c)
+		port.counters.device = c.device
+		port.time = now
+	}
+	for key, port := range h.ports {
+		if now.Sub(port.time) > topHistoryExpire {
+			delete(h.ports, key)
+		}
+	}
+}
+
+// mergeCounters copies the values that are set in src to dst
+func mergeCounters(dst *PerfQueryCounters, src PerfQueryCounters) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src)
+	for i := 0; i < s.NumField(); i++ {
+		f := s.Field(i)
+		if f.Kind() == reflect.Float64 && !math.IsNaN(f.Float()) {
+			d.Field(i).SetFloat(f.Float())
+		}
+	}
+}
+
+// TopPorts ranks ports by the per second increase over the window, a window of 0 uses the last two collections
+func TopPorts(sortBy string, n int, window time.Duration) ([]TopPort, error) {
+	index := -1
+	for i, name := range TopSorts {
+		if name == sortBy {
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil, fmt.Errorf("Unknown sort %s", sortBy)
+	}
+	if window > topHistoryExpire {
+		return nil, fmt.Errorf("Window %s is longer than the %s history", window, topHistoryExpire)
+	}
+	ports := []TopPort{}
+	portHistory.Lock()
+	for _, current := range portHistory.ports {
+		var delta float64
+		var start time.Time
+		if window == 0 {
+			if current.latest == nil {
+				continue
+			}
+			delta = current.latest.increase[index]
+			start = current.latest.start
+		} else {
+			cutoff := current.time.Add(-window)
+			for _, bucket := range current.buckets {
+				if !bucket.end.After(cutoff) {
+					continue
+				}
+				if start.IsZero() {
+					start = bucket.start
+				}
+				delta += bucket.increase[index]
+			}
+		}
+		interval := current.time.Sub(start).Seconds()
+		if start.IsZero() || interval <= 0 || delta <= 0 {
+			continue
+		}
+		device := current.counters.device
+		port := TopPort{
+			GUID:     device.GUID,
+			Name:     device.Name,
+			Type:     device.Type,
+			Port:     current.counters.PortSelect,
+			Delta:    delta,
+			Value:    delta / interval,
+			Interval: interval,
+		}
+		if uplink, ok := device.Uplinks[port.Port]; ok {
+			port.Peer = uplink.Name
+			port.Rate = uplink.Rate
+		}
+		ports = append(ports, port)
+	}
+	portHistory.Unlock()
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Value != ports[j].Value {
+			return ports[i].Value > ports[j].Value
+		}
+		if ports[i].GUID != ports[j].GUID {
+			return ports[i].GUID < ports[j].GUID
+		}
+		return ports[i].Port < ports[j].Port
+	})
+	if n > 0 && len(ports) > n {
+		ports = ports[:n]
+	}
+	return ports, nil
+}
+
+// counterDelta sums the increase of fields, counters that were reset or not collected are ignored
+func counterDelta(previous PerfQueryCounters, current PerfQueryCounters, fields []string) float64 {
+	var delta float64
+	p := reflect.ValueOf(previous)
+	c := reflect.ValueOf(current)
+	for _, field := range fields {
+		prev := p.FieldByName(field).Float()
+		cur := c.FieldByName(field).Float()
+		if math.IsNaN(prev) || math.IsNaN(cur) || cur < prev {
+			continue
+		}
+		delta += cur - prev
+	}
+	return delta
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func topCounters(device InfinibandDevice, port string, data float64, wait float64) PerfQueryCounters {
+	counters := PerfQueryCounters{device: device, PortSelect: port}
+	initializeCounters(&counters)
+	counters.PortXmitData = data
+	counters.PortRcvData = data
+	counters.PortXmitWait = wait
+	return counters
+}
+
+func topRcvErrCounters(device InfinibandDevice, port string, symbolErrors float64) PerfQueryCounters {
+	counters := PerfQueryCounters{device: device, PortSelect: port}
+	initializeCounters(&counters)
+	counters.SymbolErrorCounter = symbolErrors
+	return counters
+}
+
+func TestTopPorts(t *testing.T) {
+	portHistory = newPortCounterHistory()
+	defer func() { portHistory = newPortCounterHistory() }()
+	now := time.Now()
+	portHistory.record([]PerfQueryCounters{
+		topCounters(switchDevices[1], "1", 1000, 10),
+		topCounters(switchDevices[1], "10", 1000, 10),
+		topRcvErrCounters(switchDevices[1], "10", 5),
+		topCounters(switchDevices[0], "35", 1000, 10),
+	}, now.Add(-10*time.Second))
+	if ports, _ := TopPorts("throughput", 20, 0); len(ports) != 0 {
+		t.Errorf("Expected no ports after one collection, got %v", ports)
+	}
+	portHistory.record([]PerfQueryCounters{
+		topCounters(switchDevices[1], "1", 6000, 10),
+		topCounters(switchDevices[1], "10", 2000, 110),
+		topRcvErrCounters(switchDevices[1], "10", 8),
+		topCounters(switchDevices[0], "35", 500, 10),
+	}, now)
+	ports, err := TopPorts("throughput", 20, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(ports) != 2 {
+		t.Fatalf("Unexpected number of ports, got %d", len(ports))
+	}
+	if ports[0].Port != "1" || ports[0].Value != 1000 || ports[0].Delta != 10000 || ports[0].Interval != 10 {
+		t.Errorf("Unexpected first port, got %v", ports[0])
+	}
+	if ports[0].Peer != "ib-i1l2s01" || ports[0].Name != "ib-i1l1s01" || ports[0].Rate != 25*4*125000000 {
+		t.Errorf("Unexpected first port peer, got %v", ports[0])
+	}
+	if ports[1].Port != "10" || ports[1].Value != 200 {
+		t.Errorf("Unexpected second port, got %v", ports[1])
+	}
+	ports, _ = TopPorts("throughput", 1, 0)
+	if len(ports) != 1 {
+		t.Errorf("Unexpected number of ports, got %d", len(ports))
+	}
+	ports, _ = TopPorts("xmit_wait", 20, 0)
+	if len(ports) != 1 || ports[0].Port != "10" || ports[0].Delta != 100 {
+		t.Errorf("Unexpected xmit_wait ports, got %v", ports)
+	}
+	ports, _ = TopPorts("errors", 20, 0)
+	if len(ports) != 1 || ports[0].Port != "10" || ports[0].Delta != 3 || ports[0].Peer != "o0001 HCA-1" {
+		t.Errorf("Unexpected errors ports, got %v", ports)
+	}
+	if _, err := TopPorts("foo", 20, 0); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestTopPortsWindow(t *testing.T) {
+	portHistory = newPortCounterHistory()
+	defer func() { portHistory = newPortCounterHistory() }()
+	start := time.Now().Add(-2 * time.Hour)
+	// Port 1 has symbol errors early in the hour, port 10 only in the last collection
+	symbolErrors := map[string][]float64{
+		"1":  {0, 30, 60, 60, 60, 60, 60},
+		"10": {0, 0, 0, 0, 0, 0, 10},
+	}
+	for i := 0; i < 7; i++ {
+		now := start.Add(time.Duration(i*10) * time.Minute)
+		portHistory.record([]PerfQueryCounters{
+			topRcvErrCounters(switchDevices[1], "1", symbolErrors["1"][i]),
+			topRcvErrCounters(switchDevices[1], "10", symbolErrors["10"][i]),
+		}, now)
+	}
+	ports, err := TopPorts("symbol_errors", 20, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(ports) != 1 || ports[0].Port != "10" || ports[0].Delta != 10 {
+		t.Errorf("Unexpected ports for last collections, got %v", ports)
+	}
+	ports, _ = TopPorts("symbol_errors", 20, time.Hour)
+	if len(ports) != 2 || ports[0].Port != "1" || ports[0].Delta != 60 || ports[0].Interval != 3600 {
+		t.Errorf("Unexpected ports for last hour, got %v", ports)
+	}
+	ports, _ = TopPorts("symbol_errors", 20, 30*time.Minute)
+	if len(ports) != 1 || ports[0].Port != "10" || ports[0].Interval != 1800 {
+		t.Errorf("Unexpected ports for last 30 minutes, got %v", ports)
+	}
+	if _, err := TopPorts("symbol_errors", 20, 2*time.Hour); err == nil {
+		t.Errorf("Expected error for window longer than history")
+	}
+	// Ports not collected within the history are dropped
+	portHistory.record(nil, start.Add(3*time.Hour))
+	if len(portHistory.ports) != 0 {
+		t.Errorf("Expected expired ports dropped, got %d", len(portHistory.ports))
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	previous := topCounters(switchDevices[0], "35", 100, math.NaN())
+	current := topCounters(switchDevices[0], "35", 50, 10)
+	if val := counterDelta(previous, current, []string{"PortXmitData", "PortXmitWait"}); val != 0 {
+		t.Errorf("Unexpected delta, got %f", val)
+	}
+}
+
+func TestSwitchCollectorRecordsHistory(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	portHistory = newPortCounterHistory()
+	defer func() { portHistory = newPortCounterHistory() }()
+	SetPerfqueryExecs(t, false, false)
+	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if _, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(portHistory.ports) != 3 {
+		t.Errorf("Unexpected history, got %d ports", len(portHistory.ports))
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	CollectUFM         = kingpin.Flag("collector.ufm", "Enable the UFM events and alarms collector").Default("false").Bool()
+	TopologySource     = kingpin.Flag("topology.source", "Source of fabric topology, one of ibnetdiscover or ufm").Default("ibnetdiscover").Enum("ibnetdiscover", "ufm")
+	ufmURL             = kingpin.Flag("ufm.url", "UFM URL, eg https://ufm.example.com").Default("").String()
+	ufmUsername        = kingpin.Flag("ufm.username", "UFM username for basic authentication").Default("").String()
+	ufmPassword        = kingpin.Flag("ufm.password", "UFM password for basic authentication").Default("").Envar("UFM_PASSWORD").String()
+	ufmToken           = kingpin.Flag("ufm.token", "UFM access token, used instead of basic authentication").Default("").Envar("UFM_TOKEN").String()
+	ufmCAFile          = kingpin.Flag("ufm.tls-ca-file", "CA certificate used to verify UFM").Default("").String()
+	ufmInsecure        = kingpin.Flag("ufm.tls-insecure-skip-verify", "Skip verification of UFM certificate").Default("false").Bool()
+	ufmTimeout         = kingpin.Flag("ufm.timeout", "Timeout for UFM API requests").Default("20s").Duration()
+	ufmCounterAttrs    []string
+	ufmAttributePrefix = "Infiniband_"
+	ufmHTTP            = &ufmHTTPClient{}
+)
+
+func init() {
+	for _, name := range perfmgrCounterNames {
+		ufmCounterAttrs = append(ufmCounterAttrs, ufmAttributePrefix+name)
+	}
+	for _, name := range []string{"PortXmitDataExtended", "PortRcvDataExtended", "PortXmitPktsExtended", "PortRcvPktsExtended"} {
+		ufmCounterAttrs = append(ufmCounterAttrs, ufmAttributePrefix+name)
+	}
+	sort.Strings(ufmCounterAttrs)
+}
+
+// ufmHTTPClient is the HTTP client shared by all UFM requests, rebuilt only when the TLS flags change
+type ufmHTTPClient struct {
+	sync.Mutex
+	key    string
+	client *http.Client
+}
+
+type UFMClient struct {
+	url    string
+	client *http.Client
+	logger log.Logger
+}
+
+type UFMSystem struct {
+	GUID string `json:"guid"`
+	Name string `json:"system_name"`
+	Type string `json:"type"`
+}
+
+type UFMPort struct {
+	Name            string `json:"name"`
+	GUID            string `json:"guid"`
+	SystemID        string `json:"system_id"`
+	NodeDescription string `json:"node_description"`
+	Number          int    `json:"number"`
+	LID             int    `json:"lid"`
+	ActiveSpeed     string `json:"active_speed"`
+	ActiveWidth     string `json:"active_width"`
+}
+
+type UFMLink struct {
+	SourceGUID      string `json:"source_guid"`
+	SourcePort      string `json:"source_port"`
+	DestinationGUID string `json:"destination_guid"`
+	DestinationPort string `json:"destination_port"`
+}
+
+type UFMAlarm struct {
+	ID         json.Number `json:"id"`
+	Name       string      `json:"name"`
+	Severity   string      `json:"severity"`
+	ObjectName string      `json:"object_name"`
+}
+
+type UFMEvent struct {
+	ID       json.Number `json:"id"`
+	Name     string      `json:"name"`
+	Severity string      `json:"severity"`
+	Category string      `json:"category"`
+}
+
+// ufmSnapshot is timestamp, object type, object name, attribute then function
+type ufmSnapshot map[string]map[string]map[string]map[string]map[string]float64
+
+func NewUFMClient(logger log.Logger) (*UFMClient, error) {
+	if *ufmURL == "" {
+		return nil, fmt.Errorf("Must specify UFM URL")
+	}
+	client, err := ufmHTTP.get()
+	if err != nil {
+		return nil, err
+	}
+	// Token authentication uses a different API root than basic authentication
+	url := strings.TrimSuffix(*ufmURL, "/") + "/ufmRest"
+	if *ufmToken != "" {
+		url = url + "V3"
+	}
+	return &UFMClient{
+		url:    url,
+		client: client,
+		logger: logger,
+	}, nil
+}
+
+func (u *ufmHTTPClient) get() (*http.Client, error) {
+	u.Lock()
+	defer u.Unlock()
+	key := fmt.Sprintf("%s-%v", *ufmCAFile, *ufmInsecure)
+	if u.client != nil && u.key == key {
+		return u.client, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: *ufmInsecure} //nolint:gosec
+	if *ufmCAFile != "" {
+		ca, err := os.ReadFile(*ufmCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Unable to parse UFM CA file %s", *ufmCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if u.client != nil {
+		u.client.CloseIdleConnections()
+	}
+	u.key = key
+	u.client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: tlsConfig,
+		IdleConnTimeout: 90 * time.Second,
+	}}
+	return u.client, nil
+}
+
+func (c *UFMClient) request(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if *ufmToken != "" {
+		req.Header.Set("Authorization", "Basic "+*ufmToken)
+	} else if *ufmUsername != "" {
+		req.SetBasicAuth(*ufmUsername, *ufmPassword)
+	}
+	level.Debug(c.logger).Log("msg", "UFM request", "method", method, "path", path)
+	resp, err := c.client.Do(req)
+	if ctx.Err() == context.DeadlineExceeded {
+		return ctx.Err()
+	} else if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("UFM request %s %s returned %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Topology returns switches and HCAs from UFM systems, ports and links
+func (c *UFMClient) Topology(ctx context.Context) (*[]InfinibandDevice, *[]InfinibandDevice, error) {
+	var systems []UFMSystem
+	var ports []UFMPort
+	var links []UFMLink
+	if err := c.request(ctx, http.MethodGet, "/resources/systems", nil, &systems); err != nil {
+		return nil, nil, err
+	}
+	if err := c.request(ctx, http.MethodGet, "/resources/ports", nil, &ports); err != nil {
+		return nil, nil, err
+	}
+	if err := c.request(ctx, http.MethodGet, "/resources/links", nil, &links); err != nil {
+		return nil, nil, err
+	}
+	switches, hcas := ufmTopologyParse(systems, ports, links, c.logger)
+	return switches, hcas, nil
+}
+
+func ufmTopologyParse(systems []UFMSystem, ports []UFMPort, links []UFMLink, logger log.Logger) (*[]InfinibandDevice, *[]InfinibandDevice) {
+	var switches, hcas []InfinibandDevice
+	systemTypes := make(map[string]UFMSystem)
+	for _, system := range systems {
+		systemTypes[strings.ToLower(system.GUID)] = system
+	}
+	devices := make(map[string]InfinibandDevice)
+	portIndex := make(map[string]UFMPort)
+	for _, port := range ports {
+		guid, err := normalizeGUID(port.GUID)
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to parse UFM port GUID", "port", port.Name, "err", err)
+			continue
+		}
+		port.GUID = guid
+		number := strconv.Itoa(port.Number)
+		portIndex[ufmPortKey(port.GUID, number)] = port
+		portIndex[ufmPortKey(port.SystemID, number)] = port
+		device, ok := devices[guid]
+		if !ok {
+			device.Uplinks = make(map[string]InfinibandUplink)
+		}
+		system := systemTypes[strings.ToLower(port.SystemID)]
+		device.GUID = guid
+		device.LID = strconv.Itoa(port.LID)
+		if system.Type == "switch" {
+			device.Type = "SW"
+			device.Name = system.Name
+		} else {
+			device.Type = "CA"
+			device.Name = port.NodeDescription
+			if device.Name == "" {
+				device.Name = system.Name
+			}
+			if rawRate, effectiveRate, err := parseRate(port.ActiveWidth, port.ActiveSpeed); err == nil {
+				device.Rate = effectiveRate
+				device.RawRate = rawRate
+			}
+		}
+		devices[guid] = device
+	}
+	addUplink := func(guid string, portNumber string, peerGUID string, peerPortNumber string) {
+		port, ok := portIndex[ufmPortKey(guid, portNumber)]
+		if !ok {
+			level.Debug(logger).Log("msg", "UFM link port not found", "guid", guid, "port", portNumber)
+			return
+		}
+		peer, ok := portIndex[ufmPortKey(peerGUID, peerPortNumber)]
+		if !ok {
+			level.Debug(logger).Log("msg", "UFM link peer port not found", "guid", peerGUID, "port", peerPortNumber)
+			return
+		}
+		device := devices[port.GUID]
+		peerDevice := devices[peer.GUID]
+		uplink := InfinibandUplink{
+			Type:       peerDevice.Type,
+			LID:        peerDevice.LID,
+			PortNumber: peerPortNumber,
+			GUID:       peerDevice.GUID,
+			Name:       peerDevice.Name,
+		}
+		if rawRate, effectiveRate, err := parseRate(port.ActiveWidth, port.ActiveSpeed); err == nil {
+			uplink.Rate = effectiveRate
+			uplink.RawRate = rawRate
+		} else {
+			level.Debug(logger).Log("msg", "Unable to parse UFM port speed", "port", port.Name, "err", err)
+		}
+		device.Uplinks[portNumber] = uplink
+	}
+	for _, link := range links {
+		addUplink(link.SourceGUID, link.SourcePort, link.DestinationGUID, link.DestinationPort)
+		addUplink(link.DestinationGUID, link.DestinationPort, link.SourceGUID, link.SourcePort)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Number < ports[j].Number })
+	for _, port := range ports {
+		number := strconv.Itoa(port.Number)
+		guid, err := normalizeGUID(port.GUID)
+		if err != nil {
+			continue
+		}
+		device := devices[guid]
+		if _, ok := device.Uplinks[number]; !ok {
+			device.FreePorts = append(device.FreePorts, number)
+			devices[guid] = device
+		}
+	}
+	deviceGUIDs := getDeviceGUIDs(devices)
+	sort.Strings(deviceGUIDs)
+	for _, guid := range deviceGUIDs {
+		device := devices[guid]
+		switch device.Type {
+		case "CA":
+			hcas = append(hcas, device)
+		case "SW":
+			switches = append(switches, device)
+		}
+	}
+	return &switches, &hcas
+}
+
+func ufmPortKey(guid string, port string) string {
+	return fmt.Sprintf("%s_%s", strings.TrimPrefix(strings.ToLower(guid), "0x"), port)
+}
+
+// PortCounters returns the port counters from a UFM monitoring snapshot
+func (c *UFMClient) PortCounters(ctx context.Context) (SourceCounters, float64, error) {
+	var snapshot ufmSnapshot
+	body := map[string]interface{}{
+		"scope_object":   "site",
+		"monitor_object": "Port",
+		"attributes":     ufmCounterAttrs,
+		"functions":      []string{"RAW"},
+		"interval":       0,
+	}
+	if err := c.request(ctx, http.MethodPost, "/monitoring/snapshot", body, &snapshot); err != nil {
+		return nil, 0, err
+	}
+	counters, errors := ufmCountersParse(snapshot, c.logger)
+	return counters, errors, nil
+}
+
+func ufmCountersParse(snapshot ufmSnapshot, logger log.Logger) (SourceCounters, float64) {
+	counters := make(SourceCounters)
+	var errors float64
+	for _, objects := range snapshot {
+		for name, attributes := range objects["Port"] {
+			items := strings.Split(name, "_")
+			if len(items) != 2 {
+				level.Error(logger).Log("msg", "Unable to parse UFM port name", "name", name)
+				errors++
+				continue
+			}
+			guid, err := normalizeGUID(items[0])
+			if err != nil {
+				level.Error(logger).Log("msg", "Unable to parse UFM port GUID", "name", name, "err", err)
+				errors++
+				continue
+			}
+			values := make(map[string]string)
+			for attribute, functions := range attributes {
+				if value, ok := functions["RAW"]; ok {
+					values[strings.TrimPrefix(attribute, ufmAttributePrefix)] = strconv.FormatFloat(value, 'f', -1, 64)
+				}
+			}
+			counter := counters.counter(guid, items[1])
+			errors = errors + setSourceCounterValues(&counter, values, logger)
+			counters[guid][items[1]] = counter
+		}
+	}
+	return counters, errors
+}
+
+type UFMDiscover struct {
+	timeoutMetric float64
+	errorMetric   float64
+	duration      float64
+	logger        log.Logger
+	collector     string
+}
+
+func NewUFMDiscover(runonce bool, logger log.Logger) *UFMDiscover {
+	collector := "ufm-topology"
+	if runonce {
+		collector = "ufm-topology-runonce"
+	}
+	return &UFMDiscover{
+		logger:    log.With(logger, "collector", collector),
+		collector: collector,
+	}
+}
+
+func (u *UFMDiscover) GetPorts() (*[]InfinibandDevice, *[]InfinibandDevice, error) {
+	collectTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), *ufmTimeout)
+	defer cancel()
+	var switches, hcas *[]InfinibandDevice
+	client, err := NewUFMClient(u.logger)
+	if err == nil {
+		switches, hcas, err = client.Topology(ctx)
+	}
+	u.duration = time.Since(collectTime).Seconds()
+	if err == context.DeadlineExceeded {
+		level.Error(u.logger).Log("msg", "Timeout collecting topology from UFM")
+		u.timeoutMetric = 1
+	} else if err != nil {
+		level.Error(u.logger).Log("msg", "Error collecting topology from UFM", "err", err)
+		u.errorMetric = 1
+	} else {
+		recordTopology(switches, hcas, u.logger)
+	}
+	return switches, hcas, err
+}
+
+func (u *UFMDiscover) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (u *UFMDiscover) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, u.errorMetric, u.collector)
+	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, u.timeoutMetric, u.collector)
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, u.duration, u.collector)
+	if strings.HasSuffix(u.collector, "-runonce") {
+		ch <- prometheus.MustNewConstMetric(lastExecution, prometheus.GaugeValue, float64(time.Now().Unix()), u.collector)
+	}
+}
+
+type UFMCollector struct {
+	logger      log.Logger
+	collector   string
+	Alarms      *prometheus.Desc
+	AlarmInfo   *prometheus.Desc
+	Events      *prometheus.Desc
+	LastEventID *prometheus.Desc
+}
+
+func NewUFMCollector(runonce bool, logger log.Logger) *UFMCollector {
+	collector := "ufm"
+	if runonce {
+		collector = "ufm-runonce"
+	}
+	return &UFMCollector{
+		logger:    log.With(logger, "collector", collector),
+		collector: collector,
+		Alarms: prometheus.NewDesc(prometheus.BuildFQName(namespace, "ufm", "alarms"),
+			"Number of active UFM alarms", []string{"severity"}, nil),
+		AlarmInfo: prometheus.NewDesc(prometheus.BuildFQName(namespace, "ufm", "alarm_info"),
+			"Active UFM alarm information", []string{"id", "name", "severity", "object"}, nil),
+		Events: prometheus.NewDesc(prometheus.BuildFQName(namespace, "ufm", "events"),
+			"Number of events in the UFM event log", []string{"severity", "category"}, nil),
+		LastEventID: prometheus.NewDesc(prometheus.BuildFQName(namespace, "ufm", "last_event_id"),
+			"ID of the most recent UFM event", nil, nil),
+	}
+}
+
+func (u *UFMCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- u.Alarms
+	ch <- u.AlarmInfo
+	ch <- u.Events
+	ch <- u.LastEventID
+}
+
+func (u *UFMCollector) Collect(ch chan<- prometheus.Metric) {
+	collectTime := time.Now()
+	alarms, events, errors, timeouts := u.collect()
+	alarmCounts := make(map[string]float64)
+	for _, alarm := range alarms {
+		alarmCounts[alarm.Severity]++
+		ch <- prometheus.MustNewConstMetric(u.AlarmInfo, prometheus.GaugeValue, 1, alarm.ID.String(), alarm.Name, alarm.Severity, alarm.ObjectName)
+	}
+	for severity, count := range alarmCounts {
+		ch <- prometheus.MustNewConstMetric(u.Alarms, prometheus.GaugeValue, count, severity)
+	}
+	eventCounts := make(map[[2]string]float64)
+	var lastEventID float64
+	for _, event := range events {
+		eventCounts[[2]string{event.Severity, event.Category}]++
+		if id, err := event.ID.Float64(); err == nil && id > lastEventID {
+			lastEventID = id
+		}
+	}
+	for key, count := range eventCounts {
+		ch <- prometheus.MustNewConstMetric(u.Events, prometheus.GaugeValue, count, key[0], key[1])
+	}
+	if events != nil {
+		ch <- prometheus.MustNewConstMetric(u.LastEventID, prometheus.GaugeValue, lastEventID)
+	}
+	ch <- prometheus.MustNewConstMetric(collectErrors, prometheus.GaugeValue, errors, u.collector)
+	ch <- prometheus.MustNewConstMetric(collecTimeouts, prometheus.GaugeValue, timeouts, u.collector)
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), u.collector)
+	if strings.HasSuffix(u.collector, "-runonce") {
+		ch <- prometheus.MustNewConstMetric(lastExecution, prometheus.GaugeValue, float64(time.Now().Unix()), u.collector)
+	}
+}
+
+func (u *UFMCollector) collect() ([]UFMAlarm, []UFMEvent, float64, float64) {
+	var alarms []UFMAlarm
+	var events []UFMEvent
+	var errors, timeouts float64
+	client, err := NewUFMClient(u.logger)
+	if err != nil {
+		level.Error(u.logger).Log("msg", "Error creating UFM client", "err", err)
+		return nil, nil, 1, 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *ufmTimeout)
+	defer cancel()
+	for path, v := range map[string]interface{}{"/app/alarms": &alarms, "/app/events": &events} {
+		err := client.request(ctx, http.MethodGet, path, nil, v)
+		if err == context.DeadlineExceeded {
+			level.Error(u.logger).Log("msg", "Timeout collecting from UFM", "path", path)
+			timeouts++
+		} else if err != nil {
+			level.Error(u.logger).Log("msg", "Error collecting from UFM", "path", path, "err", err)
+			errors++
+		}
+	}
+	return alarms, events, errors, timeouts
+}
@@ -0,0 +1,277 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectors
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	ufmFixtures = map[string]string{
+		"GET /resources/systems":    "systems",
+		"GET /resources/ports":      "ports",
+		"GET /resources/links":      "links",
+		"POST /monitoring/snapshot": "snapshot",
+		"GET /app/alarms":           "alarms",
+		"GET /app/events":           "events",
+	}
+)
+
+func newUFMServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var path string
+		if strings.HasPrefix(r.URL.Path, "/ufmRestV3/") {
+			if r.Header.Get("Authorization") != "Basic secret-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			path = strings.TrimPrefix(r.URL.Path, "/ufmRestV3")
+		} else {
+			if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "123456" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			path = strings.TrimPrefix(r.URL.Path, "/ufmRest")
+		}
+		fixture, ok := ufmFixtures[r.Method+" "+path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		out, err := ReadFixture("ufm", fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		//nolint:errcheck
+		w.Write([]byte(out))
+	}))
+}
+
+func setUFMFlags(t *testing.T, args ...string) {
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestUFMClientReused(t *testing.T) {
+	setUFMFlags(t, "--ufm.url=https://ufm.example.com")
+	first, err := NewUFMClient(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewUFMClient(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.client != second.client {
+		t.Errorf("Expected HTTP client reused between UFM clients")
+	}
+	setUFMFlags(t, "--ufm.url=https://ufm.example.com", "--ufm.tls-insecure-skip-verify")
+	third, err := NewUFMClient(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.client == first.client {
+		t.Errorf("Expected new HTTP client when TLS flags change")
+	}
+}
+
+func TestUFMTopology(t *testing.T) {
+	server := newUFMServer(t)
+	defer server.Close()
+	setUFMFlags(t, "--ufm.url="+server.URL, "--ufm.username=admin", "--ufm.password=123456")
+	client, err := NewUFMClient(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	switches, hcas, err := client.Topology(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(*switches) != 2 {
+		t.Fatalf("Unexpected number of switches, got %d", len(*switches))
+	}
+	if len(*hcas) != 2 {
+		t.Fatalf("Unexpected number of HCAs, got %d", len(*hcas))
+	}
+	sw := (*switches)[0]
+	if sw.GUID != "0x7cfe9003009ce5b0" || sw.Name != "ib-i1l1s01" || sw.LID != "1719" || sw.Type != "SW" {
+		t.Errorf("Unexpected switch, got %v", sw)
+	}
+	if len(sw.Uplinks) != 3 {
+		t.Errorf("Unexpected number of uplinks, got %d", len(sw.Uplinks))
+	}
+	if val := sw.Uplinks["10"]; val != switchDevices[1].Uplinks["10"] {
+		t.Errorf("Unexpected uplink, got %v", val)
+	}
+	if !reflect.DeepEqual(sw.FreePorts, []string{"12"}) {
+		t.Errorf("Unexpected free ports, got %v", sw.FreePorts)
+	}
+	if val := sw.Uplinks["1"]; val.Name != "ib-i1l2s01" || val.Type != "SW" || val.LID != "1516" {
+		t.Errorf("Unexpected uplink, got %v", val)
+	}
+	hca := (*hcas)[1]
+	if hca.GUID != hcaDevices[1].GUID || hca.Name != hcaDevices[1].Name || hca.LID != hcaDevices[1].LID || hca.Rate != hcaDevices[1].Rate {
+		t.Errorf("Unexpected HCA, got %v", hca)
+	}
+	if val := hca.Uplinks["1"]; val.Name != "ib-i1l1s01" || val.PortNumber != "10" || val.GUID != "0x7cfe9003009ce5b0" {
+		t.Errorf("Unexpected HCA uplink, got %v", val)
+	}
+}
+
+func TestUFMToken(t *testing.T) {
+	server := newUFMServer(t)
+	defer server.Close()
+	setUFMFlags(t, "--ufm.url="+server.URL+"/", "--ufm.token=secret-token")
+	discover := NewUFMDiscover(false, log.NewNopLogger())
+	switches, _, err := discover.GetPorts()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(*switches) != 2 {
+		t.Errorf("Unexpected number of switches, got %d", len(*switches))
+	}
+}
+
+func TestUFMDiscoverError(t *testing.T) {
+	server := newUFMServer(t)
+	defer server.Close()
+	setUFMFlags(t, "--ufm.url="+server.URL, "--ufm.username=admin", "--ufm.password=wrong")
+	discover := NewUFMDiscover(false, log.NewNopLogger())
+	if _, _, err := discover.GetPorts(); err == nil {
+		t.Errorf("Expected error")
+	}
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="ufm-topology"} 1
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="ufm-topology"} 0
+	`
+	gatherers := setupGatherer(discover)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestSwitchCollectorUFM(t *testing.T) {
+	server := newUFMServer(t)
+	defer server.Close()
+	setUFMFlags(t, "--counters.source=ufm", "--ufm.url="+server.URL, "--ufm.username=admin", "--ufm.password=123456")
+	SetPerfqueryExecs(t, true, false)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="switch"} 2
+		# HELP infiniband_switch_collect_error Indicates if collect error
+		# TYPE infiniband_switch_collect_error gauge
+		infiniband_switch_collect_error{collector="switch",guid="0x506b4b03005c2740"} 1
+		infiniband_switch_collect_error{collector="switch",guid="0x7cfe9003009ce5b0"} 0
+		# HELP infiniband_switch_port_link_downed_total Infiniband switch port LinkDownedCounter
+		# TYPE infiniband_switch_port_link_downed_total counter
+		infiniband_switch_port_link_downed_total{guid="0x7cfe9003009ce5b0",port="1"} 0
+		infiniband_switch_port_link_downed_total{guid="0x7cfe9003009ce5b0",port="10"} 0
+		infiniband_switch_port_link_downed_total{guid="0x7cfe9003009ce5b0",port="11"} 3
+		# HELP infiniband_switch_port_transmit_data_bytes_total Infiniband switch port PortXmitData
+		# TYPE infiniband_switch_port_transmit_data_bytes_total counter
+		infiniband_switch_port_transmit_data_bytes_total{guid="0x7cfe9003009ce5b0",port="1"} 4000
+		infiniband_switch_port_transmit_data_bytes_total{guid="0x7cfe9003009ce5b0",port="10"} 12000
+		infiniband_switch_port_transmit_data_bytes_total{guid="0x7cfe9003009ce5b0",port="11"} 20000
+	`
+	collector := NewSwitchCollector(&switchDevices, false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_switch_collect_error",
+		"infiniband_switch_port_link_downed_total", "infiniband_switch_port_transmit_data_bytes_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestUFMCollector(t *testing.T) {
+	server := newUFMServer(t)
+	defer server.Close()
+	setUFMFlags(t, "--ufm.url="+server.URL, "--ufm.username=admin", "--ufm.password=123456")
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="ufm"} 0
+		# HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
+		# TYPE infiniband_exporter_collect_timeouts gauge
+		infiniband_exporter_collect_timeouts{collector="ufm"} 0
+		# HELP infiniband_ufm_alarm_info Active UFM alarm information
+		# TYPE infiniband_ufm_alarm_info gauge
+		infiniband_ufm_alarm_info{id="12",name="Link is down",object="7cfe9003009ce5b0_12",severity="Critical"} 1
+		infiniband_ufm_alarm_info{id="15",name="Symbol error rate",object="7cfe9003009ce5b0_1",severity="Warning"} 1
+		# HELP infiniband_ufm_alarms Number of active UFM alarms
+		# TYPE infiniband_ufm_alarms gauge
+		infiniband_ufm_alarms{severity="Critical"} 1
+		infiniband_ufm_alarms{severity="Warning"} 1
+		# HELP infiniband_ufm_events Number of events in the UFM event log
+		# TYPE infiniband_ufm_events gauge
+		infiniband_ufm_events{category="Communication Error",severity="Warning"} 1
+		infiniband_ufm_events{category="Fabric Topology",severity="Critical"} 1
+		infiniband_ufm_events{category="Fabric Topology",severity="Info"} 2
+		# HELP infiniband_ufm_last_event_id ID of the most recent UFM event
+		# TYPE infiniband_ufm_last_event_id gauge
+		infiniband_ufm_last_event_id 1004
+	`
+	collector := NewUFMCollector(false, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 11 {
+		t.Errorf("Unexpected collection count %d, expected 11", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"infiniband_exporter_collect_errors", "infiniband_exporter_collect_timeouts",
+		"infiniband_ufm_alarm_info", "infiniband_ufm_alarms", "infiniband_ufm_events", "infiniband_ufm_last_event_id"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestUFMCollectorError(t *testing.T) {
+	setUFMFlags(t)
+	expected := `
+		# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
+		# TYPE infiniband_exporter_collect_errors gauge
+		infiniband_exporter_collect_errors{collector="ufm-runonce"} 1
+	`
+	collector := NewUFMCollector(true, log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 4 {
+		t.Errorf("Unexpected collection count %d, expected 4", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected), "infiniband_exporter_collect_errors"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ruleSymbolErrors  = "symbol_errors"
+	ruleLinkDowned    = "link_downed"
+	ruleTemperature   = "temperature"
+	ruleFanRPM        = "fan_rpm"
+	ruleFanStatus     = "fan_status"
+	rulePSUStatus     = "psu_status"
+	ruleDegradedLinks = "degraded_links"
+)
+
+var (
+	configFile  = kingpin.Flag("config.file", "Path to exporter configuration file").Default("").String()
+	rulesOutput = kingpin.Flag("rules.output", "Write a Prometheus rule file matching the rules of the configuration file to this path and exit").Default("").String()
+	// Rule types that do not compare against a threshold
+	statusRuleTypes = map[string]bool{ruleFanStatus: true, rulePSUStatus: true}
+	// Rule types evaluated over a window of counter values
+	counterRuleTypes = map[string]bool{ruleSymbolErrors: true, ruleLinkDowned: true}
+	ruleTypes        = []string{ruleSymbolErrors, ruleLinkDowned, ruleTemperature, ruleFanRPM, ruleFanStatus, rulePSUStatus, ruleDegradedLinks}
+)
+
+type exporterConfig struct {
+	Rules []alertRule `yaml:"rules"`
+}
+
+// alertRule is a threshold the exporter evaluates against its collected data
+type alertRule struct {
+	Name      string         `yaml:"name"`
+	Type      string         `yaml:"type"`
+	Threshold float64        `yaml:"threshold"`
+	Window    model.Duration `yaml:"window"`
+	For       model.Duration `yaml:"for"`
+	Severity  string         `yaml:"severity"`
+}
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string           `yaml:"name"`
+	Rules []prometheusRule `yaml:"rules"`
+}
+
+type prometheusRule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+func loadConfig(path string) (*exporterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &exporterConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("Unable to parse configuration file %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("Rule %d has no name", i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("Rule %s is defined more than once", rule.Name)
+		}
+		names[rule.Name] = true
+		if !stringInSlice(rule.Type, ruleTypes) {
+			return nil, fmt.Errorf("Rule %s has unknown type %s, must be one of %v", rule.Name, rule.Type, ruleTypes)
+		}
+		if !statusRuleTypes[rule.Type] && rule.Threshold <= 0 {
+			return nil, fmt.Errorf("Rule %s of type %s requires a threshold", rule.Name, rule.Type)
+		}
+		if counterRuleTypes[rule.Type] && rule.Window == 0 {
+			rule.Window = model.Duration(time.Hour)
+		}
+		if rule.Severity == "" {
+			rule.Severity = "warning"
+		}
+	}
+	return config, nil
+}
+
+func stringInSlice(value string, list []string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func formatThreshold(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// ruleExpr returns the PromQL expression and annotation of a rule
+func ruleExpr(rule alertRule) (string, string) {
+	threshold := formatThreshold(rule.Threshold)
+	switch rule.Type {
+	case ruleSymbolErrors:
+		return fmt.Sprintf(`rate({__name__=~"infiniband_(switch|hca)_port_symbol_error_total"}[%s]) * 3600 > %s`, rule.Window, threshold),
+			"InfiniBand port {{ $labels.port }} of {{ $labels.guid }} has {{ $value | humanize }} symbol errors per hour"
+	case ruleLinkDowned:
+		return fmt.Sprintf(`increase({__name__=~"infiniband_(switch|hca)_port_link_downed_total"}[%s]) >= %s`, rule.Window, threshold),
+			fmt.Sprintf("InfiniBand port {{ $labels.port }} of {{ $labels.guid }} link went down {{ $value | humanize }} times in %s", rule.Window)
+	case ruleTemperature:
+		return fmt.Sprintf(`(infiniband_switch_temperature_celsius * ON(guid) group_left(switch) infiniband_switch_info) > %s`, threshold),
+			"Infiniband switch {{ $labels.switch }} has temperature {{ $value }}C"
+	case ruleFanRPM:
+		return fmt.Sprintf(`(min by (guid) (infiniband_switch_fan_rpm) * ON(guid) group_left(switch) infiniband_switch_info) < %s`, threshold),
+			"Infiniband switch {{ $labels.switch }} has a fan at {{ $value }} RPM"
+	case ruleFanStatus:
+		return `(infiniband_switch_fan_status_info{status!="OK"} * ON(guid) group_left(switch) infiniband_switch_info) == 1`,
+			"Infiniband switch {{ $labels.switch }} has fan status {{ $labels.status }}"
+	case rulePSUStatus:
+		return `(infiniband_switch_power_supply_status_info{status!="OK"} * ON(guid) group_left(switch) infiniband_switch_info) == 1`,
+			"Infiniband switch {{ $labels.switch }} has power supply status {{ $labels.status }} on PSU {{ $labels.psu }}"
+	case ruleDegradedLinks:
+		return fmt.Sprintf(`(infiniband_switch_port_rate_bytes_per_second or label_replace(infiniband_hca_rate_bytes_per_second, "port", "1", "", "")) * 8 / 1e9 < %s`, threshold),
+			"InfiniBand port {{ $labels.port }} of {{ $labels.guid }} is running at {{ $value }} Gb/s"
+	}
+	return "", ""
+}
+
+func recordingRules() []ruleGroup {
+	trafficCounters := []string{"transmit_data_bytes", "receive_data_bytes", "transmit_packets", "receive_packets",
+		"unicast_transmit_packets", "unicast_receive_packets", "multicast_transmit_packets", "multicast_receive_packets"}
+	errorCounters := []string{"symbol_error", "link_error_recovery", "link_downed", "receive_errors", "receive_remote_physical_errors",
+		"receive_switch_relay_errors", "transmit_discards", "transmit_constraint_errors", "receive_constraint_errors",
+		"local_link_integrity_errors", "excessive_buffer_overrun_errors", "vl15_dropped", "transmit_wait", "qp1_dropped"}
+	port := ruleGroup{Name: "infiniband-record"}
+	switches := ruleGroup{Name: "infiniband-record-switch"}
+	for _, counter := range append(trafficCounters, errorCounters...) {
+		functions := []string{"irate", "rate"}
+		if stringInSlice(counter, errorCounters) {
+			functions = []string{"delta", "irate", "rate"}
+		}
+		for _, function := range functions {
+			port.Rules = append(port.Rules, prometheusRule{
+				Record: fmt.Sprintf("infiniband:switch_port_%s:%s5m", counter, function),
+				Expr:   fmt.Sprintf("%s(infiniband_switch_port_%s_total[5m]) * on(guid,port) group_left(switch, host, uplink, uplink_port) infiniband_switch_uplink_info", function, counter),
+			})
+		}
+		for _, function := range []string{"irate", "rate"} {
+			switches.Rules = append(switches.Rules, prometheusRule{
+				Record: fmt.Sprintf("infiniband:switch_port_%s:switch_%s5m", counter, function),
+				Expr:   fmt.Sprintf("sum(infiniband:switch_port_%s:%s5m) without (host, port, uplink, uplink_port)", counter, function),
+			})
+		}
+	}
+	return []ruleGroup{port, switches}
+}
+
+func collectorAlerts() []prometheusRule {
+	labels := map[string]string{"severity": "warning", "alertgroup": "infiniband"}
+	return []prometheusRule{
+		{Alert: "InfinibandCollectError", Expr: "infiniband_exporter_collect_errors > 0", For: "5m", Labels: labels, Annotations: map[string]string{
+			"title":       "InfiniBand collector {{ $labels.collector }} for {{ $labels.instance }} has {{ $value }} errors",
+			"description": "InfiniBand collector {{ $labels.collector }} for {{ $labels.instance }} has {{ $value }} errors",
+		}},
+		{Alert: "InfinibandCollectTimeout", Expr: "infiniband_exporter_collect_timeouts > 0", For: "5m", Labels: labels, Annotations: map[string]string{
+			"title":       "InfiniBand collector {{ $labels.collector }} for {{ $labels.instance }} has {{ $value }} time outs",
+			"description": "InfiniBand collector {{ $labels.collector }} for {{ $labels.instance }} has {{ $value }} time outs",
+		}},
+		{Alert: "InfinibandCollectorStale", Expr: "(time() - infiniband_exporter_last_execution) > 900", For: "10m", Labels: labels, Annotations: map[string]string{
+			"title":       "Infiniband collector {{ $labels.collector }} on {{ $labels.instance }} is stale",
+			"description": "Infiniband collector {{ $labels.collector }} on {{ $labels.instance }} has not run in {{ $value | humanizeDuration }}",
+		}},
+		{Alert: "InfinibandSwitchDCPowerStatus", Expr: `(infiniband_switch_power_supply_dc_power_status_info{status!="OK"} * ON(guid) group_left(switch) infiniband_switch_info) == 1`, For: "10m", Labels: labels, Annotations: map[string]string{
+			"title":       "Infiniband switch {{ $labels.switch }} has DC Power status {{ $labels.status }} on PSU {{ $labels.psu }}",
+			"description": "Infiniband switch {{ $labels.switch }} has DC Power status {{ $labels.status }} on PSU {{ $labels.psu }}",
+		}},
+		{Alert: "InfinibandSwitchPowerSupplyFanStatus", Expr: `(infiniband_switch_power_supply_fan_status_info{status!="OK"} * ON(guid) group_left(switch) infiniband_switch_info) == 1`, For: "10m", Labels: labels, Annotations: map[string]string{
+			"title":       "Infiniband switch {{ $labels.switch }} has power supply fan status {{ $labels.status }} on PSU {{ $labels.psu }}",
+			"description": "Infiniband switch {{ $labels.switch }} has power supply fan status {{ $labels.status }} on PSU {{ $labels.psu }}",
+		}},
+	}
+}
+
+// generateRules returns a Prometheus rule file with the recording rules, collector alerts and an alert for each configured rule
+func generateRules(config *exporterConfig) ([]byte, error) {
+	alerts := ruleGroup{Name: "infiniband", Rules: collectorAlerts()}
+	for _, rule := range config.Rules {
+		expr, annotation := ruleExpr(rule)
+		alert := prometheusRule{
+			Alert:       rule.Name,
+			Expr:        expr,
+			Labels:      map[string]string{"severity": rule.Severity, "alertgroup": "infiniband"},
+			Annotations: map[string]string{"title": annotation, "description": annotation},
+		}
+		if rule.For > 0 {
+			alert.For = rule.For.String()
+		}
+		alerts.Rules = append(alerts.Rules, alert)
+	}
+	file := ruleFile{Groups: append(recordingRules(), alerts)}
+	// Keep expressions on one line
+	yaml.FutureLineWrap()
+	return yaml.Marshal(file)
+}
+
+func writeRules(config *exporterConfig, path string) error {
+	data, err := generateRules(config)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, `
+rules:
+- name: SymbolErrors
+  type: symbol_errors
+  threshold: 10
+- name: PSU
+  type: psu_status
+  severity: critical
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.Rules) != 2 {
+		t.Fatalf("Unexpected rules: %v", config.Rules)
+	}
+	if time.Duration(config.Rules[0].Window) != time.Hour || config.Rules[0].Severity != "warning" {
+		t.Errorf("Unexpected defaults: %v", config.Rules[0])
+	}
+	if config.Rules[1].Window != 0 || config.Rules[1].Severity != "critical" {
+		t.Errorf("Unexpected status rule: %v", config.Rules[1])
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"has no name":              "rules:\n- type: temperature\n  threshold: 70\n",
+		"defined more than once":   "rules:\n- name: A\n  type: fan_status\n- name: A\n  type: psu_status\n",
+		"unknown type":             "rules:\n- name: A\n  type: humidity\n",
+		"requires a threshold":     "rules:\n- name: A\n  type: temperature\n",
+		"Unable to parse":          "rules:\n- name: A\n  type: temperature\n  threshold: 70\n  unknown: 1\n",
+		"unknown unit":             "rules:\n- name: A\n  type: link_downed\n  threshold: 1\n  window: 1x\n",
+		"no such file or director": "",
+	}
+	for expected, content := range tests {
+		path := filepath.Join(t.TempDir(), "missing.yml")
+		if content != "" {
+			path = writeConfig(t, content)
+		}
+		_, err := loadConfig(path)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error containing %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestGenerateRulesExample(t *testing.T) {
+	config, err := loadConfig("examples/infiniband_exporter.yml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := generateRules(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected, err := os.ReadFile("examples/infiniband.rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(expected) {
+		t.Errorf("examples/infiniband.rules does not match examples/infiniband_exporter.yml, regenerate it with --rules.output")
+	}
+}
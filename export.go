@@ -0,0 +1,234 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	formatPrometheus  = "prometheus"
+	formatInflux      = "influx"
+	formatJSON        = "json"
+	influxContentType = "text/plain; charset=utf-8"
+	jsonContentType   = "application/x-ndjson"
+)
+
+var (
+	outputFormat       = kingpin.Flag("exporter.output-format", "Format of the runonce output file, one of prometheus, influx or json").Default(formatPrometheus).Enum(formatPrometheus, formatInflux, formatJSON)
+	influxMeasurement  = kingpin.Flag("exporter.influx-measurement", "Measurement name used by the influx output format").Default("infiniband").String()
+	influxEscaper      = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+)
+
+type sampleLabel struct {
+	Name  string
+	Value string
+}
+
+// sample is a single value of a gathered metric family
+type sample struct {
+	Name      string
+	Labels    []sampleLabel
+	Value     float64
+	Timestamp int64
+}
+
+// gatheredSamples flattens metric families into samples, using now when metrics have no timestamp
+func gatheredSamples(mfs []*dto.MetricFamily, now time.Time) []sample {
+	var samples []sample
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			timestamp := now.UnixMilli()
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+			var labels []sampleLabel
+			for _, label := range m.GetLabel() {
+				labels = append(labels, sampleLabel{Name: label.GetName(), Value: label.GetValue()})
+			}
+			add := func(name string, value float64, extra ...sampleLabel) {
+				samples = append(samples, sample{Name: name, Labels: append(labels[:len(labels):len(labels)], extra...), Value: value, Timestamp: timestamp})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add(name, q.GetValue(), sampleLabel{Name: "quantile", Value: formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", m.GetSummary().GetSampleSum())
+				add(name+"_count", float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				for _, b := range m.GetHistogram().GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), sampleLabel{Name: "le", Value: formatFloat(b.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(m.GetHistogram().GetSampleCount()), sampleLabel{Name: "le", Value: "+Inf"})
+				add(name+"_sum", m.GetHistogram().GetSampleSum())
+				add(name+"_count", float64(m.GetHistogram().GetSampleCount()))
+			default:
+				add(name, m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return samples
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sampleRecord is the values of all metrics sharing the same labels and timestamp, such as the counters of a port
+type sampleRecord struct {
+	Timestamp time.Time          `json:"timestamp"`
+	Labels    map[string]string  `json:"labels"`
+	Values    map[string]float64 `json:"values"`
+}
+
+// sampleRecords groups samples by labels and timestamp, values that are not finite are skipped
+func sampleRecords(samples []sample) []sampleRecord {
+	var records []sampleRecord
+	index := make(map[string]int)
+	for _, s := range samples {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		labels := append([]sampleLabel{}, s.Labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+		var key strings.Builder
+		key.WriteString(strconv.FormatInt(s.Timestamp, 10))
+		for _, label := range labels {
+			key.WriteString("\xff" + label.Name + "\xff" + label.Value)
+		}
+		i, ok := index[key.String()]
+		if !ok {
+			record := sampleRecord{Timestamp: time.UnixMilli(s.Timestamp).UTC(), Labels: make(map[string]string), Values: make(map[string]float64)}
+			for _, label := range labels {
+				record.Labels[label.Name] = label.Value
+			}
+			i = len(records)
+			index[key.String()] = i
+			records = append(records, record)
+		}
+		records[i].Values[s.Name] = s.Value
+	}
+	return records
+}
+
+// writeInflux writes records as InfluxDB line protocol, labels are tags and metrics are fields
+func writeInflux(w io.Writer, records []sampleRecord) error {
+	bw := bufio.NewWriter(w)
+	for _, record := range records {
+		bw.WriteString(measurementEscaper.Replace(*influxMeasurement))
+		for _, name := range sortedKeys(record.Labels) {
+			// Influx does not allow empty tag values
+			if record.Labels[name] == "" {
+				continue
+			}
+			bw.WriteString("," + influxEscaper.Replace(name) + "=" + influxEscaper.Replace(record.Labels[name]))
+		}
+		for i, name := range sortedKeys(record.Values) {
+			sep := ","
+			if i == 0 {
+				sep = " "
+			}
+			bw.WriteString(sep + influxEscaper.Replace(name) + "=" + strconv.FormatFloat(record.Values[name], 'g', -1, 64))
+		}
+		bw.WriteString(" " + strconv.FormatInt(record.Timestamp.UnixNano(), 10) + "\n")
+	}
+	return bw.Flush()
+}
+
+// writeJSON writes one JSON record per line
+func writeJSON(w io.Writer, records []sampleRecord) error {
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFormat writes metric families in the given format
+func writeFormat(w io.Writer, format string, mfs []*dto.MetricFamily, now time.Time) error {
+	switch format {
+	case formatInflux:
+		return writeInflux(w, sampleRecords(gatheredSamples(mfs, now)))
+	case formatJSON:
+		return writeJSON(w, sampleRecords(gatheredSamples(mfs, now)))
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// negotiateFormat picks the format from the format query parameter or Accept header
+func negotiateFormat(format string, accept string) (string, string) {
+	if format == "" {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			if mediaType == jsonContentType || mediaType == "application/json" {
+				format = formatJSON
+				break
+			}
+			if mediaType == "text/plain" && params["format"] == formatInflux {
+				format = formatInflux
+				break
+			}
+		}
+	}
+	switch format {
+	case formatInflux:
+		return formatInflux, influxContentType
+	case formatJSON:
+		return formatJSON, jsonContentType
+	case formatPrometheus, "":
+		return formatPrometheus, string(expfmt.NewFormat(expfmt.TypeTextPlain))
+	}
+	return "", ""
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
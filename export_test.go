@@ -0,0 +1,166 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+)
+
+var (
+	exportTime    = time.Unix(1700000000, 0)
+	exportSamples = []sample{
+		{Name: "infiniband_switch_port_transmit_data_bytes_total", Labels: []sampleLabel{{Name: "port", Value: "1"}, {Name: "guid", Value: "0x00"}}, Value: 100, Timestamp: exportTime.UnixMilli()},
+		{Name: "infiniband_switch_port_receive_data_bytes_total", Labels: []sampleLabel{{Name: "guid", Value: "0x00"}, {Name: "port", Value: "1"}}, Value: 200, Timestamp: exportTime.UnixMilli()},
+		{Name: "infiniband_switch_port_transmit_data_bytes_total", Labels: []sampleLabel{{Name: "guid", Value: "0x00"}, {Name: "port", Value: "2"}}, Value: 300, Timestamp: exportTime.UnixMilli()},
+		{Name: "infiniband_switch_info", Labels: []sampleLabel{{Name: "guid", Value: "0x00"}, {Name: "name", Value: "ib switch,1"}, {Name: "lid", Value: ""}}, Value: 1, Timestamp: exportTime.UnixMilli()},
+		{Name: "infiniband_switch_uptime_seconds", Labels: []sampleLabel{{Name: "guid", Value: "0x00"}}, Value: math.NaN(), Timestamp: exportTime.UnixMilli()},
+	}
+)
+
+func TestSampleRecords(t *testing.T) {
+	records := sampleRecords(exportSamples)
+	if len(records) != 3 {
+		t.Fatalf("Unexpected records, got %v", records)
+	}
+	if len(records[0].Values) != 2 || records[0].Values["infiniband_switch_port_receive_data_bytes_total"] != 200 {
+		t.Errorf("Expected port values grouped, got %v", records[0])
+	}
+	if !records[0].Timestamp.Equal(exportTime) {
+		t.Errorf("Unexpected timestamp, got %v", records[0].Timestamp)
+	}
+}
+
+func TestWriteInflux(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeInflux(&buf, sampleRecords(exportSamples)); err != nil {
+		t.Fatal(err)
+	}
+	expected := `infiniband,guid=0x00,port=1 infiniband_switch_port_receive_data_bytes_total=200,infiniband_switch_port_transmit_data_bytes_total=100 1700000000000000000
+infiniband,guid=0x00,port=2 infiniband_switch_port_transmit_data_bytes_total=300 1700000000000000000
+infiniband,guid=0x00,name=ib\ switch\,1 infiniband_switch_info=1 1700000000000000000
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output\nExpected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, sampleRecords(exportSamples)); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Unexpected lines, got %d", len(lines))
+	}
+	expected := `{"timestamp":"2023-11-14T22:13:20Z","labels":{"guid":"0x00","port":"2"},"values":{"infiniband_switch_port_transmit_data_bytes_total":300}}`
+	if lines[1] != expected {
+		t.Errorf("Unexpected line\nExpected:\n%s\nGot:\n%s", expected, lines[1])
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		Format   string
+		Accept   string
+		Expected string
+	}{
+		{Expected: formatPrometheus},
+		{Format: "influx", Accept: "application/json", Expected: formatInflux},
+		{Accept: "application/x-ndjson", Expected: formatJSON},
+		{Accept: "text/html, application/json;q=0.9", Expected: formatJSON},
+		{Accept: "text/plain; format=influx", Expected: formatInflux},
+		{Accept: "text/plain;version=0.0.4", Expected: formatPrometheus},
+		{Format: "foo", Expected: ""},
+	}
+	for i, test := range tests {
+		if format, _ := negotiateFormat(test.Format, test.Accept); format != test.Expected {
+			t.Errorf("Unexpected format in case %d\nExpected: %s\nGot: %s", i, test.Expected, format)
+		}
+	}
+}
+
+func TestCollectToFileJSON(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "output.json")
+	if _, err := kingpin.CommandLine.Parse([]string{"--exporter.runonce", fmt.Sprintf("--exporter.output=%s", outputPath), "--exporter.output-format=json"}); err != nil {
+		t.Fatal(err)
+	}
+	defer kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+	if err := writeMetrics(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var record sampleRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Unexpected error parsing %s: %v", line, err)
+		}
+		if record.Labels["guid"] == "0x7cfe9003009ce5b0" && record.Labels["port"] == "1" {
+			if _, ok := record.Values["infiniband_switch_port_transmit_data_bytes_total"]; ok {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected port record in output:\n%s", content)
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, exportEndpoint+"?format=influx", nil)
+	w := httptest.NewRecorder()
+	exportHandler(log.NewNopLogger())(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != influxContentType {
+		t.Fatalf("Unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "infiniband,guid=0x7cfe9003009ce5b0,port=1 ") {
+		t.Errorf("Unexpected body:\n%s", w.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodGet, exportEndpoint, nil)
+	req.Header.Set("Accept", jsonContentType)
+	w = httptest.NewRecorder()
+	exportHandler(log.NewNopLogger())(w, req)
+	if w.Header().Get("Content-Type") != jsonContentType || !strings.HasPrefix(w.Body.String(), `{"timestamp":`) {
+		t.Errorf("Unexpected JSON response %s:\n%s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodGet, exportEndpoint+"?format=foo", nil)
+	w = httptest.NewRecorder()
+	exportHandler(log.NewNopLogger())(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status for invalid format, got %d", w.Code)
+	}
+}
@@ -14,10 +14,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
@@ -25,6 +36,7 @@ import (
 	"github.com/gofrs/flock"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
@@ -34,7 +46,20 @@ import (
 )
 
 const (
-	metricsEndpoint = "/metrics"
+	metricsEndpoint  = "/metrics"
+	commandsEndpoint = "/debug/commands"
+	exportEndpoint   = "/export"
+	pathEndpoint     = "/path"
+	topEndpoint      = "/top"
+	topTemplate      = statusHeader + `<h2>Top ports by {{.Sort}}{{if .Window}} over {{.Window}}{{end}}</h2>
+<p>{{range .Sorts}}<a href="?sort={{.}}&n={{$.N}}&window={{$.Window}}">{{.}}</a> {{end}}<a href="?sort={{.Sort}}&n={{.N}}&window={{.Window}}&format=json">JSON</a></p>
+{{if .Ports}}<table border="1">
+<tr><th>Name</th><th>GUID</th><th>Port</th><th>Peer</th><th>Rate (bytes/s)</th><th>Delta</th><th>Per second</th><th>Interval (s)</th></tr>
+{{range .Ports}}<tr><td>{{.Name}}</td><td>{{.GUID}}</td><td>{{.Port}}</td><td>{{.Peer}}</td><td>{{printf "%.0f" .Rate}}</td><td>{{printf "%.0f" .Delta}}</td><td>{{printf "%.2f" .Value}}</td><td>{{printf "%.0f" .Interval}}</td></tr>
+{{end}}</table>{{else}}<p>No ports have changed {{if .Window}}over {{.Window}}{{else}}between the last two collections{{end}}.</p>{{end}}
+</body>
+</html>
+`
 )
 
 var (
@@ -42,37 +67,98 @@ var (
 	output                 = kingpin.Flag("exporter.output", "Output file to write metrics to when using runonce").Default("").String()
 	lockFile               = kingpin.Flag("exporter.lockfile", "Lock file path").Default("/tmp/infiniband_exporter.lock").String()
 	disableExporterMetrics = kingpin.Flag("web.disable-exporter-metrics", "Exclude metrics about the exporter (promhttp_*, process_*, go_*)").Default("false").Bool()
+	pathMaxConcurrent      = kingpin.Flag("web.path-max-concurrent", "Max number of concurrent path tracing requests").Default("1").Int()
 	toolkitFlags           = webflag.AddFlags(kingpin.CommandLine, ":9315")
+	topPage                = template.Must(template.New("top").Parse(topTemplate))
+	pathActive             int32
 )
 
-func setupGathers(runonce bool, logger log.Logger) prometheus.Gatherer {
-	registry := prometheus.NewRegistry()
+func newDiscoverer(runonce bool, logger log.Logger) collectors.Discoverer {
+	if *collectors.TopologySource == "ufm" {
+		return collectors.NewUFMDiscover(runonce, logger)
+	}
+	return collectors.NewIBNetDiscover(runonce, logger)
+}
 
-	ibnetdiscoverCollector := collectors.NewIBNetDiscover(runonce, logger)
-	registry.MustRegister(ibnetdiscoverCollector)
-	switches, hcas, err := ibnetdiscoverCollector.GetPorts()
+// namedCollector is a collector whose runonce output can be written to its own file
+type namedCollector struct {
+	name      string
+	collector prometheus.Collector
+}
+
+// setupCollectors returns the collectors shared by all collectors, such as discovery, and the enabled collectors
+func setupCollectors(runonce bool, logger log.Logger) ([]prometheus.Collector, []namedCollector) {
+	var shared []prometheus.Collector
+	var named []namedCollector
+
+	var discover collectors.Discoverer
+	if loop != nil {
+		discover = loop.discoverer
+		shared = append(shared, loop)
+	} else {
+		discover = newDiscoverer(runonce, logger)
+	}
+	shared = append(shared, discover)
+	if collectors.MADSchedulerEnabled() {
+		shared = append(shared, collectors.NewMADSchedulerCollector())
+	}
+	if collectors.EventsEnabled() {
+		shared = append(shared, collectors.NewEventsCollector())
+	}
+	switches, hcas, err := discover.GetPorts()
 	if err != nil {
-		level.Error(logger).Log("msg", "Error collecting ports with ibnetdiscover", "err", err)
+		level.Error(logger).Log("msg", "Error discovering ports", "source", *collectors.TopologySource, "err", err)
 	} else {
+		status.setTopology(switches, hcas)
 		if *collectors.CollectSwitch {
 			switchCollector := collectors.NewSwitchCollector(switches, runonce, logger)
-			registry.MustRegister(switchCollector)
+			named = append(named, namedCollector{"switch", switchCollector})
 		}
 		if *collectors.CollectIbswinfo {
 			ibswinfoCollector := collectors.NewIbswinfoCollector(switches, runonce, logger)
-			registry.MustRegister(ibswinfoCollector)
+			named = append(named, namedCollector{"ibswinfo", ibswinfoCollector})
+		}
+		if *collectors.CollectPortinfo {
+			portinfoCollector := collectors.NewPortinfoCollector(switches, runonce, logger)
+			named = append(named, namedCollector{"portinfo", portinfoCollector})
+		}
+		if *collectors.CollectRoutes {
+			routesCollector := collectors.NewRoutesCollector(switches, runonce, logger)
+			named = append(named, namedCollector{"routes", routesCollector})
 		}
 		if *collectors.CollectHCA {
 			hcaCollector := collectors.NewHCACollector(hcas, runonce, logger)
-			registry.MustRegister(hcaCollector)
+			named = append(named, namedCollector{"hca", hcaCollector})
 		}
 	}
+	if *collectors.CollectUFM {
+		ufmCollector := collectors.NewUFMCollector(runonce, logger)
+		named = append(named, namedCollector{"ufm", ufmCollector})
+	}
+	if *collectors.CollectSM {
+		smCollector := collectors.NewSMCollector(switches, hcas, runonce, logger)
+		named = append(named, namedCollector{"sm", smCollector})
+	}
+	return shared, named
+}
+
+func setupGathers(runonce bool, logger log.Logger) prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+
+	shared, named := setupCollectors(runonce, logger)
+	registry.MustRegister(shared...)
+	for _, c := range named {
+		registry.MustRegister(c.collector)
+	}
 
 	gatherers := prometheus.Gatherers{registry}
 
 	if !*disableExporterMetrics && !*runOnce {
 		gatherers = append(gatherers, prometheus.DefaultGatherer)
 	}
+	if alerts != nil {
+		return ruleGatherer{gatherers}
+	}
 	return gatherers
 }
 
@@ -81,66 +167,342 @@ func metricsHandler(logger log.Logger) http.HandlerFunc {
 		gatherers := setupGathers(false, logger)
 
 		// Delegate http serving to Prometheus client library, which will call collector.Collect.
-		h := promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+		h := promhttp.HandlerFor(statusGatherer{gatherers}, promhttp.HandlerOpts{})
 		h.ServeHTTP(w, r)
 	}
 }
 
+func pathHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		src := r.URL.Query().Get("src")
+		dst := r.URL.Query().Get("dst")
+		if src == "" || dst == "" {
+			http.Error(w, "Must specify src and dst", http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt32(&pathActive, 1) > int32(*pathMaxConcurrent) {
+			atomic.AddInt32(&pathActive, -1)
+			http.Error(w, "Too many concurrent path requests", http.StatusTooManyRequests)
+			return
+		}
+		defer atomic.AddInt32(&pathActive, -1)
+		// Use the topology of the last collection, only discovering when nothing has been collected yet
+		switches, hcas, ok := status.topology()
+		if !ok {
+			var err error
+			switches, hcas, err = newDiscoverer(false, logger).GetPorts()
+			if err != nil {
+				level.Error(logger).Log("msg", "Error discovering ports", "source", *collectors.TopologySource, "err", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			status.setTopology(switches, hcas)
+		}
+		path, err := collectors.TracePath(switches, hcas, src, dst, logger)
+		if errors.Is(err, collectors.ErrNodeNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			level.Error(logger).Log("msg", "Error tracing path", "src", src, "dst", dst, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		//nolint:errcheck
+		json.NewEncoder(w).Encode(path)
+	}
+}
+
+func commandsHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		history := collectors.CommandHistory(r.URL.Query().Get("target"))
+		w.Header().Set("Content-Type", "application/json")
+		//nolint:errcheck
+		json.NewEncoder(w).Encode(history)
+	}
+}
+
+func exportHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format, contentType := negotiateFormat(r.URL.Query().Get("format"), r.Header.Get("Accept"))
+		if format == "" {
+			http.Error(w, fmt.Sprintf("Invalid format %s", r.URL.Query().Get("format")), http.StatusBadRequest)
+			return
+		}
+		mfs, err := statusGatherer{setupGathers(false, logger)}.Gather()
+		if err != nil {
+			level.Error(logger).Log("msg", "Error gathering metrics for export", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		if err := writeFormat(w, format, mfs, time.Now()); err != nil {
+			level.Error(logger).Log("msg", "Error writing export", "format", format, "err", err)
+		}
+	}
+}
+
+func topHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sortBy := r.URL.Query().Get("sort")
+		if sortBy == "" {
+			sortBy = "throughput"
+		}
+		n := 20
+		if val := r.URL.Query().Get("n"); val != "" {
+			var err error
+			if n, err = strconv.Atoi(val); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid n %s", val), http.StatusBadRequest)
+				return
+			}
+		}
+		var window time.Duration
+		if val := r.URL.Query().Get("window"); val != "" {
+			var err error
+			if window, err = time.ParseDuration(val); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid window %s", val), http.StatusBadRequest)
+				return
+			}
+		}
+		ports, err := collectors.TopPorts(sortBy, n, window)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			//nolint:errcheck
+			json.NewEncoder(w).Encode(ports)
+			return
+		}
+		data := struct {
+			Sort   string
+			Sorts  []string
+			N      int
+			Window string
+			Ports  []collectors.TopPort
+		}{sortBy, collectors.TopSorts, n, r.URL.Query().Get("window"), ports}
+		if err := topPage.Execute(w, data); err != nil {
+			level.Error(logger).Log("msg", "Error rendering top ports", "err", err)
+		}
+	}
+}
+
+// sharedGatherer reuses a gather for pushes that happen within half of the shortest push interval
+type sharedGatherer struct {
+	sync.Mutex
+	maxAge time.Duration
+	time   time.Time
+	mfs    []*dto.MetricFamily
+	err    error
+	logger log.Logger
+}
+
+func newSharedGatherer(intervals []time.Duration, logger log.Logger) *sharedGatherer {
+	g := &sharedGatherer{logger: logger}
+	for _, interval := range intervals {
+		if g.maxAge == 0 || interval/2 < g.maxAge {
+			g.maxAge = interval / 2
+		}
+	}
+	return g
+}
+
+func (g *sharedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.Lock()
+	defer g.Unlock()
+	if !g.time.IsZero() && time.Since(g.time) < g.maxAge {
+		return g.mfs, g.err
+	}
+	g.mfs, g.err = setupGathers(false, g.logger).Gather()
+	g.time = time.Now()
+	return g.mfs, g.err
+}
+
 func writeMetrics(logger log.Logger) error {
-	tmp, err := os.CreateTemp(filepath.Dir(*output), filepath.Base(*output))
+	var mfs, sharedMfs []*dto.MetricFamily
+	var failedCollectors []string
+	var err error
+	if *outputPattern != "" {
+		mfs, sharedMfs, failedCollectors, err = writeCollectorFiles(logger)
+		if err == nil && alerts != nil {
+			alerts.evaluate(mfs, time.Now())
+			if mfs, err = mergeGathered(mfs, alerts.gatherer()); err == nil {
+				sharedMfs, err = mergeGathered(sharedMfs, alerts.gatherer())
+			}
+		}
+	} else {
+		mfs, err = setupGathers(true, logger).Gather()
+	}
+	if err != nil {
+		level.Error(logger).Log("msg", "Error gathering Prometheus metrics", "err", err)
+		return err
+	}
+	// Push to Pushgateway first so the result is included in the output file
+	var pushErr error
+	if *pushgatewayURL != "" {
+		var results prometheus.Gatherer
+		results, pushErr = pushgatewayPush(mfs, logger)
+		mfs, err = mergeGathered(mfs, results)
+		if err == nil && *outputPattern != "" {
+			sharedMfs, err = mergeGathered(sharedMfs, results)
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Error gathering Pushgateway results", "err", err)
+			return err
+		}
+	}
+	if *output != "" {
+		if err := writeTextfile(*output, mfs, logger); err != nil {
+			return err
+		}
+	}
+	if *outputPattern != "" {
+		written, err := writeSharedFile(sharedMfs, logger)
+		if err != nil {
+			return err
+		}
+		if !written {
+			failedCollectors = append(failedCollectors, sharedOutputName)
+		}
+	}
+	if *remoteWriteURL != "" {
+		writer, err := sharedRemoteWriter(logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to setup remote write", "err", err)
+			return err
+		}
+		if err := writer.push(mfs, time.Now()); err != nil {
+			level.Error(logger).Log("msg", "Error pushing metrics with remote write", "url", *remoteWriteURL, "err", err)
+			return err
+		}
+	}
+	if *otlpEndpoint != "" {
+		exporter, err := sharedOTLPExporter(logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to setup OTLP exporter", "err", err)
+			return err
+		}
+		if err := exporter.export(mfs, time.Now()); err != nil {
+			level.Error(logger).Log("msg", "Error pushing metrics with OTLP", "endpoint", *otlpEndpoint, "err", err)
+			return err
+		}
+	}
+	if len(failedCollectors) > 0 {
+		return fmt.Errorf("Collectors skipped or failed to write output: %s", strings.Join(failedCollectors, ", "))
+	}
+	return pushErr
+}
+
+func writeTextfile(path string, mfs []*dto.MetricFamily, logger log.Logger) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path))
 	if err != nil {
 		level.Error(logger).Log("msg", "Unable to create temporary file", "err", err)
 		return err
 	}
 	defer os.Remove(tmp.Name())
-	gatherers := setupGathers(true, logger)
-	err = prometheus.WriteToTextfile(tmp.Name(), gatherers)
+	err = writeFormat(tmp, *outputFormat, mfs, time.Now())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
 	if err != nil {
-		level.Error(logger).Log("msg", "Error writing Prometheus metrics to file", "path", tmp.Name(), "err", err)
+		level.Error(logger).Log("msg", "Error writing metrics to file", "path", tmp.Name(), "format", *outputFormat, "err", err)
 		return err
 	}
-	err = os.Rename(tmp.Name(), *output)
+	err = os.Rename(tmp.Name(), path)
 	if err != nil {
-		level.Error(logger).Log("msg", "Error renaming temporary file to output", "tmp", tmp.Name(), "output", *output, "err", err)
+		level.Error(logger).Log("msg", "Error renaming temporary file to output", "tmp", tmp.Name(), "output", path, "err", err)
 		return err
 	}
 	return nil
 }
 
 func run(logger log.Logger) error {
+	defer flushEvents(logger)
+	config := &exporterConfig{}
+	if *configFile != "" {
+		var err error
+		if config, err = loadConfig(*configFile); err != nil {
+			return err
+		}
+	}
+	if *rulesOutput != "" {
+		return writeRules(config, *rulesOutput)
+	}
+	if len(config.Rules) > 0 {
+		alerts = newRuleEvaluator(config.Rules)
+	}
+	if *loopInterval > 0 && !*runOnce {
+		return fmt.Errorf("Loop interval requires runonce mode")
+	}
 	if *runOnce {
-		if *output == "" {
-			return fmt.Errorf("Must specify output path when using runonce mode")
+		defer closeOTLPExporter()
+		if *output == "" && *outputPattern == "" && *remoteWriteURL == "" && *otlpEndpoint == "" && *pushgatewayURL == "" {
+			return fmt.Errorf("Must specify output path, output pattern, remote write URL, OTLP endpoint or Pushgateway URL when using runonce mode")
+		}
+		if *outputPattern != "" && !strings.Contains(*outputPattern, collectorPlaceholder) {
+			return fmt.Errorf("Output pattern %s must contain %s", *outputPattern, collectorPlaceholder)
+		}
+		// Each collector takes its own lock when writing an output pattern
+		if *outputPattern == "" {
+			fileLock := flock.New(*lockFile)
+			unlocked, err := fileLock.TryLock()
+			if err != nil {
+				level.Error(logger).Log("msg", "Unable to obtain lock on lock file", "lockfile", *lockFile)
+				return err
+			}
+			if !unlocked {
+				return fmt.Errorf("Lock file %s is locked", *lockFile)
+			}
+			defer fileLock.Unlock() //nolint:errcheck
 		}
-		fileLock := flock.New(*lockFile)
-		unlocked, err := fileLock.TryLock()
+		if *loopInterval > 0 {
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+			defer stop()
+			return runLoop(ctx, logger)
+		}
+		return writeMetrics(logger)
+	}
+	level.Info(logger).Log("msg", "Starting infiniband_exporter", "version", version.Info())
+	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
+
+	// Remote write and OTLP share one gather when their intervals line up
+	var intervals []time.Duration
+	if *remoteWriteURL != "" && *remoteWriteInterval > 0 {
+		intervals = append(intervals, *remoteWriteInterval)
+	}
+	if *otlpEndpoint != "" {
+		intervals = append(intervals, *otlpInterval)
+	}
+	pushGather := newSharedGatherer(intervals, logger)
+	if *remoteWriteURL != "" && *remoteWriteInterval > 0 {
+		writer, err := sharedRemoteWriter(logger)
 		if err != nil {
-			level.Error(logger).Log("msg", "Unable to obtain lock on lock file", "lockfile", *lockFile)
+			level.Error(logger).Log("msg", "Unable to setup remote write", "err", err)
 			return err
 		}
-		if !unlocked {
-			return fmt.Errorf("Lock file %s is locked", *lockFile)
-		}
-		err = writeMetrics(logger)
+		go writer.run(*remoteWriteInterval, pushGather)
+	}
+	if *otlpEndpoint != "" {
+		exporter, err := newOTLPExporter(logger)
 		if err != nil {
+			level.Error(logger).Log("msg", "Unable to setup OTLP exporter", "err", err)
 			return err
 		}
-		return nil
+		go exporter.run(*otlpInterval, pushGather)
 	}
-	level.Info(logger).Log("msg", "Starting infiniband_exporter", "version", version.Info())
-	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		//nolint:errcheck
-		w.Write([]byte(`<html>
-             <head><title>InfiniBand Exporter</title></head>
-             <body>
-             <h1>InfiniBand Exporter</h1>
-             <p><a href='` + metricsEndpoint + `'>Metrics</a></p>
-             </body>
-             </html>`))
-	})
+	http.Handle("/", statusHandler(logger))
+	http.Handle(commandsEndpoint, commandsHandler(logger))
+	http.Handle(deviceEndpoint, deviceHandler(logger))
+	http.Handle(exportEndpoint, exportHandler(logger))
 	http.Handle(metricsEndpoint, metricsHandler(logger))
+	http.Handle(pathEndpoint, pathHandler(logger))
+	http.Handle(topEndpoint, topHandler(logger))
+	http.Handle(alertsEndpoint, alertsHandler(logger))
 	srv := &http.Server{}
 	if err := web.ListenAndServe(srv, toolkitFlags, logger); err != nil {
 		level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
@@ -149,6 +511,13 @@ func run(logger log.Logger) error {
 	return nil
 }
 
+// flushEvents sends the queued events before exiting
+func flushEvents(logger log.Logger) {
+	if err := collectors.FlushEvents(*collectors.EventsFlushTimeout); err != nil {
+		level.Error(logger).Log("msg", "Error flushing events", "err", err)
+	}
+}
+
 func main() {
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
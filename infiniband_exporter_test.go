@@ -18,10 +18,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
@@ -35,8 +38,12 @@ const (
 
 var (
 	outputPath     string
-	expectedSwitch = `# HELP infiniband_switch_info Infiniband switch information
+	expectedSwitch = `# HELP infiniband_switch_free_port_info Infiniband switch port that is not connected
+# TYPE infiniband_switch_free_port_info gauge
+infiniband_switch_free_port_info{guid="0x506b4b03005c2740",port="37",switch="ib-i4l1s01"} 1
+# HELP infiniband_switch_info Infiniband switch information
 # TYPE infiniband_switch_info gauge
+infiniband_switch_info{guid="0x08c0eb0300add20e",lid="1781",switch="ib-i7l2s01"} 1
 infiniband_switch_info{guid="0x506b4b03005c2740",lid="2052",switch="ib-i4l1s01"} 1
 infiniband_switch_info{guid="0x7cfe9003009ce5b0",lid="1719",switch="ib-i1l1s01"} 1
 # HELP infiniband_switch_port_excessive_buffer_overrun_errors_total Infiniband switch port ExcessiveBufferOverrunErrors
@@ -161,6 +168,20 @@ infiniband_switch_port_unicast_transmit_packets_total{guid="0x7cfe9003009ce5b0",
 infiniband_switch_port_vl15_dropped_total{guid="0x506b4b03005c2740",port="1"} 0
 infiniband_switch_port_vl15_dropped_total{guid="0x7cfe9003009ce5b0",port="1"} 0
 infiniband_switch_port_vl15_dropped_total{guid="0x7cfe9003009ce5b0",port="2"} 0
+# HELP infiniband_switch_ports Infiniband switch number of ports by status
+# TYPE infiniband_switch_ports gauge
+infiniband_switch_ports{guid="0x08c0eb0300add20e",status="connected"} 0
+infiniband_switch_ports{guid="0x08c0eb0300add20e",status="disconnected"} 0
+infiniband_switch_ports{guid="0x08c0eb0300add20e",status="split"} 1
+infiniband_switch_ports{guid="0x08c0eb0300add20e",status="total"} 1
+infiniband_switch_ports{guid="0x506b4b03005c2740",status="connected"} 1
+infiniband_switch_ports{guid="0x506b4b03005c2740",status="disconnected"} 1
+infiniband_switch_ports{guid="0x506b4b03005c2740",status="split"} 0
+infiniband_switch_ports{guid="0x506b4b03005c2740",status="total"} 2
+infiniband_switch_ports{guid="0x7cfe9003009ce5b0",status="connected"} 3
+infiniband_switch_ports{guid="0x7cfe9003009ce5b0",status="disconnected"} 0
+infiniband_switch_ports{guid="0x7cfe9003009ce5b0",status="split"} 0
+infiniband_switch_ports{guid="0x7cfe9003009ce5b0",status="total"} 3
 # HELP infiniband_switch_uplink_info Infiniband switch uplink information
 # TYPE infiniband_switch_uplink_info gauge
 infiniband_switch_uplink_info{guid="0x506b4b03005c2740",port="35",switch="ib-i4l1s01",uplink="p0001 HCA-1",uplink_guid="0x506b4b0300cc02a6",uplink_lid="1432",uplink_port="1",uplink_type="CA"} 1
@@ -192,8 +213,13 @@ infiniband_switch_fan_status_info{guid="0x506b4b03005c2740",status="OK"} 1
 infiniband_switch_fan_status_info{guid="0x7cfe9003009ce5b0",status="ERROR"} 1
 # HELP infiniband_switch_hardware_info Infiniband switch hardware info
 # TYPE infiniband_switch_hardware_info gauge
-infiniband_switch_hardware_info{firmware_version="11.2008.2102",guid="0x7cfe9003009ce5b0",part_number="MSB7790-ES2F",psid="MT_1880110032",serial_number="MT1943X00498",switch="ib-i1l1s01"} 1
-infiniband_switch_hardware_info{firmware_version="27.2010.3118",guid="0x506b4b03005c2740",part_number="MQM8790-HS2F",psid="MT_0000000063",serial_number="MT2152T10239",switch="ib-i4l1s01"} 1
+infiniband_switch_hardware_info{firmware_version="",guid="0x08c0eb0300add20e",part_number="",ports="",product_name="",psid="",revision="",serial_number="",switch="ib-i7l2s01",system_guid=""} 1
+infiniband_switch_hardware_info{firmware_version="11.2008.2102",guid="0x7cfe9003009ce5b0",part_number="MSB7790-ES2F",ports="36",product_name="Scorpion IB EDR Unmanaged",psid="MT_1880110032",revision="AN",serial_number="MT1943X00498",switch="ib-i1l1s01",system_guid="0x1c34da0300010540"} 1
+infiniband_switch_hardware_info{firmware_version="27.2010.3118",guid="0x506b4b03005c2740",part_number="MQM8790-HS2F",ports="40",product_name="Jaguar Unmng IB 200",psid="MT_0000000063",revision="AJ",serial_number="MT2152T10239",switch="ib-i4l1s01",system_guid="0x08c0eb0300d9f672"} 1
+# HELP infiniband_switch_max_temperature_celsius Infiniband switch max temperature celsius
+# TYPE infiniband_switch_max_temperature_celsius gauge
+infiniband_switch_max_temperature_celsius{guid="0x506b4b03005c2740"} 58
+infiniband_switch_max_temperature_celsius{guid="0x7cfe9003009ce5b0"} 57
 # HELP infiniband_switch_power_supply_dc_power_status_info Infiniband switch power supply DC power status
 # TYPE infiniband_switch_power_supply_dc_power_status_info gauge
 infiniband_switch_power_supply_dc_power_status_info{guid="0x506b4b03005c2740",psu="0",status="OK"} 1
@@ -206,6 +232,12 @@ infiniband_switch_power_supply_fan_status_info{guid="0x506b4b03005c2740",psu="0"
 infiniband_switch_power_supply_fan_status_info{guid="0x506b4b03005c2740",psu="1",status="OK"} 1
 infiniband_switch_power_supply_fan_status_info{guid="0x7cfe9003009ce5b0",psu="0",status="OK"} 1
 infiniband_switch_power_supply_fan_status_info{guid="0x7cfe9003009ce5b0",psu="1",status="OK"} 1
+# HELP infiniband_switch_power_supply_hardware_info Infiniband switch power supply hardware info
+# TYPE infiniband_switch_power_supply_hardware_info gauge
+infiniband_switch_power_supply_hardware_info{guid="0x506b4b03005c2740",part_number="MTEF-PSF-AC-C",psu="0",serial_number="MT2150T22468"} 1
+infiniband_switch_power_supply_hardware_info{guid="0x506b4b03005c2740",part_number="MTEF-PSF-AC-C",psu="1",serial_number="MT2150T22467"} 1
+infiniband_switch_power_supply_hardware_info{guid="0x7cfe9003009ce5b0",part_number="MTEF-PSF-AC-A",psu="0",serial_number="MT1944X10558"} 1
+infiniband_switch_power_supply_hardware_info{guid="0x7cfe9003009ce5b0",part_number="MTEF-PSF-AC-A",psu="1",serial_number="MT1944X10555"} 1
 # HELP infiniband_switch_power_supply_status_info Infiniband switch power supply status
 # TYPE infiniband_switch_power_supply_status_info gauge
 infiniband_switch_power_supply_status_info{guid="0x506b4b03005c2740",psu="0",status="OK"} 1
@@ -351,11 +383,37 @@ infiniband_exporter_collect_timeouts{collector="switch-runonce"} 0`
 	expectedIbnetdiscoverError = `# HELP infiniband_exporter_collect_errors Number of errors that occurred during collection
 # TYPE infiniband_exporter_collect_errors gauge
 infiniband_exporter_collect_errors{collector="ibnetdiscover-runonce"} 1
+# HELP infiniband_exporter_collect_failures_total Number of collection failures by reason
+# TYPE infiniband_exporter_collect_failures_total counter
+infiniband_exporter_collect_failures_total{collector="ibnetdiscover-runonce",guid="",reason="other"} 1
 # HELP infiniband_exporter_collect_timeouts Number of timeouts that occurred during collection
 # TYPE infiniband_exporter_collect_timeouts gauge
 infiniband_exporter_collect_timeouts{collector="ibnetdiscover-runonce"} 0`
 )
 
+// resetState resets the state the exporter keeps between runs
+func resetState() {
+	remoteWrite = nil
+	closeOTLPExporter()
+	status = newStatusStore()
+}
+
+// setupTest parses args and resets the exporter state, both are restored when the test ends
+func setupTest(t *testing.T, args []string) {
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	resetState()
+	remoteWriteSleep = func(time.Duration) {}
+	t.Cleanup(func() {
+		// Repeatable flags are not reset by parsing
+		*outputCollectors = nil
+		kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+		resetState()
+		remoteWriteSleep = time.Sleep
+	})
+}
+
 func TestMain(m *testing.M) {
 	w := log.NewSyncWriter(os.Stderr)
 	logger := log.NewLogfmtLogger(w)
@@ -386,6 +444,14 @@ func TestMain(m *testing.M) {
 			return "", nil
 		}
 	}
+	collectors.IbrouteExec = func(lid string, ctx context.Context) (string, error) {
+		out, err := collectors.ReadFixture("ibroute", lid)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		return out, nil
+	}
 	exitVal := m.Run()
 	os.Exit(exitVal)
 }
@@ -423,6 +489,8 @@ func TestCollectToFile(t *testing.T) {
 
 func TestCollect(t *testing.T) {
 	var err error
+	// Listen addresses accumulate defaults from earlier parses of the command line
+	*toolkitFlags.WebListenAddresses = nil
 	if _, err = kingpin.CommandLine.Parse([]string{fmt.Sprintf("--web.listen-address=%s", address)}); err != nil {
 		t.Fatal(err)
 	}
@@ -432,6 +500,13 @@ func TestCollect(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// Wait for the HTTP server to start listening
+	for i := 0; i < 50; i++ {
+		if _, err = queryExporter(""); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 	body, err := queryExporter(metricsEndpoint)
 	if err != nil {
 		t.Fatalf("Unexpected error GET %s: %s", metricsEndpoint, err.Error())
@@ -499,6 +574,106 @@ func TestBaseURL(t *testing.T) {
 	}
 }
 
+func TestPath(t *testing.T) {
+	collectors.IbnetdiscoverExec = func(ctx context.Context) (string, error) {
+		return collectors.ReadFixture("ibnetdiscover", "test")
+	}
+	body, err := queryExporter(pathEndpoint + "?src=o0001+HCA-1&dst=0x7cfe9003003b4b96")
+	if err != nil {
+		t.Fatalf("Unexpected error GET %s: %s", pathEndpoint, err.Error())
+	}
+	expected := `"hops":[{"guid":"0x7cfe9003009ce5b0","name":"ib-i1l1s01","lid":"1719","in_port":"10","out_port":"11"}]`
+	if !strings.Contains(body, expected) {
+		t.Errorf("Unexpected body\nExpected:\n%s\nGot:\n%s\n", expected, body)
+	}
+	_, err = queryExporter(pathEndpoint + "?src=foo&dst=133")
+	if err == nil || !strings.Contains(err.Error(), "have 404") || !strings.Contains(err.Error(), "Node not found: foo") {
+		t.Errorf("Unexpected error GET %s: %v", pathEndpoint, err)
+	}
+	_, err = queryExporter(pathEndpoint)
+	if err == nil || !strings.Contains(err.Error(), "have 400") {
+		t.Errorf("Unexpected error GET %s: %v", pathEndpoint, err)
+	}
+}
+
+func TestPathTopologyReused(t *testing.T) {
+	discoveries := 0
+	ibnetdiscoverExec := collectors.IbnetdiscoverExec
+	collectors.IbnetdiscoverExec = func(ctx context.Context) (string, error) {
+		discoveries++
+		return collectors.ReadFixture("ibnetdiscover", "test")
+	}
+	defer func() { collectors.IbnetdiscoverExec = ibnetdiscoverExec }()
+	saved := status
+	status = newStatusStore()
+	defer func() { status = saved }()
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		pathHandler(log.NewNopLogger())(recorder, httptest.NewRequest("GET", pathEndpoint+"?src=o0001+HCA-1&dst=133", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+	if discoveries != 1 {
+		t.Errorf("Expected topology discovered once, got %d", discoveries)
+	}
+	atomic.StoreInt32(&pathActive, int32(*pathMaxConcurrent))
+	defer atomic.StoreInt32(&pathActive, 0)
+	recorder := httptest.NewRecorder()
+	pathHandler(log.NewNopLogger())(recorder, httptest.NewRequest("GET", pathEndpoint+"?src=o0001+HCA-1&dst=133", nil))
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected too many requests, got %d", recorder.Code)
+	}
+}
+
+func TestTop(t *testing.T) {
+	collectors.IbnetdiscoverExec = func(ctx context.Context) (string, error) {
+		return collectors.ReadFixture("ibnetdiscover", "test")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := queryExporter(metricsEndpoint); err != nil {
+			t.Fatalf("Unexpected error GET %s: %s", metricsEndpoint, err.Error())
+		}
+	}
+	body, err := queryExporter(topEndpoint + "?format=json")
+	if err != nil {
+		t.Fatalf("Unexpected error GET %s: %s", topEndpoint, err.Error())
+	}
+	if strings.TrimSpace(body) != "[]" {
+		t.Errorf("Unexpected body\nExpected: []\nGot:\n%s\n", body)
+	}
+	body, err = queryExporter(topEndpoint + "?sort=errors")
+	if err != nil {
+		t.Fatalf("Unexpected error GET %s: %s", topEndpoint, err.Error())
+	}
+	if !strings.Contains(body, "Top ports by errors") || !strings.Contains(body, "No ports have changed") {
+		t.Errorf("Unexpected body\nGot:\n%s\n", body)
+	}
+	body, err = queryExporter(topEndpoint + "?sort=symbol_errors&window=1h")
+	if err != nil {
+		t.Fatalf("Unexpected error GET %s: %s", topEndpoint, err.Error())
+	}
+	if !strings.Contains(body, "Top ports by symbol_errors over 1h") {
+		t.Errorf("Unexpected body\nGot:\n%s\n", body)
+	}
+	for _, query := range []string{"?sort=foo", "?window=foo", "?window=2h"} {
+		_, err = queryExporter(topEndpoint + query)
+		if err == nil || !strings.Contains(err.Error(), "have 400") {
+			t.Errorf("Unexpected error GET %s%s: %v", topEndpoint, query, err)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	body, err := queryExporter(commandsEndpoint + "?target=0x7cfe9003009ce5b0")
+	if err != nil {
+		t.Fatalf("Unexpected error GET %s: %s", commandsEndpoint, err.Error())
+	}
+	if strings.TrimSpace(body) != "{}" {
+		t.Errorf("Unexpected body\nExpected: {}\nGot:\n%s\n", body)
+	}
+}
+
 func queryExporter(path string) (string, error) {
 	resp, err := http.Get(fmt.Sprintf("http://%s%s", address, path))
 	if err != nil {
@@ -0,0 +1,196 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/treydock/infiniband_exporter/collectors"
+)
+
+var (
+	loopInterval          = kingpin.Flag("exporter.loop-interval", "Keep running in runonce mode and write output on this interval, 0 runs once").Default("0s").Duration()
+	loopDiscoveryInterval = kingpin.Flag("exporter.loop-discovery-interval", "Interval to refresh the discovered topology in loop mode, 0 discovers every cycle").Default("5m").Duration()
+	loop                  *loopState
+)
+
+// loopState persists between cycles of loop mode
+type loopState struct {
+	sync.Mutex
+	discoverer    *cachedDiscoverer
+	cycles        float64
+	failures      float64
+	overruns      float64
+	skipped       float64
+	lastDuration  float64
+	due           time.Time
+	behind        float64
+	CycleDuration *prometheus.Desc
+	Cycles        *prometheus.Desc
+	Failures      *prometheus.Desc
+	Overruns      *prometheus.Desc
+	Skipped       *prometheus.Desc
+	Behind        *prometheus.Desc
+}
+
+// cachedDiscoverer reuses the discovered topology until it is older than maxAge
+type cachedDiscoverer struct {
+	sync.Mutex
+	discoverer collectors.Discoverer
+	switches   *[]collectors.InfinibandDevice
+	hcas       *[]collectors.InfinibandDevice
+	time       time.Time
+	maxAge     time.Duration
+	logger     log.Logger
+}
+
+func newLoopState(logger log.Logger) *loopState {
+	return &loopState{
+		discoverer: &cachedDiscoverer{maxAge: *loopDiscoveryInterval, logger: logger},
+		CycleDuration: prometheus.NewDesc("infiniband_exporter_loop_cycle_duration_seconds",
+			"Duration of the previous loop cycle", nil, nil),
+		Cycles: prometheus.NewDesc("infiniband_exporter_loop_cycles_total",
+			"Number of completed loop cycles", nil, nil),
+		Failures: prometheus.NewDesc("infiniband_exporter_loop_cycle_failures_total",
+			"Number of loop cycles that failed to write or push metrics", nil, nil),
+		Overruns: prometheus.NewDesc("infiniband_exporter_loop_overruns_total",
+			"Number of loop cycles that took longer than the loop interval", nil, nil),
+		Skipped: prometheus.NewDesc("infiniband_exporter_loop_skipped_cycles_total",
+			"Number of loop cycles skipped because the previous cycle was still running", nil, nil),
+		Behind: prometheus.NewDesc("infiniband_exporter_loop_seconds_behind_schedule",
+			"Seconds the current loop cycle started after it was due", nil, nil),
+	}
+}
+
+func (l *loopState) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.CycleDuration
+	ch <- l.Cycles
+	ch <- l.Failures
+	ch <- l.Overruns
+	ch <- l.Skipped
+	ch <- l.Behind
+}
+
+func (l *loopState) Collect(ch chan<- prometheus.Metric) {
+	l.Lock()
+	defer l.Unlock()
+	ch <- prometheus.MustNewConstMetric(l.CycleDuration, prometheus.GaugeValue, l.lastDuration)
+	ch <- prometheus.MustNewConstMetric(l.Cycles, prometheus.CounterValue, l.cycles)
+	ch <- prometheus.MustNewConstMetric(l.Failures, prometheus.CounterValue, l.failures)
+	ch <- prometheus.MustNewConstMetric(l.Overruns, prometheus.CounterValue, l.overruns)
+	ch <- prometheus.MustNewConstMetric(l.Skipped, prometheus.CounterValue, l.skipped)
+	ch <- prometheus.MustNewConstMetric(l.Behind, prometheus.GaugeValue, l.behind)
+}
+
+// begin accounts for how late a cycle starts so the lateness is part of the metrics the cycle writes
+func (l *loopState) begin(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	l.behind = 0
+	if !l.due.IsZero() && now.After(l.due) {
+		l.behind = now.Sub(l.due).Seconds()
+	}
+}
+
+// record accounts for a finished cycle and returns when the next cycle starts,
+// cycles whose start passed while the cycle was running are skipped
+func (l *loopState) record(start time.Time, now time.Time, interval time.Duration, err error) time.Time {
+	l.Lock()
+	defer l.Unlock()
+	l.cycles++
+	if err != nil {
+		l.failures++
+	}
+	duration := now.Sub(start)
+	l.lastDuration = duration.Seconds()
+	if duration > interval {
+		l.overruns++
+	}
+	next := start.Add(interval)
+	l.due = next
+	for next.Before(now) {
+		next = next.Add(interval)
+		l.skipped++
+	}
+	return next
+}
+
+func (c *cachedDiscoverer) Describe(ch chan<- *prometheus.Desc) {
+	c.Lock()
+	defer c.Unlock()
+	if c.discoverer != nil {
+		c.discoverer.Describe(ch)
+	}
+}
+
+func (c *cachedDiscoverer) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	if c.discoverer != nil {
+		c.discoverer.Collect(ch)
+	}
+}
+
+// GetPorts discovers the topology when the cache is expired, using the cached topology if discovery fails
+func (c *cachedDiscoverer) GetPorts() (*[]collectors.InfinibandDevice, *[]collectors.InfinibandDevice, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.switches != nil && time.Since(c.time) < c.maxAge {
+		return c.switches, c.hcas, nil
+	}
+	c.discoverer = newDiscoverer(true, c.logger)
+	switches, hcas, err := c.discoverer.GetPorts()
+	if err != nil {
+		if c.switches != nil {
+			level.Warn(c.logger).Log("msg", "Using previously discovered topology", "age", time.Since(c.time), "err", err)
+			return c.switches, c.hcas, nil
+		}
+		return switches, hcas, err
+	}
+	c.switches, c.hcas, c.time = switches, hcas, time.Now()
+	return switches, hcas, nil
+}
+
+// runLoop writes metrics every loop interval until ctx is cancelled, finishing the running cycle first
+func runLoop(ctx context.Context, logger log.Logger) error {
+	loop = newLoopState(logger)
+	defer func() { loop = nil }()
+	level.Info(logger).Log("msg", "Starting loop mode", "interval", *loopInterval, "output", *output)
+	for {
+		start := time.Now()
+		loop.begin(start)
+		err := writeMetrics(logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Loop cycle failed", "err", err)
+		}
+		next := loop.record(start, time.Now(), *loopInterval, err)
+		if next.Sub(start) > *loopInterval {
+			level.Warn(logger).Log("msg", "Loop cycle took longer than interval, skipping cycles", "duration", time.Since(start), "interval", *loopInterval)
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			level.Info(logger).Log("msg", "Stopping loop mode")
+			return nil
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/treydock/infiniband_exporter/collectors"
+)
+
+func TestLoopStateRecord(t *testing.T) {
+	state := newLoopState(log.NewNopLogger())
+	start := time.Unix(1700000000, 0)
+	next := state.record(start, start.Add(10*time.Second), time.Minute, nil)
+	if !next.Equal(start.Add(time.Minute)) {
+		t.Errorf("Unexpected next cycle, got %v", next)
+	}
+	next = state.record(start, start.Add(150*time.Second), time.Minute, fmt.Errorf("failed"))
+	if !next.Equal(start.Add(3 * time.Minute)) {
+		t.Errorf("Unexpected next cycle after overrun, got %v", next)
+	}
+	if state.cycles != 2 || state.failures != 1 || state.overruns != 1 || state.skipped != 2 || state.lastDuration != 150 {
+		t.Errorf("Unexpected loop state %v %v %v %v %v", state.cycles, state.failures, state.overruns, state.skipped, state.lastDuration)
+	}
+	// The cycle after the overrun was due a minute after the previous start
+	state.begin(next)
+	if state.behind != 120 {
+		t.Errorf("Unexpected seconds behind schedule, got %v", state.behind)
+	}
+	state.record(next, next.Add(10*time.Second), time.Minute, nil)
+	state.begin(next.Add(time.Minute))
+	if state.behind != 0 {
+		t.Errorf("Unexpected seconds behind schedule on time, got %v", state.behind)
+	}
+}
+
+func TestRunLoop(t *testing.T) {
+	var discoveries int32
+	ibnetdiscoverExec := collectors.IbnetdiscoverExec
+	collectors.IbnetdiscoverExec = func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&discoveries, 1)
+		return collectors.ReadFixture("ibnetdiscover", "test")
+	}
+	defer func() { collectors.IbnetdiscoverExec = ibnetdiscoverExec }()
+	outputPath := filepath.Join(t.TempDir(), "output.prom")
+	if _, err := kingpin.CommandLine.Parse([]string{"--exporter.runonce", fmt.Sprintf("--exporter.output=%s", outputPath),
+		"--exporter.loop-interval=50ms", "--exporter.loop-discovery-interval=1h"}); err != nil {
+		t.Fatal(err)
+	}
+	defer kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := runLoop(ctx, log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if loop != nil {
+		t.Errorf("Expected loop state cleared after loop stopped")
+	}
+	if discoveries != 1 {
+		t.Errorf("Expected discovery reused between cycles, got %d discoveries", discoveries)
+	}
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, metric := range []string{"infiniband_exporter_loop_cycles_total", "infiniband_exporter_loop_skipped_cycles_total", "infiniband_switch_info"} {
+		if !strings.Contains(string(content), metric) {
+			t.Errorf("Expected %s in output:\n%s", metric, content)
+		}
+	}
+	if strings.Contains(string(content), "infiniband_exporter_loop_cycles_total 0") {
+		t.Errorf("Expected completed cycles in output:\n%s", content)
+	}
+}
+
+func TestCachedDiscovererError(t *testing.T) {
+	ibnetdiscoverExec := collectors.IbnetdiscoverExec
+	defer func() { collectors.IbnetdiscoverExec = ibnetdiscoverExec }()
+	collectors.IbnetdiscoverExec = func(ctx context.Context) (string, error) {
+		return collectors.ReadFixture("ibnetdiscover", "test")
+	}
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	discoverer := &cachedDiscoverer{logger: log.NewNopLogger()}
+	switches, _, err := discoverer.GetPorts()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	collectors.IbnetdiscoverExec = func(ctx context.Context) (string, error) {
+		return "", fmt.Errorf("failed")
+	}
+	cached, _, err := discoverer.GetPorts()
+	if err != nil {
+		t.Errorf("Expected previous topology used on error, got %v", err)
+	}
+	if cached != switches {
+		t.Errorf("Expected previous topology returned")
+	}
+}
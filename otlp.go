@@ -0,0 +1,432 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	smMasterInfoMetric = "infiniband_sm_master_info"
+)
+
+var (
+	otlpEndpoint           = kingpin.Flag("otlp.endpoint", "OTLP endpoint to push metrics to, eg localhost:4317 for grpc or http://localhost:4318 for http/protobuf").Default("").String()
+	otlpProtocol           = kingpin.Flag("otlp.protocol", "OTLP protocol, one of grpc or http/protobuf").Default("grpc").Enum("grpc", "http/protobuf")
+	otlpHeaders            = kingpin.Flag("otlp.header", "Header added to OTLP requests, eg Authorization=Bearer token, can be repeated").StringMap()
+	otlpResourceAttributes = kingpin.Flag("otlp.resource-attribute", "Resource attribute added to pushed metrics, eg infiniband.fabric=fabric1, can be repeated").StringMap()
+	otlpInsecure           = kingpin.Flag("otlp.insecure", "Connect to the OTLP endpoint without TLS, or skip certificate verification of an https endpoint").Default("false").Bool()
+	otlpCAFile             = kingpin.Flag("otlp.tls-ca-file", "CA certificate used to verify the OTLP endpoint").Default("").String()
+	otlpTimeout            = kingpin.Flag("otlp.timeout", "Timeout for OTLP requests").Default("10s").Duration()
+	otlpInterval           = kingpin.Flag("otlp.interval", "Interval to collect and push metrics when not using runonce").Default("1m").Duration()
+	sysfsPath              = kingpin.Flag("path.sysfs", "Sysfs mount point used to read the subnet prefix").Default("/sys").String()
+	startTime              = time.Now()
+	// otlpExport is reused by every write so the connection is kept between loop cycles
+	otlpExport *otlpExporter
+	// otlpFabricInfo maps _info families describing the whole fabric to the prefix of their resource attributes
+	otlpFabricInfo = map[string]string{smMasterInfoMetric: "infiniband.sm"}
+	// otlpInfoKeys are labels that tell apart the series of an _info family for one device
+	otlpInfoKeys = []string{"port", "psu", "id"}
+)
+
+type otlpExporter struct {
+	conn       *grpc.ClientConn
+	client     colmetricspb.MetricsServiceClient
+	httpClient *http.Client
+	hostname   string
+	logger     log.Logger
+}
+
+func newOTLPExporter(logger log.Logger) (*otlpExporter, error) {
+	tlsConfig := &tls.Config{}
+	if *otlpCAFile != "" {
+		ca, err := os.ReadFile(*otlpCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Unable to parse OTLP CA file %s", *otlpCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	hostname, _ := os.Hostname()
+	e := &otlpExporter{hostname: hostname, logger: logger}
+	if *otlpProtocol == "http/protobuf" {
+		tlsConfig.InsecureSkipVerify = *otlpInsecure //nolint:gosec
+		e.httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		return e, nil
+	}
+	creds := credentials.NewTLS(tlsConfig)
+	if *otlpInsecure {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(*otlpEndpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	e.conn = conn
+	e.client = colmetricspb.NewMetricsServiceClient(conn)
+	return e, nil
+}
+
+// sharedOTLPExporter returns the OTLP exporter of the process, creating it on first use
+func sharedOTLPExporter(logger log.Logger) (*otlpExporter, error) {
+	if otlpExport == nil {
+		exporter, err := newOTLPExporter(logger)
+		if err != nil {
+			return nil, err
+		}
+		otlpExport = exporter
+	}
+	return otlpExport, nil
+}
+
+// closeOTLPExporter closes the shared OTLP exporter if one was created
+func closeOTLPExporter() {
+	if otlpExport != nil {
+		otlpExport.close()
+		otlpExport = nil
+	}
+}
+
+func (e *otlpExporter) close() {
+	if e.conn != nil {
+		e.conn.Close()
+	}
+	if e.httpClient != nil {
+		e.httpClient.CloseIdleConnections()
+	}
+}
+
+// otlpURL returns the http/protobuf metrics URL, endpoints without a scheme use https unless insecure
+func otlpURL() string {
+	endpoint := strings.TrimSuffix(*otlpEndpoint, "/")
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https"
+		if *otlpInsecure {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint
+	}
+	return endpoint + "/v1/metrics"
+}
+
+// export converts gathered metrics to OTLP and pushes them
+func (e *otlpExporter) export(mfs []*dto.MetricFamily, now time.Time) error {
+	req := otlpRequest(mfs, e.resourceAttributes(), now)
+	ctx, cancel := context.WithTimeout(context.Background(), *otlpTimeout)
+	defer cancel()
+	if e.client != nil {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(*otlpHeaders))
+		_, err := e.client.Export(ctx, req)
+		return err
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, otlpURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range *otlpHeaders {
+		httpReq.Header.Set(name, value)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", fmt.Sprintf("infiniband_exporter/%s", version.Version))
+	resp, err := e.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("OTLP endpoint returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// run collects and pushes metrics on an interval
+func (e *otlpExporter) run(interval time.Duration, gatherer prometheus.Gatherer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			level.Error(e.logger).Log("msg", "Error gathering metrics for OTLP", "err", err)
+		}
+		if err := e.export(mfs, time.Now()); err != nil {
+			level.Error(e.logger).Log("msg", "Error pushing metrics with OTLP", "endpoint", *otlpEndpoint, "err", err)
+		}
+	}
+}
+
+// resourceAttributes describes the exporter host and fabric
+func (e *otlpExporter) resourceAttributes() map[string]string {
+	attributes := map[string]string{
+		"service.name":    "infiniband_exporter",
+		"service.version": version.Version,
+		"host.name":       e.hostname,
+	}
+	if prefix := subnetPrefix(); prefix != "" {
+		attributes["infiniband.subnet_prefix"] = prefix
+	}
+	for name, value := range *otlpResourceAttributes {
+		attributes[name] = value
+	}
+	return attributes
+}
+
+// subnetPrefix reads the subnet prefix from the GID of the first active local port
+func subnetPrefix() string {
+	gids, _ := filepath.Glob(filepath.Join(*sysfsPath, "class", "infiniband", "*", "ports", "*", "gids", "0"))
+	for _, path := range gids {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		groups := strings.Split(strings.TrimSpace(string(data)), ":")
+		if len(groups) != 8 {
+			continue
+		}
+		prefix := strings.Join(groups[:4], "")
+		if strings.Trim(prefix, "0") == "" {
+			continue
+		}
+		return "0x" + prefix
+	}
+	return ""
+}
+
+func otlpAttributes(attributes map[string]string) []*commonpb.KeyValue {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var kvs []*commonpb.KeyValue
+	for _, name := range names {
+		kvs = append(kvs, &commonpb.KeyValue{
+			Key:   name,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: attributes[name]}},
+		})
+	}
+	return kvs
+}
+
+func otlpLabels(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	attributes := make(map[string]string)
+	for _, label := range labels {
+		attributes[label.GetName()] = label.GetValue()
+	}
+	return otlpAttributes(attributes)
+}
+
+// otlpRequest converts gathered metrics, counters become cumulative sums starting when the exporter started.
+// Series with a guid label are pushed in a resource for that device and _info series become resource attributes.
+func otlpRequest(mfs []*dto.MetricFamily, resource map[string]string, now time.Time) *colmetricspb.ExportMetricsServiceRequest {
+	fabric := make(map[string]string)
+	for name, value := range resource {
+		fabric[name] = value
+	}
+	devices := make(map[string]map[string]string)
+	metrics := make(map[string][]*metricspb.Metric)
+	for _, mf := range mfs {
+		if strings.HasSuffix(mf.GetName(), "_info") {
+			otlpInfoAttributes(mf, fabric, devices)
+			continue
+		}
+		series := make(map[string][]*dto.Metric)
+		var guids []string
+		for _, m := range mf.GetMetric() {
+			guid := otlpLabelValue(m.GetLabel(), "guid")
+			if _, ok := series[guid]; !ok {
+				guids = append(guids, guid)
+			}
+			series[guid] = append(series[guid], m)
+		}
+		for _, guid := range guids {
+			if metric := otlpMetric(mf, series[guid], now); metric != nil {
+				metrics[guid] = append(metrics[guid], metric)
+			}
+		}
+	}
+	guids := []string{""}
+	for guid := range devices {
+		guids = append(guids, guid)
+	}
+	for guid := range metrics {
+		if _, ok := devices[guid]; !ok && guid != "" {
+			guids = append(guids, guid)
+		}
+	}
+	sort.Strings(guids[1:])
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	for _, guid := range guids {
+		attributes := fabric
+		if guid != "" {
+			attributes = map[string]string{"infiniband.guid": guid}
+			for name, value := range resource {
+				attributes[name] = value
+			}
+			for name, value := range devices[guid] {
+				attributes[name] = value
+			}
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, &metricspb.ResourceMetrics{
+			Resource: &resourcepb.Resource{Attributes: otlpAttributes(attributes)},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: "github.com/treydock/infiniband_exporter", Version: version.Version},
+				Metrics: metrics[guid],
+			}},
+		})
+	}
+	return req
+}
+
+// otlpInfoAttributes adds the labels of _info series to the fabric resource or the resource of their device
+func otlpInfoAttributes(mf *dto.MetricFamily, fabric map[string]string, devices map[string]map[string]string) {
+	prefix, isFabric := otlpFabricInfo[mf.GetName()]
+	if !isFabric {
+		prefix = "infiniband." + strings.TrimSuffix(strings.TrimPrefix(mf.GetName(), "infiniband_"), "_info")
+	}
+	for _, m := range mf.GetMetric() {
+		labels := make(map[string]string)
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		attributes := fabric
+		if guid := labels["guid"]; guid != "" && !isFabric {
+			if devices[guid] == nil {
+				devices[guid] = make(map[string]string)
+			}
+			attributes = devices[guid]
+			delete(labels, "guid")
+		}
+		key := prefix
+		for _, name := range otlpInfoKeys {
+			if value, ok := labels[name]; ok {
+				key = key + "." + value
+				delete(labels, name)
+			}
+		}
+		for name, value := range labels {
+			attributes[key+"."+name] = value
+		}
+	}
+}
+
+func otlpLabelValue(labels []*dto.LabelPair, name string) string {
+	for _, label := range labels {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+// otlpMetric converts the series of a metric family, returning nil for series without data
+func otlpMetric(mf *dto.MetricFamily, series []*dto.Metric, now time.Time) *metricspb.Metric {
+	start := uint64(startTime.UnixNano())
+	metric := &metricspb.Metric{Name: mf.GetName(), Description: mf.GetHelp()}
+	var numbers []*metricspb.NumberDataPoint
+	for _, m := range series {
+		timestamp := uint64(now.UnixNano())
+		if m.TimestampMs != nil {
+			timestamp = uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+		}
+		attributes := otlpLabels(m.GetLabel())
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			numbers = append(numbers, &metricspb.NumberDataPoint{Attributes: attributes, StartTimeUnixNano: start, TimeUnixNano: timestamp,
+				Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetCounter().GetValue()}})
+		case dto.MetricType_GAUGE:
+			numbers = append(numbers, &metricspb.NumberDataPoint{Attributes: attributes, TimeUnixNano: timestamp,
+				Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetGauge().GetValue()}})
+		case dto.MetricType_SUMMARY:
+			summary, _ := metric.Data.(*metricspb.Metric_Summary)
+			if summary == nil {
+				summary = &metricspb.Metric_Summary{Summary: &metricspb.Summary{}}
+				metric.Data = summary
+			}
+			point := &metricspb.SummaryDataPoint{Attributes: attributes, StartTimeUnixNano: start, TimeUnixNano: timestamp,
+				Count: m.GetSummary().GetSampleCount(), Sum: m.GetSummary().GetSampleSum()}
+			for _, q := range m.GetSummary().GetQuantile() {
+				point.QuantileValues = append(point.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+			}
+			summary.Summary.DataPoints = append(summary.Summary.DataPoints, point)
+		case dto.MetricType_HISTOGRAM:
+			histogram, _ := metric.Data.(*metricspb.Metric_Histogram)
+			if histogram == nil {
+				histogram = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE}}
+				metric.Data = histogram
+			}
+			sum := m.GetHistogram().GetSampleSum()
+			point := &metricspb.HistogramDataPoint{Attributes: attributes, StartTimeUnixNano: start, TimeUnixNano: timestamp,
+				Count: m.GetHistogram().GetSampleCount(), Sum: &sum}
+			// OTLP bucket counts are not cumulative and include the +Inf bucket
+			var previous uint64
+			for _, b := range m.GetHistogram().GetBucket() {
+				point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+				point.BucketCounts = append(point.BucketCounts, b.GetCumulativeCount()-previous)
+				previous = b.GetCumulativeCount()
+			}
+			point.BucketCounts = append(point.BucketCounts, m.GetHistogram().GetSampleCount()-previous)
+			histogram.Histogram.DataPoints = append(histogram.Histogram.DataPoints, point)
+		default:
+			numbers = append(numbers, &metricspb.NumberDataPoint{Attributes: attributes, TimeUnixNano: timestamp,
+				Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetUntyped().GetValue()}})
+		}
+	}
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{DataPoints: numbers, IsMonotonic: true,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE}}
+	case dto.MetricType_SUMMARY, dto.MetricType_HISTOGRAM:
+	default:
+		metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: numbers}}
+	}
+	if metric.Data == nil {
+		return nil
+	}
+	return metric
+}
@@ -0,0 +1,273 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+type otlpReceiver struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	sync.Mutex
+	requests []*colmetricspb.ExportMetricsServiceRequest
+	headers  []string
+}
+
+func (r *otlpReceiver) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, req)
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.headers = append(r.headers, md.Get("x-fabric")...)
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/metrics" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	exportReq := &colmetricspb.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, exportReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, exportReq)
+	r.headers = append(r.headers, req.Header.Get("X-Fabric"))
+}
+
+func otlpTestGatherer() prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "Test counter"}, []string{"guid", "port"})
+	counter.WithLabelValues("0x00", "1").Add(10)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test gauge"})
+	gauge.Set(2)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "Test histogram", Buckets: []float64{1, 2}})
+	histogram.Observe(0.5)
+	histogram.Observe(1.5)
+	histogram.Observe(3)
+	master := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: smMasterInfoMetric, Help: "Test master"}, []string{"guid", "lid", "name"})
+	master.WithLabelValues("0x7cfe9003009ce5b0", "1719", "ib-i1l1s01").Set(1)
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "infiniband_switch_info", Help: "Test switch"}, []string{"guid", "switch", "lid"})
+	info.WithLabelValues("0x00", "ib-i1l1s01", "1719").Set(1)
+	psu := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "infiniband_switch_power_supply_status_info", Help: "Test psu"}, []string{"guid", "psu", "status"})
+	psu.WithLabelValues("0x00", "0", "OK").Set(1)
+	psu.WithLabelValues("0x00", "1", "ERROR").Set(1)
+	registry.MustRegister(counter, gauge, histogram, master, info, psu)
+	return registry
+}
+
+func TestOTLPRequest(t *testing.T) {
+	mfs, err := otlpTestGatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	req := otlpRequest(mfs, map[string]string{"host.name": "test"}, now)
+	if len(req.ResourceMetrics) != 2 {
+		t.Fatalf("Unexpected resources, got %d", len(req.ResourceMetrics))
+	}
+	expected := []map[string]string{
+		{"host.name": "test", "infiniband.sm.guid": "0x7cfe9003009ce5b0", "infiniband.sm.lid": "1719", "infiniband.sm.name": "ib-i1l1s01"},
+		{"host.name": "test", "infiniband.guid": "0x00", "infiniband.switch.switch": "ib-i1l1s01", "infiniband.switch.lid": "1719",
+			"infiniband.switch_power_supply_status.0.status": "OK", "infiniband.switch_power_supply_status.1.status": "ERROR"},
+	}
+	var metrics []*metricspb.Metric
+	for i, resourceMetrics := range req.ResourceMetrics {
+		attributes := make(map[string]string)
+		for _, attribute := range resourceMetrics.Resource.Attributes {
+			attributes[attribute.Key] = attribute.Value.GetStringValue()
+		}
+		if !reflect.DeepEqual(attributes, expected[i]) {
+			t.Errorf("Unexpected resource attributes\nExpected\n%v\nGot\n%v", expected[i], attributes)
+		}
+		metrics = append(metrics, resourceMetrics.ScopeMetrics[0].Metrics...)
+	}
+	if len(req.ResourceMetrics[1].ScopeMetrics[0].Metrics) != 1 || req.ResourceMetrics[1].ScopeMetrics[0].Metrics[0].Name != "test_total" {
+		t.Errorf("Expected device series in device resource, got %v", req.ResourceMetrics[1].ScopeMetrics[0].Metrics)
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("Unexpected metrics, got %d", len(metrics))
+	}
+	for _, metric := range metrics {
+		switch metric.Name {
+		case "test_total":
+			sum := metric.GetSum()
+			if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+				t.Fatalf("Expected cumulative sum, got %v", metric)
+			}
+			point := sum.DataPoints[0]
+			if point.GetAsDouble() != 10 || point.TimeUnixNano != uint64(now.UnixNano()) || point.StartTimeUnixNano != uint64(startTime.UnixNano()) {
+				t.Errorf("Unexpected data point, got %v", point)
+			}
+			if len(point.Attributes) != 2 || point.Attributes[0].Key != "guid" || point.Attributes[1].Value.GetStringValue() != "1" {
+				t.Errorf("Unexpected attributes, got %v", point.Attributes)
+			}
+		case "test_gauge":
+			if gauge := metric.GetGauge(); gauge == nil || gauge.DataPoints[0].GetAsDouble() != 2 {
+				t.Errorf("Unexpected gauge, got %v", metric)
+			}
+		case "test_seconds":
+			point := metric.GetHistogram().DataPoints[0]
+			if point.Count != 3 || point.GetSum() != 5 {
+				t.Errorf("Unexpected histogram, got %v", point)
+			}
+			if !reflect.DeepEqual(point.BucketCounts, []uint64{1, 1, 1}) || !reflect.DeepEqual(point.ExplicitBounds, []float64{1, 2}) {
+				t.Errorf("Unexpected buckets, got %v %v", point.BucketCounts, point.ExplicitBounds)
+			}
+		default:
+			t.Errorf("Unexpected metric %s", metric.Name)
+		}
+	}
+}
+
+func TestOTLPResourceAttributes(t *testing.T) {
+	sysfs := t.TempDir()
+	gids := filepath.Join(sysfs, "class", "infiniband", "mlx5_0", "ports", "1", "gids")
+	if err := os.MkdirAll(gids, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(gids, "0"), []byte("fe80:0000:0000:0000:7cfe:9003:009c:e5b0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setupTest(t, []string{fmt.Sprintf("--path.sysfs=%s", sysfs), "--otlp.resource-attribute=infiniband.fabric=fabric1"})
+	exporter := &otlpExporter{hostname: "test"}
+	attributes := exporter.resourceAttributes()
+	expected := map[string]string{
+		"infiniband.fabric":        "fabric1",
+		"infiniband.subnet_prefix": "0xfe80000000000000",
+		"host.name":                "test",
+		"service.name":             "infiniband_exporter",
+	}
+	for name, value := range expected {
+		if attributes[name] != value {
+			t.Errorf("Unexpected resource attribute %s, got %s", name, attributes[name])
+		}
+	}
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+	receiver := &otlpReceiver{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(server, receiver)
+	go server.Serve(listener) //nolint:errcheck
+	defer server.Stop()
+	setupTest(t, []string{fmt.Sprintf("--otlp.endpoint=%s", listener.Addr()), "--otlp.insecure", "--otlp.header=x-fabric=fabric1"})
+	exporter, err := newOTLPExporter(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.close()
+	mfs, _ := otlpTestGatherer().Gather()
+	if err := exporter.export(mfs, time.Now()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(receiver.requests) != 1 || len(receiver.requests[0].ResourceMetrics) != 2 {
+		t.Errorf("Unexpected requests, got %v", receiver.requests)
+	}
+	if !reflect.DeepEqual(receiver.headers, []string{"fabric1"}) {
+		t.Errorf("Unexpected headers, got %v", receiver.headers)
+	}
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+	receiver := &otlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	setupTest(t, []string{"--exporter.runonce", fmt.Sprintf("--otlp.endpoint=%s", server.URL), "--otlp.protocol=http/protobuf", "--otlp.header=X-Fabric=fabric1"})
+	if err := writeMetrics(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(receiver.requests) != 1 {
+		t.Fatalf("Unexpected requests, got %d", len(receiver.requests))
+	}
+	var found bool
+	for _, resourceMetrics := range receiver.requests[0].ResourceMetrics {
+		for _, metric := range resourceMetrics.ScopeMetrics[0].Metrics {
+			if metric.Name == "infiniband_switch_port_transmit_data_bytes_total" && metric.GetSum() != nil {
+				found = true
+			}
+			if strings.HasSuffix(metric.Name, "_info") {
+				t.Errorf("Unexpected info metric %s", metric.Name)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected switch counters pushed as sums")
+	}
+	if !reflect.DeepEqual(receiver.headers, []string{"fabric1"}) {
+		t.Errorf("Unexpected headers, got %v", receiver.headers)
+	}
+}
+
+func TestOTLPExportHTTPInsecure(t *testing.T) {
+	receiver := &otlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	setupTest(t, []string{"--exporter.runonce", fmt.Sprintf("--otlp.endpoint=%s", strings.TrimPrefix(server.URL, "http://")),
+		"--otlp.protocol=http/protobuf", "--otlp.insecure"})
+	for i := 0; i < 2; i++ {
+		if err := writeMetrics(log.NewNopLogger()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if len(receiver.requests) != 2 {
+		t.Errorf("Unexpected requests, got %d", len(receiver.requests))
+	}
+	exporter := otlpExport
+	if err := writeMetrics(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if otlpExport != exporter {
+		t.Errorf("Expected OTLP exporter reused")
+	}
+	tlsServer := httptest.NewTLSServer(receiver)
+	defer tlsServer.Close()
+	setupTest(t, []string{fmt.Sprintf("--otlp.endpoint=%s", tlsServer.URL), "--otlp.protocol=http/protobuf", "--otlp.insecure"})
+	exporter, err := newOTLPExporter(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs, _ := otlpTestGatherer().Gather()
+	if err := exporter.export(mfs, time.Now()); err != nil {
+		t.Errorf("Unexpected error skipping verification: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	pushgatewayURL      = kingpin.Flag("pushgateway.url", "Pushgateway URL to push metrics to when using runonce, eg http://pushgateway.example.com:9091").Default("").String()
+	pushgatewayJob      = kingpin.Flag("pushgateway.job", "Job name used when pushing to Pushgateway").Default("infiniband_exporter").String()
+	pushgatewayGrouping = kingpin.Flag("pushgateway.grouping", "Grouping label used when pushing to Pushgateway, eg fabric=fabric1, can be repeated").StringMap()
+	pushgatewayUsername = kingpin.Flag("pushgateway.username", "Pushgateway username for basic authentication").Default("").String()
+	pushgatewayPassword = kingpin.Flag("pushgateway.password", "Pushgateway password for basic authentication").Default("").Envar("PUSHGATEWAY_PASSWORD").String()
+	pushgatewayTimeout  = kingpin.Flag("pushgateway.timeout", "Timeout for pushing to Pushgateway").Default("30s").Duration()
+)
+
+// pushgatewayPush replaces the metrics of the job and grouping so devices that vanished are removed,
+// the returned gatherer has the result and duration of the push
+func pushgatewayPush(mfs []*dto.MetricFamily, logger log.Logger) (prometheus.Gatherer, error) {
+	start := time.Now()
+	pusher := push.New(*pushgatewayURL, *pushgatewayJob).
+		Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return withoutTimestamps(mfs), nil }))
+	names := make([]string, 0, len(*pushgatewayGrouping))
+	for name := range *pushgatewayGrouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pusher = pusher.Grouping(name, (*pushgatewayGrouping)[name])
+	}
+	if *pushgatewayUsername != "" {
+		pusher = pusher.BasicAuth(*pushgatewayUsername, *pushgatewayPassword)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *pushgatewayTimeout)
+	defer cancel()
+	err := pusher.PushContext(ctx)
+	duration := time.Since(start).Seconds()
+	success := 1.0
+	if err != nil {
+		level.Error(logger).Log("msg", "Error pushing metrics to Pushgateway", "url", *pushgatewayURL, "err", err)
+		success = 0
+	} else {
+		level.Debug(logger).Log("msg", "Pushed metrics to Pushgateway", "url", *pushgatewayURL, "duration", duration)
+	}
+	registry := prometheus.NewRegistry()
+	successGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "infiniband_exporter_pushgateway_success",
+		Help: "Indicates if pushing metrics to Pushgateway was successful"})
+	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "infiniband_exporter_pushgateway_duration_seconds",
+		Help: "Time taken to push metrics to Pushgateway"})
+	successGauge.Set(success)
+	durationGauge.Set(duration)
+	registry.MustRegister(successGauge, durationGauge)
+	return registry, err
+}
+
+// withoutTimestamps removes timestamps, which Pushgateway rejects, from metrics such as cached values
+func withoutTimestamps(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	var result []*dto.MetricFamily
+	for _, mf := range mfs {
+		mf = proto.Clone(mf).(*dto.MetricFamily)
+		for _, m := range mf.GetMetric() {
+			m.TimestampMs = nil
+		}
+		result = append(result, mf)
+	}
+	return result
+}
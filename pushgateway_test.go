@@ -0,0 +1,129 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+type pushgatewayReceiver struct {
+	status int
+	method string
+	path   string
+	user   string
+	body   []byte
+}
+
+func (r *pushgatewayReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.method = req.Method
+	r.path = req.URL.Path
+	r.user, _, _ = req.BasicAuth()
+	r.body, _ = io.ReadAll(req.Body)
+	if r.status != 0 {
+		http.Error(w, "failed", r.status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func setupPushgateway(t *testing.T, receiver *pushgatewayReceiver, args []string) string {
+	server := httptest.NewServer(receiver)
+	outputPath := filepath.Join(t.TempDir(), "output.prom")
+	args = append(args, "--exporter.runonce", fmt.Sprintf("--exporter.output=%s", outputPath), fmt.Sprintf("--pushgateway.url=%s", server.URL))
+	t.Cleanup(server.Close)
+	setupTest(t, args)
+	return outputPath
+}
+
+func TestCollectToPushgateway(t *testing.T) {
+	receiver := &pushgatewayReceiver{}
+	outputPath := setupPushgateway(t, receiver, []string{"--pushgateway.grouping=fabric=fabric1", "--pushgateway.grouping=shard=1", "--pushgateway.username=foo"})
+	if err := writeMetrics(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if receiver.method != http.MethodPut {
+		t.Errorf("Unexpected method, got %s", receiver.method)
+	}
+	// Grouping labels are sent in any order
+	if receiver.path != "/metrics/job/infiniband_exporter/fabric/fabric1/shard/1" && receiver.path != "/metrics/job/infiniband_exporter/shard/1/fabric/fabric1" {
+		t.Errorf("Unexpected path, got %s", receiver.path)
+	}
+	if receiver.user != "foo" {
+		t.Errorf("Unexpected basic auth user, got %s", receiver.user)
+	}
+	var parser expfmt.TextParser
+	if len(receiver.body) == 0 {
+		t.Fatal("Expected pushed metrics")
+	}
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := parser.TextToMetricFamilies(strings.NewReader(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mf, ok := mfs["infiniband_exporter_pushgateway_success"]; !ok || mf.GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Errorf("Expected push success in output, got %v", mf)
+	}
+	if _, ok := mfs["infiniband_exporter_pushgateway_duration_seconds"]; !ok {
+		t.Errorf("Expected push duration in output")
+	}
+	if _, ok := mfs["infiniband_switch_port_transmit_data_bytes_total"]; !ok {
+		t.Errorf("Expected switch metrics in output")
+	}
+}
+
+func TestCollectToPushgatewayError(t *testing.T) {
+	receiver := &pushgatewayReceiver{status: http.StatusBadRequest}
+	outputPath := setupPushgateway(t, receiver, []string{})
+	if err := writeMetrics(log.NewNopLogger()); err == nil {
+		t.Errorf("Expected error")
+	}
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Expected output written after push error: %v", err)
+	}
+	if !strings.Contains(string(content), "infiniband_exporter_pushgateway_success 0") {
+		t.Errorf("Expected push failure in output:\n%s", content)
+	}
+}
+
+func TestWithoutTimestamps(t *testing.T) {
+	timestamp := int64(1700000000000)
+	mfs := []*dto.MetricFamily{{
+		Name:   proto.String("test"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}, TimestampMs: &timestamp}},
+	}}
+	result := withoutTimestamps(mfs)
+	if result[0].GetMetric()[0].TimestampMs != nil {
+		t.Errorf("Expected timestamp removed")
+	}
+	if mfs[0].GetMetric()[0].TimestampMs == nil {
+		t.Errorf("Expected gathered metrics unchanged")
+	}
+}
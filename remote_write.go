@@ -0,0 +1,236 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	remoteWriteURL          = kingpin.Flag("remote-write.url", "Remote write endpoint to push metrics to, eg https://prometheus.example.com/api/v1/write").Default("").String()
+	remoteWriteHeaders      = kingpin.Flag("remote-write.header", "Header added to remote write requests, eg X-Scope-OrgID=fabric1, can be repeated").StringMap()
+	remoteWriteLabels       = kingpin.Flag("remote-write.label", "Label added to pushed series that do not already have it, eg job=infiniband_exporter, can be repeated").StringMap()
+	remoteWriteUsername     = kingpin.Flag("remote-write.username", "Remote write username for basic authentication").Default("").String()
+	remoteWritePassword     = kingpin.Flag("remote-write.password", "Remote write password for basic authentication").Default("").Envar("REMOTE_WRITE_PASSWORD").String()
+	remoteWriteCAFile       = kingpin.Flag("remote-write.tls-ca-file", "CA certificate used to verify the remote write endpoint").Default("").String()
+	remoteWriteCertFile     = kingpin.Flag("remote-write.tls-cert-file", "Client certificate used to authenticate to the remote write endpoint").Default("").String()
+	remoteWriteKeyFile      = kingpin.Flag("remote-write.tls-key-file", "Client key used to authenticate to the remote write endpoint").Default("").String()
+	remoteWriteInsecure     = kingpin.Flag("remote-write.tls-insecure-skip-verify", "Skip verification of the remote write endpoint certificate").Default("false").Bool()
+	remoteWriteTimeout      = kingpin.Flag("remote-write.timeout", "Timeout for remote write requests").Default("30s").Duration()
+	remoteWriteInterval     = kingpin.Flag("remote-write.interval", "Interval to collect and push metrics when not using runonce, 0 disables").Default("0s").Duration()
+	remoteWriteRetries      = kingpin.Flag("remote-write.retries", "Number of times to retry a remote write request that failed with a recoverable error").Default("3").Int()
+	remoteWriteRetryBackoff = kingpin.Flag("remote-write.retry-backoff", "Initial backoff between remote write retries, doubled after each retry").Default("1s").Duration()
+	remoteWriteQueueSize    = kingpin.Flag("remote-write.queue-size", "Number of failed remote write requests kept to send with the next push").Default("10").Int()
+	remoteWriteSleep        = time.Sleep
+	// remoteWrite is reused by every write so failed requests are retried with the next push
+	remoteWrite *remoteWriter
+)
+
+type remoteWriter struct {
+	client *http.Client
+	queue  [][]byte
+	logger log.Logger
+}
+
+type remoteWriteError struct {
+	err         error
+	recoverable bool
+}
+
+func (e *remoteWriteError) Error() string {
+	return e.err.Error()
+}
+
+// marshalWriteRequest encodes samples as a remote write WriteRequest protobuf
+func marshalWriteRequest(samples []sample, extraLabels map[string]string) []byte {
+	var req []byte
+	for _, s := range samples {
+		labels := map[string]string{"__name__": s.Name}
+		for name, value := range extraLabels {
+			labels[name] = value
+		}
+		for _, label := range s.Labels {
+			labels[label.Name] = label.Value
+		}
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var series []byte
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, labels[name])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.Fixed64Type)
+		value = protowire.AppendFixed64(value, math.Float64bits(s.Value))
+		value = protowire.AppendTag(value, 2, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(s.Timestamp))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, value)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+	return req
+}
+
+func newRemoteWriter(logger log.Logger) (*remoteWriter, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: *remoteWriteInsecure} //nolint:gosec
+	if *remoteWriteCAFile != "" {
+		ca, err := os.ReadFile(*remoteWriteCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Unable to parse remote write CA file %s", *remoteWriteCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if *remoteWriteCertFile != "" || *remoteWriteKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*remoteWriteCertFile, *remoteWriteKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &remoteWriter{
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		logger: logger,
+	}, nil
+}
+
+// sharedRemoteWriter returns the remote writer of the process, creating it on first use
+func sharedRemoteWriter(logger log.Logger) (*remoteWriter, error) {
+	if remoteWrite == nil {
+		writer, err := newRemoteWriter(logger)
+		if err != nil {
+			return nil, err
+		}
+		remoteWrite = writer
+	}
+	return remoteWrite, nil
+}
+
+// push sends gathered metrics along with requests that failed previous pushes
+func (w *remoteWriter) push(mfs []*dto.MetricFamily, now time.Time) error {
+	samples := gatheredSamples(mfs, now)
+	w.queue = append(w.queue, snappy.Encode(nil, marshalWriteRequest(samples, *remoteWriteLabels)))
+	var lastErr error
+	for len(w.queue) > 0 {
+		err := w.send(w.queue[0])
+		if rwErr, ok := err.(*remoteWriteError); ok && rwErr.recoverable {
+			if dropped := len(w.queue) - *remoteWriteQueueSize; dropped > 0 {
+				level.Warn(w.logger).Log("msg", "Remote write queue full, dropping oldest requests", "dropped", dropped)
+				w.queue = w.queue[dropped:]
+			}
+			return err
+		}
+		if err != nil {
+			level.Error(w.logger).Log("msg", "Dropping remote write request that can not be retried", "err", err)
+			lastErr = err
+		}
+		w.queue = w.queue[1:]
+	}
+	level.Debug(w.logger).Log("msg", "Pushed metrics with remote write", "samples", len(samples))
+	return lastErr
+}
+
+// send posts a request, retrying recoverable errors with exponential backoff
+func (w *remoteWriter) send(body []byte) error {
+	var err error
+	backoff := *remoteWriteRetryBackoff
+	for attempt := 0; attempt <= *remoteWriteRetries; attempt++ {
+		if attempt > 0 {
+			remoteWriteSleep(backoff)
+			backoff = backoff * 2
+		}
+		err = w.sendOnce(body)
+		if rwErr, ok := err.(*remoteWriteError); !ok || !rwErr.recoverable {
+			return err
+		}
+		level.Debug(w.logger).Log("msg", "Remote write request failed", "attempt", attempt+1, "err", err)
+	}
+	return err
+}
+
+func (w *remoteWriter) sendOnce(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *remoteWriteTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return &remoteWriteError{err: err}
+	}
+	for name, value := range *remoteWriteHeaders {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", fmt.Sprintf("infiniband_exporter/%s", version.Version))
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if *remoteWriteUsername != "" {
+		req.SetBasicAuth(*remoteWriteUsername, *remoteWritePassword)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return &remoteWriteError{err: err, recoverable: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("Remote write returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return &remoteWriteError{err: err, recoverable: resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests}
+}
+
+// run collects and pushes metrics on an interval
+func (w *remoteWriter) run(interval time.Duration, gatherer prometheus.Gatherer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			level.Error(w.logger).Log("msg", "Error gathering metrics for remote write", "err", err)
+		}
+		if err := w.push(mfs, time.Now()); err != nil {
+			level.Error(w.logger).Log("msg", "Error pushing metrics with remote write", "err", err)
+		}
+	}
+}
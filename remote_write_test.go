@@ -0,0 +1,284 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type remoteWriteReceiver struct {
+	sync.Mutex
+	statuses []int
+	requests []*http.Request
+	series   [][]sample
+}
+
+func (r *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, req)
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status = r.statuses[0]
+		r.statuses = r.statuses[1:]
+	}
+	if status/100 != 2 {
+		http.Error(w, "failed", status)
+		return
+	}
+	compressed, _ := io.ReadAll(req.Body)
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.series = append(r.series, decodeWriteRequest(body))
+	w.WriteHeader(status)
+}
+
+// decodeWriteRequest decodes a WriteRequest into samples with __name__ kept as a label
+func decodeWriteRequest(b []byte) []sample {
+	var samples []sample
+	for len(b) > 0 {
+		_, _, n := protowire.ConsumeTag(b)
+		series, m := protowire.ConsumeBytes(b[n:])
+		b = b[n+m:]
+		var s sample
+		for len(series) > 0 {
+			num, _, n := protowire.ConsumeTag(series)
+			field, m := protowire.ConsumeBytes(series[n:])
+			series = series[n+m:]
+			if num == 1 {
+				_, _, n := protowire.ConsumeTag(field)
+				name, m := protowire.ConsumeString(field[n:])
+				field = field[n+m:]
+				_, _, n = protowire.ConsumeTag(field)
+				value, _ := protowire.ConsumeString(field[n:])
+				s.Labels = append(s.Labels, sampleLabel{Name: name, Value: value})
+				continue
+			}
+			_, _, n = protowire.ConsumeTag(field)
+			value, m := protowire.ConsumeFixed64(field[n:])
+			field = field[n+m:]
+			s.Value = math.Float64frombits(value)
+			_, _, n = protowire.ConsumeTag(field)
+			timestamp, _ := protowire.ConsumeVarint(field[n:])
+			s.Timestamp = int64(timestamp)
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+func setupRemoteWrite(t *testing.T, receiver *remoteWriteReceiver, args []string) {
+	server := httptest.NewServer(receiver)
+	args = append(args, fmt.Sprintf("--remote-write.url=%s", server.URL))
+	t.Cleanup(server.Close)
+	setupTest(t, args)
+}
+
+func testGatherer(value float64) prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_value", Help: "Test"}, []string{"guid"})
+	gauge.WithLabelValues("0x00").Set(value)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "Test", Buckets: []float64{1}})
+	histogram.Observe(0.5)
+	registry.MustRegister(gauge, histogram)
+	return registry
+}
+
+func TestGatheredSamples(t *testing.T) {
+	mfs, err := testGatherer(2).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	samples := gatheredSamples(mfs, now)
+	expected := []sample{
+		{Name: "test_seconds_bucket", Labels: []sampleLabel{{Name: "le", Value: "1"}}, Value: 1, Timestamp: now.UnixMilli()},
+		{Name: "test_seconds_bucket", Labels: []sampleLabel{{Name: "le", Value: "+Inf"}}, Value: 1, Timestamp: now.UnixMilli()},
+		{Name: "test_seconds_sum", Value: 0.5, Timestamp: now.UnixMilli()},
+		{Name: "test_seconds_count", Value: 1, Timestamp: now.UnixMilli()},
+		{Name: "test_value", Labels: []sampleLabel{{Name: "guid", Value: "0x00"}}, Value: 2, Timestamp: now.UnixMilli()},
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Unexpected samples\nExpected:\n%v\nGot:\n%v", expected, samples)
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	receiver := &remoteWriteReceiver{}
+	setupRemoteWrite(t, receiver, []string{"--remote-write.header=X-Scope-OrgID=fabric1", "--remote-write.label=job=infiniband_exporter",
+		"--remote-write.label=guid=ignored", "--remote-write.username=foo", "--remote-write.password=bar"})
+	writer, err := newRemoteWriter(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs, _ := testGatherer(2).Gather()
+	if err := writer.push(mfs, time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(receiver.requests) != 1 {
+		t.Fatalf("Unexpected requests, got %d", len(receiver.requests))
+	}
+	req := receiver.requests[0]
+	if val := req.Header.Get("Content-Encoding"); val != "snappy" {
+		t.Errorf("Unexpected Content-Encoding, got %s", val)
+	}
+	if val := req.Header.Get("X-Prometheus-Remote-Write-Version"); val != "0.1.0" {
+		t.Errorf("Unexpected remote write version, got %s", val)
+	}
+	if val := req.Header.Get("X-Scope-OrgID"); val != "fabric1" {
+		t.Errorf("Unexpected X-Scope-OrgID, got %s", val)
+	}
+	if username, password, ok := req.BasicAuth(); !ok || username != "foo" || password != "bar" {
+		t.Errorf("Unexpected basic auth, got %s %s", username, password)
+	}
+	series := receiver.series[0]
+	if len(series) != 5 {
+		t.Fatalf("Unexpected series, got %v", series)
+	}
+	expected := sample{
+		Labels:    []sampleLabel{{Name: "__name__", Value: "test_value"}, {Name: "guid", Value: "0x00"}, {Name: "job", Value: "infiniband_exporter"}},
+		Value:     2,
+		Timestamp: 1700000000000,
+	}
+	if !reflect.DeepEqual(series[4], expected) {
+		t.Errorf("Unexpected series\nExpected:\n%v\nGot:\n%v", expected, series[4])
+	}
+}
+
+func TestRemoteWriteRetry(t *testing.T) {
+	receiver := &remoteWriteReceiver{statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}}
+	setupRemoteWrite(t, receiver, []string{})
+	writer, _ := newRemoteWriter(log.NewNopLogger())
+	mfs, _ := testGatherer(2).Gather()
+	if err := writer.push(mfs, time.Now()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(receiver.requests) != 3 || len(receiver.series) != 1 {
+		t.Errorf("Unexpected requests, got %d", len(receiver.requests))
+	}
+	receiver.statuses = []int{http.StatusBadRequest}
+	if err := writer.push(mfs, time.Now()); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected bad request error, got %v", err)
+	}
+	if len(receiver.requests) != 4 || len(writer.queue) != 0 {
+		t.Errorf("Expected bad request not retried, got %d requests and queue %d", len(receiver.requests), len(writer.queue))
+	}
+}
+
+func TestRemoteWriteQueue(t *testing.T) {
+	receiver := &remoteWriteReceiver{}
+	setupRemoteWrite(t, receiver, []string{"--remote-write.retries=0", "--remote-write.queue-size=2"})
+	writer, _ := newRemoteWriter(log.NewNopLogger())
+	receiver.statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+	for i := 1; i <= 3; i++ {
+		mfs, _ := testGatherer(float64(i)).Gather()
+		if err := writer.push(mfs, time.Now()); err == nil {
+			t.Errorf("Expected error")
+		}
+	}
+	if len(writer.queue) != 2 {
+		t.Errorf("Unexpected queue size, got %d", len(writer.queue))
+	}
+	mfs, _ := testGatherer(4).Gather()
+	if err := writer.push(mfs, time.Now()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var values []float64
+	for _, series := range receiver.series {
+		values = append(values, series[4].Value)
+	}
+	if !reflect.DeepEqual(values, []float64{2, 3, 4}) {
+		t.Errorf("Unexpected pushed values, got %v", values)
+	}
+}
+
+func TestCollectToRemoteWrite(t *testing.T) {
+	receiver := &remoteWriteReceiver{}
+	setupRemoteWrite(t, receiver, []string{"--exporter.runonce"})
+	if err := writeMetrics(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(receiver.series) != 1 {
+		t.Fatalf("Unexpected requests, got %d", len(receiver.requests))
+	}
+	var found bool
+	for _, s := range receiver.series[0] {
+		if s.Labels[0].Value == "infiniband_switch_port_transmit_data_bytes_total" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected switch metrics pushed")
+	}
+}
+
+func TestCollectToRemoteWriteQueue(t *testing.T) {
+	receiver := &remoteWriteReceiver{}
+	setupRemoteWrite(t, receiver, []string{"--exporter.runonce", "--remote-write.retries=0"})
+	receiver.statuses = []int{http.StatusServiceUnavailable}
+	if err := writeMetrics(log.NewNopLogger()); err == nil {
+		t.Errorf("Expected error")
+	}
+	if err := writeMetrics(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(receiver.series) != 2 {
+		t.Errorf("Expected failed request retried with the next write, got %d", len(receiver.series))
+	}
+}
+
+func TestSharedGatherer(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	gatherer := newSharedGatherer([]time.Duration{time.Minute, 2 * time.Minute}, log.NewNopLogger())
+	if gatherer.maxAge != 30*time.Second {
+		t.Errorf("Unexpected max age, got %v", gatherer.maxAge)
+	}
+	if _, err := gatherer.Gather(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	gathered := gatherer.time
+	if _, err := gatherer.Gather(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if gatherer.time != gathered {
+		t.Errorf("Expected gather reused")
+	}
+	gatherer.time = gathered.Add(-time.Minute)
+	if _, err := gatherer.Gather(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !gatherer.time.After(gathered) {
+		t.Errorf("Expected new gather after max age")
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	alertsEndpoint = "/alerts"
+	alertPending   = "pending"
+	alertFiring    = "firing"
+)
+
+var (
+	// alerts is set when rules are configured
+	alerts          *ruleEvaluator
+	symbolErrorsMFs = []string{"infiniband_switch_port_symbol_error_total", "infiniband_hca_port_symbol_error_total"}
+	linkDownedMFs   = []string{"infiniband_switch_port_link_downed_total", "infiniband_hca_port_link_downed_total"}
+	psuStatusMFs    = []string{"infiniband_switch_power_supply_status_info", "infiniband_switch_power_supply_dc_power_status_info", "infiniband_switch_power_supply_fan_status_info"}
+	portRateMFs     = []string{"infiniband_switch_port_rate_bytes_per_second", "infiniband_hca_rate_bytes_per_second"}
+)
+
+// alert is the state of a rule for a device or port whose condition is met
+type alert struct {
+	Rule      string    `json:"rule"`
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	GUID      string    `json:"guid"`
+	Port      string    `json:"port,omitempty"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold,omitempty"`
+	State     string    `json:"state"`
+	ActiveAt  time.Time `json:"active_at"`
+}
+
+type counterSample struct {
+	time  time.Time
+	value float64
+}
+
+// ruleEvaluator evaluates rules against gathered metrics, keeping counter history for rules over a window
+type ruleEvaluator struct {
+	sync.Mutex
+	rules   []alertRule
+	history map[string][]counterSample
+	active  map[string]*alert
+}
+
+// ruleGatherer adds the state of alerts to the gathered metrics
+type ruleGatherer struct {
+	prometheus.Gatherer
+}
+
+func newRuleEvaluator(rules []alertRule) *ruleEvaluator {
+	return &ruleEvaluator{
+		rules:   rules,
+		history: make(map[string][]counterSample),
+		active:  make(map[string]*alert),
+	}
+}
+
+func (g ruleGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if err != nil {
+		return mfs, err
+	}
+	alerts.evaluate(mfs, time.Now())
+	return mergeGathered(mfs, alerts.gatherer())
+}
+
+func metricLabel(m *dto.Metric, name string) string {
+	for _, label := range m.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+// metricsOf returns the metrics of the named families
+func metricsOf(mfs []*dto.MetricFamily, names []string) []*dto.Metric {
+	var metrics []*dto.Metric
+	for _, mf := range mfs {
+		if stringInSlice(mf.GetName(), names) {
+			metrics = append(metrics, mf.GetMetric()...)
+		}
+	}
+	return metrics
+}
+
+// conditions returns the value of each device or port, keyed by GUID and port, that meets the rule
+func (e *ruleEvaluator) conditions(rule alertRule, mfs []*dto.MetricFamily, now time.Time) map[[2]string]float64 {
+	result := make(map[[2]string]float64)
+	switch rule.Type {
+	case ruleSymbolErrors, ruleLinkDowned:
+		names := symbolErrorsMFs
+		if rule.Type == ruleLinkDowned {
+			names = linkDownedMFs
+		}
+		for _, m := range metricsOf(mfs, names) {
+			key := [2]string{metricLabel(m, "guid"), metricLabel(m, "port")}
+			increase, elapsed := e.increase(names, key, now.Add(-time.Duration(rule.Window)))
+			if elapsed <= 0 {
+				continue
+			}
+			if rule.Type == ruleSymbolErrors {
+				if perHour := increase / elapsed.Hours(); perHour > rule.Threshold {
+					result[key] = perHour
+				}
+			} else if increase >= rule.Threshold {
+				result[key] = increase
+			}
+		}
+	case ruleTemperature:
+		for _, m := range metricsOf(mfs, []string{"infiniband_switch_temperature_celsius"}) {
+			if value := metricValue(m); value > rule.Threshold {
+				result[[2]string{metricLabel(m, "guid"), ""}] = value
+			}
+		}
+	case ruleFanRPM:
+		lowest := make(map[[2]string]float64)
+		for _, m := range metricsOf(mfs, []string{"infiniband_switch_fan_rpm"}) {
+			key := [2]string{metricLabel(m, "guid"), ""}
+			if value, ok := lowest[key]; !ok || metricValue(m) < value {
+				lowest[key] = metricValue(m)
+			}
+		}
+		for key, value := range lowest {
+			if value < rule.Threshold {
+				result[key] = value
+			}
+		}
+	case ruleFanStatus, rulePSUStatus:
+		names := psuStatusMFs
+		if rule.Type == ruleFanStatus {
+			names = []string{"infiniband_switch_fan_status_info"}
+		}
+		for _, m := range metricsOf(mfs, names) {
+			if metricLabel(m, "status") != "OK" && metricValue(m) == 1 {
+				result[[2]string{metricLabel(m, "guid"), ""}]++
+			}
+		}
+	case ruleDegradedLinks:
+		for _, m := range metricsOf(mfs, portRateMFs) {
+			// The HCA rate has no port label and is the rate of port 1
+			port := metricLabel(m, "port")
+			if port == "" {
+				port = "1"
+			}
+			if gbps := metricValue(m) * 8 / 1e9; gbps < rule.Threshold {
+				result[[2]string{metricLabel(m, "guid"), port}] = gbps
+			}
+		}
+	}
+	return result
+}
+
+// record stores counter values used by rules over a window, dropping values older than the longest window
+func (e *ruleEvaluator) record(mfs []*dto.MetricFamily, now time.Time) {
+	var window time.Duration
+	for _, rule := range e.rules {
+		if time.Duration(rule.Window) > window {
+			window = time.Duration(rule.Window)
+		}
+	}
+	if window == 0 {
+		return
+	}
+	for _, mf := range mfs {
+		if !stringInSlice(mf.GetName(), symbolErrorsMFs) && !stringInSlice(mf.GetName(), linkDownedMFs) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			key := fmt.Sprintf("%s-%s-%s", mf.GetName(), metricLabel(m, "guid"), metricLabel(m, "port"))
+			e.history[key] = append(e.history[key], counterSample{time: now, value: metricValue(m)})
+		}
+	}
+	for key, samples := range e.history {
+		i := 0
+		for i < len(samples) && now.Sub(samples[i].time) > window {
+			i++
+		}
+		if i == len(samples) {
+			delete(e.history, key)
+		} else {
+			e.history[key] = samples[i:]
+		}
+	}
+}
+
+// increase returns how much the counters of a port increased since start, handling counter resets,
+// and the time covered by the values
+func (e *ruleEvaluator) increase(names []string, key [2]string, start time.Time) (float64, time.Duration) {
+	var increase float64
+	var elapsed time.Duration
+	for _, name := range names {
+		var first, previous counterSample
+		for _, sample := range e.history[fmt.Sprintf("%s-%s-%s", name, key[0], key[1])] {
+			if sample.time.Before(start) || math.IsNaN(sample.value) {
+				continue
+			}
+			if first.time.IsZero() {
+				first = sample
+			} else if sample.value >= previous.value {
+				increase += sample.value - previous.value
+			} else {
+				increase += sample.value
+			}
+			previous = sample
+		}
+		if covered := previous.time.Sub(first.time); covered > elapsed {
+			elapsed = covered
+		}
+	}
+	return increase, elapsed
+}
+
+// evaluate updates the alerts of every rule, alerts fire once their condition held for the rule's for duration
+func (e *ruleEvaluator) evaluate(mfs []*dto.MetricFamily, now time.Time) {
+	e.Lock()
+	defer e.Unlock()
+	e.record(mfs, now)
+	active := make(map[string]*alert)
+	for _, rule := range e.rules {
+		for key, value := range e.conditions(rule, mfs, now) {
+			id := fmt.Sprintf("%s-%s-%s", rule.Name, key[0], key[1])
+			a, ok := e.active[id]
+			if !ok {
+				a = &alert{Rule: rule.Name, Type: rule.Type, Severity: rule.Severity, GUID: key[0], Port: key[1], ActiveAt: now}
+				if !statusRuleTypes[rule.Type] {
+					a.Threshold = rule.Threshold
+				}
+			}
+			a.Value = value
+			a.State = alertPending
+			if now.Sub(a.ActiveAt) >= time.Duration(rule.For) {
+				a.State = alertFiring
+			}
+			active[id] = a
+		}
+	}
+	e.active = active
+}
+
+// list returns the current alerts sorted by rule, GUID and port
+func (e *ruleEvaluator) list() []alert {
+	e.Lock()
+	defer e.Unlock()
+	list := []alert{}
+	for _, a := range e.active {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Rule != list[j].Rule {
+			return list[i].Rule < list[j].Rule
+		}
+		if list[i].GUID != list[j].GUID {
+			return list[i].GUID < list[j].GUID
+		}
+		return list[i].Port < list[j].Port
+	})
+	return list
+}
+
+// gatherer returns the firing alerts as metrics
+func (e *ruleEvaluator) gatherer() prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	active := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "infiniband_alert_active",
+		Help: "Infiniband alert rule is firing for the device or port",
+	}, []string{"rule", "guid", "port"})
+	for _, a := range e.list() {
+		if a.State == alertFiring {
+			active.WithLabelValues(a.Rule, a.GUID, a.Port).Set(1)
+		}
+	}
+	registry.MustRegister(active)
+	return registry
+}
+
+func alertsHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list := []alert{}
+		if alerts != nil {
+			list = alerts.list()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		//nolint:errcheck
+		json.NewEncoder(w).Encode(struct {
+			Alerts []alert `json:"alerts"`
+		}{list})
+	}
+}
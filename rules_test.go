@@ -0,0 +1,192 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+func parseFamilies(t *testing.T, text string) []*dto.MetricFamily {
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(strings.NewReader(text + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mfs []*dto.MetricFamily
+	for _, mf := range parsed {
+		mfs = append(mfs, mf)
+	}
+	return mfs
+}
+
+func TestRuleConditions(t *testing.T) {
+	mfs := parseFamilies(t, `
+infiniband_switch_temperature_celsius{guid="0x1"} 75
+infiniband_switch_temperature_celsius{guid="0x2"} 45
+infiniband_switch_fan_rpm{guid="0x1",fan="1"} 8000
+infiniband_switch_fan_rpm{guid="0x1",fan="2"} 1200
+infiniband_switch_fan_rpm{guid="0x2",fan="1"} 8000
+infiniband_switch_fan_status_info{guid="0x1",status="OK"} 1
+infiniband_switch_fan_status_info{guid="0x2",status="ERROR"} 1
+infiniband_switch_power_supply_status_info{guid="0x1",psu="0",status="OK"} 1
+infiniband_switch_power_supply_dc_power_status_info{guid="0x1",psu="0",status="ERROR"} 1
+infiniband_switch_power_supply_fan_status_info{guid="0x1",psu="0",status="ERROR"} 1
+infiniband_switch_port_rate_bytes_per_second{guid="0x1",port="1"} 1.25e+10
+infiniband_switch_port_rate_bytes_per_second{guid="0x1",port="2"} 6.25e+09
+infiniband_hca_rate_bytes_per_second{guid="0x3"} 1.25e+09
+`)
+	tests := []struct {
+		rule     alertRule
+		expected map[[2]string]float64
+	}{
+		{alertRule{Type: ruleTemperature, Threshold: 70}, map[[2]string]float64{{"0x1", ""}: 75}},
+		{alertRule{Type: ruleFanRPM, Threshold: 3000}, map[[2]string]float64{{"0x1", ""}: 1200}},
+		{alertRule{Type: ruleFanStatus}, map[[2]string]float64{{"0x2", ""}: 1}},
+		{alertRule{Type: rulePSUStatus}, map[[2]string]float64{{"0x1", ""}: 2}},
+		{alertRule{Type: ruleDegradedLinks, Threshold: 100}, map[[2]string]float64{{"0x1", "2"}: 50, {"0x3", "1"}: 10}},
+	}
+	evaluator := newRuleEvaluator(nil)
+	for _, test := range tests {
+		result := evaluator.conditions(test.rule, mfs, time.Now())
+		if len(result) != len(test.expected) {
+			t.Errorf("Unexpected result for %s: %v", test.rule.Type, result)
+			continue
+		}
+		for key, value := range test.expected {
+			if result[key] != value {
+				t.Errorf("Unexpected value for %s %v, got %v", test.rule.Type, key, result)
+			}
+		}
+	}
+}
+
+func TestRuleCounters(t *testing.T) {
+	evaluator := newRuleEvaluator([]alertRule{
+		{Name: "SymbolErrors", Type: ruleSymbolErrors, Threshold: 10, Window: model.Duration(time.Hour), Severity: "warning"},
+		{Name: "LinkDowned", Type: ruleLinkDowned, Threshold: 1, Window: model.Duration(time.Hour), Severity: "critical"},
+	})
+	start := time.Unix(1700000000, 0)
+	evaluator.evaluate(parseFamilies(t, `
+infiniband_switch_port_symbol_error_total{guid="0x1",port="1"} 100
+infiniband_switch_port_link_downed_total{guid="0x1",port="1"} 5
+infiniband_hca_port_symbol_error_total{guid="0x3",port="1"} 0
+`), start)
+	if list := evaluator.list(); len(list) != 0 {
+		t.Errorf("Expected no alerts from first collection, got %v", list)
+	}
+	evaluator.evaluate(parseFamilies(t, `
+infiniband_switch_port_symbol_error_total{guid="0x1",port="1"} 102
+infiniband_switch_port_link_downed_total{guid="0x1",port="1"} 5
+infiniband_hca_port_symbol_error_total{guid="0x3",port="1"} 3
+`), start.Add(30*time.Minute))
+	evaluator.evaluate(parseFamilies(t, `
+infiniband_switch_port_symbol_error_total{guid="0x1",port="1"} 104
+infiniband_switch_port_link_downed_total{guid="0x1",port="1"} 1
+infiniband_hca_port_symbol_error_total{guid="0x3",port="1"} 15
+`), start.Add(time.Hour))
+	list := evaluator.list()
+	if len(list) != 2 {
+		t.Fatalf("Unexpected alerts: %v", list)
+	}
+	if list[0].Rule != "LinkDowned" || list[0].GUID != "0x1" || list[0].Value != 1 || list[0].State != alertFiring {
+		t.Errorf("Unexpected link downed alert after counter reset: %v", list[0])
+	}
+	if list[1].Rule != "SymbolErrors" || list[1].GUID != "0x3" || list[1].Value != 15 {
+		t.Errorf("Unexpected symbol errors alert: %v", list[1])
+	}
+	evaluator.evaluate(parseFamilies(t, `
+infiniband_switch_port_link_downed_total{guid="0x1",port="1"} 1
+`), start.Add(3*time.Hour))
+	if len(evaluator.history) != 1 {
+		t.Errorf("Expected values outside the window dropped, got %v", evaluator.history)
+	}
+}
+
+func TestRuleFor(t *testing.T) {
+	evaluator := newRuleEvaluator([]alertRule{
+		{Name: "Temperature", Type: ruleTemperature, Threshold: 70, For: model.Duration(10 * time.Minute), Severity: "warning"},
+	})
+	hot := parseFamilies(t, `infiniband_switch_temperature_celsius{guid="0x1"} 75`)
+	start := time.Unix(1700000000, 0)
+	evaluator.evaluate(hot, start)
+	if list := evaluator.list(); len(list) != 1 || list[0].State != alertPending {
+		t.Fatalf("Expected pending alert, got %v", list)
+	}
+	if count, err := testutil.GatherAndCount(evaluator.gatherer()); err != nil || count != 0 {
+		t.Errorf("Expected no active alert metric for pending alert, got %d", count)
+	}
+	evaluator.evaluate(hot, start.Add(10*time.Minute))
+	list := evaluator.list()
+	if len(list) != 1 || list[0].State != alertFiring || !list[0].ActiveAt.Equal(start) {
+		t.Fatalf("Expected firing alert, got %v", list)
+	}
+	expected := `
+# HELP infiniband_alert_active Infiniband alert rule is firing for the device or port
+# TYPE infiniband_alert_active gauge
+infiniband_alert_active{guid="0x1",port="",rule="Temperature"} 1
+`
+	if err := testutil.GatherAndCompare(evaluator.gatherer(), strings.NewReader(expected), "infiniband_alert_active"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	evaluator.evaluate(parseFamilies(t, `infiniband_switch_temperature_celsius{guid="0x1"} 50`), start.Add(11*time.Minute))
+	if list := evaluator.list(); len(list) != 0 {
+		t.Errorf("Expected alert resolved, got %v", list)
+	}
+}
+
+func TestRuleGathererError(t *testing.T) {
+	alerts = newRuleEvaluator([]alertRule{{Name: "Temperature", Type: ruleTemperature, Threshold: 70}})
+	defer func() { alerts = nil }()
+	hot := parseFamilies(t, `infiniband_switch_temperature_celsius{guid="0x1"} 75`)
+	gatherer := ruleGatherer{prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return hot, fmt.Errorf("gather failed")
+	})}
+	if _, err := gatherer.Gather(); err == nil {
+		t.Errorf("Expected gather error")
+	}
+	if list := alerts.list(); len(list) != 0 {
+		t.Errorf("Expected no alerts evaluated after gather error, got %v", list)
+	}
+}
+
+func TestAlertsHandler(t *testing.T) {
+	alerts = newRuleEvaluator([]alertRule{{Name: "PSU", Type: rulePSUStatus, Severity: "critical"}})
+	defer func() { alerts = nil }()
+	alerts.evaluate(parseFamilies(t, `infiniband_switch_power_supply_status_info{guid="0x1",psu="0",status="ERROR"} 1`), time.Unix(1700000000, 0))
+	recorder := httptest.NewRecorder()
+	alertsHandler(nil)(recorder, httptest.NewRequest("GET", alertsEndpoint, nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Unexpected content type %s", contentType)
+	}
+	var body struct {
+		Alerts []alert `json:"alerts"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Unexpected error decoding %s: %v", recorder.Body.String(), err)
+	}
+	if len(body.Alerts) != 1 || body.Alerts[0].Rule != "PSU" || body.Alerts[0].Severity != "critical" || body.Alerts[0].State != alertFiring {
+		t.Errorf("Unexpected alerts: %s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gofrs/flock"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	collectorPlaceholder = "{collector}"
+	sharedOutputName     = "exporter"
+)
+
+var (
+	outputPattern = kingpin.Flag("exporter.output-pattern",
+		"Write the output of each collector to its own file when using runonce, {collector} is replaced by the collector name, eg /var/lib/node_exporter/infiniband_{collector}.prom").Default("").String()
+	outputCollectors = kingpin.Flag("exporter.output-collector",
+		"Only collect and write the output of this enabled collector when using an output pattern, may be repeated, defaults to all enabled collectors").Strings()
+)
+
+func collectorOutput(name string) string {
+	return strings.ReplaceAll(*outputPattern, collectorPlaceholder, name)
+}
+
+// collectorLockFile adds the collector name to the lock file, eg /tmp/infiniband_exporter-switch.lock
+func collectorLockFile(name string) string {
+	ext := filepath.Ext(*lockFile)
+	return strings.TrimSuffix(*lockFile, ext) + "-" + name + ext
+}
+
+func mergeGathered(mfs []*dto.MetricFamily, gatherer prometheus.Gatherer) ([]*dto.MetricFamily, error) {
+	gathered := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil })
+	return prometheus.Gatherers{gathered, gatherer}.Gather()
+}
+
+// collectorFailed returns true when a collector reported errors and collected no device,
+// per device errors are used when the collector reports them otherwise any sample counts as data
+func collectorFailed(mfs []*dto.MetricFamily) bool {
+	var errors float64
+	var data bool
+	devices := make(map[string]bool)
+	for _, mf := range mfs {
+		name := mf.GetName()
+		switch {
+		case name == "infiniband_exporter_collect_errors":
+			for _, m := range mf.GetMetric() {
+				errors += m.GetGauge().GetValue()
+			}
+		case strings.HasSuffix(name, "_collect_error") || strings.HasSuffix(name, "_collect_timeout"):
+			for _, m := range mf.GetMetric() {
+				var guid, collector string
+				for _, label := range m.GetLabel() {
+					switch label.GetName() {
+					case "guid":
+						guid = label.GetValue()
+					case "collector":
+						collector = label.GetValue()
+					}
+				}
+				if strings.HasSuffix(collector, "-rcv-err") {
+					continue
+				}
+				devices[guid] = devices[guid] || m.GetGauge().GetValue() > 0
+			}
+		case !strings.HasPrefix(name, "infiniband_exporter_") && !strings.Contains(name, "_collect_"):
+			data = data || len(mf.GetMetric()) > 0
+		}
+	}
+	if errors == 0 {
+		return false
+	}
+	if len(devices) > 0 {
+		for _, failed := range devices {
+			if !failed {
+				return false
+			}
+		}
+		return true
+	}
+	return !data
+}
+
+// selectCollectors returns the collectors selected with --exporter.output-collector
+func selectCollectors(named []namedCollector) ([]namedCollector, error) {
+	if len(*outputCollectors) == 0 {
+		return named, nil
+	}
+	var selected []namedCollector
+	for _, name := range *outputCollectors {
+		found := false
+		for _, c := range named {
+			if c.name == name {
+				selected = append(selected, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Output collector %s is not an enabled collector", name)
+		}
+	}
+	return selected, nil
+}
+
+// writeSharedFile writes the shared metrics, such as discovery, while holding their own lock file.
+// Returns false without writing when another run holds the lock.
+func writeSharedFile(mfs []*dto.MetricFamily, logger log.Logger) (bool, error) {
+	fileLock := flock.New(collectorLockFile(sharedOutputName))
+	locked, err := fileLock.TryLock()
+	if err != nil {
+		level.Error(logger).Log("msg", "Unable to obtain lock on lock file", "collector", sharedOutputName, "lockfile", fileLock.Path(), "err", err)
+		return false, err
+	}
+	if !locked {
+		level.Warn(logger).Log("msg", "Skipping shared output, lock file is locked", "lockfile", fileLock.Path())
+		return false, nil
+	}
+	defer fileLock.Unlock() //nolint:errcheck
+	return true, writeTextfile(collectorOutput(sharedOutputName), mfs, logger)
+}
+
+// writeCollectorFiles collects each selected collector in parallel and writes its own output file.
+// Collectors whose lock file is locked by another run are skipped and a collector that fails
+// leaves its previous output file in place, the names of both are returned.
+// Returns the metrics of all collectors and the shared metrics, such as discovery, that are not yet written.
+func writeCollectorFiles(logger log.Logger) ([]*dto.MetricFamily, []*dto.MetricFamily, []string, error) {
+	shared, named := setupCollectors(true, logger)
+	named, err := selectCollectors(named)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sharedRegistry := prometheus.NewRegistry()
+	sharedRegistry.MustRegister(shared...)
+	var gatherers prometheus.Gatherers
+	var failed []string
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	addFailed := func(name string) {
+		mu.Lock()
+		failed = append(failed, name)
+		mu.Unlock()
+	}
+	for _, c := range named {
+		fileLock := flock.New(collectorLockFile(c.name))
+		locked, err := fileLock.TryLock()
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to obtain lock on lock file", "collector", c.name, "lockfile", fileLock.Path(), "err", err)
+			addFailed(c.name)
+			continue
+		}
+		if !locked {
+			level.Warn(logger).Log("msg", "Skipping collector, lock file is locked", "collector", c.name, "lockfile", fileLock.Path())
+			addFailed(c.name)
+			continue
+		}
+		wg.Add(1)
+		go func(c namedCollector, fileLock *flock.Flock) {
+			defer wg.Done()
+			defer fileLock.Unlock() //nolint:errcheck
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(c.collector)
+			mfs, err := registry.Gather()
+			if err != nil {
+				level.Error(logger).Log("msg", "Error gathering Prometheus metrics", "collector", c.name, "err", err)
+				addFailed(c.name)
+				return
+			}
+			if collectorFailed(mfs) {
+				level.Error(logger).Log("msg", "Collector failed, keeping previous output", "collector", c.name, "output", collectorOutput(c.name))
+				addFailed(c.name)
+				return
+			}
+			if err := writeTextfile(collectorOutput(c.name), mfs, logger); err != nil {
+				addFailed(c.name)
+				return
+			}
+			mu.Lock()
+			gatherers = append(gatherers, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil }))
+			mu.Unlock()
+		}(c, fileLock)
+	}
+	wg.Wait()
+	sort.Strings(failed)
+	sharedMfs, err := sharedRegistry.Gather()
+	if err != nil {
+		return nil, nil, failed, err
+	}
+	mfs, err := mergeGathered(sharedMfs, gatherers)
+	return mfs, sharedMfs, failed, err
+}
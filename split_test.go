@@ -0,0 +1,207 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/gofrs/flock"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/treydock/infiniband_exporter/collectors"
+)
+
+func setupOutputPattern(t *testing.T, args []string) string {
+	dir := t.TempDir()
+	args = append(args, "--exporter.runonce", fmt.Sprintf("--exporter.output-pattern=%s", filepath.Join(dir, "infiniband_{collector}.prom")),
+		fmt.Sprintf("--exporter.lockfile=%s", filepath.Join(dir, "infiniband_exporter.lock")))
+	setupTest(t, args)
+	return dir
+}
+
+func TestCollectorLockFile(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--exporter.lockfile=/tmp/infiniband_exporter.lock"}); err != nil {
+		t.Fatal(err)
+	}
+	defer kingpin.CommandLine.Parse([]string{}) //nolint:errcheck
+	if path := collectorLockFile("switch"); path != "/tmp/infiniband_exporter-switch.lock" {
+		t.Errorf("Unexpected lock file, got %s", path)
+	}
+}
+
+func TestCollectToCollectorFiles(t *testing.T) {
+	dir := setupOutputPattern(t, []string{"--collector.hca", "--collector.ibswinfo"})
+	if err := writeMetrics(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"exporter": "infiniband_exporter_collect_errors{collector=\"ibnetdiscover-runonce\"}",
+		"switch":   "infiniband_switch_port_transmit_data_bytes_total",
+		"hca":      "infiniband_hca_port_transmit_data_bytes_total",
+		"ibswinfo": "infiniband_switch_temperature_celsius",
+	}
+	series := map[string]string{}
+	for name, metric := range expected {
+		content, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("infiniband_%s.prom", name)))
+		if err != nil {
+			t.Fatalf("Expected output for %s: %v", name, err)
+		}
+		if !strings.Contains(string(content), metric) {
+			t.Errorf("Expected %s in %s output:\n%s", metric, name, content)
+		}
+		var parser expfmt.TextParser
+		mfs, err := parser.TextToMetricFamilies(strings.NewReader(string(content)))
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s output: %v", name, err)
+		}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				key := fmt.Sprintf("%s%v", mf.GetName(), m.GetLabel())
+				if other, ok := series[key]; ok {
+					t.Errorf("Series %s in both %s and %s output", key, other, name)
+				}
+				series[key] = name
+			}
+		}
+	}
+}
+
+func TestCollectToCollectorFilesLocked(t *testing.T) {
+	dir := setupOutputPattern(t, []string{"--collector.hca"})
+	fileLock := flock.New(collectorLockFile("switch"))
+	if locked, err := fileLock.TryLock(); err != nil || !locked {
+		t.Fatalf("Unable to lock switch lock file: %v", err)
+	}
+	defer fileLock.Unlock() //nolint:errcheck
+	if err := writeMetrics(log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "switch") {
+		t.Errorf("Expected error for skipped switch collector, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "infiniband_switch.prom")); !os.IsNotExist(err) {
+		t.Errorf("Expected locked switch collector skipped, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "infiniband_hca.prom")); err != nil {
+		t.Errorf("Expected HCA output written: %v", err)
+	}
+}
+
+func TestCollectToCollectorFilesSharedLocked(t *testing.T) {
+	dir := setupOutputPattern(t, []string{"--collector.hca"})
+	fileLock := flock.New(collectorLockFile(sharedOutputName))
+	if locked, err := fileLock.TryLock(); err != nil || !locked {
+		t.Fatalf("Unable to lock shared lock file: %v", err)
+	}
+	defer fileLock.Unlock() //nolint:errcheck
+	if err := writeMetrics(log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), sharedOutputName) {
+		t.Errorf("Expected error for skipped shared output, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "infiniband_exporter.prom")); !os.IsNotExist(err) {
+		t.Errorf("Expected locked shared output skipped, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "infiniband_hca.prom")); err != nil {
+		t.Errorf("Expected HCA output written: %v", err)
+	}
+}
+
+func TestCollectToCollectorFilesSelected(t *testing.T) {
+	dir := setupOutputPattern(t, []string{"--collector.hca", "--exporter.output-collector=hca"})
+	perfqueryExec := collectors.PerfqueryExec
+	guids := map[string]bool{}
+	collectors.PerfqueryExec = func(guid string, port string, extraArgs []string, ctx context.Context) (string, error) {
+		guids[guid] = true
+		return perfqueryExec(guid, port, extraArgs, ctx)
+	}
+	defer func() { collectors.PerfqueryExec = perfqueryExec }()
+	if err := writeMetrics(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"exporter", "hca"} {
+		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("infiniband_%s.prom", name))); err != nil {
+			t.Errorf("Expected %s output written: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "infiniband_switch.prom")); !os.IsNotExist(err) {
+		t.Errorf("Expected switch collector not run, got %v", err)
+	}
+	if guids["0x7cfe9003009ce5b0"] {
+		t.Errorf("Expected no perfquery of switches")
+	}
+}
+
+func TestCollectToCollectorFilesUnknown(t *testing.T) {
+	setupOutputPattern(t, []string{"--exporter.output-collector=hca"})
+	if err := writeMetrics(log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "hca") {
+		t.Errorf("Expected error for collector not enabled, got %v", err)
+	}
+}
+
+func TestCollectToCollectorFilesFailed(t *testing.T) {
+	dir := setupOutputPattern(t, []string{"--collector.hca"})
+	output := filepath.Join(dir, "infiniband_hca.prom")
+	if err := os.WriteFile(output, []byte("previous\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	perfqueryExec := collectors.PerfqueryExec
+	collectors.PerfqueryExec = func(guid string, port string, extraArgs []string, ctx context.Context) (string, error) {
+		return "", fmt.Errorf("Error")
+	}
+	defer func() { collectors.PerfqueryExec = perfqueryExec }()
+	if err := writeMetrics(log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "hca") {
+		t.Errorf("Expected error for failed HCA collector, got %v", err)
+	}
+	if content, _ := os.ReadFile(output); string(content) != "previous\n" {
+		t.Errorf("Expected previous HCA output kept, got %s", content)
+	}
+	// The switch without connected ports is still collected
+	if _, err := os.Stat(filepath.Join(dir, "infiniband_switch.prom")); err != nil {
+		t.Errorf("Expected switch output written: %v", err)
+	}
+}
+
+func TestCollectorFailed(t *testing.T) {
+	tests := []struct {
+		Text     string
+		Expected bool
+	}{
+		{Text: "infiniband_exporter_collect_errors{collector=\"sm\"} 0\n", Expected: false},
+		{Text: "infiniband_exporter_collect_errors{collector=\"sm\"} 1\n", Expected: true},
+		{Text: "infiniband_exporter_collect_errors{collector=\"sm\"} 1\ninfiniband_sm_info{guid=\"0x00\"} 1\n", Expected: false},
+		{Text: "infiniband_exporter_collect_errors{collector=\"switch\"} 1\ninfiniband_switch_info{guid=\"0x00\"} 1\n" +
+			"infiniband_switch_collect_error{collector=\"switch\",guid=\"0x00\"} 1\n", Expected: true},
+		{Text: "infiniband_exporter_collect_errors{collector=\"switch\"} 1\n" +
+			"infiniband_switch_collect_error{collector=\"switch\",guid=\"0x00\"} 0\n" +
+			"infiniband_switch_collect_error{collector=\"switch-rcv-err\",guid=\"0x00\"} 1\n", Expected: false},
+	}
+	for i, test := range tests {
+		var parser expfmt.TextParser
+		text := "# TYPE infiniband_exporter_collect_errors gauge\n# TYPE infiniband_switch_collect_error gauge\n" + test.Text
+		parsed, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mfs []*dto.MetricFamily
+		for _, mf := range parsed {
+			mfs = append(mfs, mf)
+		}
+		if failed := collectorFailed(mfs); failed != test.Expected {
+			t.Errorf("Unexpected result in case %d, got %v", i, failed)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/treydock/infiniband_exporter/collectors"
+)
+
+const (
+	deviceEndpoint = "/device"
+	statusHeader   = `<html>
+<head><title>InfiniBand Exporter</title></head>
+<body>
+<h1>InfiniBand Exporter</h1>
+<p><a href="/">Status</a> <a href="` + metricsEndpoint + `">Metrics</a> <a href="` + topEndpoint + `">Top ports</a> <a href="` + commandsEndpoint + `">Commands</a> <a href="` + alertsEndpoint + `">Alerts</a></p>
+`
+	statusTemplate = statusHeader + `<h2>Collectors</h2>
+{{if .Collectors}}<table border="1">
+<tr><th>Collector</th><th>Last collection</th><th>Duration (s)</th><th>Errors</th><th>Timeouts</th></tr>
+{{range .Collectors}}<tr><td>{{.Name}}</td><td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td><td>{{printf "%.3f" .Duration}}</td><td>{{.Errors}}</td><td>{{.Timeouts}}</td></tr>
+{{end}}</table>{{else}}<p>No collections yet, metrics are collected when <a href="` + metricsEndpoint + `">Metrics</a> is scraped.</p>{{end}}
+<h2>Switches</h2>
+{{template "devices" .Switches}}
+<h2>HCAs</h2>
+{{template "devices" .HCAs}}
+</body>
+</html>
+{{define "devices"}}{{if .}}<table border="1">
+<tr><th>Name</th><th>LID</th><th>GUID</th><th>Connected ports</th><th>Errors</th><th>Timeouts</th></tr>
+{{range .}}<tr><td><a href="` + deviceEndpoint + `?guid={{.GUID}}">{{.Name}}</a></td><td>{{.LID}}</td><td>{{.GUID}}</td><td>{{.Ports}}</td><td>{{.Errors}}</td><td>{{.Timeouts}}</td></tr>
+{{end}}</table>{{else}}<p>None discovered</p>{{end}}{{end}}
+`
+	deviceTemplate = statusHeader + `<h2>{{.Device.Name}}</h2>
+<p>GUID {{.Device.GUID}} LID {{.Device.LID}}</p>
+<h3>Collection</h3>
+{{if .Collections}}<table border="1">
+<tr><th>Collector</th><th>Duration (s)</th><th>Error</th><th>Timeout</th></tr>
+{{range .Collections}}<tr><td>{{.Collector}}</td><td>{{printf "%.3f" .Duration}}</td><td>{{.Error}}</td><td>{{.Timeout}}</td></tr>
+{{end}}</table>{{else}}<p>Not collected</p>{{end}}
+<h3>Uplinks</h3>
+{{if .Uplinks}}<table border="1">
+<tr><th>Port</th><th>Name</th><th>Type</th><th>GUID</th><th>LID</th><th>Remote port</th><th>Rate (bytes/s)</th></tr>
+{{range .Uplinks}}<tr><td>{{.Port}}</td><td><a href="` + deviceEndpoint + `?guid={{.GUID}}">{{.Name}}</a></td><td>{{.Type}}</td><td>{{.GUID}}</td><td>{{.LID}}</td><td>{{.PortNumber}}</td><td>{{printf "%.0f" .Rate}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+<h3>Metrics</h3>
+{{if .Metrics}}<table border="1">
+<tr><th>Metric</th><th>Labels</th><th>Value</th></tr>
+{{range .Metrics}}<tr><td>{{.Name}}</td><td>{{.Labels}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+</body>
+</html>
+`
+)
+
+var (
+	status       = newStatusStore()
+	statusPage   = template.Must(template.New("status").Parse(statusTemplate))
+	devicePage   = template.Must(template.New("device").Parse(deviceTemplate))
+	statusSuffix = []string{"_collect_error", "_collect_timeout", "_collect_duration_seconds"}
+)
+
+type collectorStatus struct {
+	Name     string
+	Time     time.Time
+	Duration float64
+	Errors   float64
+	Timeouts float64
+}
+
+type deviceCollection struct {
+	Collector string
+	Duration  float64
+	Error     float64
+	Timeout   float64
+}
+
+type deviceMetric struct {
+	Name   string
+	Labels string
+	Value  float64
+}
+
+type deviceRow struct {
+	Name     string
+	LID      string
+	GUID     string
+	Ports    int
+	Errors   float64
+	Timeouts float64
+}
+
+type uplinkRow struct {
+	Port string
+	collectors.InfinibandUplink
+}
+
+// statusStore keeps what the last scrape discovered and collected for the status pages
+type statusStore struct {
+	sync.Mutex
+	switches    []collectors.InfinibandDevice
+	hcas        []collectors.InfinibandDevice
+	collectors  map[string]collectorStatus
+	collections map[string]map[string]*deviceCollection
+	metrics     map[string][]deviceMetric
+}
+
+// statusGatherer records the gathered metrics for the status pages
+type statusGatherer struct {
+	prometheus.Gatherer
+}
+
+func newStatusStore() *statusStore {
+	return &statusStore{
+		collectors:  make(map[string]collectorStatus),
+		collections: make(map[string]map[string]*deviceCollection),
+		metrics:     make(map[string][]deviceMetric),
+	}
+}
+
+func (g statusGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	status.update(mfs, time.Now())
+	return mfs, err
+}
+
+func (s *statusStore) setTopology(switches *[]collectors.InfinibandDevice, hcas *[]collectors.InfinibandDevice) {
+	s.Lock()
+	defer s.Unlock()
+	s.switches = *switches
+	s.hcas = *hcas
+}
+
+// topology returns the last discovered topology, false if nothing was discovered yet
+func (s *statusStore) topology() (*[]collectors.InfinibandDevice, *[]collectors.InfinibandDevice, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.switches == nil && s.hcas == nil {
+		return nil, nil, false
+	}
+	switches := append([]collectors.InfinibandDevice{}, s.switches...)
+	hcas := append([]collectors.InfinibandDevice{}, s.hcas...)
+	return &switches, &hcas, true
+}
+
+func (s *statusStore) update(mfs []*dto.MetricFamily, now time.Time) {
+	collectorStatuses := make(map[string]collectorStatus)
+	collections := make(map[string]map[string]*deviceCollection)
+	metrics := make(map[string][]deviceMetric)
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			value := metricValue(m)
+			if collector, ok := labels["collector"]; ok && strings.HasPrefix(name, "infiniband_exporter_") {
+				c := collectorStatuses[collector]
+				c.Name = collector
+				c.Time = now
+				switch name {
+				case "infiniband_exporter_collect_errors":
+					c.Errors = value
+				case "infiniband_exporter_collect_timeouts":
+					c.Timeouts = value
+				case "infiniband_exporter_collector_duration_seconds":
+					c.Duration = value
+				}
+				collectorStatuses[collector] = c
+				continue
+			}
+			guid, ok := labels["guid"]
+			if !ok {
+				continue
+			}
+			if suffix := statusMetricSuffix(name); suffix != "" && labels["collector"] != "" {
+				if _, ok := collections[guid]; !ok {
+					collections[guid] = make(map[string]*deviceCollection)
+				}
+				c, ok := collections[guid][labels["collector"]]
+				if !ok {
+					c = &deviceCollection{Collector: labels["collector"]}
+					collections[guid][labels["collector"]] = c
+				}
+				switch suffix {
+				case "_collect_error":
+					c.Error = value
+				case "_collect_timeout":
+					c.Timeout = value
+				case "_collect_duration_seconds":
+					c.Duration = value
+				}
+				continue
+			}
+			var pairs []string
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "guid" {
+					continue
+				}
+				pairs = append(pairs, label.GetName()+"="+label.GetValue())
+			}
+			metrics[guid] = append(metrics[guid], deviceMetric{Name: name, Labels: strings.Join(pairs, " "), Value: value})
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	for name, c := range collectorStatuses {
+		s.collectors[name] = c
+	}
+	s.collections = collections
+	s.metrics = metrics
+}
+
+func statusMetricSuffix(name string) string {
+	for _, suffix := range statusSuffix {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	}
+	return 0
+}
+
+func (s *statusStore) deviceRows(devices []collectors.InfinibandDevice) []deviceRow {
+	var rows []deviceRow
+	for _, device := range devices {
+		row := deviceRow{Name: device.Name, LID: device.LID, GUID: device.GUID, Ports: len(device.Uplinks)}
+		for _, c := range s.collections[device.GUID] {
+			row.Errors += c.Error
+			row.Timeouts += c.Timeout
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (s *statusStore) findDevice(guid string) (collectors.InfinibandDevice, bool) {
+	for _, devices := range [][]collectors.InfinibandDevice{s.switches, s.hcas} {
+		for _, device := range devices {
+			if device.GUID == guid {
+				return device, true
+			}
+		}
+	}
+	return collectors.InfinibandDevice{}, false
+}
+
+func statusHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The status page is registered on "/" which matches every path
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		status.Lock()
+		var collectorStatuses []collectorStatus
+		for _, c := range status.collectors {
+			collectorStatuses = append(collectorStatuses, c)
+		}
+		sort.Slice(collectorStatuses, func(i, j int) bool { return collectorStatuses[i].Name < collectorStatuses[j].Name })
+		data := struct {
+			Collectors []collectorStatus
+			Switches   []deviceRow
+			HCAs       []deviceRow
+		}{collectorStatuses, status.deviceRows(status.switches), status.deviceRows(status.hcas)}
+		status.Unlock()
+		if err := statusPage.Execute(w, data); err != nil {
+			level.Error(logger).Log("msg", "Error rendering status", "err", err)
+		}
+	}
+}
+
+func deviceHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		guid := r.URL.Query().Get("guid")
+		status.Lock()
+		device, ok := status.findDevice(guid)
+		if !ok {
+			status.Unlock()
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		var collections []deviceCollection
+		for _, c := range status.collections[guid] {
+			collections = append(collections, *c)
+		}
+		metrics := append([]deviceMetric{}, status.metrics[guid]...)
+		status.Unlock()
+		sort.Slice(collections, func(i, j int) bool { return collections[i].Collector < collections[j].Collector })
+		var uplinks []uplinkRow
+		for port, uplink := range device.Uplinks {
+			uplinks = append(uplinks, uplinkRow{Port: port, InfinibandUplink: uplink})
+		}
+		sort.Slice(uplinks, func(i, j int) bool { return portLess(uplinks[i].Port, uplinks[j].Port) })
+		data := struct {
+			Device      collectors.InfinibandDevice
+			Collections []deviceCollection
+			Uplinks     []uplinkRow
+			Metrics     []deviceMetric
+		}{device, collections, uplinks, metrics}
+		if err := devicePage.Execute(w, data); err != nil {
+			level.Error(logger).Log("msg", "Error rendering device", "guid", guid, "err", err)
+		}
+	}
+}
+
+// portLess sorts port numbers numerically
+func portLess(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/treydock/infiniband_exporter/collectors"
+)
+
+var (
+	statusSwitches = []collectors.InfinibandDevice{
+		{Type: "SW", LID: "1719", GUID: "0x7cfe9003009ce5b0", Name: "ib-i1l1s01",
+			Uplinks: map[string]collectors.InfinibandUplink{
+				"1":  {Type: "SW", LID: "1516", PortNumber: "1", GUID: "0x7cfe900300b07320", Name: "ib-i1l2s01", Rate: 12500000000},
+				"10": {Type: "CA", LID: "134", PortNumber: "1", GUID: "0x7cfe9003003b4bde", Name: "o0001 HCA-1", Rate: 12500000000},
+				"2":  {Type: "SW", LID: "2052", PortNumber: "1", GUID: "0x506b4b03005c2740", Name: "ib-i4l1s01", Rate: 12500000000},
+			},
+		},
+	}
+	statusHCAs = []collectors.InfinibandDevice{
+		{Type: "CA", LID: "134", GUID: "0x7cfe9003003b4bde", Name: "o0001 HCA-1",
+			Uplinks: map[string]collectors.InfinibandUplink{
+				"1": {Type: "SW", LID: "1719", PortNumber: "10", GUID: "0x7cfe9003009ce5b0", Name: "ib-i1l1s01"},
+			},
+		},
+	}
+)
+
+func statusRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	errors := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "infiniband_exporter_collect_errors"}, []string{"collector"})
+	errors.WithLabelValues("switch").Set(1)
+	duration := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "infiniband_exporter_collector_duration_seconds"}, []string{"collector"})
+	duration.WithLabelValues("switch").Set(2.5)
+	deviceError := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "infiniband_switch_collect_error"}, []string{"guid", "collector"})
+	deviceError.WithLabelValues("0x7cfe9003009ce5b0", "switch").Set(1)
+	deviceTimeout := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "infiniband_switch_collect_timeout"}, []string{"guid", "collector"})
+	deviceTimeout.WithLabelValues("0x7cfe9003009ce5b0", "switch").Set(0)
+	data := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "infiniband_switch_port_transmit_data_bytes_total"}, []string{"guid", "port"})
+	data.WithLabelValues("0x7cfe9003009ce5b0", "1").Add(4000)
+	registry.MustRegister(errors, duration, deviceError, deviceTimeout, data)
+	return registry
+}
+
+func TestStatusUpdate(t *testing.T) {
+	store := newStatusStore()
+	mfs, err := statusRegistry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.update(mfs, now)
+	c := store.collectors["switch"]
+	if c.Errors != 1 || c.Duration != 2.5 || c.Timeouts != 0 || c.Time != now {
+		t.Errorf("Unexpected collector status, got %v", c)
+	}
+	collection := store.collections["0x7cfe9003009ce5b0"]["switch"]
+	if collection == nil || collection.Error != 1 || collection.Timeout != 0 {
+		t.Errorf("Unexpected device collection, got %v", collection)
+	}
+	metrics := store.metrics["0x7cfe9003009ce5b0"]
+	if len(metrics) != 1 || metrics[0].Name != "infiniband_switch_port_transmit_data_bytes_total" || metrics[0].Labels != "port=1" || metrics[0].Value != 4000 {
+		t.Errorf("Unexpected device metrics, got %v", metrics)
+	}
+}
+
+func TestStatusHandlers(t *testing.T) {
+	status = newStatusStore()
+	defer func() { status = newStatusStore() }()
+	status.setTopology(&statusSwitches, &statusHCAs)
+	if _, err := (statusGatherer{statusRegistry()}).Gather(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	statusHandler(log.NewNopLogger())(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"<td>switch</td>",
+		`<a href="/device?guid=0x7cfe9003009ce5b0">ib-i1l1s01</a></td><td>1719</td><td>0x7cfe9003009ce5b0</td><td>3</td><td>1</td><td>0</td>`,
+		`<a href="/device?guid=0x7cfe9003003b4bde">o0001 HCA-1</a>`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Unexpected body\nExpected:\n%s\nGot:\n%s\n", expected, body)
+		}
+	}
+	rec = httptest.NewRecorder()
+	deviceHandler(log.NewNopLogger())(rec, httptest.NewRequest(http.MethodGet, "/device?guid=0x7cfe9003009ce5b0", nil))
+	body = rec.Body.String()
+	for _, expected := range []string{
+		"<h2>ib-i1l1s01</h2>",
+		"<tr><td>switch</td><td>0.000</td><td>1</td><td>0</td></tr>",
+		"<tr><td>infiniband_switch_port_transmit_data_bytes_total</td><td>port=1</td><td>4000</td></tr>",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Unexpected body\nExpected:\n%s\nGot:\n%s\n", expected, body)
+		}
+	}
+	if strings.Index(body, "<tr><td>2</td>") > strings.Index(body, "<tr><td>10</td>") {
+		t.Errorf("Unexpected uplink order\nGot:\n%s\n", body)
+	}
+	rec = httptest.NewRecorder()
+	deviceHandler(log.NewNopLogger())(rec, httptest.NewRequest(http.MethodGet, "/device?guid=foo", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status code, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	statusHandler(log.NewNopLogger())(rec, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status code for unknown path, got %d", rec.Code)
+	}
+}